@@ -0,0 +1,346 @@
+package buddystore
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A vnode as reported by the admin server
+type AdminVnode struct {
+	Id   string
+	Host string
+}
+
+func adminVnode(vn *Vnode) *AdminVnode {
+	if vn == nil {
+		return nil
+	}
+	return &AdminVnode{Id: vn.String(), Host: vn.Host}
+}
+
+// Keeps the position of unknown vnodes as nulls
+func adminVnodes(vnodes []*Vnode) []*AdminVnode {
+	res := make([]*AdminVnode, len(vnodes))
+	for i, vn := range vnodes {
+		res[i] = adminVnode(vn)
+	}
+	return res
+}
+
+// A filled entry of a finger table
+type FingerStatus struct {
+	Index int
+	Vnode *AdminVnode
+}
+
+type WLockStatus struct {
+	NodeID  string
+	LockID  string
+	Version uint
+	Timeout *time.Time
+}
+
+// The state of the lock manager of a vnode
+type LockManagerStatus struct {
+	CurrentLM   bool
+	CommitPoint uint64
+	WLocks      map[string]*WLockStatus
+	RLocks      map[string]map[string][]string // The copyset of every key, from node to its lock ID and address
+}
+
+// The state of a local vnode, as served by the admin server under /admin/vnodes
+type VnodeStatus struct {
+	RingId         string
+	Host           string
+	Id             string
+	Successors     []*AdminVnode
+	Predecessor    *AdminVnode
+	Predecessors   []*AdminVnode
+	Fingers        []*FingerStatus
+	LastStabilized time.Time
+	Keys           int
+	Versions       int
+	Bytes          int
+	LockManager    *LockManagerStatus
+}
+
+// The outcome of a forced stabilization, by vnode ID
+type StabilizeResult struct {
+	Stabilized []string
+	Skipped    []string // Already stabilizing, or stopped
+}
+
+/*
+AdminServer serves the internal state of the local vnodes of a node as JSON,
+for debugging. It is read-only, unless it is given a token, which then
+enables actions to clients presenting it as a bearer token.
+
+	GET  /admin/vnodes[?ring=<ring ID>]     State of every local vnode
+	GET  /admin/tracker?ring=<ring ID>      Members of a ring known to the tracker
+	GET  /admin/snapshot[?ring=<ring ID>]   Layout of a ring, as DOT with format=dot
+	GET  /admin/check[?ring=<ring ID>]      Violations of the invariants of a ring
+	POST /admin/check[?ring=<ring ID>]      Check a ring and repair it
+	POST /admin/stabilize[?vnode=<ID>]      Stabilize right away
+*/
+type AdminServer struct {
+	token string
+	rings func() []*Ring
+	mux   *http.ServeMux
+}
+
+// Serves the rings returned by rings, which is called on every request
+func NewAdminServer(token string, rings func() []*Ring) *AdminServer {
+	a := &AdminServer{token: token, rings: rings, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/admin/vnodes", a.handleVnodes)
+	a.mux.HandleFunc("/admin/tracker", a.handleTracker)
+	a.mux.HandleFunc("/admin/snapshot", a.handleSnapshot)
+	a.mux.HandleFunc("/admin/check", a.handleCheck)
+	a.mux.HandleFunc("/admin/stabilize", a.handleStabilize)
+	return a
+}
+
+// Starts serving the admin pages. Close the listener to stop.
+func ServeAdmin(listen string, token string, rings func() []*Ring) (net.Listener, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	go http.Serve(listener, NewAdminServer(token, rings))
+	return listener, nil
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.mux.ServeHTTP(w, req)
+}
+
+func (a *AdminServer) handleVnodes(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, filter := req.URL.Query()["ring"]
+	ringId := req.URL.Query().Get("ring")
+
+	res := []*VnodeStatus{}
+	for _, r := range a.rings() {
+		if filter && r.config.RingId != ringId {
+			continue
+		}
+		res = append(res, r.Status()...)
+	}
+	writeJSON(w, res)
+}
+
+func (a *AdminServer) handleTracker(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ringId := req.URL.Query().Get("ring")
+	if len(ringId) == 0 {
+		http.Error(w, "Missing ring", http.StatusBadRequest)
+		return
+	}
+
+	rings := a.rings()
+	if len(rings) == 0 {
+		http.Error(w, "Not part of any ring", http.StatusServiceUnavailable)
+		return
+	}
+
+	members, err := rings[0].vnodes[0].tracker.members(ringId)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read the members of ring %s: %s", ringId, err), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, adminVnodes(members))
+}
+
+func (a *AdminServer) handleSnapshot(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ring := a.findRing(w, req)
+	if ring == nil {
+		return
+	}
+
+	snapshot, err := ring.Snapshot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if req.URL.Query().Get("format") == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		snapshot.WriteDOT(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	snapshot.WriteJSON(w)
+}
+
+func (a *AdminServer) handleCheck(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	repair := req.Method == "POST"
+	if repair && !a.authorized(w, req) {
+		return
+	}
+
+	ring := a.findRing(w, req)
+	if ring == nil {
+		return
+	}
+	writeJSON(w, ring.Check(repair))
+}
+
+func (a *AdminServer) handleStabilize(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.authorized(w, req) {
+		return
+	}
+
+	_, filter := req.URL.Query()["vnode"]
+	id := req.URL.Query().Get("vnode")
+
+	res := &StabilizeResult{Stabilized: []string{}, Skipped: []string{}}
+	for _, r := range a.rings() {
+		for _, vn := range r.vnodes {
+			if filter && vn.String() != id {
+				continue
+			}
+			if vn.stabilizeNow() {
+				res.Stabilized = append(res.Stabilized, vn.String())
+			} else {
+				res.Skipped = append(res.Skipped, vn.String())
+			}
+		}
+	}
+
+	if filter && len(res.Stabilized)+len(res.Skipped) == 0 {
+		http.Error(w, fmt.Sprintf("Unknown vnode %s", id), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, res)
+}
+
+// Returns the ring a request is for, the first one by default, and fails the
+// request if there is no such ring
+func (a *AdminServer) findRing(w http.ResponseWriter, req *http.Request) *Ring {
+	ringId := req.URL.Query().Get("ring")
+	for _, r := range a.rings() {
+		if len(ringId) == 0 || r.config.RingId == ringId {
+			return r
+		}
+	}
+	http.Error(w, fmt.Sprintf("Unknown ring %s", ringId), http.StatusNotFound)
+	return nil
+}
+
+// Checks the bearer token of an action, and fails the request if it is not allowed
+func (a *AdminServer) authorized(w http.ResponseWriter, req *http.Request) bool {
+	if len(a.token) == 0 {
+		http.Error(w, "Admin actions are disabled", http.StatusForbidden)
+		return false
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// Returns the state of every local vnode, as served under /admin/vnodes
+func (r *Ring) Status() []*VnodeStatus {
+	res := make([]*VnodeStatus, 0, len(r.vnodes))
+	for _, vn := range r.vnodes {
+		res = append(res, vn.status())
+	}
+	return res
+}
+
+// Returns a snapshot of the state of the vnode
+func (vn *localVnode) status() *VnodeStatus {
+	res := &VnodeStatus{
+		RingId:         vn.ring.config.RingId,
+		Host:           vn.Host,
+		Id:             vn.String(),
+		Successors:     adminVnodes(vn.CopyOfSuccessors()),
+		Predecessor:    adminVnode(vn.Predecessor()),
+		LastStabilized: vn.lastStabilized(),
+		Fingers:        []*FingerStatus{},
+	}
+
+	vn.predecessorLock.RLock()
+	res.Predecessors = adminVnodes(vn.predecessors)
+	vn.predecessorLock.RUnlock()
+
+	vn.fingerLock.RLock()
+	for i, finger := range vn.finger {
+		if finger != nil {
+			res.Fingers = append(res.Fingers, &FingerStatus{Index: i, Vnode: adminVnode(finger)})
+		}
+	}
+	vn.fingerLock.RUnlock()
+
+	res.Keys, res.Versions, res.Bytes = vn.store.stats()
+	res.LockManager = vn.lm.status()
+	return res
+}
+
+// Returns a snapshot of the state of the lock manager
+func (lm *LManager) status() *LockManagerStatus {
+	res := &LockManagerStatus{
+		CurrentLM: lm.CurrentLM,
+		WLocks:    make(map[string]*WLockStatus),
+		RLocks:    make(map[string]map[string][]string),
+	}
+
+	lm.opsLogMut.Lock()
+	res.CommitPoint = lm.CommitPoint
+	lm.opsLogMut.Unlock()
+
+	lm.wLockMut.Lock()
+	for key, entry := range lm.WLocks {
+		res.WLocks[key] = &WLockStatus{NodeID: entry.nodeID, LockID: entry.LockID, Version: entry.version, Timeout: entry.timeout}
+	}
+	lm.wLockMut.Unlock()
+
+	lm.rLockMut.Lock()
+	for key, entry := range lm.RLocks {
+		copySet := make(map[string][]string, len(entry.CopySet))
+		for node, lock := range entry.CopySet {
+			copySet[node] = append([]string(nil), lock...)
+		}
+		res.RLocks[key] = copySet
+	}
+	lm.rLockMut.Unlock()
+
+	return res
+}
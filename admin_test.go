@@ -0,0 +1,166 @@
+package buddystore
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func startAdminCluster(t *testing.T, token string) (*Cluster, *httptest.Server) {
+	c, err := NewStableCluster(2, 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	server := httptest.NewServer(NewAdminServer(token, func() []*Ring {
+		var rings []*Ring
+		for _, node := range c.Running() {
+			rings = append(rings, node.Ring)
+		}
+		return rings
+	}))
+	return c, server
+}
+
+func adminRequest(t *testing.T, method, url, token string, res interface{}) int {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && res != nil {
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminVnodes(t *testing.T) {
+	c, server := startAdminCluster(t, "")
+	defer c.Shutdown()
+	defer server.Close()
+
+	if err := c.Node("host-0").KV.Set("key", []byte("value")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if _, err := c.Node("host-1").LM.RLock("key", true); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	var vnodes []*VnodeStatus
+	if code := adminRequest(t, "GET", server.URL+"/admin/vnodes", "", &vnodes); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	var local []*localVnode
+	for _, n := range c.Running() {
+		local = append(local, n.Ring.vnodes...)
+	}
+	if len(vnodes) != len(local) {
+		t.Fatalf("expected %d vnodes, got %d", len(local), len(vnodes))
+	}
+
+	locked := 0
+	for i, status := range vnodes {
+		if status.Id != local[i].String() || status.Host != local[i].Host {
+			t.Fatalf("unexpected vnode %s on %s", status.Id, status.Host)
+		}
+		if status.Successors[0] == nil || status.Predecessor == nil || len(status.Fingers) == 0 {
+			t.Fatalf("expected a stable vnode, got %+v", status)
+		}
+		if status.LastStabilized.IsZero() {
+			t.Fatalf("expected vnode %s to have stabilized", status.Id)
+		}
+		if copySet, ok := status.LockManager.RLocks["key"]; ok {
+			locked++
+			if !status.LockManager.CurrentLM || len(copySet) != 1 {
+				t.Fatalf("unexpected lock state of key %+v", status.LockManager)
+			}
+		}
+	}
+	if locked == 0 {
+		t.Fatalf("expected the lock manager to report the read lock")
+	}
+
+	if code := adminRequest(t, "GET", server.URL+"/admin/vnodes?ring=other", "", &vnodes); code != http.StatusOK || len(vnodes) != 0 {
+		t.Fatalf("expected no vnodes of another ring, got %d, %d", code, len(vnodes))
+	}
+}
+
+func TestAdminTracker(t *testing.T) {
+	c, server := startAdminCluster(t, "")
+	defer c.Shutdown()
+	defer server.Close()
+
+	// Members of a ring are recorded under its ID
+	joined := []*Vnode{c.Node("host-1").Ring.GetLocalVnode()}
+	record, _ := json.Marshal(joined)
+	if err := c.Node("host-1").KV.Set("friend", record); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	var members []*AdminVnode
+	if code := adminRequest(t, "GET", server.URL+"/admin/tracker?ring=friend", "", &members); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if len(members) != 1 || members[0].Id != joined[0].String() || members[0].Host != "host-1" {
+		t.Fatalf("unexpected members %v", members)
+	}
+
+	if code := adminRequest(t, "GET", server.URL+"/admin/tracker", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", code)
+	}
+}
+
+func TestAdminStabilize(t *testing.T) {
+	c, server := startAdminCluster(t, "secret")
+	defer c.Shutdown()
+	defer server.Close()
+
+	vn := c.Node("host-0").Ring.vnodes[0]
+	url := server.URL + "/admin/stabilize?vnode=" + vn.String()
+
+	for token, expected := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized} {
+		if code := adminRequest(t, "POST", url, token, nil); code != expected {
+			t.Fatalf("unexpected status %d with token %q", code, token)
+		}
+	}
+	if code := adminRequest(t, "GET", url, "secret", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if code := adminRequest(t, "POST", server.URL+"/admin/stabilize?vnode=00", "secret", nil); code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", code)
+	}
+
+	before := vn.lastStabilized()
+	var res StabilizeResult
+	if code := adminRequest(t, "POST", url, "secret", &res); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if len(res.Stabilized)+len(res.Skipped) != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if len(res.Stabilized) == 1 && !vn.lastStabilized().After(before) {
+		t.Fatalf("expected the vnode to have stabilized")
+	}
+
+	// Read-only without a token
+	readOnly := httptest.NewServer(NewAdminServer("", func() []*Ring {
+		return []*Ring{c.Node("host-0").Ring}
+	}))
+	defer readOnly.Close()
+	if code := adminRequest(t, "POST", readOnly.URL+"/admin/stabilize", "secret", nil); code != http.StatusForbidden {
+		t.Fatalf("unexpected status %d", code)
+	}
+}
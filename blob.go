@@ -0,0 +1,335 @@
+package buddystore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Size of the chunks objects are split into by default
+const BLOB_CHUNK_SIZE = 1 << 20
+
+// Prefixes of the keys manifests and chunks are stored under
+const (
+	BLOB_MANIFEST_PREFIX = "blob/"
+	BLOB_CHUNK_PREFIX    = "chunk/"
+)
+
+// Key the chunks found unreferenced by CollectGarbage are recorded under
+const BLOB_GC_KEY = "blobgc"
+
+// Time a chunk stays unreferenced before CollectGarbage deletes it by default
+const BLOB_GC_GRACE = 1 * time.Hour
+
+/*
+BlobStore stores large objects on top of a KVStoreClient, without ever
+holding a whole object in a single value. Objects are split into chunks,
+each stored under the SHA1 of its content, so chunks spread across the ring
+and are shared between every object and version containing them. A manifest
+listing the chunks of an object is written under the name of the object
+once all of its chunks are stored, so readers see either the old version or
+the new one.
+
+Chunks are cut at fixed offsets, so only content aligned to the chunk size
+is shared between versions. Deleting an object only deletes its manifest,
+CollectGarbage deletes the chunks no manifest has referred to for a while.
+*/
+type BlobStore struct {
+	ChunkSize int           // Size of the chunks, BLOB_CHUNK_SIZE if 0
+	GCGrace   time.Duration // Time a chunk stays unreferenced before it is deleted, BLOB_GC_GRACE if 0
+
+	kv KVStoreClient
+}
+
+// Lists the chunks of an object, in order
+type BlobManifest struct {
+	Size   int64
+	Chunks []string // Hex SHA1 of every chunk
+}
+
+func NewBlobStore(kv KVStoreClient) *BlobStore {
+	return &BlobStore{kv: kv}
+}
+
+func blobManifestKey(name string) string {
+	return BLOB_MANIFEST_PREFIX + name
+}
+
+func blobChunkKey(sum string) string {
+	return BLOB_CHUNK_PREFIX + sum
+}
+
+/*
+Stores the content of r as the object name, replacing any previous version.
+Chunks already stored by another object or version are not written again.
+Returns the manifest written.
+*/
+func (bs *BlobStore) PutObject(name string, r io.Reader) (*BlobManifest, error) {
+	chunkSize := bs.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = BLOB_CHUNK_SIZE
+	}
+
+	manifest := &BlobManifest{Chunks: []string{}}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sum, err := bs.putChunk(buf[:n])
+			if err != nil {
+				return nil, err
+			}
+			manifest.Chunks = append(manifest.Chunks, sum)
+			manifest.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	val, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := bs.kv.Set(blobManifestKey(name), val); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Stores a chunk unless it is already stored, and returns its hex SHA1
+func (bs *BlobStore) putChunk(chunk []byte) (string, error) {
+	hash := sha1.Sum(chunk)
+	sum := hex.EncodeToString(hash[:])
+
+	// Chunks are immutable, so any stored copy is the same content
+	_, err := bs.kv.Get(blobChunkKey(sum), false)
+	if err == nil {
+		return sum, nil
+	}
+	if !IsNotFound(err) {
+		return "", err
+	}
+
+	// Stores may keep the value given, and the caller reuses its buffer
+	if err := bs.kv.Set(blobChunkKey(sum), append([]byte(nil), chunk...)); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+// Returns the manifest of the current version of an object
+func (bs *BlobStore) Stat(name string) (*BlobManifest, error) {
+	val, err := bs.kv.Get(blobManifestKey(name), true)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BlobManifest{}
+	if err := json.Unmarshal(val, manifest); err != nil {
+		return nil, fmt.Errorf("Invalid manifest for %s: %s", name, err)
+	}
+	return manifest, nil
+}
+
+/*
+Returns a reader of the current version of an object. Chunks are fetched
+one at a time as they are read, and checked against their hash.
+*/
+func (bs *BlobStore) GetObject(name string) (*BlobReader, error) {
+	manifest, err := bs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobReader{Manifest: manifest, kv: bs.kv}, nil
+}
+
+// Deletes the manifest of an object. Its chunks are left for CollectGarbage.
+func (bs *BlobStore) DeleteObject(name string) error {
+	deleter, ok := bs.kv.(kvDeleter)
+	if !ok {
+		return fmt.Errorf("Store cannot delete keys")
+	}
+	return deleter.Delete(blobManifestKey(name))
+}
+
+// Lists the names of the objects stored
+func (bs *BlobStore) List() ([]string, error) {
+	keys, err := bs.listKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, BLOB_MANIFEST_PREFIX) {
+			names = append(names, strings.TrimPrefix(key, BLOB_MANIFEST_PREFIX))
+		}
+	}
+	return names, nil
+}
+
+func (bs *BlobStore) listKeys() ([]string, error) {
+	lister, ok := bs.kv.(keyLister)
+	if !ok {
+		return nil, fmt.Errorf("Store cannot list its keys")
+	}
+	return lister.Keys()
+}
+
+/*
+Deletes the chunks no manifest has referred to for at least GCGrace, and
+returns how many were deleted. Unreferenced chunks are recorded under
+BLOB_GC_KEY when first found and only deleted by a later run, so the chunks
+of an object being written survive until its manifest is, as long as
+PutObject completes within GCGrace. The record is rewritten under a write
+lease, so concurrent runs are serialized.
+*/
+func (bs *BlobStore) CollectGarbage() (int, error) {
+	deleter, ok := bs.kv.(kvDeleter)
+	if !ok {
+		return 0, fmt.Errorf("Store cannot delete keys")
+	}
+
+	grace := bs.GCGrace
+	if grace == 0 {
+		grace = BLOB_GC_GRACE
+	}
+
+	// Unreferenced chunks, with the time they were first found
+	unused := make(map[string]time.Time)
+	val, version, err := bs.kv.GetForSet(BLOB_GC_KEY, true)
+	if err == nil {
+		err = json.Unmarshal(val, &unused)
+	} else if IsNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		bs.abort(BLOB_GC_KEY, version)
+		return 0, err
+	}
+
+	deleted, err := bs.sweep(deleter, unused, grace)
+	if err != nil {
+		bs.abort(BLOB_GC_KEY, version)
+		return deleted, err
+	}
+
+	if val, err = json.Marshal(unused); err != nil {
+		bs.abort(BLOB_GC_KEY, version)
+		return deleted, err
+	}
+	return deleted, bs.kv.SetVersion(BLOB_GC_KEY, version, val)
+}
+
+// Deletes the chunks found unreferenced at least grace ago, and records
+// the ones found unreferenced for the first time
+func (bs *BlobStore) sweep(deleter kvDeleter, unused map[string]time.Time, grace time.Duration) (int, error) {
+	keys, err := bs.listKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	used := make(map[string]bool)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, BLOB_MANIFEST_PREFIX) {
+			continue
+		}
+		manifest, err := bs.Stat(strings.TrimPrefix(key, BLOB_MANIFEST_PREFIX))
+		if err != nil {
+			// Deleted since the listing. Any other failure leaves chunks
+			// that may be in use unaccounted for, so nothing is deleted.
+			if IsNotFound(err) {
+				continue
+			}
+			return 0, err
+		}
+		for _, sum := range manifest.Chunks {
+			used[sum] = true
+		}
+	}
+
+	now := time.Now()
+	stored := make(map[string]bool)
+	deleted := 0
+	for _, key := range keys {
+		if !strings.HasPrefix(key, BLOB_CHUNK_PREFIX) {
+			continue
+		}
+		sum := strings.TrimPrefix(key, BLOB_CHUNK_PREFIX)
+		if used[sum] {
+			continue
+		}
+
+		found, ok := unused[sum]
+		if !ok {
+			unused[sum] = now
+			stored[sum] = true
+			continue
+		}
+		if now.Sub(found) < grace {
+			stored[sum] = true
+			continue
+		}
+
+		if err := deleter.Delete(key); err != nil && !IsNotFound(err) {
+			return deleted, err
+		}
+		delete(unused, sum)
+		deleted++
+	}
+
+	// Forget the chunks referred to again, or deleted by others
+	for sum := range unused {
+		if !stored[sum] {
+			delete(unused, sum)
+		}
+	}
+	return deleted, nil
+}
+
+// Gives up a write lease taken with GetForSet, if the store can
+func (bs *BlobStore) abort(key string, version uint) {
+	if aborter, ok := bs.kv.(kvAborter); ok {
+		aborter.AbortVersion(key, version)
+	}
+}
+
+// Reads an object chunk by chunk
+type BlobReader struct {
+	Manifest *BlobManifest
+
+	kv    KVStoreClient
+	next  int // Index of the next chunk to fetch
+	chunk *bytes.Reader
+}
+
+func (br *BlobReader) Read(p []byte) (int, error) {
+	for br.chunk == nil || br.chunk.Len() == 0 {
+		if br.next == len(br.Manifest.Chunks) {
+			return 0, io.EOF
+		}
+
+		sum := br.Manifest.Chunks[br.next]
+		val, err := br.kv.Get(blobChunkKey(sum), true)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to read chunk %s: %s", sum, err)
+		}
+		hash := sha1.Sum(val)
+		if hex.EncodeToString(hash[:]) != sum {
+			return 0, fmt.Errorf("Chunk %s is corrupted", sum)
+		}
+
+		br.chunk = bytes.NewReader(val)
+		br.next++
+	}
+	return br.chunk.Read(p)
+}
@@ -0,0 +1,212 @@
+package buddystore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startBlobCluster(t *testing.T) (*Cluster, *BlobStore) {
+	c, err := NewStableCluster(2, 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	bs := NewBlobStore(c.Node("host-0").KV)
+	bs.ChunkSize = 4
+	return c, bs
+}
+
+// Counts the chunks stored on the ring
+func countChunks(t *testing.T, c *Cluster) int {
+	keys, err := c.Node("host-1").Ring.Keys()
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	n := 0
+	for _, key := range keys {
+		if strings.HasPrefix(key, BLOB_CHUNK_PREFIX) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBlobPutGet(t *testing.T) {
+	c, bs := startBlobCluster(t)
+	defer c.Shutdown()
+
+	manifest, err := bs.PutObject("object", strings.NewReader("aaaabbbbaaaacc"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if manifest.Size != 14 || len(manifest.Chunks) != 4 || manifest.Chunks[0] != manifest.Chunks[2] {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+	if n := countChunks(t, c); n != 3 {
+		t.Fatalf("expected 3 chunks, got %d", n)
+	}
+
+	// Read from another node
+	reader, err := NewBlobStore(c.Node("host-1").KV).GetObject("object")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if val, err := ioutil.ReadAll(reader); err != nil || string(val) != "aaaabbbbaaaacc" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+
+	// A new version shares the unchanged chunks
+	if _, err := bs.PutObject("object", strings.NewReader("aaaabbbbdddd")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if n := countChunks(t, c); n != 4 {
+		t.Fatalf("expected 4 chunks, got %d", n)
+	}
+	reader, err = bs.GetObject("object")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if val, err := ioutil.ReadAll(reader); err != nil || string(val) != "aaaabbbbdddd" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+
+	manifest, err = bs.PutObject("empty", bytes.NewReader(nil))
+	if err != nil || manifest.Size != 0 || len(manifest.Chunks) != 0 {
+		t.Fatalf("unexpected manifest %+v. %v", manifest, err)
+	}
+	reader, err = bs.GetObject("empty")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if val, err := ioutil.ReadAll(reader); err != nil || len(val) != 0 {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+
+	names, err := bs.List()
+	if err != nil || len(names) != 2 || names[0] != "empty" || names[1] != "object" {
+		t.Fatalf("unexpected names %v. %v", names, err)
+	}
+	if _, err := bs.GetObject("missing"); err == nil {
+		t.Fatalf("expected an error reading a missing object")
+	}
+}
+
+func TestBlobCorruptedChunk(t *testing.T) {
+	c, bs := startBlobCluster(t)
+	defer c.Shutdown()
+
+	manifest, err := bs.PutObject("object", strings.NewReader("aaaabbbb"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := c.Node("host-1").KV.Set(blobChunkKey(manifest.Chunks[1]), []byte("cccc")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	reader, err := bs.GetObject("object")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if _, err := ioutil.ReadAll(reader); err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Fatalf("expected a corrupted chunk, got %v", err)
+	}
+}
+
+func TestBlobCollectGarbage(t *testing.T) {
+	c, bs := startBlobCluster(t)
+	defer c.Shutdown()
+
+	if _, err := bs.PutObject("a", strings.NewReader("aaaabbbb")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if _, err := bs.PutObject("b", strings.NewReader("bbbbcccc")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if n := countChunks(t, c); n != 3 {
+		t.Fatalf("expected 3 chunks, got %d", n)
+	}
+
+	if deleted, err := bs.CollectGarbage(); err != nil || deleted != 0 {
+		t.Fatalf("unexpected garbage %d. %v", deleted, err)
+	}
+
+	if err := bs.DeleteObject("a"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Unreferenced chunks are only deleted once the grace period is over
+	bs.GCGrace = time.Hour
+	if deleted, err := bs.CollectGarbage(); err != nil || deleted != 0 {
+		t.Fatalf("unexpected garbage %d. %v", deleted, err)
+	}
+	if deleted, err := bs.CollectGarbage(); err != nil || deleted != 0 {
+		t.Fatalf("unexpected garbage %d. %v", deleted, err)
+	}
+	if n := countChunks(t, c); n != 3 {
+		t.Fatalf("expected 3 chunks, got %d", n)
+	}
+
+	bs.GCGrace = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	if deleted, err := bs.CollectGarbage(); err != nil || deleted != 1 {
+		t.Fatalf("unexpected garbage %d. %v", deleted, err)
+	}
+	if n := countChunks(t, c); n != 2 {
+		t.Fatalf("expected 2 chunks, got %d", n)
+	}
+
+	reader, err := bs.GetObject("b")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if val, err := ioutil.ReadAll(reader); err != nil || string(val) != "bbbbcccc" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+}
+
+// Fails to read the manifests, as if their replicas were unreachable
+type unreachableManifestsKV struct {
+	*KVStoreClientImpl
+}
+
+func (kv unreachableManifestsKV) Get(key string, retry bool) ([]byte, error) {
+	if strings.HasPrefix(key, BLOB_MANIFEST_PREFIX) {
+		return nil, fmt.Errorf("All read replicas failed")
+	}
+	return kv.KVStoreClientImpl.Get(key, retry)
+}
+
+func TestBlobCollectGarbageUnreachableManifest(t *testing.T) {
+	c, bs := startBlobCluster(t)
+	defer c.Shutdown()
+
+	if _, err := bs.PutObject("a", strings.NewReader("aaaabbbb")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Chunks of manifests that cannot be read are never collected
+	gc := NewBlobStore(unreachableManifestsKV{c.Node("host-0").KV})
+	gc.GCGrace = time.Millisecond
+	for i := 0; i < 2; i++ {
+		if _, err := gc.CollectGarbage(); err == nil {
+			t.Fatalf("expected the collection to fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := countChunks(t, c); n != 2 {
+		t.Fatalf("expected 2 chunks, got %d", n)
+	}
+
+	reader, err := bs.GetObject("a")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if val, err := ioutil.ReadAll(reader); err != nil || string(val) != "aaaabbbb" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+}
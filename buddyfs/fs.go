@@ -0,0 +1,645 @@
+/*
+Package buddyfs provides a filesystem of directories and files over the KV
+store of a ring, so applications can treat a ring like a disk.
+
+Every file and directory is an inode, stored as JSON under its own key. A
+directory inode holds the names of its entries and the IDs of their inodes,
+and is updated atomically by taking a write lease on it with GetForSet and
+writing it back with SetVersion. The content of a file is stored as a blob
+named after its inode, see buddystore.BlobStore.
+
+FS implements fs.FS, fs.StatFS, fs.ReadDirFS and fs.ReadFileFS, so the
+io/fs helpers work on it, and adds methods to modify the tree.
+*/
+package buddyfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buddyfs/buddystore"
+)
+
+// Prefix of the keys inodes are stored under
+const INODE_PREFIX = "inode/"
+
+// ID of the inode of the root directory
+const ROOT_INODE = "root"
+
+// Metadata of a file or directory
+type Inode struct {
+	Id      string
+	Mode    fs.FileMode
+	Size    int64
+	ModTime time.Time
+	Owner   string
+	Entries map[string]string `json:",omitempty"` // Names and inode IDs of the entries of a directory
+}
+
+func (ino *Inode) IsDir() bool {
+	return ino.Mode.IsDir()
+}
+
+// A filesystem stored on the ring of a KV client
+type FS struct {
+	Owner string // Owner of the files and directories created
+
+	kv    buddystore.KVStoreClient
+	blobs *buddystore.BlobStore
+}
+
+var (
+	_ fs.StatFS     = &FS{}
+	_ fs.ReadDirFS  = &FS{}
+	_ fs.ReadFileFS = &FS{}
+)
+
+// Opens the filesystem stored through kv, creating its root directory if missing
+func New(kv buddystore.KVStoreClient, owner string) (*FS, error) {
+	fsys := &FS{Owner: owner, kv: kv, blobs: buddystore.NewBlobStore(kv)}
+
+	if _, err := fsys.getInode(ROOT_INODE); err == nil {
+		return fsys, nil
+	} else if !buddystore.IsNotFound(err) {
+		return nil, err
+	}
+
+	// Only one of the hosts opening a new filesystem at once creates the root
+	_, version, err := fsys.kv.GetForSet(inodeKey(ROOT_INODE), true)
+	if err == nil || !buddystore.IsNotFound(err) {
+		fsys.abort(ROOT_INODE, version)
+		if err != nil {
+			return nil, err
+		}
+		return fsys, nil
+	}
+
+	root := &Inode{Id: ROOT_INODE, Mode: fs.ModeDir | 0755, ModTime: time.Now(), Owner: owner, Entries: map[string]string{}}
+	val, err := json.Marshal(root)
+	if err != nil {
+		fsys.abort(ROOT_INODE, version)
+		return nil, err
+	}
+	if err := fsys.kv.SetVersion(inodeKey(ROOT_INODE), version, val); err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+func inodeKey(id string) string {
+	return INODE_PREFIX + id
+}
+
+func newInodeId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (fsys *FS) getInode(id string) (*Inode, error) {
+	val, err := fsys.kv.Get(inodeKey(id), true)
+	if err != nil {
+		return nil, err
+	}
+	return decodeInode(id, val)
+}
+
+func decodeInode(id string, val []byte) (*Inode, error) {
+	ino := &Inode{}
+	if err := json.Unmarshal(val, ino); err != nil {
+		return nil, fmt.Errorf("Invalid inode %s: %s", id, err)
+	}
+
+	// Empty directories are stored without entries
+	if ino.IsDir() && ino.Entries == nil {
+		ino.Entries = map[string]string{}
+	}
+	return ino, nil
+}
+
+func (fsys *FS) putInode(ino *Inode) error {
+	val, err := json.Marshal(ino)
+	if err != nil {
+		return err
+	}
+	return fsys.kv.Set(inodeKey(ino.Id), val)
+}
+
+/*
+Updates an inode atomically. A write lease is held on the inode while update
+runs, so concurrent updates are serialized. If the inode cannot be read or
+update fails, the lease is given up without writing.
+*/
+func (fsys *FS) updateInode(id string, update func(ino *Inode) error) error {
+	val, version, err := fsys.kv.GetForSet(inodeKey(id), true)
+	if err != nil {
+		fsys.abort(id, version)
+		return err
+	}
+
+	ino, err := decodeInode(id, val)
+	if err != nil {
+		fsys.abort(id, version)
+		return err
+	}
+
+	if err := update(ino); err != nil {
+		fsys.abort(id, version)
+		return err
+	}
+
+	updated, err := json.Marshal(ino)
+	if err != nil {
+		fsys.abort(id, version)
+		return err
+	}
+	return fsys.kv.SetVersion(inodeKey(id), version, updated)
+}
+
+// Gives up a write lease taken on an inode with GetForSet. Leases are left
+// to time out on stores which cannot give them up.
+func (fsys *FS) abort(id string, version uint) {
+	aborter, ok := fsys.kv.(interface {
+		AbortVersion(key string, version uint) error
+	})
+	if ok {
+		aborter.AbortVersion(inodeKey(id), version)
+	}
+}
+
+// Returns the inode at a path, which must satisfy fs.ValidPath
+func (fsys *FS) lookup(name string) (*Inode, error) {
+	ino, err := fsys.getInode(ROOT_INODE)
+	if err != nil || name == "." {
+		return ino, err
+	}
+
+	for _, elem := range strings.Split(name, "/") {
+		if !ino.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+		id, ok := ino.Entries[elem]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		if ino, err = fsys.getInode(id); err != nil {
+			if buddystore.IsNotFound(err) {
+				return nil, fs.ErrNotExist
+			}
+			return nil, err
+		}
+	}
+	return ino, nil
+}
+
+// Returns the directory holding name, and the base name of name in it
+func (fsys *FS) lookupParent(op, name string) (*Inode, string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	dir, err := fsys.lookup(path.Dir(name))
+	if err != nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if !dir.IsDir() {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return dir, path.Base(name), nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	ino, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return &fileInfo{path.Base(name), ino}, nil
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	ino, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	info := &fileInfo{path.Base(name), ino}
+
+	if ino.IsDir() {
+		entries, err := fsys.readDir(ino)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &dir{info: info, entries: entries}, nil
+	}
+
+	reader, err := fsys.blobs.GetObject(ino.Id)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{info: info, reader: reader}, nil
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	ino, err := fsys.lookup(name)
+	if err == nil && !ino.IsDir() {
+		err = fmt.Errorf("Not a directory")
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries, err := fsys.readDir(ino)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// Lists the entries of a directory, sorted by name
+func (fsys *FS) readDir(ino *Inode) ([]fs.DirEntry, error) {
+	names := make([]string, 0, len(ino.Entries))
+	for name := range ino.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, name := range names {
+		child, err := fsys.getInode(ino.Entries[name])
+		if err != nil {
+			// Removed since the directory was read
+			if buddystore.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{name, child}))
+	}
+	return entries, nil
+}
+
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	val, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return val, nil
+}
+
+// Adds an entry to a directory, failing if the name is taken
+func (fsys *FS) link(dir *Inode, name, id string) error {
+	return fsys.updateInode(dir.Id, func(ino *Inode) error {
+		if _, ok := ino.Entries[name]; ok {
+			return fs.ErrExist
+		}
+		ino.Entries[name] = id
+		ino.ModTime = time.Now()
+		return nil
+	})
+}
+
+// Creates a directory
+func (fsys *FS) Mkdir(name string, perm fs.FileMode) error {
+	parent, base, err := fsys.lookupParent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if _, ok := parent.Entries[base]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+
+	id, err := newInodeId()
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	ino := &Inode{Id: id, Mode: fs.ModeDir | perm.Perm(), ModTime: time.Now(), Owner: fsys.Owner, Entries: map[string]string{}}
+	if err := fsys.putInode(ino); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	if err := fsys.link(parent, base, id); err != nil {
+		fsys.deleteInode(ino)
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Creates a directory and any missing parents
+func (fsys *FS) MkdirAll(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	for i := 0; i <= len(name); i++ {
+		if i < len(name) && name[i] != '/' {
+			continue
+		}
+		prefix := name[:i]
+		err := fsys.Mkdir(prefix, perm)
+		if err == nil {
+			continue
+		}
+		if info, serr := fsys.Stat(prefix); serr != nil || !info.IsDir() {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Writes the content of r to a file, creating it with perm if missing. The
+content is replaced atomically, so readers see either the old content or
+the new one. The size and modification time are updated after it.
+*/
+func (fsys *FS) WriteFile(name string, r io.Reader, perm fs.FileMode) error {
+	parent, base, err := fsys.lookupParent("write", name)
+	if err != nil {
+		return err
+	}
+
+	id, exists := parent.Entries[base]
+	if exists {
+		if ino, err := fsys.getInode(id); err == nil && ino.IsDir() {
+			return &fs.PathError{Op: "write", Path: name, Err: fmt.Errorf("Is a directory")}
+		}
+	} else {
+		if id, err = newInodeId(); err != nil {
+			return &fs.PathError{Op: "write", Path: name, Err: err}
+		}
+	}
+
+	manifest, err := fsys.blobs.PutObject(id, r)
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+
+	if exists {
+		err = fsys.updateInode(id, func(ino *Inode) error {
+			if ino.IsDir() {
+				return fmt.Errorf("Is a directory")
+			}
+			ino.Size = manifest.Size
+			ino.ModTime = time.Now()
+			return nil
+		})
+		if err != nil {
+			return &fs.PathError{Op: "write", Path: name, Err: err}
+		}
+		return nil
+	}
+
+	ino := &Inode{Id: id, Mode: perm.Perm(), Size: manifest.Size, ModTime: time.Now(), Owner: fsys.Owner}
+	if err := fsys.putInode(ino); err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	if err := fsys.link(parent, base, id); err != nil {
+		fsys.deleteInode(ino)
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Deletes an inode and the content of a file. Its chunks are left for BlobStore.CollectGarbage.
+func (fsys *FS) deleteInode(ino *Inode) error {
+	deleter, ok := fsys.kv.(interface {
+		Delete(key string) error
+	})
+	if !ok {
+		return fmt.Errorf("Store cannot delete keys")
+	}
+
+	if !ino.IsDir() {
+		if err := fsys.blobs.DeleteObject(ino.Id); err != nil && !buddystore.IsNotFound(err) {
+			return err
+		}
+	}
+	return deleter.Delete(inodeKey(ino.Id))
+}
+
+// Removes a file or an empty directory
+func (fsys *FS) Remove(name string) error {
+	parent, base, err := fsys.lookupParent("remove", name)
+	if err != nil {
+		return err
+	}
+
+	var removed *Inode
+	err = fsys.updateInode(parent.Id, func(dir *Inode) error {
+		id, ok := dir.Entries[base]
+		if !ok {
+			return fs.ErrNotExist
+		}
+		ino, err := fsys.getInode(id)
+		if err != nil {
+			return err
+		}
+		if ino.IsDir() && len(ino.Entries) > 0 {
+			return fmt.Errorf("Directory not empty")
+		}
+
+		delete(dir.Entries, base)
+		dir.ModTime = time.Now()
+		removed = ino
+		return nil
+	})
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	// Nothing refers to the inode anymore, failing to delete it only leaks it
+	fsys.deleteInode(removed)
+	return nil
+}
+
+/*
+Renames a file or directory, replacing the file at newname if any.
+Renaming within a directory is atomic. Renaming across directories adds the
+new entry before removing the old one, so a failure in between leaves the
+inode under both names.
+*/
+func (fsys *FS) Rename(oldname, newname string) error {
+	oldParent, oldBase, err := fsys.lookupParent("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newParent, newBase, err := fsys.lookupParent("rename", newname)
+	if err != nil {
+		return err
+	}
+	if oldname == newname {
+		return nil
+	}
+	if strings.HasPrefix(newname, oldname+"/") {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fmt.Errorf("Cannot move a directory into itself")}
+	}
+
+	id, ok := oldParent.Entries[oldBase]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+
+	// Links newname to the inode, returning the inode replaced
+	var replaced *Inode
+	replace := func(dir *Inode) error {
+		if target, ok := dir.Entries[newBase]; ok {
+			ino, err := fsys.getInode(target)
+			if err != nil {
+				return err
+			}
+			if ino.IsDir() {
+				return fs.ErrExist
+			}
+			replaced = ino
+		}
+		dir.Entries[newBase] = id
+		dir.ModTime = time.Now()
+		return nil
+	}
+	unlink := func(dir *Inode) error {
+		if dir.Entries[oldBase] != id {
+			return fs.ErrNotExist
+		}
+		delete(dir.Entries, oldBase)
+		dir.ModTime = time.Now()
+		return nil
+	}
+
+	if oldParent.Id == newParent.Id {
+		err = fsys.updateInode(oldParent.Id, func(dir *Inode) error {
+			if err := unlink(dir); err != nil {
+				return err
+			}
+			return replace(dir)
+		})
+	} else if err = fsys.updateInode(newParent.Id, replace); err == nil {
+		err = fsys.updateInode(oldParent.Id, unlink)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+
+	if replaced != nil && replaced.Id != id {
+		fsys.deleteInode(replaced)
+	}
+	return nil
+}
+
+// Changes the permissions of a file or directory
+func (fsys *FS) Chmod(name string, mode fs.FileMode) error {
+	return fsys.updateMetadata("chmod", name, func(ino *Inode) {
+		ino.Mode = ino.Mode.Type() | mode.Perm()
+	})
+}
+
+// Changes the owner of a file or directory
+func (fsys *FS) Chown(name, owner string) error {
+	return fsys.updateMetadata("chown", name, func(ino *Inode) {
+		ino.Owner = owner
+	})
+}
+
+// Changes the modification time of a file or directory
+func (fsys *FS) Chtimes(name string, mtime time.Time) error {
+	return fsys.updateMetadata("chtimes", name, func(ino *Inode) {
+		ino.ModTime = mtime
+	})
+}
+
+func (fsys *FS) updateMetadata(op, name string, update func(ino *Inode)) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	ino, err := fsys.lookup(name)
+	if err == nil {
+		err = fsys.updateInode(ino.Id, func(ino *Inode) error {
+			update(ino)
+			return nil
+		})
+	}
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// Describes an inode under the name it was reached through
+type fileInfo struct {
+	name string
+	ino  *Inode
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.ino.Size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.ino.Mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.ino.ModTime }
+func (fi *fileInfo) IsDir() bool        { return fi.ino.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return fi.ino }
+
+// An open file, read chunk by chunk
+type file struct {
+	info   *fileInfo
+	reader *buddystore.BlobReader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *file) Read(p []byte) (int, error) { return f.reader.Read(p) }
+func (f *file) Close() error               { return nil }
+
+// An open directory, with its entries read when it was opened
+type dir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fmt.Errorf("Is a directory")}
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,179 @@
+package buddyfs
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/buddyfs/buddystore"
+)
+
+func startFS(t *testing.T) (*buddystore.Cluster, *FS) {
+	c, err := buddystore.NewStableCluster(2, 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	fsys, err := New(c.Node("host-0").KV, "alice")
+	if err != nil {
+		c.Shutdown()
+		t.Fatalf("unexpected err. %s", err)
+	}
+	return c, fsys
+}
+
+func TestFS(t *testing.T) {
+	c, fsys := startFS(t)
+	defer c.Shutdown()
+
+	if err := fsys.MkdirAll("docs/notes", 0750); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := fsys.WriteFile("docs/notes/todo.txt", strings.NewReader("buy milk"), 0640); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := fsys.WriteFile("readme", strings.NewReader("hello"), 0644); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := fsys.Mkdir("empty", 0755); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	if err := fstest.TestFS(fsys, "docs/notes/todo.txt", "readme", "empty"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// The same tree is seen from another node
+	other, err := New(c.Node("host-1").KV, "bob")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if val, err := fs.ReadFile(other, "docs/notes/todo.txt"); err != nil || string(val) != "buy milk" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+
+	info, err := other.Stat("docs/notes/todo.txt")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if info.Size() != 8 || info.Mode() != 0640 || info.Sys().(*Inode).Owner != "alice" {
+		t.Fatalf("unexpected info %+v", info.Sys())
+	}
+}
+
+func TestFSWrite(t *testing.T) {
+	c, fsys := startFS(t)
+	defer c.Shutdown()
+
+	if err := fsys.WriteFile("file", strings.NewReader("first"), 0644); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := fsys.WriteFile("file", strings.NewReader("second version"), 0600); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if val, err := fsys.ReadFile("file"); err != nil || string(val) != "second version" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+	if info, err := fsys.Stat("file"); err != nil || info.Size() != 14 || info.Mode() != 0644 {
+		t.Fatalf("unexpected info %+v. %v", info, err)
+	}
+
+	mtime := time.Date(2014, 5, 1, 0, 0, 0, 0, time.UTC)
+	if err := fsys.Chmod("file", 0600); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := fsys.Chown("file", "bob"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := fsys.Chtimes("file", mtime); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	info, err := fsys.Stat("file")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if info.Mode() != 0600 || info.Sys().(*Inode).Owner != "bob" || !info.ModTime().Equal(mtime) {
+		t.Fatalf("unexpected info %+v", info.Sys())
+	}
+
+	if err := fsys.Mkdir("file", 0755); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("unexpected err. %v", err)
+	}
+	// The lease on the root was given up by the failed update
+	if err := fsys.Mkdir("dir", 0755); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := fsys.WriteFile("missing/file", strings.NewReader(""), 0644); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unexpected err. %v", err)
+	}
+	if err := fsys.WriteFile("/file", strings.NewReader(""), 0644); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("unexpected err. %v", err)
+	}
+}
+
+func TestFSRenameRemove(t *testing.T) {
+	c, fsys := startFS(t)
+	defer c.Shutdown()
+
+	for _, dir := range []string{"a", "b"} {
+		if err := fsys.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+	}
+	for _, name := range []string{"a/x", "a/y", "b/z"} {
+		if err := fsys.WriteFile(name, strings.NewReader(name), 0644); err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+	}
+
+	// Within a directory, across directories, and replacing a file
+	if err := fsys.Rename("a/x", "a/w"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := fsys.Rename("a/w", "b/w"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := fsys.Rename("a/y", "b/z"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if val, err := fsys.ReadFile("b/z"); err != nil || string(val) != "a/y" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+	if val, err := fsys.ReadFile("b/w"); err != nil || string(val) != "a/x" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+	if entries, err := fsys.ReadDir("a"); err != nil || len(entries) != 0 {
+		t.Fatalf("unexpected entries %v. %v", entries, err)
+	}
+
+	if err := fsys.Rename("b", "b/c"); err == nil {
+		t.Fatalf("expected an error moving a directory into itself")
+	}
+	if err := fsys.Rename("b/z", "a"); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("unexpected err. %v", err)
+	}
+	if err := fsys.Rename("b", "a/b"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if val, err := fsys.ReadFile("a/b/w"); err != nil || string(val) != "a/x" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+
+	if err := fsys.Remove("a/b"); err == nil {
+		t.Fatalf("expected an error removing a directory which is not empty")
+	}
+	for _, name := range []string{"a/b/w", "a/b/z", "a/b", "a"} {
+		if err := fsys.Remove(name); err != nil {
+			t.Fatalf("unexpected err removing %s. %s", name, err)
+		}
+	}
+	if err := fsys.Remove("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unexpected err. %v", err)
+	}
+	if entries, err := fsys.ReadDir("."); err != nil || len(entries) != 0 {
+		t.Fatalf("unexpected entries %v. %v", entries, err)
+	}
+}
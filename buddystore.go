@@ -5,37 +5,109 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/anupcshan/Taipei-Torrent/torrent"
-	"github.com/golang/glog"
 	"github.com/nictuku/nettools"
 )
 
 const ENOTINITIALIZED = -1
+const ENOTJOINED = -2
 const OK = 0
 
 const TRACKER_URL = "udp://tracker.openbittorrent.com:80/announce"
 const BUDDYSTORE_INFOHASH_BASE = "BuddyStore"
 const PEERLEN = 6
 
+// Interval between attempts to join friend rings that could not be joined
+var FRIEND_RETRY_INTERVAL = 30 * time.Second
+
+// Backoff between failed initialization attempts
+const INIT_RETRY_MIN_WAIT = 1 * time.Second
+const INIT_RETRY_MAX_WAIT = 30 * time.Second
+
+type BuddyStoreStatus int
+
+const (
+	STATUS_STOPPED BuddyStoreStatus = iota
+	STATUS_STARTING
+	STATUS_RUNNING
+)
+
+func (s BuddyStoreStatus) String() string {
+	switch s {
+	case STATUS_STOPPED:
+		return "stopped"
+	case STATUS_STARTING:
+		return "starting"
+	case STATUS_RUNNING:
+		return "running"
+	}
+	return fmt.Sprintf("BuddyStoreStatus(%d)", int(s))
+}
+
 type BuddyStore struct {
 	Config     *BuddyStoreConfig
 	GlobalRing RingIntf
 	SubRings   map[string]RingIntf
 	Tracker    TrackerClient
-
-	initalized bool
-	lock       sync.Mutex
+	Discovery  *LANDiscovery
+	State      *NodeState
+
+	transport      Transport
+	metrics        net.Listener
+	admin          net.Listener
+	gateway        net.Listener
+	s3             net.Listener
+	pendingFriends map[string]bool
+	friendTimer    *time.Timer
+	lock           sync.Mutex
+
+	status      BuddyStoreStatus
+	lastErr     error
+	cancelStart chan struct{}
+	statusLock  sync.Mutex
 }
 
 type BuddyStoreConfig struct {
-	MyID      string
-	Friends   []string
-	LocalOnly bool
+	MyID         string
+	Friends      []string
+	LocalOnly    bool
+	LANDiscovery *LANDiscoveryConfig // Set to discover and prefer peers on the local network
+	TrackerURL   string              // BitTorrent tracker used for bootstrap. Defaults to TRACKER_URL
+	InitRetries  int                 // Number of times to retry a failed initialization. Negative retries forever
+	StateDir     string              // Directory persisting the node identity across restarts. Empty disables
+	Transport    *TCPTransportConfig // Listen and advertised addresses and ports. Random ports if nil
+	MetricsAddr  string              // Address serving Prometheus metrics under /metrics. Empty disables
+	AdminAddr    string              // Address serving the state of the node under /admin. Empty disables
+	AdminToken   string              // Bearer token allowing admin actions. Empty keeps the admin server read-only
+	GatewayAddr  string              // Address serving the KV stores of the joined rings over HTTP under /rings. Empty disables
+	S3Addr       string              // Address serving the joined rings as buckets through the S3 API. Empty disables
+	Logger       Logger              // Receives the log of the store and everything it runs. Defaults to DefaultLogger
+}
+
+func (bs *BuddyStore) log() *fieldLogger {
+	return newFieldLogger(bs.Config.Logger, Field("id", bs.Config.MyID))
+}
+
+// Returns the transport configuration, logging to the logger of the store
+func (bs *BuddyStore) transportConfig() *TCPTransportConfig {
+	if bs.Config.Logger == nil {
+		return bs.Config.Transport
+	}
+
+	tconf := TCPTransportConfig{}
+	if bs.Config.Transport != nil {
+		tconf = *bs.Config.Transport
+	}
+	if tconf.Logger == nil {
+		tconf.Logger = bs.Config.Logger
+	}
+	return &tconf
 }
 
 /*
@@ -46,19 +118,576 @@ func (bs *BuddyStore) addRing(ringId string, ring RingIntf) {
 	bs.SubRings[ringId] = ring
 }
 
+// Returns the rings joined so far, the global ring first
+func (bs *BuddyStore) localRings() []*Ring {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	var rings []*Ring
+	if r, ok := bs.GlobalRing.(*Ring); ok {
+		rings = append(rings, r)
+	}
+	for _, ring := range bs.SubRings {
+		if r, ok := ring.(*Ring); ok {
+			rings = append(rings, r)
+		}
+	}
+	return rings
+}
+
+// Returns the IDs of the rings joined so far, in sorted order
+func (bs *BuddyStore) ringIds() []string {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	ids := make([]string, 0, len(bs.SubRings))
+	for ringId := range bs.SubRings {
+		ids = append(ids, ringId)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
 /*
  * Join the global ring and all interested subrings.
+ * On failure, everything joined so far is torn down again.
  */
-func (bs *BuddyStore) init() error {
+func (bs *BuddyStore) init() (err error) {
 	bs.lock.Lock()
 	defer bs.lock.Unlock()
 
-	if bs.initalized {
+	if bs.GlobalRing != nil {
 		return fmt.Errorf("Attempting to initialize an already initialized store")
 	}
 
-	port, transport, conf := CreateNewTCPTransport(bs.Config.LocalOnly)
+	defer func() {
+		if err != nil {
+			bs.teardown()
+		}
+	}()
+
+	if len(bs.Config.MetricsAddr) > 0 {
+		bs.metrics, err = ServeMetrics(bs.Config.MetricsAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(bs.Config.AdminAddr) > 0 {
+		bs.admin, err = ServeAdmin(bs.Config.AdminAddr, bs.Config.AdminToken, bs.localRings)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(bs.Config.GatewayAddr) > 0 {
+		bs.gateway, err = ServeKVGateway(bs.Config.GatewayAddr, func(ringId string) (KVStoreClient, int) {
+			return bs.GetKVClient(ringId)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(bs.Config.S3Addr) > 0 {
+		bs.s3, err = ServeS3Gateway(bs.Config.S3Addr, func(ringId string) (KVStoreClient, int) {
+			return bs.GetKVClient(ringId)
+		}, bs.ringIds)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(bs.Config.StateDir) > 0 {
+		bs.State, err = loadNodeState(bs.Config.StateDir, bs.Config.Logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The global ring is recorded in the node state under the empty ring ID
+	port, transport, conf, err := bs.State.createTransport("", bs.transportConfig(), bs.Config.LocalOnly)
+	if err != nil {
+		return err
+	}
+	bs.transport = transport
+
+	if bs.Config.LANDiscovery != nil {
+		lconf := *bs.Config.LANDiscovery
+		if lconf.Logger == nil {
+			lconf.Logger = bs.Config.Logger
+		}
+		bs.Discovery, err = NewLANDiscovery(&lconf)
+		if err != nil {
+			bs.log().Error("Unable to start LAN discovery", Field("err", err))
+		} else {
+			conf.Discovery = bs.Discovery
+		}
+	}
+
+	// Peers on the local network are preferred over the ones the tracker knows about
+	if bs.Discovery != nil {
+		for _, peer := range bs.Discovery.WaitForPeers(conf.RingId, LAN_DISCOVERY_WAIT) {
+			if err = ensureReachable(bs.natConfig(), transport, conf, peer); err != nil {
+				bs.log().Error("Skipping LAN peer", Field("peer", peer), Field("err", err))
+				continue
+			}
+			bs.GlobalRing, err = Join(conf, transport, peer)
+			if err == nil {
+				bs.log().Info("Successfully joined chord ring using LAN peer", Field("peer", peer))
+				break
+			}
+			bs.GlobalRing = nil
+		}
+	}
+
+	// The tracker only knows about IP addresses and ports
+	if bs.GlobalRing == nil && !bs.Config.Transport.isUnix() {
+		err = bs.joinGlobalRingViaTracker(port, transport, conf)
+		if err != nil {
+			if bs.Discovery == nil {
+				return err
+			}
+
+			// Keep going without the tracker, LAN peers can still find us
+			bs.log().Error("Continuing without tracker", Field("err", err))
+		}
+	}
+
+	if bs.GlobalRing == nil {
+		bs.GlobalRing, err = Create(conf, transport)
+
+		if err != nil {
+			// Simply retry the init process
+			return err
+		}
+	}
+
+	bs.State.recordRing("", bs.GlobalRing)
+
+	// A relay only forwards the listener of the global ring, so a relayed
+	// node has to serve all of its rings over it. So does a node on a Unix
+	// socket, which has a single path to listen on.
+	shared, ok := transport.(*TCPTransport)
+	if ok && (bs.Config.Transport != nil && bs.Config.Transport.Shared || bs.Config.Transport.isUnix() || shared.RelayAddr() != "") {
+		bs.Tracker = NewTrackerClientWithSharedTransport(bs.GlobalRing, bs.Discovery, bs.State, shared)
+	} else {
+		bs.Tracker = NewTrackerClientWithTransportConfig(bs.GlobalRing, bs.Discovery, bs.State, bs.transportConfig())
+	}
+
+	// Join my own ring
+	ring, err := bs.Tracker.JoinRing(bs.Config.MyID, bs.Config.LocalOnly)
+	if err != nil {
+		// If I'm not able to join my own ring, bail
+		return err
+	} else {
+		bs.addRing(bs.Config.MyID, ring)
+	}
+
+	// Any errors from this point on will not prevent initialization
+	// from completing successfully.
+
+	// Join my friends' rings. Failed joins are retried in the background.
+	bs.pendingFriends = make(map[string]bool)
+	for _, friend := range bs.Config.Friends {
+		ring, err := bs.joinFriend(bs.Tracker, friend)
+		bs.addFriendRing(friend, ring, err)
+	}
+	bs.scheduleFriendRetry()
+
+	return nil
+}
+
+/*
+ * Join a friend's ring through tracker. Joining blocks on the network, so
+ * the lock need not be held.
+ */
+func (bs *BuddyStore) joinFriend(tracker TrackerClient, friend string) (*Ring, error) {
+	ring, err := tracker.JoinRing(friend, bs.Config.LocalOnly)
+	if err != nil {
+		bs.log().Error("Unable to join ring of friend", Field("friend", friend), Field("err", err))
+	}
+	return ring, err
+}
+
+/*
+ * Install the ring of a friend, or remember the friend for a later retry if
+ * the ring could not be joined.
+ * Expected to be called with lock being held.
+ */
+func (bs *BuddyStore) addFriendRing(friend string, ring *Ring, err error) {
+	if err != nil {
+		bs.pendingFriends[friend] = true
+		return
+	}
+
+	delete(bs.pendingFriends, friend)
+	bs.addRing(friend, ring)
+}
+
+/*
+ * Join a friend's ring without holding the lock. The ring is left again if
+ * the store was torn down, or the friend removed or joined, in the meantime.
+ * Expected to be called without lock being held.
+ */
+func (bs *BuddyStore) joinFriendUnlocked(tracker TrackerClient, friend string) error {
+	ring, err := bs.joinFriend(tracker, friend)
+
+	bs.lock.Lock()
+	_, joined := bs.SubRings[friend]
+	if bs.Tracker == tracker && bs.isFriend(friend) && !joined {
+		bs.addFriendRing(friend, ring, err)
+		bs.lock.Unlock()
+		return err
+	}
+	bs.lock.Unlock()
+
+	if err == nil {
+		bs.log().Info("Leaving ring of friend no longer needed", Field("friend", friend))
+		leaveAndShutdown(ring)
+	}
+	return err
+}
+
+/*
+ * Returns true if friend is among the configured friends.
+ * Expected to be called with lock being held.
+ */
+func (bs *BuddyStore) isFriend(friend string) bool {
+	for _, f := range bs.Config.Friends {
+		if f == friend {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Schedule a retry of the pending friend rings, if there are any.
+ * Expected to be called with lock being held.
+ */
+func (bs *BuddyStore) scheduleFriendRetry() {
+	if len(bs.pendingFriends) == 0 || bs.friendTimer != nil {
+		return
+	}
+	bs.friendTimer = time.AfterFunc(FRIEND_RETRY_INTERVAL, bs.retryFriends)
+}
+
+// Retries joining all the friend rings that could not be joined so far
+func (bs *BuddyStore) retryFriends() {
+	bs.lock.Lock()
+	tracker := bs.Tracker
+	timer := bs.friendTimer
+
+	// Store was torn down in the meantime
+	if tracker == nil {
+		bs.lock.Unlock()
+		return
+	}
+
+	pending := make([]string, 0, len(bs.pendingFriends))
+	for friend := range bs.pendingFriends {
+		pending = append(pending, friend)
+	}
+	bs.lock.Unlock()
+
+	// The timer stays set while joining, so that no other retry starts
+	for _, friend := range pending {
+		bs.joinFriendUnlocked(tracker, friend)
+	}
+
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	if bs.Tracker != tracker || bs.friendTimer != timer {
+		return
+	}
+	bs.friendTimer = nil
+	bs.scheduleFriendRetry()
+}
+
+/*
+ * Add a friend and join their ring. If the ring cannot be joined right
+ * now, the error is returned and joining is retried in the background.
+ */
+func (bs *BuddyStore) AddFriend(friend string) error {
+	if len(friend) == 0 || friend == bs.Config.MyID {
+		return fmt.Errorf("Invalid friend ID %q", friend)
+	}
+
+	bs.lock.Lock()
+	if !bs.isFriend(friend) {
+		bs.Config.Friends = append(bs.Config.Friends, friend)
+	}
+	tracker := bs.Tracker
+	_, joined := bs.SubRings[friend]
+	bs.lock.Unlock()
 
+	// Friend rings are joined on Start
+	if tracker == nil || joined {
+		return nil
+	}
+
+	err := bs.joinFriendUnlocked(tracker, friend)
+
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	if bs.Tracker == tracker {
+		bs.scheduleFriendRetry()
+	}
+	return err
+}
+
+/*
+ * Remove a friend and leave their ring.
+ */
+func (bs *BuddyStore) RemoveFriend(friend string) error {
+	if friend == bs.Config.MyID {
+		return fmt.Errorf("Cannot leave our own ring")
+	}
+
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+
+	friends := make([]string, 0, len(bs.Config.Friends))
+	for _, f := range bs.Config.Friends {
+		if f != friend {
+			friends = append(friends, f)
+		}
+	}
+	bs.Config.Friends = friends
+	delete(bs.pendingFriends, friend)
+
+	ring, ok := bs.SubRings[friend]
+	if !ok {
+		return nil
+	}
+
+	delete(bs.SubRings, friend)
+	return leaveAndShutdown(ring)
+}
+
+/*
+ * Leave every ring and release the network resources held by the store.
+ * Expected to be called with lock being held.
+ */
+func (bs *BuddyStore) teardown() error {
+	var err error
+
+	if bs.friendTimer != nil {
+		bs.friendTimer.Stop()
+		bs.friendTimer = nil
+	}
+	bs.pendingFriends = nil
+
+	if bs.metrics != nil {
+		bs.metrics.Close()
+		bs.metrics = nil
+	}
+
+	if bs.admin != nil {
+		bs.admin.Close()
+		bs.admin = nil
+	}
+
+	if bs.gateway != nil {
+		bs.gateway.Close()
+		bs.gateway = nil
+	}
+
+	if bs.s3 != nil {
+		bs.s3.Close()
+		bs.s3 = nil
+	}
+
+	// Leaving a ring waits for its vnodes to finish stabilizing, so leave
+	// all of them at once
+	rings := make([]RingIntf, 0, len(bs.SubRings)+1)
+	for ringId, ring := range bs.SubRings {
+		rings = append(rings, ring)
+		delete(bs.SubRings, ringId)
+	}
+
+	if bs.GlobalRing != nil {
+		// The global ring owns bs.transport
+		rings = append(rings, bs.GlobalRing)
+		bs.GlobalRing = nil
+	} else if bs.transport != nil {
+		shutdownTransport(bs.transport)
+	}
+	bs.transport = nil
+
+	errs := make(chan error, len(rings))
+	for _, ring := range rings {
+		go func(ring RingIntf) {
+			errs <- leaveAndShutdown(ring)
+		}(ring)
+	}
+	for i := 0; i < len(rings); i++ {
+		err = mergeErrors(err, <-errs)
+	}
+
+	if bs.Discovery != nil {
+		bs.Discovery.Shutdown()
+		bs.Discovery = nil
+	}
+
+	bs.Tracker = nil
+	bs.State = nil
+	return err
+}
+
+// Returns the NAT traversal configuration of the transports, if any
+func (bs *BuddyStore) natConfig() *NATConfig {
+	if bs.Config.Transport == nil {
+		return nil
+	}
+	return bs.Config.Transport.NAT
+}
+
+// Leaves a ring and shuts down the transport it was using
+func leaveAndShutdown(ring RingIntf) error {
+	err := ring.Leave()
+	shutdownTransport(ring.Transport())
+	return err
+}
+
+// Shuts down a transport, if it supports being shut down
+func shutdownTransport(trans Transport) {
+	if s, ok := trans.(interface {
+		Shutdown()
+	}); ok {
+		s.Shutdown()
+	}
+}
+
+/*
+ * Initialize the store, retrying failed attempts with exponential backoff
+ * up to Config.InitRetries times. Returns the last initialization error.
+ */
+func (bs *BuddyStore) Start() error {
+	bs.statusLock.Lock()
+	if bs.status != STATUS_STOPPED {
+		defer bs.statusLock.Unlock()
+		return fmt.Errorf("Cannot start BuddyStore while it is %s", bs.status)
+	}
+	bs.status = STATUS_STARTING
+	cancel := make(chan struct{})
+	bs.cancelStart = cancel
+	bs.statusLock.Unlock()
+
+	wait := INIT_RETRY_MIN_WAIT
+	for attempt := 0; ; attempt++ {
+		err := bs.init()
+
+		bs.statusLock.Lock()
+		select {
+		case <-cancel:
+			// Close was called while we were initializing, and may have
+			// torn the store down before we joined anything, so tear down
+			// whatever we joined ourselves.
+			bs.statusLock.Unlock()
+			bs.lock.Lock()
+			bs.teardown()
+			bs.lock.Unlock()
+			return fmt.Errorf("BuddyStore was closed while starting")
+		default:
+		}
+
+		if err == nil {
+			bs.status = STATUS_RUNNING
+			bs.lastErr = nil
+			bs.cancelStart = nil
+			bs.statusLock.Unlock()
+			return nil
+		}
+
+		bs.lastErr = err
+		if bs.Config.InitRetries >= 0 && attempt >= bs.Config.InitRetries {
+			bs.status = STATUS_STOPPED
+			bs.cancelStart = nil
+			bs.statusLock.Unlock()
+			return err
+		}
+		bs.statusLock.Unlock()
+
+		bs.log().Error("Error while initializing buddystore, retrying", Field("wait", wait), Field("err", err))
+
+		select {
+		case <-cancel:
+			return fmt.Errorf("BuddyStore was closed while starting")
+		case <-time.After(wait):
+		}
+
+		wait *= 2
+		if wait > INIT_RETRY_MAX_WAIT {
+			wait = INIT_RETRY_MAX_WAIT
+		}
+	}
+}
+
+/*
+ * Leave all rings and shut down all transports. The store can be started
+ * again afterwards using Start.
+ */
+func (bs *BuddyStore) Close() error {
+	bs.statusLock.Lock()
+	if bs.cancelStart != nil {
+		close(bs.cancelStart)
+		bs.cancelStart = nil
+	}
+	bs.statusLock.Unlock()
+
+	bs.lock.Lock()
+	err := bs.teardown()
+	bs.lock.Unlock()
+
+	bs.statusLock.Lock()
+	bs.status = STATUS_STOPPED
+	bs.statusLock.Unlock()
+
+	return err
+}
+
+/*
+ * Close the store and start it again using a new configuration.
+ */
+func (bs *BuddyStore) Restart(bsConfig *BuddyStoreConfig) error {
+	if len(bsConfig.MyID) == 0 {
+		return fmt.Errorf("Cannot restart BuddyStore instance without ID")
+	}
+
+	if err := bs.Close(); err != nil {
+		bs.log().Error("Error while closing buddystore", Field("err", err))
+	}
+
+	bs.lock.Lock()
+	bs.Config = bsConfig
+	bs.lock.Unlock()
+
+	return bs.Start()
+}
+
+// Returns the current lifecycle status of the store
+func (bs *BuddyStore) Status() BuddyStoreStatus {
+	bs.statusLock.Lock()
+	defer bs.statusLock.Unlock()
+	return bs.status
+}
+
+// Returns the error from the last failed initialization attempt, if any
+func (bs *BuddyStore) LastError() error {
+	bs.statusLock.Lock()
+	defer bs.statusLock.Unlock()
+	return bs.lastErr
+}
+
+/*
+ * Announce ourselves to the BitTorrent tracker and try to join the global
+ * ring through one of the peers it returns. Leaves bs.GlobalRing nil if no
+ * peer could be contacted.
+ */
+func (bs *BuddyStore) joinGlobalRingViaTracker(port int, transport Transport, conf *Config) error {
 	var err error
 
 	h := sha1.New()
@@ -68,7 +697,10 @@ func (bs *BuddyStore) init() error {
 	var peeridBase = bs.Config.MyID
 	h = sha1.New()
 	interfaces, err := net.Interfaces()
-	if err == nil {
+	if bs.State != nil {
+		// A persisted identity is stable even if the network interfaces change
+		peeridBase = bs.State.NodeId()
+	} else if err == nil {
 		for _, iface := range interfaces {
 			if iface.Flags&net.FlagLoopback == net.FlagLoopback {
 				continue
@@ -77,101 +709,75 @@ func (bs *BuddyStore) init() error {
 			break
 		}
 	}
-	glog.Infof("Peerid base: %s", peeridBase)
+	bs.log().Info("Peerid base", Field("base", peeridBase))
 	io.WriteString(h, peeridBase)
 	peerid := hex.EncodeToString(h.Sum([]byte(nil)))[:20]
 
-	glog.Infof("Announcing to tracker %s about infohash '%s' using peerid '%s' on port %d", TRACKER_URL, infohash, peerid, port)
-	tResp, err := torrent.QueryTracker(nil, torrent.ClientStatusReport{InfoHash: infohash, PeerId: peerid, Port: uint16(port), Downloaded: 100, Left: 10, Uploaded: 200}, TRACKER_URL)
+	trackerURL := bs.Config.TrackerURL
+	if len(trackerURL) == 0 {
+		trackerURL = TRACKER_URL
+	}
+
+	bs.log().Info("Announcing to tracker", Field("tracker", trackerURL), Field("infohash", infohash), Field("peerid", peerid), Field("port", port))
+	tResp, err := torrent.QueryTracker(nil, torrent.ClientStatusReport{InfoHash: infohash, PeerId: peerid, Port: uint16(port), Downloaded: 100, Left: 10, Uploaded: 200}, trackerURL)
 
 	if err != nil {
-		glog.Errorf("Error querying tracker: %s", err)
+		bs.log().Error("Error querying tracker", Field("tracker", trackerURL), Field("err", err))
 		return err
 	}
 
-	glog.Infof("Tracker Response Peers: %d, %d, %q", tResp.Complete, tResp.Incomplete, tResp.Peers)
+	bs.log().Info("Tracker response", Field("complete", tResp.Complete), Field("incomplete", tResp.Incomplete), Field("peers", len(tResp.Peers)/PEERLEN))
 
 	peers := tResp.Peers
 
 	if len(peers) > 0 {
-		log.Println("Tracker gave us", len(peers)/PEERLEN, "peers")
 		for i := 0; i < len(peers); i += PEERLEN {
 			peer := nettools.BinaryToDottedPort(peers[i : i+PEERLEN])
 			_, prt, _ := net.SplitHostPort(peer)
 			if prt == strconv.Itoa(port) {
-				glog.Infoln("Skipping self as peer")
+				bs.log().Info("Skipping self as peer")
 				// TODO: Hack to make sure we don't connect to ourselves.
 				// To be more correct, we should check hostname as well.
 				continue
 			}
 
-			if glog.V(2) {
-				glog.Infof("Trying to contact peer: %q, me: %d", peer, port)
+			bs.log().Debug("Trying to contact peer", Field("peer", peer), Field("port", port))
+			if err = ensureReachable(bs.natConfig(), transport, conf, peer); err != nil {
+				bs.log().Error("Skipping peer", Field("peer", peer), Field("err", err))
+				continue
 			}
 			bs.GlobalRing, err = Join(conf, transport, peer)
 
 			if err == nil {
-				glog.Infof("Successfully joined chord ring using peer %s", peer)
+				bs.log().Info("Successfully joined chord ring using peer", Field("peer", peer))
 				break
 			} else {
-				if glog.V(2) {
-					glog.Infof("Failed to contact peer with error: %s", err)
-				}
+				bs.log().Debug("Failed to contact peer", Field("peer", peer), Field("err", err))
 			}
 
 			bs.GlobalRing = nil
 		}
 	}
 
-	if bs.GlobalRing == nil {
-		bs.GlobalRing, err = Create(conf, transport)
-
-		if err != nil {
-			// Simply retry the init process
-			return err
-		}
-	}
-
-	bs.Tracker = NewTrackerClient(bs.GlobalRing)
-
-	// Join my own ring
-	ring, err := bs.Tracker.JoinRing(bs.Config.MyID, bs.Config.LocalOnly)
-	if err != nil {
-		// If I'm not able to join my own ring, bail
-		return err
-	} else {
-		bs.addRing(bs.Config.MyID, ring)
-	}
-
-	// Any errors from this point on will not prevent initialization
-	// from completing successfully.
-
-	// Join my friends' rings
-	for _, friend := range bs.Config.Friends { // TODO : Is the list of friends sub-rings getting populated from the global ring?
-		ring, err := bs.Tracker.JoinRing(friend, bs.Config.LocalOnly)
-
-		if err != nil {
-			bs.addRing(friend, ring)
-		}
-	}
-
-	bs.initalized = true
 	return nil
 }
 
-func (bs BuddyStore) GetMyKVClient() (KVStoreClient, int) {
+func (bs *BuddyStore) GetMyKVClient() (KVStoreClient, int) {
 	return bs.GetKVClient(bs.Config.MyID)
 }
 
-func (bs BuddyStore) GetKVClient(ringId string) (KVStoreClient, int) {
+func (bs *BuddyStore) GetKVClient(ringId string) (KVStoreClient, int) {
 	bs.lock.Lock()
 	defer bs.lock.Unlock()
 
-	if !bs.initalized {
+	if bs.Status() != STATUS_RUNNING {
 		return nil, ENOTINITIALIZED
 	}
 
-	ring := bs.SubRings[ringId]
+	ring, ok := bs.SubRings[ringId]
+	if !ok {
+		return nil, ENOTJOINED
+	}
 	lm := ring.GetLocalLocalVnode().lm_client
 
 	kvClient := NewKVStoreClientWithLM(ring, lm)
@@ -180,16 +786,16 @@ func (bs BuddyStore) GetKVClient(ringId string) (KVStoreClient, int) {
 
 func NewBuddyStore(bsConfig *BuddyStoreConfig) *BuddyStore {
 	if len(bsConfig.MyID) == 0 {
-		glog.Errorf("Cannot create BuddyStore instance without ID")
+		newFieldLogger(bsConfig.Logger).Error("Cannot create BuddyStore instance without ID")
 		return nil
 	}
 
 	bs := &BuddyStore{Config: bsConfig, lock: sync.Mutex{}, SubRings: make(map[string]RingIntf)}
-	err := bs.init()
+	err := bs.Start()
 
 	if err != nil {
-		// TODO: Should we retry initialization here?
-		glog.Errorf("Error while initializing buddystore: %s", err)
+		// Callers can inspect Status() and LastError(), and call Start() again
+		bs.log().Error("Error while initializing buddystore", Field("err", err))
 	}
 
 	return bs
@@ -0,0 +1,354 @@
+package buddystore
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuddyStoreBootstrapWithLocalTracker(t *testing.T) {
+	tr, err := NewUDPTracker(fmt.Sprintf("127.0.0.1:%d", PORT+2012))
+	if err != nil {
+		t.Fatalf("Unable to start tracker: %s", err)
+	}
+	defer tr.Shutdown()
+
+	bs1 := NewBuddyStore(&BuddyStoreConfig{MyID: "node1", LocalOnly: true, TrackerURL: tr.URL()})
+	assert.NotNil(t, bs1)
+	assert.Equal(t, STATUS_RUNNING, bs1.Status())
+
+	bs2 := NewBuddyStore(&BuddyStoreConfig{MyID: "node2", LocalOnly: true, TrackerURL: tr.URL()})
+	assert.NotNil(t, bs2)
+	assert.Equal(t, STATUS_RUNNING, bs2.Status())
+
+	// The second node should have joined the ring created by the first one
+	host1 := bs1.GlobalRing.GetLocalVnode().Host
+	found := false
+	for _, vn := range bs2.GlobalRing.GetLocalLocalVnode().Successors() {
+		if vn != nil && vn.Host == host1 {
+			found = true
+		}
+	}
+	assert.True(t, found, "Expected %s among the successors of the second node", host1)
+
+	assert.NoError(t, bs2.Close())
+
+	assert.NoError(t, bs1.Close())
+	assert.Equal(t, STATUS_STOPPED, bs1.Status())
+}
+
+func TestBuddyStoreCloseAndStart(t *testing.T) {
+	tr, err := NewUDPTracker(fmt.Sprintf("127.0.0.1:%d", PORT+2013))
+	if err != nil {
+		t.Fatalf("Unable to start tracker: %s", err)
+	}
+	defer tr.Shutdown()
+
+	bs := NewBuddyStore(&BuddyStoreConfig{MyID: "node1", LocalOnly: true, TrackerURL: tr.URL()})
+	assert.Equal(t, STATUS_RUNNING, bs.Status())
+	host := bs.GlobalRing.GetLocalVnode().Host
+
+	assert.NoError(t, bs.Close())
+	assert.Equal(t, STATUS_STOPPED, bs.Status())
+	assert.Nil(t, bs.GlobalRing)
+	assert.Empty(t, bs.SubRings)
+
+	_, code := bs.GetMyKVClient()
+	assert.Equal(t, ENOTINITIALIZED, code)
+
+	// The transport should no longer be listening
+	_, err = net.Dial("tcp", host)
+	assert.Error(t, err)
+
+	assert.NoError(t, bs.Start())
+	assert.Equal(t, STATUS_RUNNING, bs.Status())
+	assert.NotNil(t, bs.SubRings["node1"])
+
+	assert.Error(t, bs.Start(), "Starting a running store should fail")
+
+	assert.NoError(t, bs.Close())
+}
+
+func TestBuddyStoreRetriesInit(t *testing.T) {
+	// Nothing is listening on the tracker address for the first attempt
+	listen := fmt.Sprintf("127.0.0.1:%d", PORT+2014)
+	go func() {
+		time.Sleep(INIT_RETRY_MIN_WAIT / 2)
+		tr, err := NewUDPTracker(listen)
+		if err == nil {
+			time.Sleep(time.Minute)
+			tr.Shutdown()
+		}
+	}()
+
+	bs := NewBuddyStore(&BuddyStoreConfig{MyID: "node1", LocalOnly: true, TrackerURL: "udp://" + listen + "/announce", InitRetries: 3})
+	assert.Equal(t, STATUS_RUNNING, bs.Status())
+	assert.NoError(t, bs.LastError())
+	assert.NoError(t, bs.Close())
+}
+
+func TestBuddyStoreCloseWhileStarting(t *testing.T) {
+	bs := &BuddyStore{Config: &BuddyStoreConfig{MyID: "node1", LocalOnly: true, TrackerURL: fmt.Sprintf("udp://127.0.0.1:%d/announce", PORT+2015), InitRetries: -1}, SubRings: make(map[string]RingIntf)}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- bs.Start()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, STATUS_STARTING, bs.Status())
+	assert.Error(t, bs.LastError())
+
+	bs.Close()
+	assert.Error(t, <-errCh)
+	assert.Equal(t, STATUS_STOPPED, bs.Status())
+}
+
+func TestBuddyStoreCloseBeforeInit(t *testing.T) {
+	tr, err := NewUDPTracker(fmt.Sprintf("127.0.0.1:%d", PORT+2017))
+	if err != nil {
+		t.Fatalf("Unable to start tracker: %s", err)
+	}
+	defer tr.Shutdown()
+
+	bs := &BuddyStore{Config: &BuddyStoreConfig{MyID: "node1", LocalOnly: true, TrackerURL: tr.URL()}, SubRings: make(map[string]RingIntf)}
+
+	// Hold the store so that Start waits to initialize it
+	bs.lock.Lock()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- bs.Start()
+	}()
+	for bs.Status() != STATUS_STARTING {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Close gets to the store first, while it is still empty
+	bs.statusLock.Lock()
+	close(bs.cancelStart)
+	bs.cancelStart = nil
+	bs.statusLock.Unlock()
+	assert.NoError(t, bs.teardown())
+	bs.statusLock.Lock()
+	bs.status = STATUS_STOPPED
+	bs.statusLock.Unlock()
+	bs.lock.Unlock()
+
+	// Start tears down the rings it joined afterwards
+	assert.Error(t, <-errCh)
+	assert.Equal(t, STATUS_STOPPED, bs.Status())
+	bs.lock.Lock()
+	assert.Nil(t, bs.GlobalRing)
+	assert.Empty(t, bs.SubRings)
+	bs.lock.Unlock()
+}
+
+// TrackerClient creating a fresh local ring for every join, unless told to fail
+type fakeTrackerClient struct {
+	fail  bool
+	joins map[string]int
+	block chan struct{} // Joins wait for it to be closed, if set
+	lock  sync.Mutex
+}
+
+func (f *fakeTrackerClient) JoinRing(ringId string, localOnly bool) (*Ring, error) {
+	if f.block != nil {
+		<-f.block
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.joins[ringId]++
+	if f.fail {
+		return nil, fmt.Errorf("Tracker unreachable")
+	}
+
+	conf := fastConf()
+	conf.RingId = ringId
+	return Create(conf, nil)
+}
+
+func (f *fakeTrackerClient) LeaveRing(ringId string) error {
+	return nil
+}
+
+func (f *fakeTrackerClient) setFail(fail bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.fail = fail
+}
+
+func createRunningStoreWithFakeTracker(friends ...string) (*BuddyStore, *fakeTrackerClient) {
+	tracker := &fakeTrackerClient{joins: make(map[string]int)}
+	bs := &BuddyStore{Config: &BuddyStoreConfig{MyID: "node1", Friends: friends}, SubRings: make(map[string]RingIntf)}
+	bs.Tracker = tracker
+	bs.pendingFriends = make(map[string]bool)
+	bs.status = STATUS_RUNNING
+	return bs, tracker
+}
+
+func TestBuddyStoreAddRemoveFriend(t *testing.T) {
+	bs, tracker := createRunningStoreWithFakeTracker()
+
+	assert.NoError(t, bs.AddFriend("friend1"))
+	assert.Equal(t, []string{"friend1"}, bs.Config.Friends)
+	assert.NotNil(t, bs.SubRings["friend1"])
+
+	kvClient, code := bs.GetKVClient("friend1")
+	assert.NotNil(t, kvClient)
+	assert.Equal(t, OK, code)
+
+	// Adding the same friend again should not join again
+	assert.NoError(t, bs.AddFriend("friend1"))
+	assert.Equal(t, []string{"friend1"}, bs.Config.Friends)
+	assert.Equal(t, 1, tracker.joins["friend1"])
+
+	assert.Error(t, bs.AddFriend("node1"))
+	assert.Error(t, bs.RemoveFriend("node1"))
+
+	assert.NoError(t, bs.RemoveFriend("friend1"))
+	assert.Empty(t, bs.Config.Friends)
+	assert.Nil(t, bs.SubRings["friend1"])
+
+	_, code = bs.GetKVClient("friend1")
+	assert.Equal(t, ENOTJOINED, code)
+}
+
+func TestBuddyStoreRetriesFriendRings(t *testing.T) {
+	oldInterval := FRIEND_RETRY_INTERVAL
+	FRIEND_RETRY_INTERVAL = 50 * time.Millisecond
+	defer func() {
+		FRIEND_RETRY_INTERVAL = oldInterval
+	}()
+
+	bs, tracker := createRunningStoreWithFakeTracker()
+
+	tracker.setFail(true)
+	assert.Error(t, bs.AddFriend("friend1"))
+	assert.Equal(t, []string{"friend1"}, bs.Config.Friends)
+
+	bs.lock.Lock()
+	assert.Nil(t, bs.SubRings["friend1"])
+	assert.True(t, bs.pendingFriends["friend1"])
+	bs.lock.Unlock()
+
+	tracker.setFail(false)
+	time.Sleep(200 * time.Millisecond)
+
+	bs.lock.Lock()
+	assert.NotNil(t, bs.SubRings["friend1"])
+	assert.Empty(t, bs.pendingFriends)
+	assert.Nil(t, bs.friendTimer)
+	bs.lock.Unlock()
+
+	assert.NoError(t, bs.Close())
+}
+
+func TestBuddyStoreJoinsFriendsWithoutLock(t *testing.T) {
+	bs, tracker := createRunningStoreWithFakeTracker()
+	tracker.block = make(chan struct{})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bs.AddFriend("friend1")
+	}()
+
+	// The store stays usable while the join blocks
+	for {
+		bs.lock.Lock()
+		added := bs.isFriend("friend1")
+		bs.lock.Unlock()
+		if added {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.NoError(t, bs.RemoveFriend("friend1"))
+
+	// A friend removed meanwhile is not joined
+	close(tracker.block)
+	assert.NoError(t, <-done)
+	assert.Nil(t, bs.SubRings["friend1"])
+	assert.Empty(t, bs.pendingFriends)
+}
+
+func TestBuddyStoreRestoresIdentity(t *testing.T) {
+	tr, err := NewUDPTracker(fmt.Sprintf("127.0.0.1:%d", PORT+2016))
+	if err != nil {
+		t.Fatalf("Unable to start tracker: %s", err)
+	}
+	defer tr.Shutdown()
+
+	bs := NewBuddyStore(&BuddyStoreConfig{MyID: "node1", LocalOnly: true, TrackerURL: tr.URL(), StateDir: t.TempDir()})
+	assert.Equal(t, STATUS_RUNNING, bs.Status())
+
+	globalVn := *bs.GlobalRing.GetLocalVnode()
+	ownVn := *bs.SubRings["node1"].GetLocalVnode()
+	nodeId := bs.State.NodeId()
+
+	assert.NoError(t, bs.Close())
+	assert.NoError(t, bs.Start())
+
+	// The restarted node should be back at the same positions and ports
+	assert.Equal(t, nodeId, bs.State.NodeId())
+	assert.Equal(t, globalVn.Host, bs.GlobalRing.GetLocalVnode().Host)
+	assert.Equal(t, globalVn.Id, bs.GlobalRing.GetLocalVnode().Id)
+	assert.Equal(t, ownVn.Host, bs.SubRings["node1"].GetLocalVnode().Host)
+	assert.Equal(t, ownVn.Id, bs.SubRings["node1"].GetLocalVnode().Id)
+
+	assert.NoError(t, bs.Close())
+}
+
+func TestBuddyStoreUsesConfiguredPorts(t *testing.T) {
+	tr, err := NewUDPTracker(fmt.Sprintf("127.0.0.1:%d", PORT+2031))
+	if err != nil {
+		t.Fatalf("Unable to start tracker: %s", err)
+	}
+	defer tr.Shutdown()
+
+	tconf := &TCPTransportConfig{ListenAddr: "127.0.0.1", Port: int(PORT + 2032), PortRange: 2}
+	bs := NewBuddyStore(&BuddyStoreConfig{MyID: "node1", LocalOnly: true, TrackerURL: tr.URL(), Transport: tconf})
+	assert.Equal(t, STATUS_RUNNING, bs.Status())
+
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", PORT+2032), bs.GlobalRing.GetLocalVnode().Host)
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", PORT+2033), bs.SubRings["node1"].GetLocalVnode().Host)
+
+	// No ports are left in the range for a friend ring
+	assert.Error(t, bs.AddFriend("node2"))
+
+	assert.NoError(t, bs.Close())
+}
+
+func TestBuddyStoreSharedListener(t *testing.T) {
+	tr, err := NewUDPTracker(fmt.Sprintf("127.0.0.1:%d", PORT+2042))
+	if err != nil {
+		t.Fatalf("Unable to start tracker: %s", err)
+	}
+	defer tr.Shutdown()
+
+	tconf := &TCPTransportConfig{ListenAddr: "127.0.0.1", Port: int(PORT + 2043), Shared: true}
+	bs := NewBuddyStore(&BuddyStoreConfig{MyID: "node1", LocalOnly: true, TrackerURL: tr.URL(), Transport: tconf})
+	assert.Equal(t, STATUS_RUNNING, bs.Status())
+
+	// All rings are served over the one configured port
+	host := fmt.Sprintf("127.0.0.1:%d", PORT+2043)
+	assert.Equal(t, host, bs.GlobalRing.GetLocalVnode().Host)
+	assert.Equal(t, host, bs.SubRings["node1"].GetLocalVnode().Host)
+
+	kv, code := bs.GetMyKVClient()
+	assert.Equal(t, OK, code)
+	assert.NoError(t, kv.Set("key", []byte("value")))
+	val, err := kv.Get("key", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	assert.NoError(t, bs.Close())
+
+	_, err = net.Dial("tcp", host)
+	assert.Error(t, err)
+}
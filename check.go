@@ -0,0 +1,272 @@
+package buddystore
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Kinds of ring violations
+const (
+	ViolationLoop         = "loop"          // The successor pointers do not lead back to the starting vnode
+	ViolationDetached     = "detached"      // A vnode of a host on the ring is not on the loop
+	ViolationPredecessor  = "predecessor"   // A vnode's predecessor is not the vnode whose successor it is
+	ViolationSuccessors   = "successors"    // A successor list differs from the vnodes following on the ring
+	ViolationUnreachable  = "unreachable"   // A vnode on the ring could not be queried
+	ViolationMisplacedKey = "misplaced-key" // A vnode holds a key it is not a replica of
+	ViolationMissingKey   = "missing-key"   // A replica of a key does not hold it
+)
+
+// An invariant of the ring found not to hold at a vnode
+type RingViolation struct {
+	Kind   string
+	Vnode  string
+	Detail string
+}
+
+/*
+RingCheck is the outcome of checking a ring. Vnodes and Keys count the vnodes
+on the loop and the distinct keys stored on them. Repairs describes the
+actions taken when asked to repair the ring.
+
+The replicas of a key are the vnodes a lookup of NumSuccessors vnodes
+returns: the owner, which must hold the key, and the vnodes following it,
+which must hold it unless they are on the owner's host. Vnodes up to
+NumSuccessors past the owner may keep a copy.
+*/
+type RingCheck struct {
+	RingId     string
+	Vnodes     int
+	Keys       int
+	Violations []*RingViolation
+	Repairs    []string
+}
+
+// Returns true if every invariant holds
+func (c *RingCheck) Ok() bool {
+	return len(c.Violations) == 0
+}
+
+// Returns the violations of the given kind
+func (c *RingCheck) ViolationsOf(kind string) []*RingViolation {
+	var res []*RingViolation
+	for _, v := range c.Violations {
+		if v.Kind == kind {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// State of a single run of the checker
+type ringChecker struct {
+	ring   *Ring
+	repair bool
+	res    *RingCheck
+	walk   []*Vnode
+	preds  []*Vnode
+	onRing map[string]bool // Vnodes on the loop
+	listed map[string]bool // Vnodes listed by the hosts on the loop
+}
+
+/*
+Checks the invariants of the ring by walking it from a local vnode through
+the transport: the successor pointers form one loop through every vnode of
+the hosts on it, each vnode's predecessor is the vnode before it, successor
+lists name the vnodes that follow, and keys sit on their replicas.
+
+With repair set, vnodes are notified of the vnodes they should have as
+predecessors, orphaned predecessors are cleared, and the local vnodes are
+stabilized right away, which also replicates their keys. The ring settles
+over the following stabilization runs, so a repaired ring should be checked
+again later.
+*/
+func (r *Ring) Check(repair bool) *RingCheck {
+	c := &ringChecker{
+		ring:   r,
+		repair: repair,
+		res:    &RingCheck{RingId: r.config.RingId},
+		onRing: make(map[string]bool),
+		listed: make(map[string]bool),
+	}
+
+	walk, preds, err := r.walkRing()
+	c.walk, c.preds = walk, preds
+	c.res.Vnodes = len(walk)
+	if err != nil {
+		c.violation(ViolationLoop, &r.vnodes[0].Vnode, err.Error())
+	} else {
+		for _, vn := range walk {
+			c.onRing[vn.String()] = true
+		}
+		c.checkDetached()
+		c.checkPredecessors()
+		c.checkSuccessors()
+		c.checkKeys()
+	}
+
+	if repair && !c.res.Ok() {
+		for _, vn := range r.vnodes {
+			if vn.stabilizeNow() {
+				c.repaired("Stabilized %s", vn)
+			}
+		}
+	}
+	return c.res
+}
+
+// Records a violation at the given vnode
+func (c *ringChecker) violation(kind string, vn *Vnode, format string, args ...interface{}) {
+	detail := fmt.Sprintf(format, args...)
+	c.res.Violations = append(c.res.Violations, &RingViolation{Kind: kind, Vnode: vn.String(), Detail: detail})
+	c.ring.log().Warn("Ring check failed", Field("kind", kind), Field("vnode", vn), Field("detail", detail))
+}
+
+// Records a repair action
+func (c *ringChecker) repaired(format string, args ...interface{}) {
+	c.res.Repairs = append(c.res.Repairs, fmt.Sprintf(format, args...))
+}
+
+// Returns the index of the vnode on the loop owning the given ID
+func (c *ringChecker) owner(id []byte) int {
+	for i, vn := range c.walk {
+		prev := c.walk[(i+len(c.walk)-1)%len(c.walk)]
+		if betweenRightIncl(prev.Id, vn.Id, id) {
+			return i
+		}
+	}
+	return 0
+}
+
+// Checks that the hosts on the loop have no vnodes off it
+func (c *ringChecker) checkDetached() {
+	hosts := make(map[string]bool)
+	for _, vn := range c.walk {
+		if hosts[vn.Host] {
+			continue
+		}
+		hosts[vn.Host] = true
+
+		vnodes, err := c.ring.transport.ListVnodes(vn.Host)
+		if err != nil {
+			c.violation(ViolationUnreachable, vn, "Unable to list the vnodes of %s: %s", vn.Host, err)
+			continue
+		}
+
+		for _, other := range vnodes {
+			c.listed[other.String()] = true
+			if c.onRing[other.String()] {
+				continue
+			}
+
+			// The successor of the detached vnode should take it as predecessor
+			succ := c.walk[c.owner(other.Id)]
+			c.violation(ViolationDetached, other, "Not reachable through successors, belongs before %s", succ)
+			if c.repair {
+				if _, err := c.ring.transport.Notify(succ, other); err == nil {
+					c.repaired("Notified %s of %s", succ, other)
+				}
+			}
+		}
+	}
+}
+
+// Checks that every vnode's predecessor is the vnode before it on the loop
+func (c *ringChecker) checkPredecessors() {
+	for i, vn := range c.walk {
+		prev := c.walk[(i+len(c.walk)-1)%len(c.walk)]
+		pred := c.preds[i]
+		if pred != nil && bytes.Equal(pred.Id, prev.Id) {
+			continue
+		}
+		c.violation(ViolationPredecessor, vn, "Predecessor is %s, expected %s", pred, prev)
+		if !c.repair {
+			continue
+		}
+
+		// Detached vnodes are taken care of by notifying their successor
+		if pred != nil && c.listed[pred.String()] && !c.onRing[pred.String()] {
+			continue
+		}
+
+		// Forget predecessors that are no longer part of the ring
+		if pred != nil && !c.onRing[pred.String()] {
+			if err := c.ring.transport.ClearPredecessor(vn, pred); err == nil {
+				c.repaired("Cleared predecessor %s of %s", pred, vn)
+			}
+		}
+		if _, err := c.ring.transport.Notify(vn, prev); err == nil {
+			c.repaired("Notified %s of %s", vn, prev)
+		}
+	}
+}
+
+// Checks that the successor list of every vnode names the vnodes following it
+func (c *ringChecker) checkSuccessors() {
+	conf := c.ring.config
+	expected := min(conf.NumSuccessors, len(c.walk)-1)
+	for i, vn := range c.walk {
+		succs, err := c.ring.transport.FindSuccessors(vn, conf.NumSuccessors, nextId(vn.Id, conf.hashBits))
+		if err != nil {
+			c.violation(ViolationUnreachable, vn, "Unable to get the successors: %s", err)
+			continue
+		}
+
+		for k := 0; k < expected; k++ {
+			next := c.walk[(i+k+1)%len(c.walk)]
+			if k >= len(succs) || succs[k] == nil {
+				c.violation(ViolationSuccessors, vn, "Successor %d is missing, expected %s", k, next)
+				break
+			}
+			if !bytes.Equal(succs[k].Id, next.Id) {
+				c.violation(ViolationSuccessors, vn, "Successor %d is %s, expected %s", k, succs[k], next)
+				break
+			}
+		}
+	}
+}
+
+// Checks that the keys stored on the ring are held by their replicas only
+func (c *ringChecker) checkKeys() {
+	holders := make(map[string]map[int]bool)
+	for i, vn := range c.walk {
+		keys, err := c.ring.transport.List(vn)
+		if err != nil {
+			c.violation(ViolationUnreachable, vn, "Unable to list the keys: %s", err)
+			continue
+		}
+		for _, key := range keys {
+			if holders[key] == nil {
+				holders[key] = make(map[int]bool)
+			}
+			holders[key][i] = true
+		}
+	}
+	c.res.Keys = len(holders)
+
+	n := len(c.walk)
+	numSucc := c.ring.config.NumSuccessors
+	for key, held := range holders {
+		h := c.ring.config.HashFunc()
+		h.Write([]byte(key))
+		owner := c.owner(h.Sum(nil))
+
+		// Copies may be kept up to NumSuccessors vnodes past the owner
+		for i := range held {
+			if dist := (i - owner + n) % n; dist > numSucc {
+				c.violation(ViolationMisplacedKey, c.walk[i], "Holds %s, owned by %s", key, c.walk[owner])
+			}
+		}
+
+		for k := 0; k < min(numSucc, n); k++ {
+			i := (owner + k) % n
+			if held[i] {
+				continue
+			}
+			// Owners do not replicate to vnodes on their own host
+			if k > 0 && c.walk[i].Host == c.walk[owner].Host {
+				continue
+			}
+			c.violation(ViolationMissingKey, c.walk[i], "Missing %s, owned by %s", key, c.walk[owner])
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package buddystore
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Starts a stable simulated ring of 3 hosts with 4 vnodes each
+func startCheckedSimRing(t *testing.T) *Simulator {
+	sim := NewSimulator(5)
+	startSimRing(t, sim, 3, 4)
+	for i := 0; i < 10 && checkSimRing(sim) != nil; i++ {
+		sim.Run(time.Minute)
+	}
+	if err := checkSimRing(sim); err != nil {
+		t.Fatalf("ring did not converge: %s", err)
+	}
+
+	// Let the successor lists catch up
+	sim.Run(time.Minute)
+	return sim
+}
+
+// Returns the local vnode behind a simulated vnode
+func simLocalVnode(sim *Simulator, vn *Vnode) *localVnode {
+	for _, local := range sim.Ring(vn.Host).vnodes {
+		if bytes.Equal(local.Id, vn.Id) {
+			return local
+		}
+	}
+	return nil
+}
+
+// Returns the position of a vnode in a walk of the ring
+func walkIndex(walk []*Vnode, vn *Vnode) int {
+	for i, other := range walk {
+		if bytes.Equal(other.Id, vn.Id) {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestRingCheckStable(t *testing.T) {
+	sim := startCheckedSimRing(t)
+	r := sim.Ring("sim-0")
+
+	owner, err := r.Lookup(1, []byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := r.Transport().Set(owner[0], "key", 1, []byte("value")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	check := r.Check(false)
+	if !check.Ok() {
+		t.Fatalf("unexpected violations %+v", check.Violations)
+	}
+	if check.Vnodes != 12 || check.Keys != 1 || len(check.Repairs) != 0 {
+		t.Fatalf("unexpected check %+v", check)
+	}
+}
+
+func TestRingCheckKeys(t *testing.T) {
+	sim := startCheckedSimRing(t)
+	r := sim.Ring("sim-0")
+	trans := r.Transport()
+
+	owner, err := r.Lookup(1, []byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := trans.Set(owner[0], "key", 1, []byte("value")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	walk, _, err := r.walkRing()
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	idx := walkIndex(walk, owner[0])
+
+	// A copy beyond the successors of the owner
+	far := walk[(idx+10)%len(walk)]
+	if err := trans.BulkSet(far, "key", []KVStoreValue{{Ver: 1, Val: []byte("value")}}); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	misplaced := r.Check(false).ViolationsOf(ViolationMisplacedKey)
+	if len(misplaced) != 1 || misplaced[0].Vnode != far.String() {
+		t.Fatalf("unexpected violations %+v", misplaced)
+	}
+	if err := trans.PurgeVersions(far, "key", 2); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// A replica on another host losing its copy
+	var replica *Vnode
+	for k := 1; k < r.config.NumSuccessors; k++ {
+		if vn := walk[(idx+k)%len(walk)]; vn.Host != owner[0].Host {
+			replica = vn
+			break
+		}
+	}
+	if err := trans.PurgeVersions(replica, "key", 2); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	check := r.Check(false)
+	missing := check.ViolationsOf(ViolationMissingKey)
+	if len(check.Violations) != 1 || len(missing) != 1 || missing[0].Vnode != replica.String() {
+		t.Fatalf("unexpected violations %+v", check.Violations)
+	}
+}
+
+func TestRingCheckRepairPredecessor(t *testing.T) {
+	sim := startCheckedSimRing(t)
+	r := sim.Ring("sim-0")
+
+	// Orphan a vnode's predecessor
+	vn := sim.Ring("sim-1").vnodes[0]
+	vn.predecessorLock.Lock()
+	vn.predecessor = &Vnode{Id: []byte("gone"), Host: "sim-9"}
+	vn.predecessorLock.Unlock()
+
+	check := r.Check(false)
+	preds := check.ViolationsOf(ViolationPredecessor)
+	if len(preds) != 1 || preds[0].Vnode != vn.String() {
+		t.Fatalf("unexpected violations %+v", check.Violations)
+	}
+	if len(check.Repairs) != 0 {
+		t.Fatalf("unexpected repairs %v", check.Repairs)
+	}
+
+	check = r.Check(true)
+	if len(check.Repairs) == 0 {
+		t.Fatalf("expected repairs of %+v", check.Violations)
+	}
+	if check = r.Check(false); !check.Ok() {
+		t.Fatalf("expected the ring to be repaired, got %+v", check.Violations)
+	}
+}
+
+func TestRingCheckRepairDetached(t *testing.T) {
+	sim := startCheckedSimRing(t)
+	r := sim.Ring("sim-0")
+
+	// Skip a vnode in the successor list of its predecessor
+	detached := sim.Ring("sim-1").vnodes[1]
+	pred := simLocalVnode(sim, detached.Predecessor())
+	pred.successorsLock.Lock()
+	copy(pred.successors, pred.successors[1:])
+	pred.successorsLock.Unlock()
+
+	check := r.Check(true)
+	violations := check.ViolationsOf(ViolationDetached)
+	if len(violations) != 1 || violations[0].Vnode != detached.String() {
+		t.Fatalf("unexpected violations %+v", check.Violations)
+	}
+	if check.Vnodes != 11 {
+		t.Fatalf("expected the detached vnode off the loop, got %d vnodes", check.Vnodes)
+	}
+
+	// The predecessor picks the vnode up again on its next stabilization
+	sim.Run(2 * time.Minute)
+	if check = r.Check(false); !check.Ok() {
+		t.Fatalf("expected the ring to be repaired, got %+v", check.Violations)
+	}
+}
+
+func TestAdminCheck(t *testing.T) {
+	c, server := startAdminCluster(t, "secret")
+	defer c.Shutdown()
+	defer server.Close()
+
+	var check RingCheck
+	if code := adminRequest(t, "GET", server.URL+"/admin/check", "", &check); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if check.Vnodes != 16 {
+		t.Fatalf("expected every vnode, got %+v", check)
+	}
+
+	if code := adminRequest(t, "POST", server.URL+"/admin/check", "wrong", nil); code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if code := adminRequest(t, "POST", server.URL+"/admin/check", "secret", &check); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if code := adminRequest(t, "GET", server.URL+"/admin/check?ring=other", "", nil); code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", code)
+	}
+}
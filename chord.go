@@ -8,10 +8,9 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"hash"
+	"math/rand"
 	"sync"
 	"time"
-
-	"github.com/golang/glog"
 )
 
 const JOIN_STABILIZE_WAIT = 5
@@ -122,6 +121,11 @@ type Config struct {
 	Delegate      Delegate         // Invoked to handle ring events
 	hashBits      int              // Bit size of the hash function
 	RingId        string
+	Discovery     *LANDiscovery // Optional LAN peer discovery, preferred when joining
+	VnodeIds      [][]byte      // Optional fixed vnode IDs, used instead of hashing Hostname
+	Clock         ClockIface    // Drives stabilization and lock manager timers. Defaults to the real clock
+	Rand          *rand.Rand    // Source of the stabilization jitter. Defaults to the global source
+	Logger        Logger        // Receives the log of the ring, its vnodes, stores and lock managers. Defaults to DefaultLogger
 }
 
 // Represents an Vnode, local or remote
@@ -153,7 +157,7 @@ type localVnode struct {
 	predecessor     *Vnode
 	predecessorLock sync.RWMutex
 	stabilized      time.Time
-	timer           *time.Timer
+	timer           Timer
 	timerLock       sync.Mutex
 	store           *KVStore
 	lm              *LManager
@@ -220,6 +224,8 @@ type Ring struct {
 	transport         Transport
 	vnodes            []*localVnode
 	delegateCh        chan func()
+	delegateClosed    bool
+	delegateLock      sync.RWMutex
 	shutdownComplete  chan bool
 	shutdownRequested bool
 	shutdownLock      sync.Mutex
@@ -240,6 +246,11 @@ func DefaultConfig(hostname string) *Config {
 		nil, // No delegate
 		160, // 160bit hash function
 		"",
+		nil, // No LAN discovery
+		nil, // Vnode IDs derived from the hostname
+		nil, // Real clock
+		nil, // Global random source
+		nil, // Default logger
 	}
 }
 
@@ -253,7 +264,15 @@ func Create(conf *Config, trans Transport) (*Ring, error) {
 	ring.init(conf, trans)
 	ring.setLocalSuccessors()
 	ring.setLocalPredecessors()
+
+	// A vnode alone on its ring is never notified by a predecessor, so it
+	// is the lock manager from the start
+	if len(ring.vnodes) == 1 {
+		ring.vnodes[0].lm.CurrentLM = true
+	}
+
 	ring.schedule()
+	ring.advertise()
 	return ring, nil
 }
 
@@ -262,8 +281,8 @@ func Join(conf *Config, trans Transport, existing string) (*Ring, error) {
 	// Initialize the hash bits
 	conf.hashBits = conf.HashFunc().Size() * 8
 
-	// Request a list of Vnodes from the remote host
-	hosts, err := trans.ListVnodes(existing)
+	// Request a list of Vnodes from a LAN peer or the remote host
+	hosts, err := listVnodesPreferLAN(conf, trans, existing)
 	if err != nil {
 		return nil, err
 	}
@@ -271,9 +290,7 @@ func Join(conf *Config, trans Transport, existing string) (*Ring, error) {
 		return nil, fmt.Errorf("Remote host has no vnodes!")
 	}
 
-	if glog.V(2) {
-		glog.Infof("Fetched hosts: %s", hosts)
-	}
+	configLogger(conf).Debug("Fetched hosts", Field("hosts", hosts))
 
 	// Create a ring
 	ring := &Ring{}
@@ -303,6 +320,7 @@ func Join(conf *Config, trans Transport, existing string) (*Ring, error) {
 	for _, vn := range ring.vnodes {
 		vn.stabilize()
 	}
+	ring.advertise()
 	return ring, nil
 }
 
@@ -313,8 +331,8 @@ func BlockingJoin(conf *Config, trans Transport, existing string) (*Ring, error)
 	// Initialize the hash bits
 	conf.hashBits = conf.HashFunc().Size() * 8
 
-	// Request a list of Vnodes from the remote host
-	hosts, err := trans.ListVnodes(existing)
+	// Request a list of Vnodes from a LAN peer or the remote host
+	hosts, err := listVnodesPreferLAN(conf, trans, existing)
 	if err != nil {
 		return nil, err
 	}
@@ -322,9 +340,7 @@ func BlockingJoin(conf *Config, trans Transport, existing string) (*Ring, error)
 		return nil, fmt.Errorf("Remote host has no vnodes!")
 	}
 
-	if glog.V(2) {
-		glog.Infof("Fetched hosts: %s", hosts)
-	}
+	configLogger(conf).Debug("Fetched hosts", Field("hosts", hosts))
 
 	// Create a ring
 	ring := &Ring{}
@@ -353,13 +369,37 @@ func BlockingJoin(conf *Config, trans Transport, existing string) (*Ring, error)
 	// Do a fast stabilization, will schedule regular execution
 	for _, vn := range ring.vnodes {
 		vn.stabilize()
-		vn.lm.cancelCheckStatus = time.AfterFunc(JOIN_STABILIZE_WAIT*time.Second, vn.lm.CheckStatus)
+		vn.lm.cancelCheckStatus = ring.clock().AfterFunc(JOIN_STABILIZE_WAIT*time.Second, vn.lm.CheckStatus)
 	}
+	ring.advertise()
 	return ring, nil
 }
 
+// Requests the list of vnodes from peers discovered on the local network
+// first, falling back to the given existing host
+func listVnodesPreferLAN(conf *Config, trans Transport, existing string) ([]*Vnode, error) {
+	if conf.Discovery != nil {
+		for _, peer := range conf.Discovery.Peers(conf.RingId) {
+			if peer == existing || peer == conf.Hostname {
+				continue
+			}
+
+			hosts, err := trans.ListVnodes(peer)
+			if err == nil && len(hosts) > 0 {
+				configLogger(conf).Debug("Joining through LAN peer", Field("peer", peer))
+				return hosts, nil
+			}
+		}
+	}
+
+	return trans.ListVnodes(existing)
+}
+
 // Leaves a given Chord ring and shuts down the local vnodes
 func (r *Ring) Leave() error {
+	// Stop advertising ourselves on the local network
+	r.withdraw()
+
 	// Shutdown the vnodes first to avoid further stabilization runs
 	r.stopVnodes()
 
@@ -371,14 +411,17 @@ func (r *Ring) Leave() error {
 
 	// Wait for the delegate callbacks to complete
 	r.stopDelegate()
+	deregisterRingMetrics(r)
 	return err
 }
 
 // Shutdown shuts down the local processes in a given Chord ring
 // Blocks until all the vnodes terminate.
 func (r *Ring) Shutdown() {
-	r.stopVnodes()
+	r.withdraw()
+	r.stopVnodesNow()
 	r.stopDelegate()
+	deregisterRingMetrics(r)
 }
 
 // Does a key lookup for up to N successors of a key
@@ -402,8 +445,13 @@ func (r *Ring) Lookup(n int, key []byte) ([]*Vnode, error) {
 		return nil, err
 	}
 
+	// A vnode alone on its ring owns every key
+	if len(successors) == 0 {
+		return []*Vnode{&nearest.Vnode}, nil
+	}
+
 	// Trim the nil successors
-	for successors[len(successors)-1] == nil {
+	for len(successors) > 0 && successors[len(successors)-1] == nil {
 		successors = successors[:len(successors)-1]
 	}
 	return successors, nil
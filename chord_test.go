@@ -1,184 +1,11 @@
 package buddystore
 
 import (
-	"fmt"
 	"runtime"
-	"sync"
 	"testing"
 	"time"
 )
 
-type MultiLocalTrans struct {
-	remote    Transport
-	hosts     map[string]*LocalTransport
-	hostsLock sync.RWMutex
-}
-
-func (ml *MultiLocalTrans) GetHost(index string) (*LocalTransport, bool) {
-	defer ml.hostsLock.RUnlock()
-	ml.hostsLock.RLock()
-	val, ok := ml.hosts[index]
-	return val, ok
-}
-
-func InitMLTransport(listen string, timeout *time.Duration) *MultiLocalTrans {
-	hosts := make(map[string]*LocalTransport)
-	var remote Transport
-	var err error
-	if listen == "" && timeout == nil {
-		remote = &BlackholeTransport{}
-	} else {
-		remote, err = InitTCPTransport(listen, *timeout)
-		if err != nil {
-			return nil
-		}
-	}
-	ml := &MultiLocalTrans{hosts: hosts}
-	ml.remote = remote
-	return ml
-}
-
-func (ml *MultiLocalTrans) ListVnodes(host string) ([]*Vnode, error) {
-	if local, ok := ml.GetHost(host); ok {
-		return local.ListVnodes(host)
-	}
-	return ml.remote.ListVnodes(host)
-}
-
-// Ping a Vnode, check for liveness
-func (ml *MultiLocalTrans) Ping(v *Vnode) (bool, error) {
-	if local, ok := ml.GetHost(v.Host); ok {
-		return local.Ping(v)
-	}
-	return ml.remote.Ping(v)
-}
-
-// Request a nodes predecessor
-func (ml *MultiLocalTrans) GetPredecessor(v *Vnode) (*Vnode, error) {
-	if local, ok := ml.GetHost(v.Host); ok {
-		return local.GetPredecessor(v)
-	}
-	return ml.remote.GetPredecessor(v)
-}
-
-// Notify our successor of ourselves
-func (ml *MultiLocalTrans) Notify(target, self *Vnode) ([]*Vnode, error) {
-	if local, ok := ml.GetHost(target.Host); ok {
-		return local.Notify(target, self)
-	}
-	return ml.remote.Notify(target, self)
-}
-
-// Find a successor
-func (ml *MultiLocalTrans) FindSuccessors(v *Vnode, n int, k []byte) ([]*Vnode, error) {
-	if local, ok := ml.GetHost(v.Host); ok {
-		return local.FindSuccessors(v, n, k)
-	}
-	return ml.remote.FindSuccessors(v, n, k)
-}
-
-// Clears a predecessor if it matches a given vnode. Used to leave.
-func (ml *MultiLocalTrans) ClearPredecessor(target, self *Vnode) error {
-	if local, ok := ml.GetHost(target.Host); ok {
-		return local.ClearPredecessor(target, self)
-	}
-	return ml.remote.ClearPredecessor(target, self)
-}
-
-// Instructs a node to skip a given successor. Used to leave.
-func (ml *MultiLocalTrans) SkipSuccessor(target, self *Vnode) error {
-	if local, ok := ml.GetHost(target.Host); ok {
-		return local.SkipSuccessor(target, self)
-	}
-	return ml.remote.SkipSuccessor(target, self)
-}
-
-// Request a nodes predecessor list
-func (ml *MultiLocalTrans) GetPredecessorList(v *Vnode) ([]*Vnode, error) {
-	if local, ok := ml.GetHost(v.Host); ok {
-		return local.GetPredecessorList(v)
-	}
-	return ml.remote.GetPredecessorList(v)
-}
-
-func (ml *MultiLocalTrans) Register(v *Vnode, o VnodeRPC) {
-	local, ok := ml.GetHost(v.Host)
-	if !ok {
-		local = InitLocalTransport(nil).(*LocalTransport)
-		ml.hostsLock.Lock()
-		defer ml.hostsLock.Unlock()
-		ml.hosts[v.Host] = local
-	}
-	local.Register(v, o)
-}
-
-func (ml *MultiLocalTrans) Deregister(host string) {
-	ml.hostsLock.Lock()
-	defer ml.hostsLock.Unlock()
-	delete(ml.hosts, host)
-}
-
-func (ml *MultiLocalTrans) RLock(v *Vnode, key string, nodeID string, opsLogEntry *OpsLogEntry) (string, uint, uint64, error) {
-	//  TODO : Are we going to use this transport. Placeholder
-	return "", 0, 0, fmt.Errorf("RLock in MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) WLock(v *Vnode, key string, version uint, timeout uint, nodeID string, opsLogEntry *OpsLogEntry) (string, uint, uint, uint64, error) {
-	return "", 0, 0, 0, fmt.Errorf("WLock in MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) CommitWLock(v *Vnode, key string, version uint, nodeID string, opsLogEntry *OpsLogEntry) (uint64, error) {
-	return 0, fmt.Errorf("CommitWLock in MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) AbortWLock(v *Vnode, key string, version uint, nodeID string, opsLogEntry *OpsLogEntry) (uint64, error) {
-	return 0, fmt.Errorf("MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) InvalidateRLock(v *Vnode, lockID string) error {
-	return fmt.Errorf("MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) Get(target *Vnode, key string, version uint) ([]byte, error) {
-	return nil, fmt.Errorf("MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) Set(target *Vnode, key string, version uint, value []byte) error {
-	return fmt.Errorf("MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) List(target *Vnode) ([]string, error) {
-	return nil, fmt.Errorf("MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) JoinRing(target *Vnode, ringId string, self *Vnode) ([]*Vnode, error) {
-	return nil, fmt.Errorf("MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) LeaveRing(target *Vnode, ringId string) error {
-	return fmt.Errorf("MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) BulkSet(target *Vnode, key string, valLst []KVStoreValue) error {
-	return nil
-}
-
-func (ml *MultiLocalTrans) SyncKeys(target *Vnode, ownerVn *Vnode, key string, ver []uint) error {
-	return fmt.Errorf("MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) MissingKeys(target *Vnode, replVn *Vnode, key string, ver []uint) error {
-	return fmt.Errorf("MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) PurgeVersions(target *Vnode, key string, maxVersion uint) error {
-	return fmt.Errorf("MultiLocalTransport not implemented yet")
-}
-
-func (ml *MultiLocalTrans) IsLocalVnode(vn *Vnode) bool {
-	panic("THIS METHOD SHOULD NEVER BE CALLED")
-}
-
 /*
 func TestDefaultConfig(t *testing.T) {
 	conf := DefaultConfig("test")
@@ -236,8 +63,8 @@ func TestCreateShutdown(t *testing.T) {
 }
 
 func TestJoin(t *testing.T) {
-	// Create a multi transport
-	ml := InitMLTransport("", nil)
+	// Create an in-memory network
+	ml := NewMemoryNetwork()
 
 	// Create the initial ring
 	conf := fastConf()
@@ -261,8 +88,8 @@ func TestJoin(t *testing.T) {
 
 /* Ignored for now : Added to check the case when the "created" ring has only one vnode */
 func SingleNodeJoin(t *testing.T) {
-	// Create a multi transport
-	ml := InitMLTransport("", nil)
+	// Create an in-memory network
+	ml := NewMemoryNetwork()
 
 	// Create the initial ring
 	conf := fastConf()
@@ -286,8 +113,8 @@ func SingleNodeJoin(t *testing.T) {
 }
 
 func TestJoinDeadHost(t *testing.T) {
-	// Create a multi transport
-	ml := InitMLTransport("", nil)
+	// Create an in-memory network
+	ml := NewMemoryNetwork()
 
 	// Create the initial ring
 	conf := fastConf()
@@ -298,8 +125,8 @@ func TestJoinDeadHost(t *testing.T) {
 }
 
 func TestLeave(t *testing.T) {
-	// Create a multi transport
-	ml := InitMLTransport("", nil)
+	// Create an in-memory network
+	ml := NewMemoryNetwork()
 
 	// Create the initial ring
 	conf := fastConf()
@@ -321,7 +148,7 @@ func TestLeave(t *testing.T) {
 
 	// Node 1 should leave
 	r.Leave()
-	ml.Deregister("test")
+	ml.Disconnect("test")
 
 	// Wait for stabilization
 	<-time.After(100 * time.Millisecond)
@@ -337,8 +164,8 @@ func TestLeave(t *testing.T) {
 }
 
 func TestLookupBadN(t *testing.T) {
-	// Create a multi transport
-	ml := InitMLTransport("", nil)
+	// Create an in-memory network
+	ml := NewMemoryNetwork()
 
 	// Create the initial ring
 	conf := fastConf()
@@ -354,8 +181,8 @@ func TestLookupBadN(t *testing.T) {
 }
 
 func TestLookup(t *testing.T) {
-	// Create a multi transport
-	ml := InitMLTransport("", nil)
+	// Create an in-memory network
+	ml := NewMemoryNetwork()
 
 	// Create the initial ring
 	conf := fastConf()
@@ -396,3 +223,41 @@ func TestLookup(t *testing.T) {
 		}
 	}
 }
+
+func TestLookupSingleVnode(t *testing.T) {
+	c, err := NewClusterWithConfig(1, func(conf *Config) {
+		conf.NumVnodes = 1
+	})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+
+	// The lone vnode owns every key
+	r := c.Node("host-0").Ring
+	for _, k := range []string{"test", "foo", "bar"} {
+		vnodes, err := r.Lookup(3, []byte(k))
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		if len(vnodes) != 1 || vnodes[0].String() != r.GetLocalVnode().String() {
+			t.Fatalf("expected the lone vnode, got %v", vnodes)
+		}
+	}
+
+	kv := c.Node("host-0").KV
+	if err := kv.Set("key", []byte("value")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if val, err := kv.Get("key", false); err != nil || string(val) != "value" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+
+	// The vnode takes the first one joining as its successor
+	if _, err := c.AddHost(); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := c.WaitForStabilization(5 * time.Second); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+}
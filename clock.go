@@ -9,7 +9,13 @@ import (
 
 type ClockIface interface {
 	Now() time.Time
-	AfterFunc(time.Duration, func()) *time.Timer
+	AfterFunc(time.Duration, func()) Timer
+}
+
+// A function scheduled with AfterFunc, which can be cancelled until it runs
+type Timer interface {
+	// Returns false if the function already ran or was stopped before
+	Stop() bool
 }
 
 type RealClock struct {
@@ -21,12 +27,15 @@ func (r *RealClock) Now() time.Time {
 	return time.Now()
 }
 
-func (r *RealClock) AfterFunc(d time.Duration, f func()) *time.Timer {
+func (r *RealClock) AfterFunc(d time.Duration, f func()) Timer {
 	return time.AfterFunc(d, f)
 }
 
 var _ ClockIface = new(RealClock)
 
+// Shared by everything that does not have a clock injected
+var realClock = new(RealClock)
+
 type MockClock struct {
 	frozen      bool
 	currentTime time.Time
@@ -95,7 +104,7 @@ func (m *MockClock) Now() time.Time {
 	return time.Now()
 }
 
-func (m *MockClock) AfterFunc(d time.Duration, f func()) *time.Timer {
+func (m *MockClock) AfterFunc(d time.Duration, f func()) Timer {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
@@ -0,0 +1,236 @@
+package buddystore
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A host of a Cluster, with the clients of its ring
+type ClusterNode struct {
+	Host string
+	Ring *Ring              // Nil while the host is down
+	KV   *KVStoreClientImpl // Reads and writes keys through the ring
+	LM   *LManagerClient    // Takes locks through the ring
+}
+
+/*
+Cluster runs a whole ring of hosts in memory, over a MemoryNetwork, for
+integration tests against the real protocol without sockets. Hosts can be
+killed and restarted, and are named host-0, host-1 and so on. Their ring
+configurations may use other host names.
+*/
+type Cluster struct {
+	Network *MemoryNetwork
+
+	lock      sync.Mutex
+	nodes     map[string]*ClusterNode
+	configure func(conf *Config)
+}
+
+// Interval between checks whether a cluster has stabilized
+const CLUSTER_POLL_INTERVAL = 10 * time.Millisecond
+
+// Starts a cluster of n hosts, stabilizing quickly
+func NewCluster(n int) (*Cluster, error) {
+	return NewClusterWithConfig(n, nil)
+}
+
+// Starts a cluster of n hosts, and waits up to timeout for its ring to stabilize
+func NewStableCluster(n int, timeout time.Duration) (*Cluster, error) {
+	c, err := NewCluster(n)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.WaitForStabilization(timeout); err != nil {
+		c.Shutdown()
+		return nil, err
+	}
+	return c, nil
+}
+
+/*
+Starts a cluster of n hosts, letting configure adjust the ring configuration
+of every host before it starts. Configurations default to stabilizing every
+15 to 45 milliseconds.
+*/
+func NewClusterWithConfig(n int, configure func(conf *Config)) (*Cluster, error) {
+	c := &Cluster{
+		Network:   NewMemoryNetwork(),
+		nodes:     make(map[string]*ClusterNode),
+		configure: configure,
+	}
+	for i := 0; i < n; i++ {
+		if _, err := c.AddHost(); err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Returns the ring configuration of a host
+func (c *Cluster) config(host string) *Config {
+	conf := DefaultConfig(host)
+	conf.StabilizeMin = 15 * time.Millisecond
+	conf.StabilizeMax = 45 * time.Millisecond
+	if c.configure != nil {
+		c.configure(conf)
+	}
+	return conf
+}
+
+// Starts one more host, joining the ring through a running host if any
+func (c *Cluster) AddHost() (*ClusterNode, error) {
+	c.lock.Lock()
+	host := fmt.Sprintf("host-%d", len(c.nodes))
+	node := &ClusterNode{Host: host}
+	c.nodes[host] = node
+	c.lock.Unlock()
+
+	return node, c.Restart(host)
+}
+
+// Starts a host that is down again, under the same name and vnode IDs
+func (c *Cluster) Restart(host string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	node, ok := c.nodes[host]
+	if !ok {
+		return fmt.Errorf("Unknown host %s", host)
+	}
+	if node.Ring != nil {
+		return fmt.Errorf("Host %s is already running", host)
+	}
+
+	conf := c.config(host)
+	trans := c.Network.TransportFor(conf.Hostname)
+
+	var ring *Ring
+	var err error
+	if existing := c.running(); len(existing) == 0 {
+		ring, err = Create(conf, trans)
+	} else {
+		ring, err = Join(conf, trans, existing[0].Ring.config.Hostname)
+	}
+	if err != nil {
+		return err
+	}
+
+	node.Ring = ring
+	node.KV = NewKVStoreClient(ring)
+	node.LM = &LManagerClient{Ring: ring, RLocks: make(map[string]*RLockVal), WLocks: make(map[string]*WLockVal)}
+	return nil
+}
+
+// Stops a host without notifying the rest of the ring, as if it crashed
+func (c *Cluster) Kill(host string) error {
+	return c.stop(host, func(r *Ring) error {
+		r.Shutdown()
+		return nil
+	})
+}
+
+// Makes a host leave the ring gracefully
+func (c *Cluster) Leave(host string) error {
+	return c.stop(host, (*Ring).Leave)
+}
+
+func (c *Cluster) stop(host string, stop func(*Ring) error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	node, ok := c.nodes[host]
+	if !ok || node.Ring == nil {
+		return fmt.Errorf("Host %s is not running", host)
+	}
+
+	err := stop(node.Ring)
+	c.Network.Disconnect(node.Ring.config.Hostname)
+	node.Ring, node.KV, node.LM = nil, nil, nil
+	return err
+}
+
+// Returns a host, running or not
+func (c *Cluster) Node(host string) *ClusterNode {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nodes[host]
+}
+
+// Returns the running hosts, ordered by name
+func (c *Cluster) Running() []*ClusterNode {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.running()
+}
+
+func (c *Cluster) running() []*ClusterNode {
+	var nodes []*ClusterNode
+	for _, node := range c.nodes {
+		if node.Ring != nil {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Host < nodes[j].Host
+	})
+	return nodes
+}
+
+/*
+Waits until the successor of every vnode of the running hosts is the next
+vnode on the ring, and its predecessor the previous one. Returns the last
+inconsistency found if that does not happen within timeout.
+*/
+func (c *Cluster) WaitForStabilization(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var rings []*Ring
+		for _, node := range c.Running() {
+			rings = append(rings, node.Ring)
+		}
+
+		err := checkRingsStable(rings)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Cluster did not stabilize within %s: %s", timeout, err)
+		}
+		time.Sleep(CLUSTER_POLL_INTERVAL)
+	}
+}
+
+// Shuts down all the running hosts
+func (c *Cluster) Shutdown() {
+	for _, node := range c.Running() {
+		c.Kill(node.Host)
+	}
+}
+
+// Checks that the vnodes of the given rings form a single, consistent ring
+func checkRingsStable(rings []*Ring) error {
+	var all []*localVnode
+	for _, r := range rings {
+		all = append(all, r.vnodes...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return bytes.Compare(all[i].Id, all[j].Id) < 0
+	})
+
+	for i, vn := range all {
+		next := all[(i+1)%len(all)]
+		if succ := vn.Successors()[0]; succ == nil || !bytes.Equal(succ.Id, next.Id) {
+			return fmt.Errorf("Vnode %s has successor %s, expected %s", vn, succ, next)
+		}
+		prev := all[(i+len(all)-1)%len(all)]
+		if pred := vn.Predecessor(); pred == nil || !bytes.Equal(pred.Id, prev.Id) {
+			return fmt.Errorf("Vnode %s has predecessor %s, expected %s", vn, pred, prev)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package buddystore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClusterKV(t *testing.T) {
+	c, err := NewCluster(3)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+	if err := c.WaitForStabilization(5 * time.Second); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	if err := c.Node("host-0").KV.Set("key", []byte("value")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	val, err := c.Node("host-2").KV.Get("key", true)
+	if err != nil || string(val) != "value" {
+		t.Fatalf("expected to read the value from another host, got %q, %v", val, err)
+	}
+
+	version, err := c.Node("host-1").LM.RLock("key", true)
+	if err != nil || version != 1 {
+		t.Fatalf("unexpected version %d, %v", version, err)
+	}
+}
+
+func TestClusterKillRestart(t *testing.T) {
+	c, err := NewClusterWithConfig(4, func(conf *Config) {
+		conf.NumVnodes = 4
+	})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+	if err := c.WaitForStabilization(5 * time.Second); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	if err := c.Kill("host-1"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := c.Kill("host-1"); err == nil {
+		t.Fatalf("expected an error killing a host twice")
+	}
+	if _, err := c.Network.TransportFor("host-0").ListVnodes("host-1"); err == nil {
+		t.Fatalf("expected a killed host to be unreachable")
+	}
+	if err := c.WaitForStabilization(5 * time.Second); err != nil {
+		t.Fatalf("ring did not recover from the crash: %s", err)
+	}
+
+	if err := c.Restart("host-1"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := c.Leave("host-2"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := c.WaitForStabilization(5 * time.Second); err != nil {
+		t.Fatalf("ring did not recover from churn: %s", err)
+	}
+	if running := c.Running(); len(running) != 3 || running[1].Host != "host-1" {
+		t.Fatalf("unexpected running hosts %v", running)
+	}
+}
+
+func TestMemoryNetworkLeaveRing(t *testing.T) {
+	c, err := NewCluster(1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+
+	// Routed to the vnode, which rejects it rather than crashing the host
+	vn := c.Node("host-0").Ring.GetLocalVnode()
+	if err := c.Network.TransportFor("client").LeaveRing(vn, "ring"); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	c.Kill("host-0")
+	if err := c.Network.TransportFor("client").LeaveRing(vn, "ring"); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/buddyfs/buddystore"
+)
+
+const commandUsage = `Commands:
+  get <key>                Print the value of a key
+  set <key> <value>        Set the value of a key
+  delete <key>             Delete a key
+  ls                       List the keys stored on the ring
+  lookup <key>             Show the vnodes owning a key, the owner first
+  ring [json|dot]          Show the vnodes of the ring and their share of it
+  locks                    Show the state of the lock managers of the node,
+                           through -admin-url for a remote node
+`
+
+var errUsage = errors.New("Invalid command")
+
+// A ring commands run against, either the ring of a local node or a remote one
+type target interface {
+	KV() *buddystore.KVStoreClientImpl
+	Lookup(n int, key []byte) ([]*buddystore.Vnode, error)
+	GetNumSuccessors() int
+	Snapshot() (*buddystore.RingSnapshot, error)
+	Keys() ([]string, error)
+	Locks() ([]*buddystore.VnodeStatus, error)
+}
+
+// The ring of the node run by this process
+type localTarget struct {
+	*buddystore.Ring
+	kv *buddystore.KVStoreClientImpl
+}
+
+func (lt *localTarget) KV() *buddystore.KVStoreClientImpl {
+	return lt.kv
+}
+
+func (lt *localTarget) Locks() ([]*buddystore.VnodeStatus, error) {
+	return lt.Status(), nil
+}
+
+// The ring of another node, reached through the transport
+type remoteTarget struct {
+	*buddystore.RemoteRing
+	kv       *buddystore.KVStoreClientImpl
+	adminURL string
+}
+
+func (rt *remoteTarget) KV() *buddystore.KVStoreClientImpl {
+	return rt.kv
+}
+
+// Fetches the state of the vnodes from the admin server of the node. The
+// transport cannot report the state of lock managers.
+func (rt *remoteTarget) Locks() ([]*buddystore.VnodeStatus, error) {
+	if len(rt.adminURL) == 0 {
+		return nil, fmt.Errorf("The lock managers of a remote node are read from its admin server, set -admin-url")
+	}
+
+	resp, err := http.Get(strings.TrimSuffix(rt.adminURL, "/") + "/admin/vnodes?ring=" + url.QueryEscape(rt.GetRingId()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Admin server returned %s", resp.Status)
+	}
+
+	var vnodes []*buddystore.VnodeStatus
+	if err := json.NewDecoder(resp.Body).Decode(&vnodes); err != nil {
+		return nil, err
+	}
+	return vnodes, nil
+}
+
+/*
+Reads commands from in and runs them against the target, until in is
+exhausted or a quit command is read. Returns true on quit.
+*/
+func shell(t target, in io.Reader, out io.Writer) bool {
+	scanner := bufio.NewScanner(in)
+	for fmt.Fprint(out, "> "); scanner.Scan(); fmt.Fprint(out, "> ") {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+
+		switch args[0] {
+		case "quit", "exit":
+			return true
+		case "help":
+			fmt.Fprint(out, commandUsage)
+			continue
+		}
+
+		if err := run(t, args, out); err == errUsage {
+			fmt.Fprint(out, commandUsage)
+		} else if err != nil {
+			fmt.Fprintln(out, err)
+		}
+	}
+	return false
+}
+
+// Runs a single command against the target
+func run(t target, args []string, out io.Writer) error {
+	argc := map[string]int{"get": 2, "set": 3, "delete": 2, "ls": 1, "lookup": 2, "locks": 1}
+	if n, ok := argc[args[0]]; ok && len(args) != n {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "get":
+		val, err := t.KV().Get(args[1], true)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\n", val)
+		return nil
+
+	case "set":
+		return t.KV().Set(args[1], []byte(args[2]))
+
+	case "delete":
+		return t.KV().Delete(args[1])
+
+	case "ls":
+		keys, err := t.Keys()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fmt.Fprintln(out, key)
+		}
+		return nil
+
+	case "lookup":
+		vnodes, err := t.Lookup(t.GetNumSuccessors(), []byte(args[1]))
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		for i, vn := range vnodes {
+			role := "replica"
+			if i == 0 {
+				role = "owner"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", vn, vn.Host, role)
+		}
+		return w.Flush()
+
+	case "ring":
+		return showRing(t, args[1:], out)
+
+	case "locks":
+		vnodes, err := t.Locks()
+		if err != nil {
+			return err
+		}
+		showLocks(vnodes, out)
+		return nil
+	}
+	return errUsage
+}
+
+// Shows the vnodes of the ring, as a table by default
+func showRing(t target, args []string, out io.Writer) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	snapshot, err := t.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	format := "table"
+	if len(args) == 1 {
+		format = args[0]
+	}
+	switch format {
+	case "json":
+		return snapshot.WriteJSON(out)
+	case "dot":
+		return snapshot.WriteDOT(out)
+	case "table":
+	default:
+		return errUsage
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VNODE\tHOST\tSHARE\tPREDECESSOR")
+	for _, vn := range snapshot.Vnodes {
+		fmt.Fprintf(w, "%s\t%s\t%.2f%%\t%s\n", vn.Id, vn.Host, vn.Share*100, vn.Predecessor)
+	}
+	fmt.Fprintln(w)
+
+	shares := snapshot.HostShares()
+	hosts := make([]string, 0, len(shares))
+	for host := range shares {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	fmt.Fprintln(w, "HOST\tSHARE")
+	for _, host := range hosts {
+		fmt.Fprintf(w, "%s\t%.2f%%\n", host, shares[host]*100)
+	}
+	return w.Flush()
+}
+
+// Shows the locks held at every lock manager among the vnodes
+func showLocks(vnodes []*buddystore.VnodeStatus, out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	for _, vn := range vnodes {
+		lm := vn.LockManager
+		if lm == nil || (!lm.CurrentLM && len(lm.WLocks) == 0 && len(lm.RLocks) == 0) {
+			continue
+		}
+		fmt.Fprintf(w, "Vnode %s on %s, current lock manager: %v, commit point: %d\n", vn.Id, vn.Host, lm.CurrentLM, lm.CommitPoint)
+
+		keys := make([]string, 0, len(lm.WLocks))
+		for key := range lm.WLocks {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			lock := lm.WLocks[key]
+			fmt.Fprintf(w, "  write\t%s\tversion %d\t%s\t%s\n", key, lock.Version, lock.NodeID, lock.LockID)
+		}
+
+		keys = keys[:0]
+		for key := range lm.RLocks {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			for node, lock := range lm.RLocks[key] {
+				fmt.Fprintf(w, "  read\t%s\t%s\t%s\n", key, node, strings.Join(lock, "\t"))
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buddyfs/buddystore"
+)
+
+func TestShell(t *testing.T) {
+	c, err := buddystore.NewStableCluster(2, 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+
+	// Run the shell on the node of the lock manager, which owns the ring ID
+	lm, err := c.Node("host-0").Ring.Lookup(1, []byte(""))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	node := c.Node(lm[0].Host)
+
+	script := strings.Join([]string{
+		"set a 1",
+		"set b 2",
+		"get a",
+		"delete b",
+		"ls",
+		"lookup a",
+		"ring",
+		"locks",
+		"get",
+		"quit",
+		"get b",
+	}, "\n")
+
+	var out bytes.Buffer
+	if !shell(&localTarget{node.Ring, node.KV}, strings.NewReader(script), &out) {
+		t.Fatalf("expected the shell to quit")
+	}
+
+	res := out.String()
+	for _, expected := range []string{
+		"> 1\n",
+		"> a\n> ",
+		"owner\n",
+		"PREDECESSOR\n",
+		"host-1",
+		"current lock manager: ",
+		"  read ",
+		commandUsage,
+	} {
+		if !strings.Contains(res, expected) {
+			t.Fatalf("expected %q in\n%s", expected, res)
+		}
+	}
+}
+
+func TestRunRemote(t *testing.T) {
+	c, err := buddystore.NewStableCluster(2, 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+
+	ring, err := buddystore.NewRemoteRing(buddystore.DefaultConfig("client"), c.Network.TransportFor("client"), "host-0")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	rt := &remoteTarget{ring, buddystore.NewRemoteKVStoreClient(ring), ""}
+
+	var out bytes.Buffer
+	if err := run(rt, []string{"set", "key", "value"}, &out); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := run(rt, []string{"get", "key"}, &out); err != nil || out.String() != "value\n" {
+		t.Fatalf("unexpected output %q. %v", out.String(), err)
+	}
+
+	out.Reset()
+	if err := run(rt, []string{"ring", "dot"}, &out); err != nil || !strings.HasPrefix(out.String(), "digraph") {
+		t.Fatalf("unexpected output %q. %v", out.String(), err)
+	}
+
+	if err := run(rt, []string{"locks"}, &out); err == nil {
+		t.Fatalf("expected an error without an admin server")
+	}
+	if err := run(rt, []string{"ring", "svg"}, &out); err != errUsage {
+		t.Fatalf("unexpected err. %v", err)
+	}
+	if err := run(rt, []string{"unknown"}, &out); err != errUsage {
+		t.Fatalf("unexpected err. %v", err)
+	}
+}
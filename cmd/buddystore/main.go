@@ -0,0 +1,163 @@
+/*
+Command buddystore runs a node of a ring, and operates on a running ring.
+
+	buddystore [flags] create            Create a ring and run its first node
+	buddystore [flags] join <seed>       Run a node joining the ring of seed
+
+A running node reads the commands below from its standard input and runs
+them against its own ring, until it is interrupted or told to quit. The same
+commands run once against the ring of the node at -node, reached through the
+transport without joining the ring:
+
+	get <key>                Print the value of a key
+	set <key> <value>        Set the value of a key
+	delete <key>             Delete a key
+	ls                       List the keys stored on the ring
+	lookup <key>             Show the vnodes owning a key, the owner first
+	ring [json|dot]          Show the vnodes of the ring and their share of it
+	locks                    Show the state of the lock managers of the node
+
+The transport has no call reporting the state of lock managers, so locks
+only reaches a remote node through its admin server, found at -admin-url.
+Without it, locks fails against a remote node.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/buddyfs/buddystore"
+)
+
+var (
+	node      = flag.String("node", "localhost:5000", "Address of the node to run commands against")
+	ringId    = flag.String("ring", "", "ID of the ring")
+	listen    = flag.String("listen", "", "IP address to listen on. Defaults to all interfaces")
+	advertise = flag.String("advertise", "", "Addresses advertised to peers. Defaults to localhost")
+	port      = flag.Int("port", 5000, "Port a node listens on. Random if 0")
+	vnodes    = flag.Int("vnodes", 8, "Number of vnodes of a node")
+	admin     = flag.String("admin", "", "Address a node serves its admin pages on. Empty disables")
+	adminURL  = flag.String("admin-url", "", "URL of the admin server of the node at -node, for locks")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] create | join <seed> | <command> [args]\n\n", os.Args[0])
+	fmt.Fprint(os.Stderr, commandUsage)
+	fmt.Fprint(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "create", "join":
+		err = runNode(args)
+	default:
+		err = runRemote(args)
+	}
+
+	if err == errUsage {
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Creates a transport for the ring and the configuration of a ring using it
+func newTransport(nodePort int) (buddystore.Transport, *buddystore.Config, error) {
+	tconf := &buddystore.TCPTransportConfig{ListenAddr: *listen, AdvertiseAddr: *advertise, Port: nodePort}
+	_, trans, conf, err := buddystore.NewTCPTransportFromConfig(tconf, true, 0, buddystore.DefaultConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conf.RingId = *ringId
+	if tcp, ok := trans.(*buddystore.TCPTransport); ok && len(*ringId) > 0 {
+		trans = tcp.ForRing(*ringId)
+	}
+	return trans, conf, nil
+}
+
+// Runs a node until it is interrupted or told to quit, then leaves the ring
+func runNode(args []string) error {
+	if (args[0] == "create" && len(args) != 1) || (args[0] == "join" && len(args) != 2) {
+		return errUsage
+	}
+
+	trans, conf, err := newTransport(*port)
+	if err != nil {
+		return err
+	}
+	conf.NumVnodes = *vnodes
+
+	var ring *buddystore.Ring
+	if args[0] == "create" {
+		ring, err = buddystore.Create(conf, trans)
+	} else {
+		ring, err = buddystore.Join(conf, trans, args[1])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Node %s is running\n", conf.Hostname)
+
+	if len(*admin) > 0 {
+		listener, err := buddystore.ServeAdmin(*admin, "", func() []*buddystore.Ring {
+			return []*buddystore.Ring{ring}
+		})
+		if err != nil {
+			ring.Shutdown()
+			return err
+		}
+		defer listener.Close()
+	}
+
+	quit := make(chan struct{})
+	go func() {
+		if shell(&localTarget{ring, buddystore.NewKVStoreClient(ring)}, os.Stdin, os.Stdout) {
+			close(quit)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-signals:
+	case <-quit:
+	}
+
+	fmt.Println("Leaving the ring")
+	return ring.Leave()
+}
+
+// Runs a single command against the ring of a remote node
+func runRemote(args []string) error {
+	trans, conf, err := newTransport(0)
+	if err != nil {
+		return err
+	}
+
+	ring, err := buddystore.NewRemoteRing(conf, trans, *node)
+	if err != nil {
+		return fmt.Errorf("Unable to reach %s: %s", *node, err)
+	}
+
+	t := &remoteTarget{ring, buddystore.NewRemoteKVStoreClient(ring), *adminURL}
+	return run(t, args, os.Stdout)
+}
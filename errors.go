@@ -42,3 +42,19 @@ func isRetryable(err error) bool {
 	// To support pure string errors
 	return strings.Contains(err.Error(), "[Retryable]")
 }
+
+// Returns true if err reports a key missing from the store: never written,
+// or deleted. Failing to reach the replicas of a key does not count.
+func IsNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "Key not present") || strings.Contains(msg, "Key not found") || isDeleted(err)
+}
+
+// Returns true if err reports that the version read was deleted
+func isDeleted(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Key deleted")
+}
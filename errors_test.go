@@ -26,3 +26,12 @@ func TestErrorsStringErrorNotRetryable(t *testing.T) {
 func TestErrorsNil(t *testing.T) {
 	assert.False(t, isRetryable(nil))
 }
+
+func TestErrorsNotFound(t *testing.T) {
+	assert.True(t, IsNotFound(fmt.Errorf("Key not found")))
+	assert.True(t, IsNotFound(fmt.Errorf("[host-0] ReadLock not possible. Key not present in LM")))
+	assert.True(t, IsNotFound(fmt.Errorf("Key deleted")))
+	assert.False(t, IsNotFound(fmt.Errorf("All read replicas failed")))
+	assert.False(t, IsNotFound(fmt.Errorf("[Retryable] foo")))
+	assert.False(t, IsNotFound(nil))
+}
@@ -0,0 +1,365 @@
+package buddystore
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+FaultRule describes faults to inject into the calls it matches. A call
+matches if it is sent from From to To, and is one of Ops. Empty fields match
+anything. The probabilities are checked independently for every call.
+*/
+type FaultRule struct {
+	From string   // Host the call is sent from
+	To   string   // Host the call is sent to
+	Ops  []string // Transport methods, e.g. "Notify"
+
+	Drop      float64       // Probability the request is lost before reaching the target
+	Fail      float64       // Probability the response is lost after the target handled the request
+	Duplicate float64       // Probability the request is delivered twice
+	Delay     time.Duration // Added to every matching call
+	Jitter    time.Duration // Maximum random delay added on top of Delay
+}
+
+func (r *FaultRule) matches(from, to, op string) bool {
+	if len(r.From) > 0 && r.From != from {
+		return false
+	}
+	if len(r.To) > 0 && r.To != to {
+		return false
+	}
+	if len(r.Ops) == 0 {
+		return true
+	}
+	for _, o := range r.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+FaultStep is one step of a fault script. It is applied After the previous
+step, by clearing the rules and healing partitions if asked to, then
+partitioning and adding rules.
+*/
+type FaultStep struct {
+	After      time.Duration
+	ClearRules bool
+	Heal       bool
+	Partition  [][]string
+	Rules      []FaultRule
+}
+
+// Counts the faults injected so far
+type FaultStats struct {
+	Calls       uint64
+	Dropped     uint64
+	Failed      uint64
+	Duplicated  uint64
+	Delayed     uint64
+	Partitioned uint64
+}
+
+// Rules and partitions shared by all the transports of a test
+type faultState struct {
+	lock      sync.Mutex
+	rand      *rand.Rand
+	nextId    int
+	rules     map[int]*FaultRule
+	partition map[string]int // Host -> group, unlisted hosts form a group of their own
+	stats     FaultStats
+	clock     ClockIface // Times delays and scripts
+}
+
+/*
+FaultTransport wraps a transport to inject faults into its calls, for testing
+the ring under failures. Calls can be dropped, delayed, duplicated or failed
+according to FaultRules, and hosts can be partitioned from each other.
+
+The host calls are sent from is learned from the vnodes registered on the
+transport, or set with SetHost. Transports created with Wrap share the rules
+and partitions, so that a single FaultTransport controls a whole test ring.
+*/
+type FaultTransport struct {
+	faults   *faultState
+	trans    Transport
+	hostLock sync.RWMutex
+	host     string
+
+	// Implements:
+	Transport
+}
+
+var _ Transport = new(FaultTransport)
+
+// Creates a fault injecting transport without any faults configured
+func NewFaultTransport(trans Transport) *FaultTransport {
+	faults := &faultState{
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		rules:     make(map[int]*FaultRule),
+		partition: make(map[string]int),
+		clock:     realClock,
+	}
+	return newFaultTransport(faults, trans)
+}
+
+func newFaultTransport(faults *faultState, trans Transport) *FaultTransport {
+	f := &FaultTransport{faults: faults, trans: trans}
+	f.Transport = InterceptTransport(trans, f.intercept)
+	return f
+}
+
+// Wraps another transport, sharing the rules and partitions of this one
+func (f *FaultTransport) Wrap(trans Transport) *FaultTransport {
+	return newFaultTransport(f.faults, trans)
+}
+
+// Seeds the random source, to make the injected faults reproducible
+func (f *FaultTransport) Seed(seed int64) {
+	f.faults.lock.Lock()
+	defer f.faults.lock.Unlock()
+	f.faults.rand = rand.New(rand.NewSource(seed))
+}
+
+// Sets the clock delays and scripts are timed by. With a Simulator, delayed
+// calls only return once the simulation runs past their delay.
+func (f *FaultTransport) SetClock(clock ClockIface) {
+	f.faults.lock.Lock()
+	defer f.faults.lock.Unlock()
+	f.faults.clock = clock
+}
+
+// Sets the host calls are sent from
+func (f *FaultTransport) SetHost(host string) {
+	f.hostLock.Lock()
+	defer f.hostLock.Unlock()
+	f.host = host
+}
+
+// Returns the host calls are sent from
+func (f *FaultTransport) Host() string {
+	f.hostLock.RLock()
+	defer f.hostLock.RUnlock()
+	return f.host
+}
+
+// Adds a rule and returns its ID
+func (f *FaultTransport) AddRule(rule FaultRule) int {
+	f.faults.lock.Lock()
+	defer f.faults.lock.Unlock()
+	f.faults.nextId++
+	f.faults.rules[f.faults.nextId] = &rule
+	return f.faults.nextId
+}
+
+// Removes the rule with the given ID
+func (f *FaultTransport) RemoveRule(id int) {
+	f.faults.lock.Lock()
+	defer f.faults.lock.Unlock()
+	delete(f.faults.rules, id)
+}
+
+// Removes all rules
+func (f *FaultTransport) ClearRules() {
+	f.faults.lock.Lock()
+	defer f.faults.lock.Unlock()
+	f.faults.rules = make(map[int]*FaultRule)
+}
+
+/*
+Partitions the network into the given groups of hosts. Hosts in different
+groups cannot reach each other, and the hosts not listed form one more group.
+Partitioning a single host thus isolates it from all others. Replaces any
+previous partition.
+*/
+func (f *FaultTransport) Partition(groups ...[]string) {
+	f.faults.lock.Lock()
+	defer f.faults.lock.Unlock()
+	f.faults.partition = make(map[string]int)
+	for i, group := range groups {
+		for _, host := range group {
+			f.faults.partition[host] = i + 1
+		}
+	}
+}
+
+// Removes the partition, all hosts can reach each other again
+func (f *FaultTransport) Heal() {
+	f.Partition()
+}
+
+// Returns the faults injected so far, by all transports sharing the rules
+func (f *FaultTransport) Stats() FaultStats {
+	f.faults.lock.Lock()
+	defer f.faults.lock.Unlock()
+	return f.faults.stats
+}
+
+/*
+Applies the steps of a fault script one after the other in the background.
+The returned channel is closed once the last step has been applied, closing
+stop aborts the script.
+*/
+func (f *FaultTransport) RunScript(steps []FaultStep, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, step := range steps {
+			elapsed := make(chan struct{})
+			timer := f.faults.getClock().AfterFunc(step.After, func() {
+				close(elapsed)
+			})
+			select {
+			case <-elapsed:
+			case <-stop:
+				timer.Stop()
+				return
+			}
+
+			if step.ClearRules {
+				f.ClearRules()
+			}
+			if step.Heal {
+				f.Heal()
+			}
+			if len(step.Partition) > 0 {
+				f.Partition(step.Partition...)
+			}
+			for _, rule := range step.Rules {
+				f.AddRule(rule)
+			}
+		}
+	}()
+	return done
+}
+
+// Learns the host calls are sent from
+func (f *FaultTransport) Register(v *Vnode, o VnodeRPC) {
+	f.hostLock.Lock()
+	if len(f.host) == 0 {
+		f.host = v.Host
+	}
+	f.hostLock.Unlock()
+	f.trans.Register(v, o)
+}
+
+// Returns the wrapped transport
+func (f *FaultTransport) Unwrap() Transport {
+	return f.trans
+}
+
+// Shuts down the wrapped transport, if it supports being shut down
+func (f *FaultTransport) Shutdown() {
+	if s, ok := f.trans.(interface {
+		Shutdown()
+	}); ok {
+		s.Shutdown()
+	}
+}
+
+// The faults to inject into a single call
+type faultPlan struct {
+	partitioned bool
+	drop        bool
+	fail        bool
+	duplicate   bool
+	delay       time.Duration
+}
+
+func (fs *faultState) getClock() ClockIface {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.clock
+}
+
+func (fs *faultState) plan(from, to, op string) faultPlan {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	var p faultPlan
+	fs.stats.Calls++
+	if len(from) > 0 && len(to) > 0 && fs.partition[from] != fs.partition[to] {
+		fs.stats.Partitioned++
+		p.partitioned = true
+		return p
+	}
+
+	// Rules draw from the random source in the order they were added, so
+	// that a seed reproduces the same faults
+	ids := make([]int, 0, len(fs.rules))
+	for id := range fs.rules {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		r := fs.rules[id]
+		if !r.matches(from, to, op) {
+			continue
+		}
+		p.drop = p.drop || fs.rand.Float64() < r.Drop
+		p.fail = p.fail || fs.rand.Float64() < r.Fail
+		p.duplicate = p.duplicate || fs.rand.Float64() < r.Duplicate
+		p.delay += r.Delay
+		if r.Jitter > 0 {
+			p.delay += time.Duration(fs.rand.Int63n(int64(r.Jitter)))
+		}
+	}
+
+	switch {
+	case p.drop:
+		fs.stats.Dropped++
+	case p.fail:
+		fs.stats.Failed++
+	case p.duplicate:
+		fs.stats.Duplicated++
+	}
+	if p.delay > 0 {
+		fs.stats.Delayed++
+	}
+	return p
+}
+
+func (f *FaultTransport) intercept(call *TransportCall, next TransportInvoker) error {
+	from := f.Host()
+	to := call.Host
+	if call.Target != nil {
+		to = call.Target.Host
+	}
+
+	p := f.faults.plan(from, to, call.Op)
+	if p.partitioned {
+		return faultError("%s from %s to %s: partitioned", call.Op, from, to)
+	}
+
+	if p.delay > 0 {
+		elapsed := make(chan struct{})
+		f.faults.getClock().AfterFunc(p.delay, func() {
+			close(elapsed)
+		})
+		<-elapsed
+	}
+
+	switch {
+	case p.drop:
+		return faultError("%s from %s to %s: request dropped", call.Op, from, to)
+	case p.fail:
+		next(call)
+		return faultError("%s from %s to %s: response lost", call.Op, from, to)
+	case p.duplicate:
+		// The caller sees the response to the second copy
+		next(call)
+	}
+	return next(call)
+}
+
+// Injected faults look like network errors, which are worth retrying
+func faultError(format string, args ...interface{}) error {
+	return BuddyStoreError{Err: "Injected fault: " + fmt.Sprintf(format, args...), Transient: true}
+}
@@ -0,0 +1,219 @@
+package buddystore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func makeFaultLocal(host string) (*FaultTransport, *Vnode, *MockVnodeRPC) {
+	vn := &Vnode{Id: []byte{1}, Host: host}
+	mock := &MockVnodeRPC{succ: []*Vnode{vn}}
+	f := NewFaultTransport(makeLocal())
+	f.Register(vn, mock)
+	return f, vn, mock
+}
+
+func TestFaultTransportDrop(t *testing.T) {
+	f, vn, mock := makeFaultLocal("a")
+	if f.Host() != "a" {
+		t.Fatalf("expected host to be learned, got %q", f.Host())
+	}
+
+	id := f.AddRule(FaultRule{Ops: []string{"FindSuccessors"}, Drop: 1})
+	_, err := f.FindSuccessors(vn, 1, []byte("key"))
+	if err == nil || !isRetryable(err) {
+		t.Fatalf("expected a retryable error, got %v", err)
+	}
+	if mock.key != nil {
+		t.Fatalf("dropped request reached the target")
+	}
+
+	// Other operations are not affected
+	if _, err := f.GetPredecessor(vn); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	f.RemoveRule(id)
+	if _, err := f.FindSuccessors(vn, 1, []byte("key")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	stats := f.Stats()
+	if stats.Calls != 3 || stats.Dropped != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFaultTransportFail(t *testing.T) {
+	f, vn, mock := makeFaultLocal("a")
+
+	f.AddRule(FaultRule{Fail: 1})
+	_, err := f.FindSuccessors(vn, 1, []byte("key"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if string(mock.key) != "key" {
+		t.Fatalf("expected the request to reach the target")
+	}
+}
+
+func TestFaultTransportDuplicateAndDelay(t *testing.T) {
+	f, vn, _ := makeFaultLocal("a")
+
+	calls := 0
+	inner := f.Wrap(InterceptTransport(makeLocal(), func(call *TransportCall, next TransportInvoker) error {
+		calls++
+		return next(call)
+	}))
+	inner.Register(vn, &MockVnodeRPC{})
+
+	f.AddRule(FaultRule{Duplicate: 1, Delay: 20 * time.Millisecond})
+	start := time.Now()
+	if _, err := inner.Ping(vn); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected the request to be delivered twice, got %d", calls)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("expected the call to be delayed")
+	}
+
+	// Rules are shared by wrapped transports
+	if _, err := f.Ping(vn); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if stats := f.Stats(); stats.Duplicated != 2 || stats.Delayed != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFaultTransportDelayClock(t *testing.T) {
+	f, vn, _ := makeFaultLocal("a")
+	sim := NewSimulator(1)
+	f.SetClock(sim)
+
+	f.AddRule(FaultRule{Delay: time.Hour})
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.Ping(vn)
+		done <- err
+	}()
+
+	// The delay passes in virtual time only
+	for sim.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sim.Run(time.Minute)
+	select {
+	case <-done:
+		t.Fatalf("expected the call to be delayed")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	sim.Run(time.Hour)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+}
+
+func TestFaultTransportHostPair(t *testing.T) {
+	f, vn, _ := makeFaultLocal("a")
+	other := &Vnode{Id: []byte{2}, Host: "b"}
+	g := f.Wrap(makeLocal())
+	g.Register(other, &MockVnodeRPC{})
+
+	// Only calls from b to a are lost
+	f.AddRule(FaultRule{From: "b", To: "a", Drop: 1})
+	if _, err := f.Ping(vn); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if _, err := g.Ping(other); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if _, err := g.Ping(vn); err == nil {
+		t.Fatalf("expected the call from b to a to be dropped")
+	}
+}
+
+func TestFaultTransportSeed(t *testing.T) {
+	run := func() []string {
+		f, vn, _ := makeFaultLocal("a")
+		f.Seed(42)
+		f.AddRule(FaultRule{Drop: 0.5})
+		f.AddRule(FaultRule{Fail: 0.5})
+		f.AddRule(FaultRule{Jitter: time.Millisecond})
+
+		var res []string
+		for i := 0; i < 20; i++ {
+			_, err := f.Ping(vn)
+			res = append(res, fmt.Sprint(err))
+		}
+		return res
+	}
+
+	// Rules are applied in the same order on every run
+	first := run()
+	for n := 0; n < 5; n++ {
+		second := run()
+		for i := range first {
+			if first[i] != second[i] {
+				t.Fatalf("expected the same faults with the same seed, got %v and %v", first, second)
+			}
+		}
+	}
+}
+
+func TestFaultTransportPartitionScript(t *testing.T) {
+	c1, t1, err := prepRing(int(PORT + 2094))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	c2, t2, err := prepRing(int(PORT + 2095))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	f1 := NewFaultTransport(t1)
+	f2 := f1.Wrap(t2)
+
+	r1, err := Create(c1, f1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r1.Shutdown()
+	r2, err := Join(c2, f2, c1.Hostname)
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+	defer r2.Shutdown()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	done := f1.RunScript([]FaultStep{
+		{After: 50 * time.Millisecond, Partition: [][]string{{c1.Hostname}}},
+		{After: time.Second, Heal: true},
+	}, stop)
+
+	// While partitioned, stabilization keeps failing to reach the other side
+	<-time.After(200 * time.Millisecond)
+	if _, err := f2.ListVnodes(c1.Hostname); err == nil {
+		t.Fatalf("expected partitioned host to be unreachable")
+	}
+	if f1.Stats().Partitioned == 0 {
+		t.Fatalf("expected calls to be cut by the partition")
+	}
+
+	<-done
+	if vns, err := f2.ListVnodes(c1.Hostname); err != nil || len(vns) != c1.NumVnodes {
+		t.Fatalf("expected host to be reachable after healing, got %v", err)
+	}
+	partitioned := f1.Stats().Partitioned
+	<-time.After(100 * time.Millisecond)
+	if f1.Stats().Partitioned != partitioned {
+		t.Fatalf("expected no more calls to be cut after healing")
+	}
+}
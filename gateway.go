@@ -0,0 +1,221 @@
+package buddystore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest value accepted by a KVGateway by default
+const GATEWAY_MAX_VALUE_SIZE = 64 << 20
+
+/*
+KVGateway serves the KV stores of rings over HTTP, for clients that cannot
+use a KVStoreClient. Values are sent and received as raw request and
+response bodies.
+
+	GET    /rings/<ring>/keys/<key>[?lease]      Read a value
+	HEAD   /rings/<ring>/keys/<key>              Check for a value
+	PUT    /rings/<ring>/keys/<key>[?version=N]  Write a value
+	DELETE /rings/<ring>/keys/<key>              Delete a value
+
+Reading with lease takes a write lease through GetForSet, and returns the
+version leased as the ETag. Writing that version back, either in the version
+query parameter or as If-Match, commits it through SetVersion, and fails
+with 412 Precondition Failed if the lease was lost. Reads support ranges.
+*/
+type KVGateway struct {
+	MaxValueSize int64 // Largest value accepted, GATEWAY_MAX_VALUE_SIZE if 0
+
+	clients func(ringId string) (KVStoreClient, int)
+}
+
+// Serves the KV stores of the rings clients returns, using the return codes of BuddyStore.GetKVClient
+func NewKVGateway(clients func(ringId string) (KVStoreClient, int)) *KVGateway {
+	return &KVGateway{clients: clients}
+}
+
+// Starts serving the KV stores over HTTP. Close the listener to stop.
+func ServeKVGateway(listen string, clients func(ringId string) (KVStoreClient, int)) (net.Listener, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	go http.Serve(listener, NewKVGateway(clients))
+	return listener, nil
+}
+
+// Stores that can delete keys
+type kvDeleter interface {
+	Delete(key string) error
+}
+
+func (g *KVGateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ringId, key, ok := parseKeyPath(req.URL.Path)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	kv, code := g.clients(ringId)
+	switch code {
+	case OK:
+	case ENOTINITIALIZED:
+		http.Error(w, "Store is not running", http.StatusServiceUnavailable)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("Unknown ring %s", ringId), http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		g.handleGet(w, req, kv, key)
+	case "PUT":
+		g.handlePut(w, req, kv, key)
+	case "DELETE":
+		g.handleDelete(w, req, kv, key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Splits a /rings/<ring>/keys/<key> path
+func parseKeyPath(path string) (string, string, bool) {
+	if !strings.HasPrefix(path, "/rings/") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, "/rings/"), "/keys/", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || strings.Contains(parts[0], "/") || len(parts[1]) == 0 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func (g *KVGateway) handleGet(w http.ResponseWriter, req *http.Request, kv KVStoreClient, key string) {
+	var val []byte
+	var err error
+	if _, lease := req.URL.Query()["lease"]; lease {
+		var version uint
+		val, version, err = kv.GetForSet(key, true)
+		if version > 0 {
+			// New keys are created by writing the leased version
+			w.Header().Set("ETag", formatETag(version))
+		}
+	} else {
+		val, err = kv.Get(key, true)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), gatewayStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(val))
+}
+
+func (g *KVGateway) handlePut(w http.ResponseWriter, req *http.Request, kv KVStoreClient, key string) {
+	version, conditional, err := requestVersion(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	max := g.MaxValueSize
+	if max == 0 {
+		max = GATEWAY_MAX_VALUE_SIZE
+	}
+	if req.ContentLength > max {
+		http.Error(w, "Value too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	val, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, max))
+	if err != nil {
+		http.Error(w, "Value too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !conditional {
+		if err := kv.Set(key, val); err != nil {
+			http.Error(w, err.Error(), gatewayStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := kv.SetVersion(key, version, val); err != nil {
+		status := gatewayStatus(err)
+		if !isRetryable(err) {
+			status = http.StatusPreconditionFailed
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("ETag", formatETag(version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *KVGateway) handleDelete(w http.ResponseWriter, req *http.Request, kv KVStoreClient, key string) {
+	deleter, ok := kv.(kvDeleter)
+	if !ok {
+		http.Error(w, "Store cannot delete keys", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := deleter.Delete(key); err != nil {
+		http.Error(w, err.Error(), gatewayStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Returns the version a write is for, from the version query parameter or
+the If-Match header, and whether one was given. Fails if they disagree.
+*/
+func requestVersion(req *http.Request) (uint, bool, error) {
+	var versions []string
+	if v := req.URL.Query().Get("version"); len(v) > 0 {
+		versions = append(versions, v)
+	}
+	if etag := req.Header.Get("If-Match"); len(etag) > 0 && etag != "*" {
+		versions = append(versions, strings.Trim(strings.TrimPrefix(etag, "W/"), `"`))
+	}
+	if len(versions) == 0 {
+		return 0, false, nil
+	}
+	if len(versions) == 2 && versions[0] != versions[1] {
+		return 0, false, fmt.Errorf("Version %s does not match If-Match %s", versions[0], versions[1])
+	}
+
+	version, err := strconv.ParseUint(versions[0], 10, 0)
+	if err != nil || version == 0 {
+		return 0, false, fmt.Errorf("Invalid version %s", versions[0])
+	}
+	return uint(version), true, nil
+}
+
+func formatETag(version uint) string {
+	return `"` + strconv.FormatUint(uint64(version), 10) + `"`
+}
+
+// Maps an error of the KV store to an HTTP status
+func gatewayStatus(err error) int {
+	switch {
+	case IsNotFound(err):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "currently being updated"):
+		return http.StatusConflict
+	case isRetryable(err), strings.Contains(err.Error(), "read replicas failed"):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
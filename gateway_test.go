@@ -0,0 +1,205 @@
+package buddystore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startGatewayCluster(t *testing.T) (*Cluster, *KVGateway, *httptest.Server) {
+	c, err := NewStableCluster(2, 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	gateway := NewKVGateway(func(ringId string) (KVStoreClient, int) {
+		switch ringId {
+		case "r":
+			return c.Node("host-0").KV, OK
+		case "down":
+			return nil, ENOTINITIALIZED
+		}
+		return nil, ENOTJOINED
+	})
+	return c, gateway, httptest.NewServer(gateway)
+}
+
+func gatewayRequest(t *testing.T, method, url string, body io.Reader, header map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer resp.Body.Close()
+
+	res, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	return resp, string(res)
+}
+
+func TestParseKeyPath(t *testing.T) {
+	ringId, key, ok := parseKeyPath("/rings/r/keys/a/b")
+	if !ok || ringId != "r" || key != "a/b" {
+		t.Fatalf("unexpected parse %q %q %v", ringId, key, ok)
+	}
+
+	for _, path := range []string{"/", "/rings/r", "/rings/r/keys/", "/rings//keys/a", "/rings/r/x/keys/a", "/admin/vnodes"} {
+		if _, _, ok := parseKeyPath(path); ok {
+			t.Fatalf("expected %s not to parse", path)
+		}
+	}
+}
+
+func TestGatewayGetSet(t *testing.T) {
+	c, _, server := startGatewayCluster(t)
+	defer c.Shutdown()
+	defer server.Close()
+	url := server.URL + "/rings/r/keys/key"
+
+	if resp, _ := gatewayRequest(t, "PUT", url, strings.NewReader("hello world"), nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if val, err := c.Node("host-1").KV.Get("key", true); err != nil || string(val) != "hello world" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+
+	if resp, res := gatewayRequest(t, "GET", url, nil, nil); resp.StatusCode != http.StatusOK || res != "hello world" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, res)
+	}
+	if resp, res := gatewayRequest(t, "GET", url, nil, map[string]string{"Range": "bytes=6-"}); resp.StatusCode != http.StatusPartialContent || res != "world" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, res)
+	}
+	if resp, res := gatewayRequest(t, "HEAD", url, nil, nil); resp.StatusCode != http.StatusOK || resp.ContentLength != 11 || res != "" {
+		t.Fatalf("unexpected response %d %d %q", resp.StatusCode, resp.ContentLength, res)
+	}
+
+	// Values of unknown length are streamed in
+	body, w := io.Pipe()
+	go func() {
+		io.WriteString(w, "streamed ")
+		io.WriteString(w, "value")
+		w.Close()
+	}()
+	if resp, _ := gatewayRequest(t, "PUT", url, body, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, res := gatewayRequest(t, "GET", url, nil, nil); resp.StatusCode != http.StatusOK || res != "streamed value" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, res)
+	}
+}
+
+func TestGatewayDelete(t *testing.T) {
+	c, _, server := startGatewayCluster(t)
+	defer c.Shutdown()
+	defer server.Close()
+	url := server.URL + "/rings/r/keys/key"
+
+	if resp, _ := gatewayRequest(t, "PUT", url, strings.NewReader("value"), nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ := gatewayRequest(t, "DELETE", url, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	// Reads of the deleted key fail on every node
+	if resp, _ := gatewayRequest(t, "GET", url, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ := gatewayRequest(t, "HEAD", url, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if val, err := c.Node("host-1").KV.Get("key", false); !isDeleted(err) {
+		t.Fatalf("expected the key to be deleted, got %q. %v", val, err)
+	}
+
+	if resp, _ := gatewayRequest(t, "DELETE", url, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ := gatewayRequest(t, "GET", server.URL+"/rings/r/keys/missing", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestGatewayLease(t *testing.T) {
+	c, _, server := startGatewayCluster(t)
+	defer c.Shutdown()
+	defer server.Close()
+	url := server.URL + "/rings/r/keys/counter"
+
+	if resp, _ := gatewayRequest(t, "PUT", url, strings.NewReader("1"), nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	resp, res := gatewayRequest(t, "GET", url+"?lease", nil, nil)
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || res != "1" || len(etag) == 0 {
+		t.Fatalf("unexpected response %d %q %q", resp.StatusCode, res, etag)
+	}
+
+	resp, _ = gatewayRequest(t, "PUT", url, strings.NewReader("2"), map[string]string{"If-Match": etag})
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("ETag") != etag {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if resp, res := gatewayRequest(t, "GET", url, nil, nil); resp.StatusCode != http.StatusOK || res != "2" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, res)
+	}
+
+	// The lease was given up by the first write
+	if resp, _ := gatewayRequest(t, "PUT", url, strings.NewReader("3"), map[string]string{"If-Match": etag}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ := gatewayRequest(t, "PUT", url+"?version=1", strings.NewReader("3"), map[string]string{"If-Match": `"2"`}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ := gatewayRequest(t, "PUT", url+"?version=x", strings.NewReader("3"), nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestGatewayErrors(t *testing.T) {
+	c, gateway, server := startGatewayCluster(t)
+	defer c.Shutdown()
+	defer server.Close()
+
+	if resp, _ := gatewayRequest(t, "GET", server.URL+"/rings/other/keys/key", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ := gatewayRequest(t, "GET", server.URL+"/rings/down/keys/key", nil, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ := gatewayRequest(t, "GET", server.URL+"/rings/r", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	// Keys whose replicas cannot be read are not missing
+	if status := gatewayStatus(fmt.Errorf("All read replicas failed")); status != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d", status)
+	}
+
+	resp, _ := gatewayRequest(t, "POST", server.URL+"/rings/r/keys/key", nil, nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed || len(resp.Header.Get("Allow")) == 0 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	gateway.MaxValueSize = 4
+	if resp, _ := gatewayRequest(t, "PUT", server.URL+"/rings/r/keys/key", strings.NewReader("too large"), nil); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ := gatewayRequest(t, "PUT", server.URL+"/rings/r/keys/key", strings.NewReader("fits"), nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
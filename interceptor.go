@@ -0,0 +1,299 @@
+package buddystore
+
+/*
+TransportCall describes a call made through a Transport to an interceptor.
+Target is the vnode the call is sent to, or nil for ListVnodes, which is sent
+to Host instead. Args holds the remaining arguments of the Transport method
+in order, and Results its return values other than the error, once the call
+went through.
+*/
+type TransportCall struct {
+	Op      string // Name of the Transport method, e.g. "FindSuccessors"
+	Target  *Vnode
+	Host    string
+	Args    []interface{}
+	Results []interface{}
+}
+
+// Performs a Transport call, or hands it on to the next interceptor
+type TransportInvoker func(call *TransportCall) error
+
+/*
+TransportInterceptor is run around every call made through an intercepted
+transport. It decides whether, and how often, the call goes through by
+invoking next, and may return a different error than next did. Results are
+only filled in while next runs.
+*/
+type TransportInterceptor func(call *TransportCall, next TransportInvoker) error
+
+/*
+Returns a transport that runs all calls through the given interceptors
+before passing them on to trans. The first interceptor sees calls first, and
+their outcome last. Register and IsLocalVnode only concern the local node and
+are passed on without interception.
+
+An intercepted transport can be passed to Create and Join like any other, and
+intercepted again to add more interceptors on the outside.
+*/
+func InterceptTransport(trans Transport, interceptors ...TransportInterceptor) Transport {
+	if len(interceptors) == 0 {
+		return trans
+	}
+	return &interceptedTransport{trans: trans, interceptors: interceptors}
+}
+
+type interceptedTransport struct {
+	trans        Transport
+	interceptors []TransportInterceptor
+
+	// Implements:
+	Transport
+}
+
+var _ Transport = new(interceptedTransport)
+
+// Runs the interceptors around the actual call
+func (it *interceptedTransport) invoke(call *TransportCall, final TransportInvoker) error {
+	next := final
+	for i := len(it.interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := it.interceptors[i], next
+		next = func(c *TransportCall) error {
+			return interceptor(c, inner)
+		}
+	}
+	return next(call)
+}
+
+// Returns the transport calls are passed on to
+func (it *interceptedTransport) Unwrap() Transport {
+	return it.trans
+}
+
+/*
+Returns the TCP transport underneath the local and intercepted transports
+wrapped around it, if there is one. Code that needs TCP specifics should use
+this rather than type assertions, so that interceptors do not get in the way.
+*/
+func tcpTransportOf(trans Transport) (*TCPTransport, bool) {
+	for {
+		switch t := trans.(type) {
+		case *TCPTransport:
+			return t, true
+		case *LocalTransport:
+			trans = t.remote
+		case interface{ Unwrap() Transport }:
+			trans = t.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+func (it *interceptedTransport) ListVnodes(host string) ([]*Vnode, error) {
+	var res []*Vnode
+	err := it.invoke(&TransportCall{Op: "ListVnodes", Host: host}, func(c *TransportCall) (err error) {
+		res, err = it.trans.ListVnodes(host)
+		c.Results = []interface{}{res}
+		return err
+	})
+	return res, err
+}
+
+func (it *interceptedTransport) Ping(vn *Vnode) (bool, error) {
+	var res bool
+	err := it.invoke(&TransportCall{Op: "Ping", Target: vn}, func(c *TransportCall) (err error) {
+		res, err = it.trans.Ping(vn)
+		c.Results = []interface{}{res}
+		return err
+	})
+	return res, err
+}
+
+func (it *interceptedTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
+	var res *Vnode
+	err := it.invoke(&TransportCall{Op: "GetPredecessor", Target: vn}, func(c *TransportCall) (err error) {
+		res, err = it.trans.GetPredecessor(vn)
+		c.Results = []interface{}{res}
+		return err
+	})
+	return res, err
+}
+
+func (it *interceptedTransport) Notify(target, self *Vnode) ([]*Vnode, error) {
+	var res []*Vnode
+	err := it.invoke(&TransportCall{Op: "Notify", Target: target, Args: []interface{}{self}}, func(c *TransportCall) (err error) {
+		res, err = it.trans.Notify(target, self)
+		c.Results = []interface{}{res}
+		return err
+	})
+	return res, err
+}
+
+func (it *interceptedTransport) FindSuccessors(vn *Vnode, n int, key []byte) ([]*Vnode, error) {
+	var res []*Vnode
+	err := it.invoke(&TransportCall{Op: "FindSuccessors", Target: vn, Args: []interface{}{n, key}}, func(c *TransportCall) (err error) {
+		res, err = it.trans.FindSuccessors(vn, n, key)
+		c.Results = []interface{}{res}
+		return err
+	})
+	return res, err
+}
+
+func (it *interceptedTransport) ClearPredecessor(target, self *Vnode) error {
+	return it.invoke(&TransportCall{Op: "ClearPredecessor", Target: target, Args: []interface{}{self}}, func(c *TransportCall) error {
+		return it.trans.ClearPredecessor(target, self)
+	})
+}
+
+func (it *interceptedTransport) SkipSuccessor(target, self *Vnode) error {
+	return it.invoke(&TransportCall{Op: "SkipSuccessor", Target: target, Args: []interface{}{self}}, func(c *TransportCall) error {
+		return it.trans.SkipSuccessor(target, self)
+	})
+}
+
+func (it *interceptedTransport) GetPredecessorList(vn *Vnode) ([]*Vnode, error) {
+	var res []*Vnode
+	err := it.invoke(&TransportCall{Op: "GetPredecessorList", Target: vn}, func(c *TransportCall) (err error) {
+		res, err = it.trans.GetPredecessorList(vn)
+		c.Results = []interface{}{res}
+		return err
+	})
+	return res, err
+}
+
+func (it *interceptedTransport) Register(v *Vnode, o VnodeRPC) {
+	it.trans.Register(v, o)
+}
+
+func (it *interceptedTransport) RLock(target *Vnode, key string, nodeID string, opsLogEntry *OpsLogEntry) (string, uint, uint64, error) {
+	var lockID string
+	var version uint
+	var commitPoint uint64
+	call := &TransportCall{Op: "RLock", Target: target, Args: []interface{}{key, nodeID, opsLogEntry}}
+	err := it.invoke(call, func(c *TransportCall) (err error) {
+		lockID, version, commitPoint, err = it.trans.RLock(target, key, nodeID, opsLogEntry)
+		c.Results = []interface{}{lockID, version, commitPoint}
+		return err
+	})
+	return lockID, version, commitPoint, err
+}
+
+func (it *interceptedTransport) WLock(target *Vnode, key string, version uint, timeout uint, nodeID string, opsLogEntry *OpsLogEntry) (string, uint, uint, uint64, error) {
+	var lockID string
+	var resVersion, resTimeout uint
+	var commitPoint uint64
+	call := &TransportCall{Op: "WLock", Target: target, Args: []interface{}{key, version, timeout, nodeID, opsLogEntry}}
+	err := it.invoke(call, func(c *TransportCall) (err error) {
+		lockID, resVersion, resTimeout, commitPoint, err = it.trans.WLock(target, key, version, timeout, nodeID, opsLogEntry)
+		c.Results = []interface{}{lockID, resVersion, resTimeout, commitPoint}
+		return err
+	})
+	return lockID, resVersion, resTimeout, commitPoint, err
+}
+
+func (it *interceptedTransport) CommitWLock(target *Vnode, key string, version uint, nodeID string, opsLogEntry *OpsLogEntry) (uint64, error) {
+	var commitPoint uint64
+	call := &TransportCall{Op: "CommitWLock", Target: target, Args: []interface{}{key, version, nodeID, opsLogEntry}}
+	err := it.invoke(call, func(c *TransportCall) (err error) {
+		commitPoint, err = it.trans.CommitWLock(target, key, version, nodeID, opsLogEntry)
+		c.Results = []interface{}{commitPoint}
+		return err
+	})
+	return commitPoint, err
+}
+
+func (it *interceptedTransport) AbortWLock(target *Vnode, key string, version uint, nodeID string, opsLogEntry *OpsLogEntry) (uint64, error) {
+	var commitPoint uint64
+	call := &TransportCall{Op: "AbortWLock", Target: target, Args: []interface{}{key, version, nodeID, opsLogEntry}}
+	err := it.invoke(call, func(c *TransportCall) (err error) {
+		commitPoint, err = it.trans.AbortWLock(target, key, version, nodeID, opsLogEntry)
+		c.Results = []interface{}{commitPoint}
+		return err
+	})
+	return commitPoint, err
+}
+
+func (it *interceptedTransport) InvalidateRLock(target *Vnode, lockID string) error {
+	return it.invoke(&TransportCall{Op: "InvalidateRLock", Target: target, Args: []interface{}{lockID}}, func(c *TransportCall) error {
+		return it.trans.InvalidateRLock(target, lockID)
+	})
+}
+
+func (it *interceptedTransport) Get(target *Vnode, key string, version uint) ([]byte, error) {
+	var value []byte
+	err := it.invoke(&TransportCall{Op: "Get", Target: target, Args: []interface{}{key, version}}, func(c *TransportCall) (err error) {
+		value, err = it.trans.Get(target, key, version)
+		c.Results = []interface{}{value}
+		return err
+	})
+	return value, err
+}
+
+func (it *interceptedTransport) Set(target *Vnode, key string, version uint, value []byte) error {
+	return it.invoke(&TransportCall{Op: "Set", Target: target, Args: []interface{}{key, version, value}}, func(c *TransportCall) error {
+		return it.trans.Set(target, key, version, value)
+	})
+}
+
+func (it *interceptedTransport) List(target *Vnode) ([]string, error) {
+	var keys []string
+	err := it.invoke(&TransportCall{Op: "List", Target: target}, func(c *TransportCall) (err error) {
+		keys, err = it.trans.List(target)
+		c.Results = []interface{}{keys}
+		return err
+	})
+	return keys, err
+}
+
+func (it *interceptedTransport) BulkSet(target *Vnode, key string, valLst []KVStoreValue) error {
+	return it.invoke(&TransportCall{Op: "BulkSet", Target: target, Args: []interface{}{key, valLst}}, func(c *TransportCall) error {
+		return it.trans.BulkSet(target, key, valLst)
+	})
+}
+
+func (it *interceptedTransport) SyncKeys(target *Vnode, ownerVn *Vnode, key string, ver []uint) error {
+	return it.invoke(&TransportCall{Op: "SyncKeys", Target: target, Args: []interface{}{ownerVn, key, ver}}, func(c *TransportCall) error {
+		return it.trans.SyncKeys(target, ownerVn, key, ver)
+	})
+}
+
+func (it *interceptedTransport) MissingKeys(target *Vnode, replVn *Vnode, key string, ver []uint) error {
+	return it.invoke(&TransportCall{Op: "MissingKeys", Target: target, Args: []interface{}{replVn, key, ver}}, func(c *TransportCall) error {
+		return it.trans.MissingKeys(target, replVn, key, ver)
+	})
+}
+
+func (it *interceptedTransport) PurgeVersions(target *Vnode, key string, maxVersion uint) error {
+	return it.invoke(&TransportCall{Op: "PurgeVersions", Target: target, Args: []interface{}{key, maxVersion}}, func(c *TransportCall) error {
+		return it.trans.PurgeVersions(target, key, maxVersion)
+	})
+}
+
+func (it *interceptedTransport) JoinRing(target *Vnode, ringId string, self *Vnode) ([]*Vnode, error) {
+	var res []*Vnode
+	err := it.invoke(&TransportCall{Op: "JoinRing", Target: target, Args: []interface{}{ringId, self}}, func(c *TransportCall) (err error) {
+		res, err = it.trans.JoinRing(target, ringId, self)
+		c.Results = []interface{}{res}
+		return err
+	})
+	return res, err
+}
+
+func (it *interceptedTransport) LeaveRing(target *Vnode, ringId string) error {
+	return it.invoke(&TransportCall{Op: "LeaveRing", Target: target, Args: []interface{}{ringId}}, func(c *TransportCall) error {
+		return it.trans.LeaveRing(target, ringId)
+	})
+}
+
+func (it *interceptedTransport) IsLocalVnode(vn *Vnode) bool {
+	return it.trans.IsLocalVnode(vn)
+}
+
+// Shuts down the wrapped transport, if it supports being shut down
+func (it *interceptedTransport) Shutdown() {
+	if s, ok := it.trans.(interface {
+		Shutdown()
+	}); ok {
+		s.Shutdown()
+	}
+}
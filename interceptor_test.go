@@ -0,0 +1,173 @@
+package buddystore
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the calls it sees, tagged with its name
+type recordingInterceptor struct {
+	name  string
+	lock  sync.Mutex
+	trace *[]string
+}
+
+func (ri *recordingInterceptor) intercept(call *TransportCall, next TransportInvoker) error {
+	ri.lock.Lock()
+	*ri.trace = append(*ri.trace, ri.name+">"+call.Op)
+	ri.lock.Unlock()
+
+	err := next(call)
+
+	ri.lock.Lock()
+	*ri.trace = append(*ri.trace, ri.name+"<"+call.Op)
+	ri.lock.Unlock()
+	return err
+}
+
+func TestInterceptTransportOrder(t *testing.T) {
+	var trace []string
+	outer := &recordingInterceptor{name: "outer", trace: &trace}
+	inner := &recordingInterceptor{name: "inner", trace: &trace}
+
+	local := makeLocal()
+	vn := &Vnode{Id: []byte{1}, Host: "test"}
+	mock := &MockVnodeRPC{succ: []*Vnode{vn}}
+	local.Register(vn, mock)
+
+	trans := InterceptTransport(local, outer.intercept, inner.intercept)
+	res, err := trans.FindSuccessors(vn, 1, []byte("key"))
+	if err != nil || len(res) != 1 || res[0] != vn {
+		t.Fatalf("unexpected result %v, %v", res, err)
+	}
+
+	expected := []string{"outer>FindSuccessors", "inner>FindSuccessors", "inner<FindSuccessors", "outer<FindSuccessors"}
+	if !reflect.DeepEqual(trace, expected) {
+		t.Fatalf("expected %v, got %v", expected, trace)
+	}
+}
+
+func TestInterceptTransportCall(t *testing.T) {
+	local := makeLocal()
+	vn := &Vnode{Id: []byte{1}, Host: "test"}
+	mock := &MockVnodeRPC{succ: []*Vnode{vn}}
+
+	var seen *TransportCall
+	var results []interface{}
+	trans := InterceptTransport(local, func(call *TransportCall, next TransportInvoker) error {
+		seen = call
+		err := next(call)
+		results = call.Results
+		return err
+	})
+
+	// Local bookkeeping is passed on without interception
+	trans.Register(vn, mock)
+	if seen != nil {
+		t.Fatalf("unexpected call %v", seen)
+	}
+	if !trans.IsLocalVnode(vn) {
+		t.Fatalf("expected vnode to be registered")
+	}
+
+	trans.FindSuccessors(vn, 3, []byte("key"))
+	if seen.Op != "FindSuccessors" || seen.Target != vn {
+		t.Fatalf("unexpected call %v", seen)
+	}
+	if !reflect.DeepEqual(seen.Args, []interface{}{3, []byte("key")}) {
+		t.Fatalf("unexpected args %v", seen.Args)
+	}
+	if !reflect.DeepEqual(results, []interface{}{[]*Vnode{vn}}) {
+		t.Fatalf("unexpected results %v", results)
+	}
+
+	trans.ListVnodes("other")
+	if seen.Op != "ListVnodes" || seen.Target != nil || seen.Host != "other" {
+		t.Fatalf("unexpected call %v", seen)
+	}
+}
+
+func TestInterceptTransportShortCircuit(t *testing.T) {
+	local := makeLocal()
+	vn := &Vnode{Id: []byte{1}, Host: "test"}
+	mock := &MockVnodeRPC{pred: vn}
+	local.Register(vn, mock)
+
+	dropped := errors.New("dropped")
+	calls := 0
+	trans := InterceptTransport(local, func(call *TransportCall, next TransportInvoker) error {
+		calls++
+		return dropped
+	})
+
+	pred, err := trans.GetPredecessor(vn)
+	if err != dropped || pred != nil || calls != 1 {
+		t.Fatalf("expected the call to be dropped, got %v, %v", pred, err)
+	}
+
+	// Interceptors may also retry
+	retried := 0
+	trans = InterceptTransport(local, func(call *TransportCall, next TransportInvoker) error {
+		retried++
+		next(call)
+		return next(call)
+	})
+	pred, err = trans.GetPredecessor(vn)
+	if err != nil || pred != vn || retried != 1 {
+		t.Fatalf("unexpected result %v, %v", pred, err)
+	}
+}
+
+func TestInterceptTransportRing(t *testing.T) {
+	c1, t1, err := prepRing(int(PORT + 2092))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	c2, t2, err := prepRing(int(PORT + 2093))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	var lock sync.Mutex
+	ops := make(map[string]int)
+	count := func(call *TransportCall, next TransportInvoker) error {
+		lock.Lock()
+		ops[call.Op]++
+		lock.Unlock()
+		return next(call)
+	}
+
+	r1, err := Create(c1, InterceptTransport(t1, count))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r1.Shutdown()
+	r2, err := Join(c2, InterceptTransport(t2, count), c1.Hostname)
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+	defer r2.Shutdown()
+
+	<-time.After(100 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, op := range []string{"ListVnodes", "FindSuccessors", "Notify"} {
+		if ops[op] == 0 {
+			t.Fatalf("expected %s calls to be intercepted, got %v", op, ops)
+		}
+	}
+
+	// TCP specifics remain reachable underneath the interceptors
+	if tcp, ok := tcpTransportOf(r2.transport); !ok || tcp != t2 {
+		t.Fatalf("expected to find the TCP transport, got %v", tcp)
+	}
+	if _, ok := tcpTransportOf(makeLocal()); ok {
+		t.Fatalf("unexpected TCP transport")
+	}
+}
@@ -0,0 +1,324 @@
+package buddystore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default multicast group used to announce nodes on the local network
+const LAN_DISCOVERY_ADDR = "239.192.66.83:7947"
+const LAN_DISCOVERY_INTERVAL = 5 * time.Second
+const LAN_DISCOVERY_EXPIRY = 20 * time.Second
+const LAN_DISCOVERY_WAIT = 1 * time.Second
+
+// Largest datagram we are willing to receive
+const LAN_DISCOVERY_MAX_PACKET = 8192
+
+const (
+	lanAnnounce = iota
+	lanQuery
+)
+
+// Configuration for LAN peer discovery
+type LANDiscoveryConfig struct {
+	ListenAddr   string        // Address to receive announcements on
+	AnnounceAddr string        // Multicast group, broadcast or unicast address to announce to
+	Interval     time.Duration // Time between periodic announcements
+	Expiry       time.Duration // Peers not heard from within this window are forgotten
+	Logger       Logger        // Defaults to DefaultLogger
+}
+
+// Returns the default LAN discovery configuration, which listens and
+// announces on the LAN_DISCOVERY_ADDR multicast group
+func DefaultLANDiscoveryConfig() *LANDiscoveryConfig {
+	return &LANDiscoveryConfig{
+		ListenAddr:   LAN_DISCOVERY_ADDR,
+		AnnounceAddr: LAN_DISCOVERY_ADDR,
+		Interval:     LAN_DISCOVERY_INTERVAL,
+		Expiry:       LAN_DISCOVERY_EXPIRY,
+	}
+}
+
+// Wire format of discovery datagrams
+type lanMessage struct {
+	Type     int
+	NodeId   string
+	Hostname string
+	RingIds  []string
+}
+
+type lanPeer struct {
+	hostname string
+	ringIds  []string
+	seen     time.Time
+}
+
+/*
+LANDiscovery announces the hostnames and ring IDs of the local node over UDP
+and keeps track of the announcements made by other nodes on the same network.
+Announcements are sent from the listening socket, so a node receiving a query
+can answer the sender directly. No internet connectivity is required.
+*/
+type LANDiscovery struct {
+	config     *LANDiscoveryConfig
+	nodeId     string
+	conn       *net.UDPConn
+	announce   *net.UDPAddr
+	lock       sync.RWMutex
+	advertised map[string]map[string]bool // Ring IDs advertised for each hostname
+	peers      map[string]*lanPeer
+	shutdown   int32
+}
+
+// Creates a new LAN discovery instance and starts listening for, and
+// periodically sending, announcements
+func NewLANDiscovery(conf *LANDiscoveryConfig) (*LANDiscovery, error) {
+	if conf == nil {
+		conf = DefaultLANDiscoveryConfig()
+	}
+
+	listen, err := net.ResolveUDPAddr("udp", conf.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	announce, err := net.ResolveUDPAddr("udp", conf.AnnounceAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *net.UDPConn
+	if listen.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, listen)
+	} else {
+		conn, err = net.ListenUDP("udp", listen)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	d := &LANDiscovery{
+		config:     conf,
+		nodeId:     hex.EncodeToString(id),
+		conn:       conn,
+		announce:   announce,
+		advertised: make(map[string]map[string]bool),
+		peers:      make(map[string]*lanPeer),
+	}
+
+	go d.listen()
+	go d.announceLoop()
+
+	return d, nil
+}
+
+// Advertise a hostname as a member of the given rings, in addition to the
+// rings already advertised for it
+func (d *LANDiscovery) Advertise(hostname string, ringIds ...string) {
+	d.lock.Lock()
+	rings := d.advertised[hostname]
+	if rings == nil {
+		rings = make(map[string]bool)
+		d.advertised[hostname] = rings
+	}
+	for _, id := range ringIds {
+		rings[id] = true
+	}
+	d.lock.Unlock()
+
+	d.sendAnnouncements(d.announce)
+}
+
+// Stop advertising a hostname as a member of the given rings, or of any
+// ring if none are given. Peers forget the hostname once it expires.
+func (d *LANDiscovery) Withdraw(hostname string, ringIds ...string) {
+	d.lock.Lock()
+	rings := d.advertised[hostname]
+	for _, id := range ringIds {
+		delete(rings, id)
+	}
+	remaining := len(ringIds) > 0 && len(rings) > 0
+	if !remaining {
+		delete(d.advertised, hostname)
+	}
+	d.lock.Unlock()
+
+	// Let peers know about the rings left right away
+	if remaining {
+		d.sendAnnouncements(d.announce)
+	}
+}
+
+// Ask every node on the network to announce itself immediately
+func (d *LANDiscovery) Query() error {
+	return d.send(&lanMessage{Type: lanQuery, NodeId: d.nodeId}, d.announce)
+}
+
+// Returns the hostnames of remote peers advertising the given ring,
+// most recently heard from first
+func (d *LANDiscovery) Peers(ringId string) []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	now := time.Now()
+	found := make([]*lanPeer, 0, len(d.peers))
+	for _, p := range d.peers {
+		if now.Sub(p.seen) > d.config.Expiry {
+			continue
+		}
+		for _, id := range p.ringIds {
+			if id == ringId {
+				found = append(found, p)
+				break
+			}
+		}
+	}
+
+	sort.Sort(lanPeersByRecency(found))
+
+	hosts := make([]string, len(found))
+	for i, p := range found {
+		hosts[i] = p.hostname
+	}
+	return hosts
+}
+
+// Queries the network and waits up to timeout for at least one peer
+// advertising the given ring
+func (d *LANDiscovery) WaitForPeers(ringId string, timeout time.Duration) []string {
+	if err := d.Query(); err != nil {
+		d.log().Error("Failed to query LAN peers", Field("err", err))
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		peers := d.Peers(ringId)
+		if len(peers) > 0 || time.Now().After(deadline) {
+			return peers
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (d *LANDiscovery) log() *fieldLogger {
+	return newFieldLogger(d.config.Logger)
+}
+
+// Stops announcing and listening
+func (d *LANDiscovery) Shutdown() {
+	atomic.StoreInt32(&d.shutdown, 1)
+	d.conn.Close()
+}
+
+func (d *LANDiscovery) isShutdown() bool {
+	return atomic.LoadInt32(&d.shutdown) == 1
+}
+
+func (d *LANDiscovery) send(msg *lanMessage, to *net.UDPAddr) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDP(buf, to)
+	return err
+}
+
+// Sends one announcement per advertised hostname
+func (d *LANDiscovery) sendAnnouncements(to *net.UDPAddr) {
+	d.lock.RLock()
+	msgs := make([]*lanMessage, 0, len(d.advertised))
+	for host, rings := range d.advertised {
+		ringIds := make([]string, 0, len(rings))
+		for id := range rings {
+			ringIds = append(ringIds, id)
+		}
+		sort.Strings(ringIds)
+		msgs = append(msgs, &lanMessage{Type: lanAnnounce, NodeId: d.nodeId, Hostname: host, RingIds: ringIds})
+	}
+	d.lock.RUnlock()
+
+	for _, msg := range msgs {
+		if err := d.send(msg, to); err != nil && !d.isShutdown() {
+			d.log().Error("Failed to send LAN announcement", Field("to", to), Field("err", err))
+		}
+	}
+}
+
+// Periodically announces all advertised hostnames
+func (d *LANDiscovery) announceLoop() {
+	for {
+		time.Sleep(d.config.Interval)
+		if d.isShutdown() {
+			return
+		}
+		d.sendAnnouncements(d.announce)
+	}
+}
+
+// Receives announcements and queries from other nodes
+func (d *LANDiscovery) listen() {
+	buf := make([]byte, LAN_DISCOVERY_MAX_PACKET)
+	for {
+		n, from, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if d.isShutdown() {
+				return
+			}
+			d.log().Error("Error reading LAN discovery packet", Field("err", err))
+			continue
+		}
+
+		msg := lanMessage{}
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			d.log().Debug("Ignoring malformed LAN discovery packet", Field("from", from), Field("err", err))
+			continue
+		}
+
+		// Ignore our own multicast loopback
+		if msg.NodeId == d.nodeId {
+			continue
+		}
+
+		switch msg.Type {
+		case lanAnnounce:
+			d.handleAnnounce(&msg)
+		case lanQuery:
+			d.sendAnnouncements(from)
+		}
+	}
+}
+
+func (d *LANDiscovery) handleAnnounce(msg *lanMessage) {
+	if len(msg.Hostname) == 0 {
+		return
+	}
+
+	d.log().Debug("LAN peer advertising rings", Field("peer", msg.Hostname), Field("rings", msg.RingIds))
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.peers[msg.Hostname] = &lanPeer{hostname: msg.Hostname, ringIds: msg.RingIds, seen: time.Now()}
+}
+
+func (d *LANDiscovery) String() string {
+	return fmt.Sprintf("LANDiscovery(%s -> %s)", d.conn.LocalAddr(), d.announce)
+}
+
+type lanPeersByRecency []*lanPeer
+
+func (p lanPeersByRecency) Len() int           { return len(p) }
+func (p lanPeersByRecency) Less(i, j int) bool { return p[i].seen.After(p[j].seen) }
+func (p lanPeersByRecency) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
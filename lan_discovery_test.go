@@ -0,0 +1,132 @@
+package buddystore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates two discovery instances on loopback announcing to each other
+func createLoopbackDiscoveryPair(t *testing.T, port uint, interval time.Duration) (*LANDiscovery, *LANDiscovery) {
+	addr1 := fmt.Sprintf("127.0.0.1:%d", port)
+	addr2 := fmt.Sprintf("127.0.0.1:%d", port+1)
+
+	d1, err := NewLANDiscovery(&LANDiscoveryConfig{ListenAddr: addr1, AnnounceAddr: addr2, Interval: interval, Expiry: time.Second})
+	if err != nil {
+		t.Fatalf("Unable to start discovery: %s", err)
+	}
+
+	d2, err := NewLANDiscovery(&LANDiscoveryConfig{ListenAddr: addr2, AnnounceAddr: addr1, Interval: interval, Expiry: time.Second})
+	if err != nil {
+		t.Fatalf("Unable to start discovery: %s", err)
+	}
+
+	return d1, d2
+}
+
+func TestLANDiscoveryAnnounce(t *testing.T) {
+	d1, d2 := createLoopbackDiscoveryPair(t, PORT+2000, 20*time.Millisecond)
+	defer d1.Shutdown()
+	defer d2.Shutdown()
+
+	d1.Advertise("host1:1234", "", "ring1")
+
+	peers := d2.WaitForPeers("ring1", time.Second)
+	assert.Equal(t, []string{"host1:1234"}, peers)
+	assert.Equal(t, []string{"host1:1234"}, d2.Peers(""))
+	assert.Empty(t, d2.Peers("ring2"))
+
+	// We should never discover ourselves
+	assert.Empty(t, d1.Peers("ring1"))
+}
+
+func TestLANDiscoveryQuery(t *testing.T) {
+	// Periodic announcements are too slow to matter, only the query can
+	// trigger one
+	d1, d2 := createLoopbackDiscoveryPair(t, PORT+2002, time.Hour)
+	defer d1.Shutdown()
+	defer d2.Shutdown()
+
+	d1.Advertise("host1:1234", "ring1")
+
+	time.Sleep(50 * time.Millisecond)
+	d2.lock.Lock()
+	d2.peers = make(map[string]*lanPeer)
+	d2.lock.Unlock()
+
+	peers := d2.WaitForPeers("ring1", time.Second)
+	assert.Equal(t, []string{"host1:1234"}, peers)
+}
+
+func TestLANDiscoveryWithdrawAndExpiry(t *testing.T) {
+	d1, d2 := createLoopbackDiscoveryPair(t, PORT+2004, 20*time.Millisecond)
+	defer d1.Shutdown()
+	defer d2.Shutdown()
+
+	d2.config.Expiry = 100 * time.Millisecond
+	d1.Advertise("host1:1234", "ring1")
+	assert.NotEmpty(t, d2.WaitForPeers("ring1", time.Second))
+
+	d1.Withdraw("host1:1234")
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, d2.Peers("ring1"))
+}
+
+func TestLANDiscoveryRingsPerHost(t *testing.T) {
+	d1, d2 := createLoopbackDiscoveryPair(t, PORT+2008, time.Hour)
+	defer d1.Shutdown()
+	defer d2.Shutdown()
+
+	// Rings sharing a hostname are advertised and withdrawn one at a time
+	d1.Advertise("host1:1234", "ring1")
+	d1.Advertise("host1:1234", "ring2")
+	assert.NotEmpty(t, d2.WaitForPeers("ring1", time.Second))
+	assert.NotEmpty(t, d2.WaitForPeers("ring2", time.Second))
+
+	d1.Withdraw("host1:1234", "ring1")
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, d2.Peers("ring1"))
+	assert.Equal(t, []string{"host1:1234"}, d2.Peers("ring2"))
+
+	d1.Withdraw("host1:1234", "ring2")
+	d1.lock.RLock()
+	assert.Empty(t, d1.advertised)
+	d1.lock.RUnlock()
+}
+
+func TestJoinPrefersLANPeer(t *testing.T) {
+	d1, d2 := createLoopbackDiscoveryPair(t, PORT+2006, 20*time.Millisecond)
+	defer d1.Shutdown()
+	defer d2.Shutdown()
+
+	ml := NewMemoryNetwork()
+
+	// Create the initial ring and advertise it on the "LAN"
+	conf := fastConf()
+	conf.Discovery = d1
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	assert.NotEmpty(t, d2.WaitForPeers("", time.Second))
+
+	// Join through a dead host, the LAN peer should be used instead
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	conf2.Discovery = d2
+	r2, err := Join(conf2, ml, "noop")
+	if err != nil {
+		t.Fatalf("failed to join through LAN peer! Got %s", err)
+	}
+
+	r.Shutdown()
+	r2.Shutdown()
+
+	// Shutdown stops advertising the ring
+	d1.lock.RLock()
+	assert.Empty(t, d1.advertised)
+	d1.lock.RUnlock()
+}
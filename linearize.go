@@ -0,0 +1,359 @@
+package buddystore
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type OpKind int
+
+const (
+	OP_GET OpKind = iota
+	OP_SET
+)
+
+func (k OpKind) String() string {
+	if k == OP_SET {
+		return "set"
+	}
+	return "get"
+}
+
+/*
+Operation is one call of a client recorded in a History. Invoke and Complete
+are logical timestamps, taken from a counter shared by all the clients of the
+history, so an operation happened before another one in real time if it
+completed before the other one was invoked.
+*/
+type Operation struct {
+	Client   int
+	Kind     OpKind
+	Key      string
+	Value    []byte // Written by a set, or read by a get
+	Version  uint   // Version locked by GetForSet and written by SetVersion, 0 otherwise
+	Err      error
+	Invoke   int64
+	Complete int64
+}
+
+// A failed set may or may not have taken effect
+func (op *Operation) indeterminate() bool {
+	return op.Kind == OP_SET && op.Err != nil
+}
+
+func (op Operation) String() string {
+	var res string
+	if op.Kind == OP_SET {
+		res = fmt.Sprintf("client %d: set %s = %q", op.Client, op.Key, op.Value)
+	} else {
+		res = fmt.Sprintf("client %d: get %s -> %q", op.Client, op.Key, op.Value)
+	}
+	if op.Version > 0 {
+		res += fmt.Sprintf(" (version %d)", op.Version)
+	}
+	if op.Err != nil {
+		res += fmt.Sprintf(" failed: %s", op.Err)
+	}
+	return res + fmt.Sprintf(" [%d, %d]", op.Invoke, op.Complete)
+}
+
+/*
+History records the operations of concurrent KVStoreClients, to be checked
+with CheckHistory afterwards. Wrap every client of a test with Client.
+*/
+type History struct {
+	lock  sync.Mutex
+	clock int64
+	ops   []Operation
+}
+
+func NewHistory() *History {
+	return &History{}
+}
+
+// Returns a client recording the operations of kv as those of client id
+func (h *History) Client(id int, kv KVStoreClient) KVStoreClient {
+	return &recordingKVClient{history: h, id: id, kv: kv}
+}
+
+// Returns the operations recorded so far, ordered by invocation
+func (h *History) Operations() []Operation {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ops := make([]Operation, len(h.ops))
+	copy(ops, h.ops)
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Invoke < ops[j].Invoke
+	})
+	return ops
+}
+
+func (h *History) tick() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.clock++
+	return h.clock
+}
+
+func (h *History) record(op Operation) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.clock++
+	op.Complete = h.clock
+	h.ops = append(h.ops, op)
+}
+
+type recordingKVClient struct {
+	history *History
+	id      int
+	kv      KVStoreClient
+
+	// Implements:
+	KVStoreClient
+}
+
+func (rc *recordingKVClient) Get(key string, retry bool) ([]byte, error) {
+	invoke := rc.history.tick()
+	val, err := rc.kv.Get(key, retry)
+	rc.history.record(Operation{Client: rc.id, Kind: OP_GET, Key: key, Value: val, Err: err, Invoke: invoke})
+	return val, err
+}
+
+func (rc *recordingKVClient) Set(key string, val []byte) error {
+	invoke := rc.history.tick()
+	err := rc.kv.Set(key, val)
+	rc.history.record(Operation{Client: rc.id, Kind: OP_SET, Key: key, Value: val, Err: err, Invoke: invoke})
+	return err
+}
+
+func (rc *recordingKVClient) GetForSet(key string, retry bool) ([]byte, uint, error) {
+	invoke := rc.history.tick()
+	val, version, err := rc.kv.GetForSet(key, retry)
+	rc.history.record(Operation{Client: rc.id, Kind: OP_GET, Key: key, Value: val, Version: version, Err: err, Invoke: invoke})
+	return val, version, err
+}
+
+func (rc *recordingKVClient) SetVersion(key string, version uint, val []byte) error {
+	invoke := rc.history.tick()
+	err := rc.kv.SetVersion(key, version, val)
+	rc.history.record(Operation{Client: rc.id, Kind: OP_SET, Key: key, Value: val, Version: version, Err: err, Invoke: invoke})
+	return err
+}
+
+// The consistency a history is checked against
+type ConsistencyModel int
+
+const (
+	// Every operation takes effect at a single point between its invocation
+	// and completion
+	LINEARIZABLE ConsistencyModel = iota
+
+	// Operations take effect in an order that respects the order of every
+	// client's own operations, but not necessarily real time
+	SEQUENTIAL
+)
+
+func (m ConsistencyModel) String() string {
+	if m == SEQUENTIAL {
+		return "sequentially consistent"
+	}
+	return "linearizable"
+}
+
+// A sub-history of a single key violating a consistency model
+type Violation struct {
+	Model ConsistencyModel
+	Key   string
+	Ops   []Operation
+}
+
+func (v *Violation) Error() string {
+	lines := make([]string, 0, len(v.Ops)+1)
+	lines = append(lines, fmt.Sprintf("History of key %s is not %s:", v.Key, v.Model))
+	for _, op := range v.Ops {
+		lines = append(lines, "  "+op.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+/*
+Checks a history against a consistency model, treating every key as a
+register that starts out empty. Keys are checked one by one, which is exact
+for linearizability, and checks sequential consistency per key.
+
+Failed gets observed nothing and are ignored, while failed sets may have
+taken effect at any point after their invocation, or not at all. Versioned
+sets have to take effect in increasing version order, and GetForSet has to
+return a version above that of every versioned set before it. Returns nil if
+the history is consistent, or else a violating sub-history of one key that
+becomes consistent if any one of its operations is removed.
+
+The search is exponential in the number of concurrent operations, so
+histories should be kept to a few hundred operations per key.
+*/
+func CheckHistory(ops []Operation, model ConsistencyModel) *Violation {
+	byKey := make(map[string][]Operation)
+	var keys []string
+	for _, op := range ops {
+		if op.Kind == OP_GET && op.Err != nil {
+			continue
+		}
+		if _, ok := byKey[op.Key]; !ok {
+			keys = append(keys, op.Key)
+		}
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !checkRegister(byKey[key], model) {
+			return &Violation{Model: model, Key: key, Ops: minimizeViolation(byKey[key], model)}
+		}
+	}
+	return nil
+}
+
+// Removes operations for as long as the history stays inconsistent. Removing
+// an operation can make others removable, so passes are repeated until none
+// can be removed.
+func minimizeViolation(ops []Operation, model ConsistencyModel) []Operation {
+	ops = append([]Operation(nil), ops...)
+	for removed := true; removed; {
+		removed = false
+		for i := len(ops) - 1; i >= 0; i-- {
+			without := append(append([]Operation(nil), ops[:i]...), ops[i+1:]...)
+			if !checkRegister(without, model) {
+				ops = without
+				removed = true
+			}
+		}
+	}
+	return ops
+}
+
+// Depth-first search for an order of the operations of a single key
+type registerSearch struct {
+	ops   []Operation
+	model ConsistencyModel
+	done  []bool
+	seen  map[string]bool // States known not to lead to a valid order
+}
+
+func checkRegister(ops []Operation, model ConsistencyModel) bool {
+	sorted := append([]Operation(nil), ops...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Invoke < sorted[j].Invoke
+	})
+
+	required := 0
+	for i := range sorted {
+		if !sorted[i].indeterminate() {
+			required++
+		}
+	}
+
+	s := &registerSearch{
+		ops:   sorted,
+		model: model,
+		done:  make([]bool, len(sorted)),
+		seen:  make(map[string]bool),
+	}
+	return s.search(nil, 0, required)
+}
+
+// Searches on from the register holding value, last written by a set of
+// the given version, or by an unversioned set if 0
+func (s *registerSearch) search(value []byte, version uint, left int) bool {
+	if left == 0 {
+		return true
+	}
+
+	state := s.state(value, version)
+	if s.seen[state] {
+		return false
+	}
+
+	for _, i := range s.candidates() {
+		op := &s.ops[i]
+		if op.Version > 0 && op.Version <= version {
+			continue
+		}
+		next, nextVersion := value, version
+		if op.Kind == OP_SET {
+			next = op.Value
+			if op.Version > 0 {
+				nextVersion = op.Version
+			}
+		} else if !bytes.Equal(op.Value, value) {
+			continue
+		}
+
+		s.done[i] = true
+		remaining := left
+		if !op.indeterminate() {
+			remaining--
+		}
+		if s.search(next, nextVersion, remaining) {
+			return true
+		}
+		s.done[i] = false
+	}
+
+	s.seen[state] = true
+	return false
+}
+
+func (s *registerSearch) state(value []byte, version uint) string {
+	var buf bytes.Buffer
+	for _, d := range s.done {
+		if d {
+			buf.WriteByte('1')
+		} else {
+			buf.WriteByte('0')
+		}
+	}
+	fmt.Fprintf(&buf, ":%d:", version)
+	buf.Write(value)
+	return buf.String()
+}
+
+// Returns the operations that may take effect next
+func (s *registerSearch) candidates() []int {
+	var res []int
+	if s.model == SEQUENTIAL {
+		// The next operation of every client, and failed sets, which are
+		// not bound to the order of their client
+		next := make(map[int]bool)
+		for i := range s.ops {
+			op := &s.ops[i]
+			switch {
+			case s.done[i]:
+			case op.indeterminate():
+				res = append(res, i)
+			case !next[op.Client]:
+				next[op.Client] = true
+				res = append(res, i)
+			}
+		}
+		return res
+	}
+
+	// Operations invoked before the first pending operation completed.
+	// Failed sets never complete.
+	var firstComplete int64 = -1
+	for i := range s.ops {
+		op := &s.ops[i]
+		if !s.done[i] && !op.indeterminate() && (firstComplete < 0 || op.Complete < firstComplete) {
+			firstComplete = op.Complete
+		}
+	}
+	for i := range s.ops {
+		if !s.done[i] && (firstComplete < 0 || s.ops[i].Invoke < firstComplete) {
+			res = append(res, i)
+		}
+	}
+	return res
+}
@@ -0,0 +1,164 @@
+package buddystore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func set(client int, key, value string, invoke, complete int64) Operation {
+	return Operation{Client: client, Kind: OP_SET, Key: key, Value: []byte(value), Invoke: invoke, Complete: complete}
+}
+
+func get(client int, key, value string, invoke, complete int64) Operation {
+	op := Operation{Client: client, Kind: OP_GET, Key: key, Invoke: invoke, Complete: complete}
+	if len(value) > 0 {
+		op.Value = []byte(value)
+	}
+	return op
+}
+
+func TestCheckHistoryLinearizable(t *testing.T) {
+	ops := []Operation{
+		set(1, "k", "a", 1, 4),
+		// Concurrent with the set, may see either value
+		get(2, "k", "", 2, 3),
+		get(3, "k", "a", 3, 6),
+		set(2, "k", "b", 5, 8),
+		get(1, "k", "b", 7, 9),
+		// Other keys are independent
+		get(1, "other", "", 10, 11),
+	}
+	if v := CheckHistory(ops, LINEARIZABLE); v != nil {
+		t.Fatalf("unexpected violation %s", v)
+	}
+}
+
+func TestCheckHistoryStaleRead(t *testing.T) {
+	ops := []Operation{
+		set(1, "k", "a", 1, 2),
+		get(2, "other", "", 1, 5),
+		set(1, "k", "b", 3, 4),
+		get(3, "k", "a", 5, 6),
+		get(2, "k", "b", 7, 8),
+	}
+
+	v := CheckHistory(ops, LINEARIZABLE)
+	if v == nil {
+		t.Fatalf("expected the stale read to be found")
+	}
+	// Without the sets, reading a value never written is enough
+	expected := []Operation{ops[3]}
+	if v.Key != "k" || fmt.Sprint(v.Ops) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected violation %s", v)
+	}
+
+	// Without real time, the read may have happened before the second set
+	if v := CheckHistory(ops, SEQUENTIAL); v != nil {
+		t.Fatalf("unexpected violation %s", v)
+	}
+}
+
+func TestCheckHistorySequential(t *testing.T) {
+	// Client 2 sees b, then a again, although a was overwritten by b
+	ops := []Operation{
+		set(1, "k", "a", 1, 2),
+		set(1, "k", "b", 3, 4),
+		get(2, "k", "b", 5, 6),
+		get(2, "k", "a", 7, 8),
+	}
+	if v := CheckHistory(ops, SEQUENTIAL); v == nil {
+		t.Fatalf("expected a violation")
+	}
+}
+
+func TestCheckHistoryFailedOps(t *testing.T) {
+	failed := set(1, "k", "a", 1, 2)
+	failed.Err = errors.New("timeout")
+	lost := get(2, "k", "", 3, 4)
+	lost.Err = errors.New("timeout")
+
+	// The failed set may or may not have happened
+	ops := []Operation{failed, lost, get(2, "k", "", 5, 6), get(3, "k", "a", 7, 8)}
+	if v := CheckHistory(ops, LINEARIZABLE); v != nil {
+		t.Fatalf("unexpected violation %s", v)
+	}
+
+	// But it cannot be undone
+	ops = append(ops, get(3, "k", "", 9, 10))
+	if v := CheckHistory(ops, LINEARIZABLE); v == nil {
+		t.Fatalf("expected a violation")
+	}
+}
+
+func TestCheckHistoryVersions(t *testing.T) {
+	written := set(1, "k", "a", 1, 2)
+	written.Version = 2
+	cleared := set(2, "k", "", 3, 4)
+	stale := get(3, "k", "", 5, 6)
+	stale.Version = 2
+
+	// The values alone are consistent, but the lease was handed out again
+	// for a version already written
+	ops := []Operation{written, cleared, stale}
+	v := CheckHistory(ops, LINEARIZABLE)
+	if v == nil {
+		t.Fatalf("expected a violation")
+	}
+	if expected := []Operation{written, stale}; fmt.Sprint(v.Ops) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected violation %s", v)
+	}
+
+	stale.Version = 3
+	if v := CheckHistory([]Operation{written, cleared, stale}, LINEARIZABLE); v != nil {
+		t.Fatalf("unexpected violation %s", v)
+	}
+
+	// Versioned sets take effect in version order, so the older one cannot
+	// have overwritten the newer one
+	older := set(2, "k", "b", 5, 6)
+	older.Version = 1
+	if v := CheckHistory([]Operation{written, older, get(1, "k", "a", 7, 8)}, SEQUENTIAL); v != nil {
+		t.Fatalf("unexpected violation %s", v)
+	}
+	if v := CheckHistory([]Operation{written, older, get(1, "k", "b", 7, 8)}, SEQUENTIAL); v == nil {
+		t.Fatalf("expected a violation")
+	}
+}
+
+func TestHistoryCluster(t *testing.T) {
+	c, err := NewStableCluster(3, 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+
+	h := NewHistory()
+	var wg sync.WaitGroup
+	for i, node := range c.Running() {
+		wg.Add(1)
+		go func(id int, kv KVStoreClient) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				kv.Set("key", []byte(fmt.Sprintf("%d-%d", id, j)))
+				kv.Get("key", true)
+			}
+		}(i, h.Client(i, node.KV))
+	}
+	wg.Wait()
+
+	ops := h.Operations()
+	if len(ops) != 30 {
+		t.Fatalf("expected all operations to be recorded, got %d", len(ops))
+	}
+	for _, op := range ops {
+		if op.Invoke >= op.Complete {
+			t.Fatalf("operation completed before it was invoked: %s", op)
+		}
+	}
+	if v := CheckHistory(ops, LINEARIZABLE); v != nil {
+		t.Fatalf("%s", v)
+	}
+}
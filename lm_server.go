@@ -50,8 +50,8 @@ type LManager struct {
 	rLockMut   sync.Mutex             // Lock for synchronizing access to RLocks
 	verMapMut  sync.Mutex             // Lock for synchronizing VersionMap accesses
 
-	TimeoutTicker *time.Ticker // Ticker that will periodically check WLocks for invalidation
-	LMCheckTicker *time.Ticker // Ticker that will periodically checks if LM has changed
+	TimeoutTicker Timer // Next periodic check of the WLocks for invalidation
+	LMCheckTicker Timer // Next periodic check whether the LM has changed
 
 	currOpNum uint64         // Current Operation Number
 	OpsLog    []*OpsLogEntry //  Actual log used for write-ahead logging each operation
@@ -63,7 +63,7 @@ type LManager struct {
 
 	// For handling virtual ring joins
 	block             bool        // Set to true if the LM is not sure if it is the primary
-	cancelCheckStatus *time.Timer //  Used for cancelling the CheckStatus operation if we hear back from the original LockManager
+	cancelCheckStatus Timer       //  Used for cancelling the CheckStatus operation if we hear back from the original LockManager
 }
 
 /* Should be extensible to be used by any underlying storage implementation */
@@ -75,6 +75,11 @@ type LManagerIntf interface {
 	abortWLock(key string, version uint, opsLogInEntry *OpsLogEntry) (uint64, error)
 }
 
+// Logs on behalf of the vnode of the lock manager
+func (lm *LManager) log() *fieldLogger {
+	return lm.Ring.log().With(Field("vnode", lm.Vn))
+}
+
 func (lm *LManager) appendToLog(opsLogInEntry *OpsLogEntry) {
 	// Backup node - Log and return
 	lm.opsLogMut.Lock()
@@ -94,70 +99,80 @@ func (lm *LManager) appendToLog(opsLogInEntry *OpsLogEntry) {
 	lm.opsLogMut.Unlock()
 }
 
+// Interval between checks for expired WLocks
+const LM_TIMEOUT_CHECK_INTERVAL = 500 * time.Millisecond
+
+// Interval between checks whether this node became the LockManager
+const LM_CHECK_INTERVAL = 100 * time.Millisecond
+
+// Returns the clock driving the timers of the LockManager
+func (lm *LManager) clock() ClockIface {
+	if lm.Ring != nil {
+		return lm.Ring.clock()
+	}
+	return realClock
+}
+
+// Returns true once the ring of the LockManager is going away
+func (lm *LManager) stopped() bool {
+	return lm.Ring != nil && lm.Ring.isBeingShutdown()
+}
+
 /*
-Creates a new Ticker which checks the existing WLocks every 500 Milliseconds */
+Checks the existing WLocks for timeouts every LM_TIMEOUT_CHECK_INTERVAL, until
+the ring shuts down. Expects wLockMut to be held. */
 func (lm *LManager) scheduleTimeoutTicker() {
-	lm.TimeoutTicker = time.NewTicker(500 * time.Millisecond)
-	quit := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-lm.TimeoutTicker.C:
-				lm.wLockMut.Lock()
-				t := time.Now().UTC()
-				for k, v := range lm.WLocks {
-					if v.timeout.Before(t) || v.timeout.Equal(t) {
-						delete(lm.WLocks, k)
-					}
-				}
-				lm.wLockMut.Unlock()
-			case <-quit:
-				lm.TimeoutTicker.Stop()
-				return
+	lm.TimeoutTicker = lm.clock().AfterFunc(LM_TIMEOUT_CHECK_INTERVAL, func() {
+		if lm.stopped() {
+			return
+		}
+
+		lm.wLockMut.Lock()
+		t := lm.clock().Now().UTC()
+		for k, v := range lm.WLocks {
+			if v.timeout.Before(t) || v.timeout.Equal(t) {
+				delete(lm.WLocks, k)
+				metricLockTimeouts.Inc()
 			}
 		}
-	}()
+		lm.scheduleTimeoutTicker()
+		lm.wLockMut.Unlock()
+	})
 }
 
 /* Logic is moved to stabilize operation in vnode.go */
 func (lm *LManager) ScheduleLMCheckTicker() {
-	lm.LMCheckTicker = time.NewTicker(100 * time.Millisecond)
-	quit := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-lm.LMCheckTicker.C:
-				// Lookup for RingID
-				LMVnodes, err := lm.Ring.Lookup(1, []byte(lm.Ring.config.RingId))
-				if err != nil {
-					continue
-				}
-				if lm.Vn.String() == LMVnodes[0].String() {
-					if lm.CurrentLM {
-						// No-op
-					} else {
-						lm.CurrentLM = true
-						/* TODO : I am the new LockManager, two cases :
-						   1. The previous LockManager died
-						   2. I just joined and figured out that I am the LockManager.
-						*/
-
-					}
-				} else {
-					if lm.CurrentLM {
-						//  I was the LockManager (or I am the one with the best knowledge of the previous LM) , now someone else has joined, give him the full LockState and set his CurrentLM when he is ready.
-					} else {
-						lm.CurrentLM = false
-						// No-op
-					}
-				}
+	lm.LMCheckTicker = lm.clock().AfterFunc(LM_CHECK_INTERVAL, func() {
+		if lm.stopped() {
+			return
+		}
+		defer lm.ScheduleLMCheckTicker()
 
-			case <-quit:
-				lm.LMCheckTicker.Stop()
-				return
+		// Lookup for RingID
+		LMVnodes, err := lm.Ring.Lookup(1, []byte(lm.Ring.config.RingId))
+		if err != nil {
+			return
+		}
+		if lm.Vn.String() == LMVnodes[0].String() {
+			if lm.CurrentLM {
+				// No-op
+			} else {
+				lm.CurrentLM = true
+				/* TODO : I am the new LockManager, two cases :
+				   1. The previous LockManager died
+				   2. I just joined and figured out that I am the LockManager.
+				*/
+
+			}
+		} else {
+			if lm.CurrentLM {
+				//  I was the LockManager (or I am the one with the best knowledge of the previous LM) , now someone else has joined, give him the full LockState and set his CurrentLM when he is ready.
+			} else {
+				lm.CurrentLM = false
+				// No-op
 			}
 		}
-	}()
+	})
 }
 
 /* LockID generator : 20 bits from crypto rand */
@@ -243,6 +258,7 @@ func (lm *LManager) createRLock(key string, nodeID string, remoteAddr string, op
 	rLockEntry.CopySet[nodeID][1] = remoteAddr // Remote address added to invalidate it when a commit happens to this key
 	lm.rLockMut.Unlock()
 
+	metricLockGrants.Inc("read")
 	return lockID, version, lm.CommitPoint, nil
 }
 
@@ -279,11 +295,10 @@ func (lm *LManager) createWLock(key string, version uint, timeout uint, nodeID s
 	if lm.WLocks == nil {
 		lm.WLocks = make(map[string]*WLockEntry)
 	}
-	lm.wLockMut.Unlock()
-
 	if lm.TimeoutTicker == nil {
 		lm.scheduleTimeoutTicker()
 	}
+	lm.wLockMut.Unlock()
 
 	present, _, err := lm.checkWLock(key)
 	if err != nil {
@@ -292,6 +307,7 @@ func (lm *LManager) createWLock(key string, version uint, timeout uint, nodeID s
 	lm.wLockMut.Lock()
 	defer lm.wLockMut.Unlock()
 	if present {
+		metricLockConflicts.Inc()
 		return "", lm.WLocks[key].version, 0, lm.CommitPoint, fmt.Errorf("WriteLock not possible. Key is currently being updated")
 	}
 
@@ -310,7 +326,7 @@ func (lm *LManager) createWLock(key string, version uint, timeout uint, nodeID s
 	if err != nil {
 		return "", 0, 0, lm.CommitPoint, err
 	}
-	t := time.Now().UTC()
+	t := lm.clock().Now().UTC()
 	t = t.Add(time.Duration(timeout) * time.Second)
 	lm.opsLogMut.Lock()
 	defer lm.opsLogMut.Unlock()
@@ -338,6 +354,7 @@ func (lm *LManager) createWLock(key string, version uint, timeout uint, nodeID s
 	}
 
 	lm.WLocks[key] = &WLockEntry{nodeID: nodeID, LockID: lockID, version: version, timeout: &t}
+	metricLockGrants.Inc("write")
 	return lockID, version, timeout, lm.CommitPoint, nil
 }
 
@@ -536,11 +553,11 @@ func (lm *LManager) SyncWithSuccessor() bool {
 func (lm *LManager) CheckStatus() {
 	LMVnodes, err := lm.Ring.Lookup(1, []byte(lm.Ring.config.RingId))
 	if err != nil {
-		fmt.Println("Lookup for LockManager failed with error ", err)
+		lm.log().Error("Lookup for LockManager failed", Field("err", err))
 	}
 
 	if lm.Vn.String() == LMVnodes[0].String() {
-		fmt.Println("******* BLocking NodeID gets the LockManager status **********")
+		lm.log().Info("Blocking vnode gets the LockManager status")
 		lm.CurrentLM = true
 	}
 	lm.block = false
@@ -548,7 +565,7 @@ func (lm *LManager) CheckStatus() {
 
 /* Called by the old LM on the new LM to update it with the Locks */
 func (lm *LManager) UpdateVersionMap(versionMap *map[string]uint) {
-	fmt.Println("LM requested to update VersionMap with ", versionMap)
+	lm.log().Info("LM requested to update VersionMap", Field("versions", len(*versionMap)))
 	lm.verMapMut.Lock()
 	defer lm.verMapMut.Unlock()
 	for k, v := range *versionMap {
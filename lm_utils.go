@@ -1,15 +1,9 @@
 package buddystore
 
-import (
-	"fmt"
-)
-
-func printLogs(opsLog []*OpsLogEntry) {
-	fmt.Println("*** LOCK OPERATIONS LOGS ***")
+func printLogs(logger *fieldLogger, opsLog []*OpsLogEntry) {
 	for i := range opsLog {
-		fmt.Println(opsLog[i].OpNum, " | ", opsLog[i].Op, " | ", opsLog[i].Key, " - ", opsLog[i].Version, " | ", opsLog[i].Timeout)
+		logger.Debug("Lock operation", Field("op_num", opsLog[i].OpNum), Field("op", opsLog[i].Op), Field("key", opsLog[i].Key), Field("version", opsLog[i].Version), Field("timeout", opsLog[i].Timeout))
 	}
-	fmt.Println()
 }
 
 // Clears off any stale state before replaying the logs
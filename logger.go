@@ -0,0 +1,210 @@
+package buddystore
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+type LogLevel int
+
+const (
+	LOG_DEBUG LogLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LOG_DEBUG:
+		return "DEBUG"
+	case LOG_INFO:
+		return "INFO"
+	case LOG_WARN:
+		return "WARN"
+	case LOG_ERROR:
+		return "ERR"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// A named value attached to a log entry, such as the vnode, ring or key concerned
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+func Field(key string, value interface{}) LogField {
+	return LogField{Key: key, Value: value}
+}
+
+/*
+Logger receives the log entries of rings, stores, lock managers, trackers and
+transports. Set it in Config or BuddyStoreConfig to silence the package or to
+send its log elsewhere. Enabled lets callers skip building entries that would
+be dropped anyway.
+*/
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...LogField)
+	Enabled(level LogLevel) bool
+}
+
+// The logger used where none is configured
+var DefaultLogger Logger = GlogLogger{}
+
+// Drops every entry
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(level LogLevel, msg string, fields ...LogField) {}
+
+func (nopLogger) Enabled(level LogLevel) bool {
+	return false
+}
+
+/*
+GlogLogger logs through glog, like the package always did. Debug entries are
+only logged at verbosity 2 and above, and warnings go to the warning log.
+Entries are attributed to the line that logged them, not to this adapter.
+*/
+type GlogLogger struct{}
+
+func (gl GlogLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if !gl.Enabled(level) {
+		return
+	}
+
+	line := formatLogEntry(msg, fields)
+	depth := callerDepth()
+	switch level {
+	case LOG_DEBUG, LOG_INFO:
+		glog.InfoDepth(depth, line)
+	case LOG_WARN:
+		glog.WarningDepth(depth, line)
+	default:
+		glog.ErrorDepth(depth, line)
+	}
+}
+
+func (GlogLogger) Enabled(level LogLevel) bool {
+	return level > LOG_DEBUG || bool(glog.V(2))
+}
+
+// Returns the depth of the first caller of Log outside this file
+func callerDepth() int {
+	// Skip callerDepth and Log
+	depth := 1
+	for {
+		_, file, _, ok := runtime.Caller(depth + 1)
+		if !ok || filepath.Base(file) != "logger.go" {
+			return depth
+		}
+		depth++
+	}
+}
+
+/*
+StdLogger logs entries at or above a level through a standard library
+logger, prefixed by their level as in "[ERR] Failed to contact ...".
+*/
+type StdLogger struct {
+	Logger *log.Logger // Defaults to the standard logger
+	Level  LogLevel
+}
+
+func NewStdLogger(logger *log.Logger, level LogLevel) *StdLogger {
+	return &StdLogger{Logger: logger, Level: level}
+}
+
+func (sl *StdLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if !sl.Enabled(level) {
+		return
+	}
+	line := fmt.Sprintf("[%s] %s", level, formatLogEntry(msg, fields))
+	if sl.Logger == nil {
+		log.Print(line)
+	} else {
+		sl.Logger.Print(line)
+	}
+}
+
+func (sl *StdLogger) Enabled(level LogLevel) bool {
+	return level >= sl.Level
+}
+
+// Formats an entry as its message followed by key=value pairs
+func formatLogEntry(msg string, fields []LogField) string {
+	var buf bytes.Buffer
+	buf.WriteString(msg)
+	for _, f := range fields {
+		value := fmt.Sprint(f.Value)
+		if len(value) == 0 || strings.ContainsAny(value, " =\"\t\n") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&buf, " %s=%s", f.Key, value)
+	}
+	return buf.String()
+}
+
+/*
+Attaches fields to every entry logged through a Logger. A nil Logger stands
+for DefaultLogger, looked up on every entry so that replacing it takes effect
+right away.
+*/
+type fieldLogger struct {
+	logger Logger
+	fields []LogField
+}
+
+func newFieldLogger(logger Logger, fields ...LogField) *fieldLogger {
+	return &fieldLogger{logger: logger, fields: fields}
+}
+
+// Returns a logger adding more fields
+func (fl *fieldLogger) With(fields ...LogField) *fieldLogger {
+	all := make([]LogField, 0, len(fl.fields)+len(fields))
+	return &fieldLogger{logger: fl.logger, fields: append(append(all, fl.fields...), fields...)}
+}
+
+func (fl *fieldLogger) target() Logger {
+	if fl.logger == nil {
+		return DefaultLogger
+	}
+	return fl.logger
+}
+
+// Implements Logger, so it can be passed on
+func (fl *fieldLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if len(fl.fields) > 0 {
+		all := make([]LogField, 0, len(fl.fields)+len(fields))
+		fields = append(append(all, fl.fields...), fields...)
+	}
+	fl.target().Log(level, msg, fields...)
+}
+
+func (fl *fieldLogger) Enabled(level LogLevel) bool {
+	return fl.target().Enabled(level)
+}
+
+func (fl *fieldLogger) Debug(msg string, fields ...LogField) {
+	fl.Log(LOG_DEBUG, msg, fields...)
+}
+
+func (fl *fieldLogger) Info(msg string, fields ...LogField) {
+	fl.Log(LOG_INFO, msg, fields...)
+}
+
+func (fl *fieldLogger) Warn(msg string, fields ...LogField) {
+	fl.Log(LOG_WARN, msg, fields...)
+}
+
+func (fl *fieldLogger) Error(msg string, fields ...LogField) {
+	fl.Log(LOG_ERROR, msg, fields...)
+}
@@ -0,0 +1,120 @@
+package buddystore
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordedEntry struct {
+	level  LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+type recordingLogger struct {
+	lock    sync.Mutex
+	entries []recordedEntry
+}
+
+func (rl *recordingLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	entry := recordedEntry{level: level, msg: msg, fields: make(map[string]interface{})}
+	for _, f := range fields {
+		entry.fields[f.Key] = f.Value
+	}
+	rl.lock.Lock()
+	rl.entries = append(rl.entries, entry)
+	rl.lock.Unlock()
+}
+
+func (rl *recordingLogger) Enabled(level LogLevel) bool {
+	return true
+}
+
+func (rl *recordingLogger) Entries() []recordedEntry {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return append([]recordedEntry(nil), rl.entries...)
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), LOG_INFO)
+
+	l.Log(LOG_DEBUG, "Dropped")
+	l.Log(LOG_ERROR, "Failed to contact vnode", Field("peer", "abc"), Field("err", "connection refused"), Field("ring", ""))
+	expected := "[ERR] Failed to contact vnode peer=abc err=\"connection refused\" ring=\"\"\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+}
+
+func TestFieldLogger(t *testing.T) {
+	rec := &recordingLogger{}
+	fl := newFieldLogger(rec, Field("ring", "r")).With(Field("vnode", "v"))
+	fl.Info("Hello", Field("key", "k"))
+
+	entries := rec.Entries()
+	if len(entries) != 1 || entries[0].level != LOG_INFO || entries[0].msg != "Hello" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	for key, value := range map[string]string{"ring": "r", "vnode": "v", "key": "k"} {
+		if entries[0].fields[key] != value {
+			t.Fatalf("expected field %s=%s in %v", key, value, entries[0].fields)
+		}
+	}
+
+	// Without a logger, entries go to whatever DefaultLogger is at the time
+	old := DefaultLogger
+	defer func() {
+		DefaultLogger = old
+	}()
+	DefaultLogger = rec
+	newFieldLogger(nil).Error("Default")
+	if entries := rec.Entries(); len(entries) != 2 || entries[1].msg != "Default" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	DefaultLogger = NopLogger
+	newFieldLogger(nil).Error("Silenced")
+	if entries := rec.Entries(); len(entries) != 2 {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+}
+
+func TestRingLogger(t *testing.T) {
+	rec := &recordingLogger{}
+	c, err := NewClusterWithConfig(2, func(conf *Config) {
+		conf.Logger = rec
+	})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+	if err := c.WaitForStabilization(5 * time.Second); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// The surviving vnodes fail to contact the killed ones
+	c.Kill("host-1")
+	if err := c.WaitForStabilization(5 * time.Second); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	local := make(map[string]bool)
+	for _, vn := range c.Node("host-0").Ring.vnodes {
+		local[vn.String()] = true
+	}
+	for _, entry := range rec.Entries() {
+		vn, ok := entry.fields["vnode"].(*Vnode)
+		if entry.level == LOG_ERROR && ok && local[vn.String()] {
+			if _, ok := entry.fields["ring"]; !ok {
+				t.Fatalf("expected the ring of %v", entry)
+			}
+			return
+		}
+	}
+	t.Fatalf("expected errors of the vnodes of host-0, got %v", rec.Entries())
+}
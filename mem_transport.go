@@ -0,0 +1,106 @@
+package buddystore
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+/*
+MemoryNetwork connects rings running in the same process without sockets.
+Calls are delivered to the target vnode with direct method calls, as if it
+was local, and vnodes are grouped into hosts by their Host. Hosts can be
+disconnected to simulate crashes, after which calls to their vnodes fail.
+
+The network is itself a Transport, which can be shared by the rings of all
+hosts. Transport returns one that only considers the vnodes of a single host
+local, like a TCPTransport would.
+*/
+type MemoryNetwork struct {
+	lock   sync.RWMutex
+	hosts  map[string][]*Vnode
+	vnodes *LocalTransport
+
+	// Implements:
+	Transport
+}
+
+var _ Transport = new(MemoryNetwork)
+
+// Creates an empty in-memory network
+func NewMemoryNetwork() *MemoryNetwork {
+	vnodes := InitLocalTransport(nil).(*LocalTransport)
+	return &MemoryNetwork{
+		hosts:     make(map[string][]*Vnode),
+		vnodes:    vnodes,
+		Transport: vnodes,
+	}
+}
+
+// Returns the transport of a host, to pass to Create or Join
+func (mn *MemoryNetwork) TransportFor(host string) Transport {
+	return &memoryTransport{host: host, MemoryNetwork: mn}
+}
+
+// Returns the connected hosts, in order
+func (mn *MemoryNetwork) Hosts() []string {
+	mn.lock.RLock()
+	defer mn.lock.RUnlock()
+	hosts := make([]string, 0, len(mn.hosts))
+	for host := range mn.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Removes the vnodes of a host from the network
+func (mn *MemoryNetwork) Disconnect(host string) {
+	mn.lock.Lock()
+	defer mn.lock.Unlock()
+	for _, vn := range mn.hosts[host] {
+		mn.vnodes.Deregister(vn)
+	}
+	delete(mn.hosts, host)
+}
+
+// Lists the vnodes of a host, ordered by ID so that joins are reproducible
+func (mn *MemoryNetwork) ListVnodes(host string) ([]*Vnode, error) {
+	mn.lock.RLock()
+	defer mn.lock.RUnlock()
+	vnodes, ok := mn.hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("Failed to connect! No such host: %s.", host)
+	}
+
+	res := make([]*Vnode, len(vnodes))
+	copy(res, vnodes)
+	sort.Slice(res, func(i, j int) bool {
+		return bytes.Compare(res[i].Id, res[j].Id) < 0
+	})
+	return res, nil
+}
+
+func (mn *MemoryNetwork) Register(v *Vnode, o VnodeRPC) {
+	mn.lock.Lock()
+	defer mn.lock.Unlock()
+	mn.hosts[v.Host] = append(mn.hosts[v.Host], v)
+	mn.vnodes.Register(v, o)
+}
+
+func (mn *MemoryNetwork) IsLocalVnode(vn *Vnode) bool {
+	return mn.vnodes.IsLocalVnode(vn)
+}
+
+// The network as seen by a single host
+type memoryTransport struct {
+	host string
+
+	// Implements:
+	*MemoryNetwork
+}
+
+func (mt *memoryTransport) IsLocalVnode(vn *Vnode) bool {
+	return vn.Host == mt.host && mt.MemoryNetwork.IsLocalVnode(vn)
+}
@@ -0,0 +1,380 @@
+package buddystore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Upper bounds of the latency histogram buckets, in seconds
+var DEFAULT_LATENCY_BUCKETS = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+/*
+MetricsRegistry holds counters, gauges and histograms, and writes them out in
+the Prometheus text format. Every metric is a family of series told apart by
+the values of its labels. Collectors are run before every scrape, to update
+gauges computed from the state of the node.
+*/
+type MetricsRegistry struct {
+	lock       sync.Mutex
+	families   []*metricFamily
+	collectors []func()
+}
+
+// The registry the ring, store and lock manager report to
+var DefaultMetrics = NewMetricsRegistry()
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{}
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // Counters and gauges
+	counts      []uint64 // Histogram observations per bucket, not cumulative
+	sum         float64
+	count       uint64
+}
+
+func (r *MetricsRegistry) register(name, help, kind string, buckets []float64, labels []string) *metricFamily {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, f := range r.families {
+		if f.name == name {
+			panic(fmt.Sprintf("Metric %s registered twice", name))
+		}
+	}
+	f := &metricFamily{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+	r.families = append(r.families, f)
+	return f
+}
+
+// Returns the series with the given label values, creating it if needed
+func (f *metricFamily) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("Metric %s expects labels %v, got %v", f.name, f.labels, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// A value that only goes up, like a number of calls
+type Counter struct {
+	family *metricFamily
+}
+
+func (r *MetricsRegistry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", nil, labels)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.family.lock.Lock()
+	defer c.family.lock.Unlock()
+	c.family.get(labelValues).value += v
+}
+
+// A value that goes up and down, like a number of keys
+type Gauge struct {
+	family *metricFamily
+}
+
+func (r *MetricsRegistry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", nil, labels)}
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.family.lock.Lock()
+	defer g.family.lock.Unlock()
+	g.family.get(labelValues).value = v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.family.lock.Lock()
+	defer g.family.lock.Unlock()
+	g.family.get(labelValues).value += v
+}
+
+// Removes all series, so that collectors can drop those of stopped vnodes
+func (g *Gauge) Reset() {
+	g.family.lock.Lock()
+	defer g.family.lock.Unlock()
+	g.family.series = make(map[string]*metricSeries)
+}
+
+// Counts observations, like durations, in buckets
+type Histogram struct {
+	family *metricFamily
+}
+
+// Creates a histogram with the given upper bounds of its buckets, in
+// increasing order
+func (r *MetricsRegistry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.register(name, help, "histogram", buckets, labels)}
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.family.lock.Lock()
+	defer h.family.lock.Unlock()
+	s := h.family.get(labelValues)
+	for i, bound := range h.family.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Adds a function run before every scrape
+func (r *MetricsRegistry) AddCollector(collect func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.collectors = append(r.collectors, collect)
+}
+
+// Writes all metrics in the Prometheus text format
+func (r *MetricsRegistry) WriteText(w io.Writer) error {
+	r.lock.Lock()
+	families := append([]*metricFamily(nil), r.families...)
+	collectors := append([]func(){}, r.collectors...)
+	r.lock.Unlock()
+
+	for _, collect := range collectors {
+		collect()
+	}
+
+	out := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(out)
+	}
+	return out.Flush()
+}
+
+func (f *metricFamily) write(out *bufio.Writer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	fmt.Fprintf(out, "# HELP %s %s\n", f.name, strings.Replace(f.help, "\n", " ", -1))
+	fmt.Fprintf(out, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := f.series[k]
+		if f.kind != "histogram" {
+			fmt.Fprintf(out, "%s%s %s\n", f.name, f.labelString(s.labelValues, ""), formatMetricValue(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(out, "%s_bucket%s %d\n", f.name, f.labelString(s.labelValues, formatMetricValue(bound)), cumulative)
+		}
+		fmt.Fprintf(out, "%s_bucket%s %d\n", f.name, f.labelString(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(out, "%s_sum%s %s\n", f.name, f.labelString(s.labelValues, ""), formatMetricValue(s.sum))
+		fmt.Fprintf(out, "%s_count%s %d\n", f.name, f.labelString(s.labelValues, ""), s.count)
+	}
+}
+
+// Formats the labels of a series, with the bucket bound le if not empty
+func (f *metricFamily) labelString(values []string, le string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", f.labels[i], strconv.Quote(v)))
+	}
+	if len(le) > 0 {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(w)
+}
+
+/*
+Serves the default metrics under /metrics on the given address, in the
+background. Close the returned listener to stop serving.
+*/
+func ServeMetrics(listen string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", DefaultMetrics)
+	go http.Serve(listener, mux)
+	return listener, nil
+}
+
+// Metrics reported by the ring, store and lock manager
+var (
+	metricRPCs        = DefaultMetrics.NewCounter("buddystore_rpc_total", "RPCs sent over TCP, by request type.", "type")
+	metricRPCErrors   = DefaultMetrics.NewCounter("buddystore_rpc_errors_total", "RPCs sent over TCP that failed, by request type.", "type")
+	metricRPCDuration = DefaultMetrics.NewHistogram("buddystore_rpc_duration_seconds", "Latency of RPCs sent over TCP, by request type.", DEFAULT_LATENCY_BUCKETS, "type")
+
+	metricStabilizeDuration = DefaultMetrics.NewHistogram("buddystore_stabilize_duration_seconds", "Duration of vnode stabilization runs.", DEFAULT_LATENCY_BUCKETS)
+	metricSuccessors        = DefaultMetrics.NewGauge("buddystore_successors", "Known successors of a vnode.", "host", "ring", "vnode")
+	metricFingers           = DefaultMetrics.NewGauge("buddystore_finger_entries", "Filled finger table entries of a vnode.", "host", "ring", "vnode")
+	metricPredecessor       = DefaultMetrics.NewGauge("buddystore_predecessor_known", "Whether a vnode knows its predecessor.", "host", "ring", "vnode")
+
+	metricKeys        = DefaultMetrics.NewGauge("buddystore_kv_keys", "Keys stored by a vnode.", "host", "ring", "vnode")
+	metricVersions    = DefaultMetrics.NewGauge("buddystore_kv_versions", "Versions of keys stored by a vnode.", "host", "ring", "vnode")
+	metricBytes       = DefaultMetrics.NewGauge("buddystore_kv_bytes", "Bytes of values stored by a vnode.", "host", "ring", "vnode")
+	metricReplBacklog = DefaultMetrics.NewGauge("buddystore_replication_backlog", "Keys waiting to be replicated to other vnodes.")
+
+	metricLockGrants    = DefaultMetrics.NewCounter("buddystore_lock_grants_total", "Locks granted by the lock manager, by mode.", "mode")
+	metricLockConflicts = DefaultMetrics.NewCounter("buddystore_lock_conflicts_total", "Write locks refused because the key was locked already.")
+	metricLockTimeouts  = DefaultMetrics.NewCounter("buddystore_lock_timeouts_total", "Write locks released because they timed out.")
+)
+
+// Rings whose vnodes are reported on
+var metricRings = struct {
+	sync.Mutex
+	rings map[*Ring]struct{}
+}{rings: make(map[*Ring]struct{})}
+
+func init() {
+	DefaultMetrics.AddCollector(collectRingMetrics)
+}
+
+// Starts reporting on the vnodes of a ring
+func registerRingMetrics(r *Ring) {
+	metricRings.Lock()
+	defer metricRings.Unlock()
+	metricRings.rings[r] = struct{}{}
+}
+
+// Stops reporting on the vnodes of a ring
+func deregisterRingMetrics(r *Ring) {
+	metricRings.Lock()
+	defer metricRings.Unlock()
+	delete(metricRings.rings, r)
+}
+
+// Updates the gauges describing the vnodes of the registered rings
+func collectRingMetrics() {
+	metricRings.Lock()
+	defer metricRings.Unlock()
+
+	for _, g := range []*Gauge{metricSuccessors, metricFingers, metricPredecessor, metricKeys, metricVersions, metricBytes} {
+		g.Reset()
+	}
+
+	for r := range metricRings.rings {
+		for _, vn := range r.vnodes {
+			host, ring, id := r.config.Hostname, r.config.RingId, vn.String()
+			metricSuccessors.Set(float64(countVnodes(vn.CopyOfSuccessors())), host, ring, id)
+
+			vn.fingerLock.RLock()
+			metricFingers.Set(float64(countVnodes(vn.finger)), host, ring, id)
+			vn.fingerLock.RUnlock()
+
+			if vn.Predecessor() != nil {
+				metricPredecessor.Set(1, host, ring, id)
+			} else {
+				metricPredecessor.Set(0, host, ring, id)
+			}
+
+			keys, versions, bytes := vn.store.stats()
+			metricKeys.Set(float64(keys), host, ring, id)
+			metricVersions.Set(float64(versions), host, ring, id)
+			metricBytes.Set(float64(bytes), host, ring, id)
+		}
+	}
+}
+
+// Counts the non-nil vnodes of a list
+func countVnodes(vnodes []*Vnode) int {
+	n := 0
+	for _, vn := range vnodes {
+		if vn != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Names of the TCP request types, used as metric labels
+var tcpReqNames = []string{
+	"Ping",
+	"ListVnodes",
+	"GetPredecessor",
+	"GetPredecessorList",
+	"Notify",
+	"FindSuccessors",
+	"ClearPredecessor",
+	"SkipSuccessor",
+	"Get",
+	"Set",
+	"List",
+	"BulkSet",
+	"SyncKeys",
+	"MissingKeys",
+	"PurgeVersions",
+	"RLock",
+	"WLock",
+	"CommitWLock",
+	"AbortWLock",
+	"InvalidateRLock",
+	"VersionMapUpdate",
+	"JoinRing",
+	"DialBack",
+	"Relay",
+	"RelayAttach",
+}
+
+func tcpReqName(reqType int) string {
+	if reqType >= 0 && reqType < len(tcpReqNames) {
+		return tcpReqNames[reqType]
+	}
+	return strconv.Itoa(reqType)
+}
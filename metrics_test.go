@@ -0,0 +1,166 @@
+package buddystore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsRegistryText(t *testing.T) {
+	r := NewMetricsRegistry()
+	c := r.NewCounter("calls_total", "Calls.", "op")
+	g := r.NewGauge("size", "Size.")
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+
+	c.Inc("get")
+	c.Add(2, "get")
+	c.Inc(`se"t`)
+	r.AddCollector(func() {
+		g.Set(7)
+	})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	expected := `# HELP calls_total Calls.
+# TYPE calls_total counter
+calls_total{op="get"} 3
+calls_total{op="se\"t"} 1
+# HELP size Size.
+# TYPE size gauge
+size 7
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestMetricsRegistryPanics(t *testing.T) {
+	r := NewMetricsRegistry()
+	c := r.NewCounter("calls_total", "Calls.", "op")
+
+	for _, f := range []func(){
+		func() { r.NewGauge("calls_total", "Again.") },
+		func() { c.Inc() },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected a panic")
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func scrapeDefaultMetrics(t *testing.T) string {
+	var buf bytes.Buffer
+	if err := DefaultMetrics.WriteText(&buf); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	return buf.String()
+}
+
+func TestRingMetrics(t *testing.T) {
+	c, err := NewClusterWithConfig(2, func(conf *Config) {
+		conf.Hostname = "metrics-" + conf.Hostname
+	})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+	if err := c.WaitForStabilization(5 * time.Second); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	node := c.Node("host-0")
+	if err := node.KV.Set("key", []byte("value")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	text := scrapeDefaultMetrics(t)
+	vn := node.Ring.vnodes[0]
+	for _, line := range []string{
+		fmt.Sprintf(`buddystore_successors{host="metrics-host-0",ring="%s",vnode="%s"} 8`, node.Ring.config.RingId, vn),
+		fmt.Sprintf(`buddystore_predecessor_known{host="metrics-host-0",ring="%s",vnode="%s"} 1`, node.Ring.config.RingId, vn),
+		"# TYPE buddystore_stabilize_duration_seconds histogram",
+		`buddystore_lock_grants_total{mode="write"}`,
+	} {
+		if !strings.Contains(text, line) {
+			t.Fatalf("expected %q in\n%s", line, text)
+		}
+	}
+	if !strings.Contains(text, `buddystore_kv_keys{host="metrics-host-`) || strings.Contains(text, "\nbuddystore_stabilize_duration_seconds_count 0\n") {
+		t.Fatalf("unexpected metrics\n%s", text)
+	}
+
+	// Stopped vnodes are not reported anymore
+	c.Kill("host-0")
+	if text := scrapeDefaultMetrics(t); strings.Contains(text, vn.String()) {
+		t.Fatalf("expected the killed vnode to be gone from\n%s", text)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	listener, err := ServeMetrics(fmt.Sprintf("localhost:%d", PORT+2098))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer listener.Close()
+
+	c1, t1, err := prepRing(int(PORT + 2096))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	c2, t2, err := prepRing(int(PORT + 2097))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	r1, err := Create(c1, t1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r1.Shutdown()
+	r2, err := Join(c2, t2, c1.Hostname)
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+	defer r2.Shutdown()
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/metrics", PORT+2098))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for _, line := range []string{
+		`buddystore_rpc_total{type="ListVnodes"}`,
+		`buddystore_rpc_duration_seconds_count{type="FindSuccessors"}`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Fatalf("expected %q in\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+package buddystore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/huin/goupnp/dcps/internetgateway1"
+)
+
+// Port NAT-PMP and PCP gateways listen on
+const NAT_PMP_PORT = 5351
+
+// Requested lifetime of NAT-PMP and PCP port mappings
+const NAT_MAPPING_LIFETIME = 2 * time.Hour
+
+// Time to wait for a gateway to answer before giving up on it
+const NAT_GATEWAY_TIMEOUT = 2 * time.Second
+
+const (
+	natPMPVersion = 0
+	pcpVersion    = 2
+)
+
+const (
+	natPMPOpExternalAddr = 0
+	natPMPOpMapTCP       = 2
+	natPMPOpResponse     = 128
+	pcpOpMap             = 1
+	pcpOpResponse        = 128
+)
+
+const (
+	natPMPResultSuccess       = 0
+	pcpResultSuccess          = 0
+	natPMPExternalAddrRespLen = 12
+	natPMPMapRespLen          = 16
+	pcpMapReqLen              = 60
+	pcpMapRespLen             = 60
+	pcpProtocolTCP            = 6
+	natPMPRetransmits         = 3
+)
+
+/*
+Configuration for NAT traversal of TCP transports. Port mappings are requested
+from the gateway using UPnP, PCP and NAT-PMP, in that order.
+
+When SelfTest is set, a node asks the peer it joins a ring through to connect
+back to its advertised address. If that fails and Relay is set, the peer is
+asked to relay inbound connections for the node instead, and the relayed
+address is advertised.
+*/
+type NATConfig struct {
+	Gateway     string        // NAT-PMP/PCP gateway address. Detected from the default route if empty
+	DisableUPnP bool          // Do not try UPnP
+	DisablePMP  bool          // Try neither PCP nor NAT-PMP
+	Lifetime    time.Duration // Requested lifetime of PCP/NAT-PMP mappings, renewed at half-life
+	Timeout     time.Duration // Time to wait for the gateway to answer
+	SelfTest    bool          // Check that peers can connect to us before joining
+	Relay       bool          // Relay through the joined peer if we are not reachable
+}
+
+// Returns the default NAT configuration, which tries all port mapping
+// protocols but neither tests reachability nor relays
+func DefaultNATConfig() *NATConfig {
+	return &NATConfig{
+		Lifetime: NAT_MAPPING_LIFETIME,
+		Timeout:  NAT_GATEWAY_TIMEOUT,
+	}
+}
+
+// Creates port mappings on a gateway. Mapping with a zero lifetime removes
+// the mapping.
+type portMapper interface {
+	// Maps the internal TCP port to the external port, if possible. Returns
+	// the external address and port that were assigned, and the lifetime
+	// granted by the gateway.
+	mapPort(internalPort, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error)
+
+	String() string
+}
+
+/*
+PortMapping is a TCP port mapping on the NAT gateway. Mappings with a limited
+lifetime are renewed in the background until Close is called.
+*/
+type PortMapping struct {
+	InternalPort int
+	ExternalIP   net.IP
+	ExternalPort int
+
+	mapper   portMapper
+	lifetime time.Duration
+	timer    *time.Timer
+	closed   bool
+	lock     sync.Mutex
+	logger   Logger
+}
+
+/*
+Creates a mapping for the given internal port on the NAT gateway, trying each
+protocol enabled in the configuration, which may be nil. The same external
+port is requested, but the gateway may assign a different one.
+*/
+func NewPortMapping(conf *NATConfig, localAddr string, port int) (*PortMapping, error) {
+	return newPortMapping(conf, localAddr, port, nil)
+}
+
+func newPortMapping(conf *NATConfig, localAddr string, port int, logger Logger) (*PortMapping, error) {
+	if conf == nil {
+		conf = DefaultNATConfig()
+	}
+
+	var err error
+	for _, mapper := range natMappers(conf, localAddr) {
+		ip, extPort, lifetime, merr := mapper.mapPort(port, port, conf.lifetime())
+		if merr != nil {
+			newFieldLogger(logger).Info("Unable to map port", Field("port", port), Field("protocol", mapper), Field("err", merr))
+			err = mergeErrors(err, fmt.Errorf("%s: %s", mapper, merr))
+			continue
+		}
+
+		m := &PortMapping{InternalPort: port, ExternalIP: ip, ExternalPort: extPort, mapper: mapper, lifetime: conf.lifetime(), logger: logger}
+		m.log().Info("Mapped port", Field("port", port), Field("external", m.ExternalAddr()), Field("protocol", mapper))
+		m.scheduleRenewal(lifetime)
+		return m, nil
+	}
+
+	if err == nil {
+		err = fmt.Errorf("No port mapping protocol enabled")
+	}
+	return nil, err
+}
+
+// Returns the address under which the mapped port is reachable from outside
+func (m *PortMapping) ExternalAddr() string {
+	return net.JoinHostPort(m.ExternalIP.String(), fmt.Sprintf("%d", m.ExternalPort))
+}
+
+func (m *PortMapping) log() *fieldLogger {
+	return newFieldLogger(m.logger)
+}
+
+// Returns the protocol that was used to create the mapping
+func (m *PortMapping) Protocol() string {
+	return m.mapper.String()
+}
+
+// Stops renewing the mapping and removes it from the gateway
+func (m *PortMapping) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+
+	_, _, _, err := m.mapper.mapPort(m.InternalPort, m.ExternalPort, 0)
+	return err
+}
+
+// Renews the mapping at half of its lifetime. Mappings without a lifetime
+// are permanent.
+func (m *PortMapping) scheduleRenewal(lifetime time.Duration) {
+	if lifetime <= 0 {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.closed {
+		m.timer = time.AfterFunc(lifetime/2, m.renew)
+	}
+}
+
+func (m *PortMapping) renew() {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return
+	}
+	m.lock.Unlock()
+
+	ip, port, lifetime, err := m.mapper.mapPort(m.InternalPort, m.ExternalPort, m.lifetime)
+	if err != nil {
+		m.log().Error("Unable to renew port mapping", Field("port", m.InternalPort), Field("protocol", m.mapper), Field("err", err))
+		// Try again before the mapping expires
+		lifetime = NAT_GATEWAY_TIMEOUT * 4
+	} else if port != m.ExternalPort || !ip.Equal(m.ExternalIP) {
+		m.log().Error("Gateway moved port mapping", Field("port", m.InternalPort), Field("from", m.ExternalAddr()), Field("to", net.JoinHostPort(ip.String(), strconv.Itoa(port))))
+	}
+
+	m.scheduleRenewal(lifetime)
+}
+
+func (c *NATConfig) lifetime() time.Duration {
+	if c.Lifetime > 0 {
+		return c.Lifetime
+	}
+	return NAT_MAPPING_LIFETIME
+}
+
+func (c *NATConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return NAT_GATEWAY_TIMEOUT
+}
+
+// Returns the gateway to send PCP and NAT-PMP requests to
+func (c *NATConfig) gateway(localAddr string) string {
+	if len(c.Gateway) > 0 {
+		if _, _, err := net.SplitHostPort(c.Gateway); err == nil {
+			return c.Gateway
+		}
+		return net.JoinHostPort(c.Gateway, fmt.Sprintf("%d", NAT_PMP_PORT))
+	}
+
+	gw := defaultGateway(localAddr)
+	if gw == nil {
+		return ""
+	}
+	return net.JoinHostPort(gw.String(), fmt.Sprintf("%d", NAT_PMP_PORT))
+}
+
+// Returns the port mappers to try, in order of preference
+func natMappers(conf *NATConfig, localAddr string) []portMapper {
+	mappers := make([]portMapper, 0, 3)
+
+	if !conf.DisableUPnP {
+		clients, _, err := internetgateway1.NewWANIPConnection1Clients()
+		if err == nil && len(clients) > 0 {
+			mappers = append(mappers, &upnpMapper{client: clients[0], localAddr: localAddr})
+		}
+	}
+
+	if !conf.DisablePMP {
+		if gw := conf.gateway(localAddr); len(gw) > 0 {
+			mappers = append(mappers,
+				&pcpMapper{gateway: gw, timeout: conf.timeout()},
+				&natPMPMapper{gateway: gw, timeout: conf.timeout()})
+		}
+	}
+
+	return mappers
+}
+
+/*
+Returns the IPv4 default gateway from the kernel routing table. Falls back to
+the first address of the local network, which is where most home routers
+live, if the routing table cannot be read.
+*/
+func defaultGateway(localAddr string) net.IP {
+	if f, err := os.Open("/proc/net/route"); err == nil {
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			// Iface Destination Gateway ...
+			if len(fields) < 3 || fields[1] != "00000000" {
+				continue
+			}
+			gw, err := hex.DecodeString(fields[2])
+			if err != nil || len(gw) != 4 {
+				continue
+			}
+			// The kernel prints addresses in host byte order
+			return net.IPv4(gw[3], gw[2], gw[1], gw[0])
+		}
+	}
+
+	ip := net.ParseIP(localAddr).To4()
+	if ip == nil || ip.IsLoopback() {
+		return nil
+	}
+	return net.IPv4(ip[0], ip[1], ip[2], 1)
+}
+
+// Maps ports using UPnP. Mappings are permanent until removed.
+type upnpMapper struct {
+	client    *internetgateway1.WANIPConnection1
+	localAddr string
+}
+
+func (u *upnpMapper) mapPort(internalPort, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	if lifetime == 0 {
+		return nil, 0, 0, u.client.DeletePortMapping("", uint16(externalPort), "TCP")
+	}
+
+	ip, err := u.externalAddr()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	err = u.client.AddPortMapping("", uint16(externalPort), "TCP", uint16(internalPort), u.localAddr, true, "BuddyStore", 0)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return ip, externalPort, 0, nil
+}
+
+func (u *upnpMapper) externalAddr() (net.IP, error) {
+	addr, err := u.client.GetExternalIPAddress()
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid external address %q", addr)
+	}
+	return ip, nil
+}
+
+func (u *upnpMapper) String() string {
+	return "UPnP"
+}
+
+// Maps ports using NAT-PMP (RFC 6886)
+type natPMPMapper struct {
+	gateway string
+	timeout time.Duration
+}
+
+func (n *natPMPMapper) mapPort(internalPort, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	var ip net.IP
+	if lifetime > 0 {
+		// The map response does not carry the external address
+		var err error
+		ip, err = n.externalAddr()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	} else {
+		// Deleting a mapping requires a zero external port
+		externalPort = 0
+	}
+
+	req := make([]byte, 12)
+	req[0] = natPMPVersion
+	req[1] = natPMPOpMapTCP
+	binary.BigEndian.PutUint16(req[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:], lifetimeSeconds(lifetime))
+
+	resp, err := gatewayCall(n.gateway, req, natPMPMapRespLen, n.timeout)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if err := checkNATPMPResponse(resp, natPMPOpMapTCP); err != nil {
+		return nil, 0, 0, err
+	}
+
+	mapped := int(binary.BigEndian.Uint16(resp[10:]))
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second
+	return ip, mapped, granted, nil
+}
+
+func (n *natPMPMapper) externalAddr() (net.IP, error) {
+	req := []byte{natPMPVersion, natPMPOpExternalAddr}
+	resp, err := gatewayCall(n.gateway, req, natPMPExternalAddrRespLen, n.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNATPMPResponse(resp, natPMPOpExternalAddr); err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func (n *natPMPMapper) String() string {
+	return "NAT-PMP"
+}
+
+func checkNATPMPResponse(resp []byte, op byte) error {
+	if resp[0] != natPMPVersion || resp[1] != natPMPOpResponse+op {
+		return fmt.Errorf("Unexpected NAT-PMP response version %d, opcode %d", resp[0], resp[1])
+	}
+	if result := binary.BigEndian.Uint16(resp[2:]); result != natPMPResultSuccess {
+		return fmt.Errorf("NAT-PMP request failed with result code %d", result)
+	}
+	return nil
+}
+
+// Maps ports using PCP (RFC 6887)
+type pcpMapper struct {
+	gateway string
+	timeout time.Duration
+	nonce   []byte
+}
+
+func (p *pcpMapper) mapPort(internalPort, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	// Renewals and deletions must reuse the nonce of the mapping
+	if p.nonce == nil {
+		p.nonce = make([]byte, 12)
+		if _, err := rand.Read(p.nonce); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
+	conn, err := net.Dial("udp4", p.gateway)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer conn.Close()
+
+	// The gateway checks that the client address matches the source address
+	client := conn.LocalAddr().(*net.UDPAddr).IP.To16()
+
+	req := make([]byte, pcpMapReqLen)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], lifetimeSeconds(lifetime))
+	copy(req[8:24], client)
+	copy(req[24:36], p.nonce)
+	req[36] = pcpProtocolTCP
+	binary.BigEndian.PutUint16(req[40:], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[42:], uint16(externalPort))
+	copy(req[44:60], net.IPv4zero.To16())
+
+	resp, err := exchange(conn, req, pcpMapRespLen, p.timeout)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	// NAT-PMP only gateways answer with their own version
+	if resp[0] != pcpVersion {
+		return nil, 0, 0, fmt.Errorf("Gateway does not support PCP, got version %d", resp[0])
+	}
+	if resp[1] != pcpOpResponse+pcpOpMap {
+		return nil, 0, 0, fmt.Errorf("Unexpected PCP response opcode %d", resp[1])
+	}
+	if resp[3] != pcpResultSuccess {
+		return nil, 0, 0, fmt.Errorf("PCP request failed with result code %d", resp[3])
+	}
+	if !bytes.Equal(resp[24:36], p.nonce) {
+		return nil, 0, 0, fmt.Errorf("PCP response nonce does not match request")
+	}
+
+	granted := time.Duration(binary.BigEndian.Uint32(resp[4:])) * time.Second
+	mapped := int(binary.BigEndian.Uint16(resp[42:]))
+	ip := net.IP(append([]byte(nil), resp[44:60]...))
+	return ip, mapped, granted, nil
+}
+
+func (p *pcpMapper) String() string {
+	return "PCP"
+}
+
+// Converts a lifetime to the whole seconds used on the wire. Lifetimes are
+// rounded up, since a zero lifetime deletes the mapping.
+func lifetimeSeconds(lifetime time.Duration) uint32 {
+	return uint32((lifetime + time.Second - 1) / time.Second)
+}
+
+// Sends a request to a PCP or NAT-PMP gateway and waits for a response of
+// at least minLen bytes
+func gatewayCall(gateway string, req []byte, minLen int, timeout time.Duration) ([]byte, error) {
+	conn, err := net.Dial("udp4", gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return exchange(conn, req, minLen, timeout)
+}
+
+// Sends a request over UDP, retransmitting with exponential backoff until
+// a long enough response arrives or the timeout passes
+func exchange(conn net.Conn, req []byte, minLen int, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	wait := timeout / (1<<natPMPRetransmits - 1)
+	buf := make([]byte, 1100)
+
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		next := time.Now().Add(wait)
+		if next.After(deadline) {
+			next = deadline
+		}
+		conn.SetReadDeadline(next)
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+
+			// Anything shorter is either garbage or a version mismatch
+			// without the fields we need
+			if n >= minLen || (n >= 4 && buf[0] != req[0]) {
+				return buf[:n], nil
+			}
+		}
+		wait *= 2
+	}
+
+	return nil, fmt.Errorf("No response from gateway %s", conn.RemoteAddr())
+}
@@ -0,0 +1,221 @@
+package buddystore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Answers NAT-PMP and, unless disabled, PCP requests like a home router would
+type fakeNATGateway struct {
+	conn       *net.UDPConn
+	externalIP net.IP
+	portOffset int // Added to requested ports, to simulate conflicts
+	noPCP      bool
+	lock       sync.Mutex
+	mappings   map[int]int // Internal port -> external port
+}
+
+func newFakeNATGateway(t *testing.T, port uint, noPCP bool) *fakeNATGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+	if err != nil {
+		t.Fatalf("Unable to start fake gateway: %s", err)
+	}
+
+	gw := &fakeNATGateway{conn: conn, externalIP: net.IPv4(203, 0, 113, 7), noPCP: noPCP, mappings: make(map[int]int)}
+	go gw.serve()
+	return gw
+}
+
+func (gw *fakeNATGateway) addr() string {
+	return gw.conn.LocalAddr().String()
+}
+
+func (gw *fakeNATGateway) mapped(internalPort int) (int, bool) {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+	ext, ok := gw.mappings[internalPort]
+	return ext, ok
+}
+
+func (gw *fakeNATGateway) mapPort(internalPort, externalPort int, lifetime uint32) int {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+
+	if lifetime == 0 {
+		delete(gw.mappings, internalPort)
+		return 0
+	}
+	if ext, ok := gw.mappings[internalPort]; ok {
+		return ext
+	}
+	gw.mappings[internalPort] = externalPort + gw.portOffset
+	return externalPort + gw.portOffset
+}
+
+func (gw *fakeNATGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, from, err := gw.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if resp := gw.handle(buf[:n]); resp != nil {
+			gw.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (gw *fakeNATGateway) handle(req []byte) []byte {
+	if len(req) < 2 {
+		return nil
+	}
+
+	if req[0] == pcpVersion && !gw.noPCP {
+		if len(req) < pcpMapReqLen || req[1] != pcpOpMap {
+			return nil
+		}
+		lifetime := binary.BigEndian.Uint32(req[4:])
+		internal := int(binary.BigEndian.Uint16(req[40:]))
+		ext := gw.mapPort(internal, int(binary.BigEndian.Uint16(req[42:])), lifetime)
+
+		resp := make([]byte, pcpMapRespLen)
+		resp[0] = pcpVersion
+		resp[1] = pcpOpResponse + pcpOpMap
+		binary.BigEndian.PutUint32(resp[4:], lifetime)
+		copy(resp[24:36], req[24:36])
+		resp[36] = req[36]
+		binary.BigEndian.PutUint16(resp[40:], uint16(internal))
+		binary.BigEndian.PutUint16(resp[42:], uint16(ext))
+		copy(resp[44:60], gw.externalIP.To16())
+		return resp
+	}
+
+	if req[0] != natPMPVersion {
+		// Unsupported version
+		resp := make([]byte, 8)
+		resp[1] = natPMPOpResponse + req[1]
+		binary.BigEndian.PutUint16(resp[2:], 1)
+		return resp
+	}
+
+	switch req[1] {
+	case natPMPOpExternalAddr:
+		resp := make([]byte, natPMPExternalAddrRespLen)
+		resp[1] = natPMPOpResponse + natPMPOpExternalAddr
+		copy(resp[8:], gw.externalIP.To4())
+		return resp
+	case natPMPOpMapTCP:
+		if len(req) < 12 {
+			return nil
+		}
+		internal := int(binary.BigEndian.Uint16(req[4:]))
+		lifetime := binary.BigEndian.Uint32(req[8:])
+		ext := gw.mapPort(internal, int(binary.BigEndian.Uint16(req[6:])), lifetime)
+
+		resp := make([]byte, natPMPMapRespLen)
+		resp[1] = natPMPOpResponse + natPMPOpMapTCP
+		binary.BigEndian.PutUint16(resp[8:], uint16(internal))
+		binary.BigEndian.PutUint16(resp[10:], uint16(ext))
+		binary.BigEndian.PutUint32(resp[12:], lifetime)
+		return resp
+	}
+	return nil
+}
+
+func (gw *fakeNATGateway) shutdown() {
+	gw.conn.Close()
+}
+
+func natTestConfig(gw *fakeNATGateway) *NATConfig {
+	return &NATConfig{Gateway: gw.addr(), DisableUPnP: true, Lifetime: time.Hour, Timeout: 500 * time.Millisecond}
+}
+
+func TestPortMappingPCP(t *testing.T) {
+	gw := newFakeNATGateway(t, PORT+2050, false)
+	defer gw.shutdown()
+
+	m, err := NewPortMapping(natTestConfig(gw), "127.0.0.1", 4000)
+	assert.NoError(t, err)
+	assert.Equal(t, "PCP", m.Protocol())
+	assert.Equal(t, "203.0.113.7:4000", m.ExternalAddr())
+
+	ext, ok := gw.mapped(4000)
+	assert.True(t, ok)
+	assert.Equal(t, 4000, ext)
+
+	assert.NoError(t, m.Close())
+	_, ok = gw.mapped(4000)
+	assert.False(t, ok)
+}
+
+func TestPortMappingFallsBackToNATPMP(t *testing.T) {
+	gw := newFakeNATGateway(t, PORT+2051, true)
+	defer gw.shutdown()
+
+	// The gateway gives us a different port than the one we asked for
+	gw.lock.Lock()
+	gw.portOffset = 1
+	gw.lock.Unlock()
+
+	m, err := NewPortMapping(natTestConfig(gw), "127.0.0.1", 4000)
+	assert.NoError(t, err)
+	assert.Equal(t, "NAT-PMP", m.Protocol())
+	assert.Equal(t, "203.0.113.7:4001", m.ExternalAddr())
+
+	assert.NoError(t, m.Close())
+	_, ok := gw.mapped(4000)
+	assert.False(t, ok)
+}
+
+func TestPortMappingRenewal(t *testing.T) {
+	gw := newFakeNATGateway(t, PORT+2052, false)
+	defer gw.shutdown()
+
+	conf := natTestConfig(gw)
+	conf.Lifetime = time.Second
+
+	m, err := NewPortMapping(conf, "127.0.0.1", 4000)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	// Drop the mapping behind our back, the renewal should restore it
+	gw.mapPort(4000, 0, 0)
+	time.Sleep(700 * time.Millisecond)
+
+	_, ok := gw.mapped(4000)
+	assert.True(t, ok)
+}
+
+func TestPortMappingNoGateway(t *testing.T) {
+	// Nothing listens on this port
+	conf := &NATConfig{Gateway: fmt.Sprintf("127.0.0.1:%d", PORT+2053), DisableUPnP: true, Timeout: 100 * time.Millisecond}
+
+	_, err := NewPortMapping(conf, "127.0.0.1", 4000)
+	assert.Error(t, err)
+
+	conf.DisablePMP = true
+	_, err = NewPortMapping(conf, "127.0.0.1", 4000)
+	assert.Error(t, err)
+}
+
+func TestTCPTransportAdvertisesMappedPort(t *testing.T) {
+	gw := newFakeNATGateway(t, PORT+2054, false)
+	defer gw.shutdown()
+
+	tconf := &TCPTransportConfig{ListenAddr: "127.0.0.1", Port: int(PORT + 2055), NAT: natTestConfig(gw)}
+	port, trans, conf, err := NewTCPTransportFromConfig(tconf, false, 0, DefaultConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, int(PORT+2055), port)
+	assert.Equal(t, fmt.Sprintf("203.0.113.7:%d,127.0.0.1:%d", PORT+2055, PORT+2055), conf.Hostname)
+
+	// The mapping is removed along with the transport
+	shutdownTransport(trans)
+	_, ok := gw.mapped(port)
+	assert.False(t, ok)
+}
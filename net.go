@@ -4,11 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/golang/glog"
 )
 
 /*
@@ -20,27 +20,61 @@ using the GOB format for simplicity.
 
 Internally, there is 1 Goroutine listening for inbound connections, 1 Goroutine PER
 inbound connection.
+
+Several rings can share one listener and connection pool. ForRing returns a
+transport for another ring on the same listener, and every request carries
+the RingId of the transport it was sent from, so that it reaches the vnodes
+of the right ring.
+
+The same transport also runs over Unix domain sockets, see InitUnixTransport.
+Addresses starting with UNIX_ADDR_SCHEME are dialed as socket paths, so nodes
+listening on TCP and on Unix sockets can talk to each other on one machine.
 */
 type TCPTransport struct {
-	sock     *net.TCPListener
+	*tcpMux
+	ringId string
+	closed int32
+
+	// Implements:
+	Transport
+}
+
+// State shared by all the rings served by a TCP listener
+type tcpMux struct {
+	sock     net.Listener
 	timeout  time.Duration
 	maxIdle  time.Duration
 	lock     sync.RWMutex
-	local    map[string]*localRPC
-	inbound  map[*net.TCPConn]struct{}
+	local    map[string]map[string]*localRPC // RingId -> Vnode -> RPC
+	inbound  map[net.Conn]struct{}
 	poolLock sync.Mutex
 	pool     map[string][]*tcpOutConn
 	shutdown int32
+	refs     int32
 
-	// Implements:
-	Transport
+	// Address that worked last, for hosts with several candidate addresses
+	addrLock sync.Mutex
+	working  map[string]string
+
+	// NAT traversal
+	mapping    *PortMapping
+	relay      *relayClient
+	relayed    int32
+	maxRelayed int32
+	relayLock  sync.Mutex
+	relayConns map[uint64]*relayedConn
+
+	logger Logger
 }
 
 var _ Transport = new(TCPTransport)
 
+// Prefix of host addresses that are Unix domain socket paths
+const UNIX_ADDR_SCHEME = "unix:"
+
 type tcpOutConn struct {
 	host   string
-	sock   *net.TCPConn
+	sock   net.Conn
 	header tcpHeader
 	enc    *json.Encoder
 	dec    *json.Decoder
@@ -70,10 +104,14 @@ const (
 	tcpInvalidateRLockReq
 	tcpVersionMapUpdate
 	tcpJoinRingReq
+	tcpDialBackReq
+	tcpRelayReq
+	tcpRelayAttachReq
 )
 
 type tcpHeader struct {
 	ReqType int
+	RingId  string `json:",omitempty"`
 }
 
 type tcpRequest interface {
@@ -169,27 +207,70 @@ type tcpBodyBoolError struct {
 // Creates a new TCP transport on the given listen address with the
 // configured timeout duration.
 func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, error) {
+	return initTCPTransport(listen, timeout, nil)
+}
+
+func initTCPTransport(listen string, timeout time.Duration, logger Logger) (*TCPTransport, error) {
 	// Try to start the listener
 	sock, err := net.Listen("tcp", listen)
 	if err != nil {
 		return nil, err
 	}
 
+	return newTCPTransport(sock, timeout, logger), nil
+}
+
+/*
+Creates a new transport listening on the Unix domain socket at the given
+path. Peers reach it under UNIX_ADDR_SCHEME followed by the path. A socket
+file left behind by a process that is gone is replaced, the socket file is
+removed again on shutdown.
+*/
+func InitUnixTransport(path string, timeout time.Duration) (*TCPTransport, error) {
+	return initUnixTransport(path, timeout, nil)
+}
+
+func initUnixTransport(path string, timeout time.Duration, logger Logger) (*TCPTransport, error) {
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		if conn, derr := net.DialTimeout("unix", path, timeout); derr == nil {
+			conn.Close()
+			return nil, err
+		}
+
+		// Nobody is listening there anymore
+		os.Remove(path)
+		if sock, err = net.Listen("unix", path); err != nil {
+			return nil, err
+		}
+	}
+
+	return newTCPTransport(sock, timeout, logger), nil
+}
+
+func newTCPTransport(sock net.Listener, timeout time.Duration, logger Logger) *TCPTransport {
 	// allocate maps
-	local := make(map[string]*localRPC)
-	inbound := make(map[*net.TCPConn]struct{})
+	local := make(map[string]map[string]*localRPC)
+	inbound := make(map[net.Conn]struct{})
 	pool := make(map[string][]*tcpOutConn)
 
 	// Maximum age of a connection
 	maxIdle := time.Duration(100 * time.Second)
 
 	// Setup the transport
-	tcp := &TCPTransport{sock: sock.(*net.TCPListener),
+	mux := &tcpMux{sock: sock,
 		timeout: timeout,
 		maxIdle: maxIdle,
 		local:   local,
 		inbound: inbound,
-		pool:    pool}
+		pool:    pool,
+		refs:    1,
+		working: make(map[string]string),
+
+		maxRelayed: TCP_RELAY_MAX_CLIENTS,
+		relayConns: make(map[uint64]*relayedConn),
+		logger:     logger}
+	tcp := &TCPTransport{tcpMux: mux}
 
 	// Listen for connections
 	go tcp.listen()
@@ -198,7 +279,41 @@ func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, erro
 	go tcp.reapOld()
 
 	// Done
-	return tcp, nil
+	return tcp
+}
+
+// Logs on behalf of the listener
+func (t *TCPTransport) log() *fieldLogger {
+	return newFieldLogger(t.logger, Field("listen", t.ListenAddr()))
+}
+
+// Returns a transport for the given ring, sharing the listener and the
+// outbound connections of this one. The listener is closed once all the
+// transports sharing it have been shut down.
+func (t *TCPTransport) ForRing(ringId string) *TCPTransport {
+	atomic.AddInt32(&t.refs, 1)
+	return &TCPTransport{tcpMux: t.tcpMux, ringId: ringId}
+}
+
+// Returns the port the transport listens on, or 0 for a Unix domain socket
+func (t *TCPTransport) ListenPort() int {
+	if addr, ok := t.sock.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// Returns the address the transport listens on, in the form peers dial it
+func (t *TCPTransport) ListenAddr() string {
+	if addr, ok := t.sock.Addr().(*net.UnixAddr); ok {
+		return UNIX_ADDR_SCHEME + addr.Name
+	}
+	return t.sock.Addr().String()
+}
+
+// Returns the ring this transport sends and receives requests for
+func (t *TCPTransport) RingId() string {
+	return t.ringId
 }
 
 // Checks for a local vnode
@@ -206,7 +321,7 @@ func (t *TCPTransport) get(vn *Vnode) (VnodeRPC, bool) {
 	key := vn.String()
 	t.lock.RLock()
 	defer t.lock.RUnlock()
-	w, ok := t.local[key]
+	w, ok := t.local[t.ringId][key]
 	if ok {
 		return w.obj, ok
 	} else {
@@ -234,15 +349,11 @@ func (t *TCPTransport) getConn(host string) (*tcpOutConn, error) {
 
 	if out == nil {
 		// Try to establish a connection
-		conn, err := net.DialTimeout("tcp", host, t.timeout)
+		sock, err := t.dial(host, t.timeout)
 		if err != nil {
 			return nil, err
 		}
 
-		// Setup the socket
-		sock := conn.(*net.TCPConn)
-		t.setupConn(sock)
-
 		out = &tcpOutConn{host: host, sock: sock}
 	}
 
@@ -254,6 +365,69 @@ func (t *TCPTransport) getConn(host string) (*tcpOutConn, error) {
 	return out, nil
 }
 
+/*
+Connects to one of the candidate addresses of a host, trying them in order of
+preference. The address that worked is tried first the next time, so a peer
+that is only reachable over some of its addresses costs one slow dial only.
+*/
+func (t *TCPTransport) dial(host string, timeout time.Duration) (net.Conn, error) {
+	addrs := HostAddrs(host)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("No address to connect to for host %q", host)
+	}
+
+	t.addrLock.Lock()
+	last, remembered := t.working[host]
+	t.addrLock.Unlock()
+	if remembered {
+		for i, addr := range addrs {
+			if addr == last {
+				copy(addrs[1:i+1], addrs[:i])
+				addrs[0] = last
+				break
+			}
+		}
+	}
+
+	// Every candidate gets a fair share of the timeout
+	each := timeout / time.Duration(len(addrs))
+
+	var err error
+	for _, addr := range addrs {
+		network, address := splitNetworkAddr(addr)
+		conn, derr := net.DialTimeout(network, address, each)
+		if derr != nil {
+			err = mergeErrors(err, derr)
+			continue
+		}
+
+		if len(addrs) > 1 && addr != last {
+			t.addrLock.Lock()
+			t.working[host] = addr
+			t.addrLock.Unlock()
+		}
+
+		// Setup the socket
+		t.setupConn(conn)
+		return conn, nil
+	}
+
+	if remembered {
+		t.addrLock.Lock()
+		delete(t.working, host)
+		t.addrLock.Unlock()
+	}
+	return nil, err
+}
+
+// Returns the address a host was last reached under, or an empty string if
+// it has a single address or was not reached yet
+func (t *TCPTransport) WorkingAddr(host string) string {
+	t.addrLock.Lock()
+	defer t.addrLock.Unlock()
+	return t.working[host]
+}
+
 // Returns an outbound TCP connection to the pool
 func (t *TCPTransport) returnConn(o *tcpOutConn) {
 	// Update the last used time
@@ -270,13 +444,33 @@ func (t *TCPTransport) returnConn(o *tcpOutConn) {
 	t.pool[o.host] = append(list, o)
 }
 
+// Returns the network and the address to dial for a candidate address
+func splitNetworkAddr(addr string) (string, string) {
+	if strings.HasPrefix(addr, UNIX_ADDR_SCHEME) {
+		return "unix", strings.TrimPrefix(addr, UNIX_ADDR_SCHEME)
+	}
+	return "tcp", addr
+}
+
 // Setup a connection
-func (t *TCPTransport) setupConn(c *net.TCPConn) {
-	c.SetNoDelay(true)
-	c.SetKeepAlive(true)
+func (t *TCPTransport) setupConn(conn net.Conn) {
+	if c, ok := conn.(*net.TCPConn); ok {
+		c.SetNoDelay(true)
+		c.SetKeepAlive(true)
+	}
 }
 
-func (t *TCPTransport) networkCall(host string, tcpReqType int, req tcpRequest, resp TCPResponse) error {
+func (t *TCPTransport) networkCall(host string, tcpReqType int, req tcpRequest, resp TCPResponse) (err error) {
+	start := time.Now()
+	defer func() {
+		name := tcpReqName(tcpReqType)
+		metricRPCs.Inc(name)
+		metricRPCDuration.Observe(time.Since(start).Seconds(), name)
+		if err != nil {
+			metricRPCErrors.Inc(name)
+		}
+	}()
+
 	// Get a conn
 	out, err := t.getConn(host)
 	if err != nil {
@@ -289,6 +483,7 @@ func (t *TCPTransport) networkCall(host string, tcpReqType int, req tcpRequest,
 
 	go func() {
 		out.header.ReqType = tcpReqType
+		out.header.RingId = t.ringId
 		if err := out.enc.Encode(&out.header); err != nil {
 			errChan <- err
 			return
@@ -526,15 +721,45 @@ func (t *TCPTransport) SkipSuccessor(target, self *Vnode) error {
 func (t *TCPTransport) Register(v *Vnode, o VnodeRPC) {
 	key := v.String()
 	t.lock.Lock()
-	t.local[key] = &localRPC{v, o}
+	local, ok := t.local[t.ringId]
+	if !ok {
+		local = make(map[string]*localRPC)
+		t.local[t.ringId] = local
+	}
+	local[key] = &localRPC{v, o}
 	t.lock.Unlock()
 }
 
-// Shutdown the TCP transport
+// Shutdown the TCP transport. Only unregisters the vnodes of our ring while
+// other rings are still sharing the listener.
 func (t *TCPTransport) Shutdown() {
+	if !atomic.CompareAndSwapInt32(&t.closed, 0, 1) {
+		return
+	}
+
+	t.lock.Lock()
+	delete(t.local, t.ringId)
+	t.lock.Unlock()
+
+	if atomic.AddInt32(&t.refs, -1) > 0 {
+		return
+	}
+
 	atomic.StoreInt32(&t.shutdown, 1)
 	t.sock.Close()
 
+	// Stop relaying and release the port on the NAT gateway
+	t.relayLock.Lock()
+	if t.relay != nil {
+		t.relay.close()
+	}
+	t.relayLock.Unlock()
+	if t.mapping != nil {
+		if err := t.mapping.Close(); err != nil {
+			t.log().Error("Unable to remove port mapping", Field("err", err))
+		}
+	}
+
 	// Close all the inbound connections
 	t.lock.RLock()
 	for conn := range t.inbound {
@@ -585,10 +810,10 @@ func (t *TCPTransport) reapOnce() {
 // Listens for inbound connections
 func (t *TCPTransport) listen() {
 	for {
-		conn, err := t.sock.AcceptTCP()
+		conn, err := t.sock.Accept()
 		if err != nil {
 			if atomic.LoadInt32(&t.shutdown) == 0 {
-				glog.Errorf("Error accepting TCP connection! %s", err)
+				t.log().Error("Error accepting TCP connection", Field("err", err))
 				continue
 			} else {
 				return
@@ -615,11 +840,13 @@ Param key : The key for which the read lock should be obtained
 */
 func (t *TCPTransport) RLock(target *Vnode, key string, nodeID string, opsLogEntry *OpsLogEntry) (string, uint, uint64, error) {
 	resp := tcpBodyLMRLockResp{}
-	for k, _ := range t.local {
+	t.lock.RLock()
+	for k, _ := range t.local[t.ringId] {
 		nodeID = k
 		break //  Think of a better way to get the local nodeID
 	}
-	err := t.networkCall(target.Host, tcpRLockReq, tcpBodyLMRLockReq{Vn: target, Key: key, SenderID: nodeID, SenderAddr: t.sock.Addr().String(), OpsLogEntryPrimary: opsLogEntry}, &resp)
+	t.lock.RUnlock()
+	err := t.networkCall(target.Host, tcpRLockReq, tcpBodyLMRLockReq{Vn: target, Key: key, SenderID: nodeID, SenderAddr: t.ListenAddr(), OpsLogEntryPrimary: opsLogEntry}, &resp)
 
 	if err != nil {
 		return "", 0, 0, resp.Error()
@@ -684,6 +911,7 @@ func (t *TCPTransport) InvalidateRLock(target *Vnode, lockID string) error {
 	go func() {
 		// Send a list command
 		out.header.ReqType = tcpInvalidateRLockReq
+		out.header.RingId = t.ringId
 		body := tcpBodyLMInvalidateRLockReq{Vn: target, LockID: lockID}
 		if err := out.enc.Encode(&out.header); err != nil {
 			errChan <- err
@@ -737,7 +965,7 @@ func (t *TCPTransport) AbortWLock(target *Vnode, key string, version uint, nodeI
 }
 
 // Handles inbound TCP connections
-func (t *TCPTransport) handleConn(conn *net.TCPConn) {
+func (t *TCPTransport) handleConn(conn net.Conn) {
 	// Defer the cleanup
 	defer func() {
 		t.lock.Lock()
@@ -751,25 +979,30 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 	header := tcpHeader{}
 	var sendResp TCPResponse
 	for {
-		// Get the header
+		// Get the header. Fields left out by the sender must not keep their
+		// values from the previous request.
+		header = tcpHeader{}
 		if err := dec.Decode(&header); err != nil {
 			if atomic.LoadInt32(&t.shutdown) == 0 && err.Error() != "EOF" {
-				glog.Errorf("Failed to decode TCP header! Got %s", err)
+				t.log().Error("Failed to decode TCP header", Field("remote", conn.RemoteAddr()), Field("err", err))
 			}
 			return
 		}
 
+		// Route the request to the vnodes of the ring it was sent for
+		rt := &TCPTransport{tcpMux: t.tcpMux, ringId: header.RingId}
+
 		// Read in the body and process request
 		switch header.ReqType {
 		case tcpPing:
 			body := tcpBodyVnode{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			_, ok := t.get(body.Vn)
+			_, ok := rt.get(body.Vn)
 			if ok {
 				sendResp = &tcpBodyBoolError{B: ok}
 			} else {
@@ -780,16 +1013,14 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpListReq:
 			body := tcpBodyString{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
-			// Generate all the local clients
-			res := make([]*Vnode, 0, len(t.local))
-
 			// Build list
 			t.lock.RLock()
-			for _, v := range t.local {
+			res := make([]*Vnode, 0, len(rt.local[rt.ringId]))
+			for _, v := range rt.local[rt.ringId] {
 				res = append(res, v.vnode)
 			}
 			t.lock.RUnlock()
@@ -800,12 +1031,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpGetPredReq:
 			body := tcpBodyVnode{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vn)
+			obj, ok := rt.get(body.Vn)
 			resp := tcpBodyVnodeError{}
 			sendResp = &resp
 			if ok {
@@ -820,12 +1051,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpNotifyReq:
 			body := tcpBodyTwoVnode{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, ok := rt.get(body.Target)
 			resp := tcpBodyVnodeListError{}
 			sendResp = &resp
 			if ok {
@@ -840,12 +1071,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpFindSucReq:
 			body := tcpBodyFindSuc{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, ok := rt.get(body.Target)
 			resp := tcpBodyVnodeListError{}
 			sendResp = &resp
 			if ok {
@@ -860,12 +1091,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpClearPredReq:
 			body := tcpBodyTwoVnode{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, ok := rt.get(body.Target)
 			resp := tcpBodyError{}
 			sendResp = &resp
 			if ok {
@@ -878,12 +1109,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpSkipSucReq:
 			body := tcpBodyTwoVnode{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, ok := rt.get(body.Target)
 			resp := tcpBodyError{}
 			sendResp = &resp
 			if ok {
@@ -896,12 +1127,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpGetPredListReq:
 			body := tcpBodyVnode{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vn)
+			obj, ok := rt.get(body.Vn)
 			resp := tcpBodyVnodeListError{}
 			sendResp = &resp
 			if ok {
@@ -916,12 +1147,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpGet:
 			body := tcpBodyGet{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vnode)
+			obj, ok := rt.get(body.Vnode)
 			resp := tcpBodyRespValue{}
 			sendResp = &resp
 			if ok {
@@ -936,12 +1167,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpSet:
 			body := tcpBodySet{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vnode)
+			obj, ok := rt.get(body.Vnode)
 			resp := tcpBodyError{}
 			sendResp = &resp
 			if ok {
@@ -956,12 +1187,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpList:
 			body := tcpBodyList{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vnode)
+			obj, ok := rt.get(body.Vnode)
 			resp := tcpBodyRespKeys{}
 			sendResp = &resp
 			if ok {
@@ -976,12 +1207,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpBulkSet:
 			body := tcpBodyBulkSet{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vnode)
+			obj, ok := rt.get(body.Vnode)
 			resp := tcpBodyError{}
 			sendResp = &resp
 			if ok {
@@ -996,12 +1227,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpSyncKeys:
 			body := tcpBodySyncKeys{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vnode)
+			obj, ok := rt.get(body.Vnode)
 			resp := tcpBodyError{}
 			sendResp = &resp
 			if ok {
@@ -1015,12 +1246,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpMissingKeys:
 			body := tcpBodyMissingKeys{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vnode)
+			obj, ok := rt.get(body.Vnode)
 			resp := tcpBodyError{}
 			sendResp = &resp
 			if ok {
@@ -1034,12 +1265,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpPurgeVersions:
 			body := tcpBodyPurgeVersions{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vnode)
+			obj, ok := rt.get(body.Vnode)
 			resp := tcpBodyError{}
 			sendResp = &resp
 			if ok {
@@ -1053,12 +1284,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpJoinRingReq:
 			body := tcpBodyJoinRingReq{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, ok := rt.get(body.Target)
 			resp := tcpBodyJoinRingResp{}
 			sendResp = &resp
 			if ok {
@@ -1073,12 +1304,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpRLockReq:
 			body := tcpBodyLMRLockReq{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vn)
+			obj, ok := rt.get(body.Vn)
 			resp := tcpBodyLMRLockResp{}
 			sendResp = &resp
 			if ok {
@@ -1097,12 +1328,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpWLockReq:
 			body := tcpBodyLMWLockReq{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vn)
+			obj, ok := rt.get(body.Vn)
 			resp := tcpBodyLMWLockResp{}
 			sendResp = &resp
 			if ok {
@@ -1122,12 +1353,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpCommitWLockReq:
 			body := tcpBodyLMCommitWLockReq{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vn)
+			obj, ok := rt.get(body.Vn)
 			resp := tcpBodyLMCommitWLockResp{}
 			sendResp = &resp
 			if ok {
@@ -1142,12 +1373,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpAbortWLockReq:
 			body := tcpBodyLMAbortWLockReq{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vn)
+			obj, ok := rt.get(body.Vn)
 			resp := tcpBodyLMAbortWLockResp{}
 			sendResp = &resp
 			if ok {
@@ -1162,12 +1393,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpInvalidateRLockReq:
 			body := tcpBodyLMInvalidateRLockReq{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, _ := t.get(body.Vn)
+			obj, _ := rt.get(body.Vn)
 			resp := tcpBodyLMInvalidateRLockResp{}
 			sendResp = &resp
 			if obj != nil {
@@ -1181,12 +1412,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 		case tcpVersionMapUpdate:
 			body := tcpVersionMapUpdateReq{}
 			if err := dec.Decode(&body); err != nil {
-				glog.Errorf("Failed to decode TCP body! Got %s", err)
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 				return
 			}
 
 			// Generate a response
-			obj, _ := t.get(body.Vn)
+			obj, _ := rt.get(body.Vn)
 			resp := tcpVersionMapUpdateResp{}
 			sendResp = &resp
 			if obj != nil {
@@ -1197,14 +1428,50 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 					body.Vn.Host, body.Vn.String()))
 			}
 
+		case tcpDialBackReq:
+			body := tcpBodyString{}
+			if err := dec.Decode(&body); err != nil {
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
+				return
+			}
+
+			// Generate a response
+			resp := tcpBodyBoolError{}
+			sendResp = &resp
+			err := rt.dialBack(conn, body.S)
+			resp.B = err == nil
+			resp.SetError(err)
+
+		case tcpRelayReq:
+			body := tcpBodyRelayReq{}
+			if err := dec.Decode(&body); err != nil {
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
+				return
+			}
+
+			// The connection is used for relay signalling from now on
+			t.serveRelay(conn, dec, enc, body.Port)
+			return
+
+		case tcpRelayAttachReq:
+			body := tcpBodyRelayAttach{}
+			if err := dec.Decode(&body); err != nil {
+				t.log().Error("Failed to decode TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
+				return
+			}
+
+			// The connection carries a relayed connection from now on
+			t.attachRelayed(conn, dec, body.ConnId)
+			return
+
 		default:
-			glog.Errorf("Unknown request type! Got %d", header.ReqType)
+			t.log().Error("Unknown request type", Field("remote", conn.RemoteAddr()), Field("request", header.ReqType))
 			return
 		}
 
 		// Send the response
 		if err := enc.Encode(sendResp); err != nil {
-			glog.Errorf("Failed to send TCP body! Got %s", err)
+			t.log().Error("Failed to send TCP body", Field("remote", conn.RemoteAddr()), Field("request", tcpReqName(header.ReqType)), Field("err", err))
 			return
 		}
 	}
@@ -1219,7 +1486,7 @@ func trimSlice(vn []*Vnode) []*Vnode {
 	// Find a non-nil index
 	idx := len(vn) - 1
 
-	for vn[idx] == nil {
+	for idx >= 0 && vn[idx] == nil {
 		idx--
 	}
 	return vn[:idx+1]
@@ -2,6 +2,9 @@ package buddystore
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -90,3 +93,248 @@ func TCPLeave(t *testing.T) {
 		}
 	}
 }
+
+func TestTCPTransportMultiplexesRings(t *testing.T) {
+	c1, t1, err := prepRing(int(PORT + 2040))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	c2, t2, err := prepRing(int(PORT + 2041))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	// Global ring over the listeners themselves
+	r1, err := Create(c1, t1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r2, err := Join(c2, t2, c1.Hostname)
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+
+	// A second, smaller ring over the same listeners
+	rc1 := DefaultConfig(c1.Hostname)
+	rc1.NumVnodes = 2
+	rc1.RingId = "ring1"
+	rt1 := t1.ForRing("ring1")
+	s1, err := Create(rc1, rt1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	rc2 := DefaultConfig(c2.Hostname)
+	rc2.NumVnodes = 2
+	rc2.RingId = "ring1"
+	rt2 := t2.ForRing("ring1")
+	s2, err := Join(rc2, rt2, c1.Hostname)
+	if err != nil {
+		t.Fatalf("failed to join sub ring! Got %s", err)
+	}
+
+	// Each ring only sees its own vnodes
+	vns, err := t2.ListVnodes(c1.Hostname)
+	if err != nil || len(vns) != c1.NumVnodes {
+		t.Fatalf("expected %d global vnodes, got %d (%v)", c1.NumVnodes, len(vns), err)
+	}
+	vns, err = rt2.ListVnodes(c1.Hostname)
+	if err != nil || len(vns) != 2 {
+		t.Fatalf("expected 2 sub ring vnodes, got %d (%v)", len(vns), err)
+	}
+
+	// The listener stays up until every ring sharing it is shut down
+	r2.Shutdown()
+	r1.Shutdown()
+	t1.Shutdown()
+	vns, err = rt2.ListVnodes(c1.Hostname)
+	if err != nil || len(vns) != 2 {
+		t.Fatalf("expected 2 sub ring vnodes after global shutdown, got %d (%v)", len(vns), err)
+	}
+	vns, err = t2.ListVnodes(c1.Hostname)
+	if err != nil || len(vns) != 0 {
+		t.Fatalf("expected no global vnodes after global shutdown, got %d (%v)", len(vns), err)
+	}
+
+	s2.Shutdown()
+	s1.Shutdown()
+	rt1.Shutdown()
+	rt2.Shutdown()
+	if _, err := t2.ListVnodes(c1.Hostname); err == nil {
+		t.Fatalf("expected the listener to be closed")
+	}
+}
+
+func TestTCPTransportMultipleAddrs(t *testing.T) {
+	c1, t1, err := prepRing(int(PORT + 2080))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	r1, err := Create(c1, t1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r1.Shutdown()
+
+	t2, err := InitTCPTransport(fmt.Sprintf("localhost:%d", PORT+2081), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	// Nothing listens on the preferred address
+	dead := fmt.Sprintf("127.0.0.1:%d", PORT+2082)
+	host := JoinHostAddrs(dead, c1.Hostname)
+
+	vns, err := t2.ListVnodes(host)
+	if err != nil || len(vns) != c1.NumVnodes {
+		t.Fatalf("expected %d vnodes, got %d (%v)", c1.NumVnodes, len(vns), err)
+	}
+	if addr := t2.WorkingAddr(host); addr != c1.Hostname {
+		t.Fatalf("expected %s to be remembered, got %s", c1.Hostname, addr)
+	}
+
+	// Once the working address goes away, the others are tried again
+	t2.poolLock.Lock()
+	delete(t2.pool, host)
+	t2.poolLock.Unlock()
+	t2.addrLock.Lock()
+	t2.working[host] = dead
+	t2.addrLock.Unlock()
+	if _, err := t2.ListVnodes(host); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if addr := t2.WorkingAddr(host); addr != c1.Hostname {
+		t.Fatalf("expected %s to be remembered, got %s", c1.Hostname, addr)
+	}
+}
+
+func TestTCPTransportIPv6(t *testing.T) {
+	listen := fmt.Sprintf("[::1]:%d", PORT+2083)
+	t1, err := InitTCPTransport(listen, time.Second)
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %s", err)
+	}
+	defer t1.Shutdown()
+
+	conf := fastConf()
+	conf.Hostname = JoinHostAddrs(listen, fmt.Sprintf("127.0.0.1:%d", PORT+2084))
+	r1, err := Create(conf, t1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r1.Shutdown()
+
+	t2, err := InitTCPTransport(fmt.Sprintf("localhost:%d", PORT+2085), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	vns, err := t2.ListVnodes(conf.Hostname)
+	if err != nil || len(vns) != conf.NumVnodes {
+		t.Fatalf("expected %d vnodes, got %d (%v)", conf.NumVnodes, len(vns), err)
+	}
+	for _, vn := range vns {
+		if vn.Host != conf.Hostname {
+			t.Fatalf("expected vnodes to advertise all addresses, got %s", vn.Host)
+		}
+	}
+}
+
+func prepUnixRing(path string) (*Config, *TCPTransport, error) {
+	trans, err := InitUnixTransport(path, 20*time.Millisecond)
+	if err != nil {
+		return nil, nil, err
+	}
+	conf := DefaultConfig(trans.ListenAddr())
+	conf.StabilizeMin = time.Duration(15 * time.Millisecond)
+	conf.StabilizeMax = time.Duration(45 * time.Millisecond)
+	return conf, trans, nil
+}
+
+func TestUnixTransportJoin(t *testing.T) {
+	dir := t.TempDir()
+	c1, t1, err := prepUnixRing(filepath.Join(dir, "n1.sock"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	c2, t2, err := prepUnixRing(filepath.Join(dir, "n2.sock"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	if c1.Hostname != UNIX_ADDR_SCHEME+filepath.Join(dir, "n1.sock") {
+		t.Fatalf("unexpected hostname %s", c1.Hostname)
+	}
+	if t1.ListenPort() != 0 {
+		t.Fatalf("expected no port, got %d", t1.ListenPort())
+	}
+
+	r1, err := Create(c1, t1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r1.Shutdown()
+
+	r2, err := Join(c2, t2, c1.Hostname)
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+	defer r2.Shutdown()
+
+	// Wait for some stabilization
+	<-time.After(200 * time.Millisecond)
+
+	for _, vn := range r2.vnodes {
+		if vn.successors[0] == nil {
+			t.Fatalf("missing successor for %s", vn)
+		}
+	}
+
+	// TCP nodes on the same machine reach Unix socket nodes as well
+	t3, err := InitTCPTransport(fmt.Sprintf("localhost:%d", PORT+2090), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t3.Shutdown()
+
+	vns, err := t3.ListVnodes(c2.Hostname)
+	if err != nil || len(vns) != c2.NumVnodes {
+		t.Fatalf("expected %d vnodes, got %d (%v)", c2.NumVnodes, len(vns), err)
+	}
+}
+
+func TestUnixTransportStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.sock")
+
+	// A crashed process leaves its socket file behind
+	sock, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	sock.SetUnlinkOnClose(false)
+	sock.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected stale socket file, got %s", err)
+	}
+
+	t1, err := InitUnixTransport(path, time.Second)
+	if err != nil {
+		t.Fatalf("expected stale socket to be replaced, got %s", err)
+	}
+
+	// A socket in use is left alone
+	if _, err := InitUnixTransport(path, time.Second); err == nil {
+		t.Fatalf("expected socket in use to be an error")
+	}
+
+	t1.Shutdown()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected socket file to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package buddystore
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Name of the file holding the node state inside the state directory
+const NODE_STATE_FILE = "node.json"
+
+// Persisted position of the local node in a single ring
+type RingState struct {
+	Port     int      // Port the transport for this ring listened on
+	VnodeIds [][]byte // IDs of the local vnodes, in creation order
+}
+
+/*
+NodeState is the identity of a node that survives restarts. It holds a node
+keypair and, for every ring the node has been a member of, the IDs of its
+vnodes and the port it listened on. Restoring these puts a restarted node
+back at the same ring positions, so it does not have to take over keys from
+scratch.
+*/
+type NodeState struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+	Rings      map[string]*RingState
+
+	path string
+	lock sync.Mutex
+}
+
+// Loads the node state from the given directory. A fresh state with a newly
+// generated keypair is created and saved if the directory holds none yet.
+func LoadNodeState(dir string) (*NodeState, error) {
+	return loadNodeState(dir, nil)
+}
+
+func loadNodeState(dir string, logger Logger) (*NodeState, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &NodeState{path: filepath.Join(dir, NODE_STATE_FILE)}
+
+	buf, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.PublicKey, s.PrivateKey, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		s.Rings = make(map[string]*RingState)
+
+		newFieldLogger(logger).Info("Created new node identity", Field("node", s.NodeId()), Field("dir", dir))
+		return s, s.Save()
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, s); err != nil {
+		return nil, fmt.Errorf("Corrupt node state in %s: %s", s.path, err)
+	}
+
+	if len(s.PrivateKey) != ed25519.PrivateKeySize || len(s.PublicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid node keypair in %s", s.path)
+	}
+
+	if s.Rings == nil {
+		s.Rings = make(map[string]*RingState)
+	}
+
+	return s, nil
+}
+
+// Returns a stable identifier for the node, derived from its public key
+func (s *NodeState) NodeId() string {
+	return hex.EncodeToString(s.PublicKey)
+}
+
+// Returns a copy of the persisted state for a ring, or nil if the node has
+// never been a member of it
+func (s *NodeState) Ring(ringId string) *RingState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rs, ok := s.Rings[ringId]
+	if !ok {
+		return nil
+	}
+
+	ids := make([][]byte, len(rs.VnodeIds))
+	copy(ids, rs.VnodeIds)
+	return &RingState{Port: rs.Port, VnodeIds: ids}
+}
+
+// Remembers the vnode IDs and port used by the local node in a ring, and
+// saves the state
+func (s *NodeState) RecordRing(ringId string, ring *Ring) error {
+	rs := &RingState{}
+
+	// Behind a NAT or a relay, the advertised ports may differ from the one
+	// we listen on
+	if tcp, ok := tcpTransportOf(ring.transport); ok {
+		rs.Port = tcp.ListenPort()
+	}
+
+	for _, addr := range HostAddrs(ring.config.Hostname) {
+		if rs.Port != 0 {
+			break
+		}
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			rs.Port, _ = strconv.Atoi(port)
+		}
+	}
+
+	for _, vn := range ring.vnodes {
+		rs.VnodeIds = append(rs.VnodeIds, vn.Id)
+	}
+
+	s.lock.Lock()
+	s.Rings[ringId] = rs
+	s.lock.Unlock()
+
+	return s.Save()
+}
+
+// Writes the state to disk. The file is replaced atomically, so a crash
+// while saving leaves the previous state intact.
+func (s *NodeState) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// Creates a TCP transport and ring configuration for a ring, reusing the
+// port and vnode IDs from a previous run if there are any. Works on a nil
+// state, in which case a fresh identity is used.
+func (s *NodeState) createTransport(ringId string, tconf *TCPTransportConfig, localOnly bool) (int, Transport, *Config, error) {
+	var rs *RingState
+	if s != nil {
+		rs = s.Ring(ringId)
+	}
+
+	if rs == nil {
+		return NewTCPTransportFromConfig(tconf, localOnly, 0, DefaultConfig)
+	}
+
+	port, transport, conf, err := NewTCPTransportFromConfig(tconf, localOnly, rs.Port, DefaultConfig)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	conf.VnodeIds = rs.VnodeIds
+	return port, transport, conf, nil
+}
+
+// Records a joined ring, logging rather than returning failures. Works on a
+// nil state.
+func (s *NodeState) recordRing(ringId string, ring RingIntf) {
+	r, ok := ring.(*Ring)
+	if s == nil || !ok {
+		return
+	}
+
+	if err := s.RecordRing(ringId, r); err != nil {
+		r.log().Error("Unable to save node state", Field("err", err))
+	}
+}
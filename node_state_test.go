@@ -0,0 +1,86 @@
+package buddystore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeStatePersistsAcrossLoads(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := LoadNodeState(dir)
+	if err != nil {
+		t.Fatalf("Unable to create node state: %s", err)
+	}
+	assert.Nil(t, s.Ring("ring1"))
+
+	ml := NewMemoryNetwork()
+	conf := fastConf()
+	conf.Hostname = "localhost:1234"
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+
+	assert.NoError(t, s.RecordRing("ring1", r))
+
+	s2, err := LoadNodeState(dir)
+	if err != nil {
+		t.Fatalf("Unable to load node state: %s", err)
+	}
+	assert.Equal(t, s.NodeId(), s2.NodeId())
+	assert.Equal(t, s.PrivateKey, s2.PrivateKey)
+
+	rs := s2.Ring("ring1")
+	if assert.NotNil(t, rs) {
+		assert.Equal(t, 1234, rs.Port)
+		assert.Len(t, rs.VnodeIds, conf.NumVnodes)
+		for i, vn := range r.vnodes {
+			assert.Equal(t, vn.Id, rs.VnodeIds[i])
+		}
+	}
+}
+
+func TestNodeStateRejectsCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, NODE_STATE_FILE), []byte("{"), 0600); err != nil {
+		t.Fatalf("Unable to write state file: %s", err)
+	}
+
+	_, err := LoadNodeState(dir)
+	assert.Error(t, err)
+}
+
+func TestCreateUsesPersistedVnodeIds(t *testing.T) {
+	ml := NewMemoryNetwork()
+
+	conf := fastConf()
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	ids := make([][]byte, len(r.vnodes))
+	for i, vn := range r.vnodes {
+		ids[i] = vn.Id
+	}
+	r.Shutdown()
+
+	// A different hostname would normally hash to different positions
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	conf2.VnodeIds = ids
+	r2, err := Create(conf2, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r2.Shutdown()
+
+	for i, vn := range r2.vnodes {
+		assert.Equal(t, ids[i], vn.Id)
+		assert.Equal(t, "test2", vn.Host)
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"math/rand"
 	"time"
-
-	"github.com/golang/glog"
 )
 
 const RETRY_WAIT = 1 * time.Millisecond
@@ -35,6 +33,11 @@ func NewKVStoreClientWithLM(ringIntf RingIntf, lm LMClientIntf) *KVStoreClientIm
 	return &KVStoreClientImpl{ring: ringIntf, lm: lm}
 }
 
+// Logs on behalf of the ring of the client
+func (kv KVStoreClientImpl) log() *fieldLogger {
+	return ringLogger(kv.ring)
+}
+
 // Inform the lock manager we're interested in reading the value for key.
 // Expected return value:
 //    Current version number associated with key
@@ -73,34 +76,35 @@ func (kv KVStoreClientImpl) getWithoutRetry(key string) ([]byte, error) {
 	v, err := kv.lm.RLock(key, false)
 
 	if err != nil {
-		glog.Errorf("Error acquiring RLock in Get(%q): %s", key, err)
+		kv.log().Error("Error acquiring RLock in Get", Field("key", key), Field("err", err))
 		return nil, err
 	}
 
 	succVnodesTemp, err := kv.ring.Lookup(kv.ring.GetNumSuccessors(), []byte(key))
 	if err != nil {
-		glog.Errorf("Error listing successors in Get(%q): %q", key, err)
+		kv.log().Error("Error listing successors in Get", Field("key", key), Field("err", err))
 		return nil, err
 	}
 
 	if len(succVnodesTemp) == 0 {
-		glog.Errorf("No successors found during Lookup in Get(%q)", key)
+		kv.log().Error("No successors found during Lookup in Get", Field("key", key))
 		return nil, fmt.Errorf("No Successors found")
 	}
 
-	succVnodes := make([]*Vnode, len(succVnodesTemp))
-	copy(succVnodes,succVnodesTemp)
-	// Logic to throw away all local vnodes from the successors list.
-	for i, vnode := range succVnodes {
-		if kv.ring.Transport().IsLocalVnode(vnode) {
-			succVnodes = append(succVnodes[:i], succVnodes[i+1:]...)
-			value, err := kv.ring.Transport().Get(vnode, key, v)
-			// fmt.Printf("GetSubLocal(key, vnode) => %s [Err: %s]\n", value, err)
-
-			// If operation failed, try another node
-			if err == nil {
-				return value, nil
-			}
+	// Read from local vnodes first, and keep the remote ones to fall back on.
+	succVnodes := make([]*Vnode, 0, len(succVnodesTemp))
+	for _, vnode := range succVnodesTemp {
+		if !kv.ring.Transport().IsLocalVnode(vnode) {
+			succVnodes = append(succVnodes, vnode)
+			continue
+		}
+
+		value, err := kv.ring.Transport().Get(vnode, key, v)
+		// fmt.Printf("GetSubLocal(key, vnode) => %s [Err: %s]\n", value, err)
+
+		// If operation failed, try another node, unless the key was deleted
+		if err == nil || isDeleted(err) {
+			return value, err
 		}
 	}
 
@@ -117,9 +121,9 @@ func (kv KVStoreClientImpl) getWithoutRetry(key string) ([]byte, error) {
 		value, err := kv.ring.Transport().Get(node, key, v)
 		// fmt.Printf("GetSub(key, vnode) => %s [Err: %s]\n", value, err)
 
-		// If operation failed, try another node
-		if err == nil {
-			return value, nil
+		// If operation failed, try another node, unless the key was deleted
+		if err == nil || isDeleted(err) {
+			return value, err
 		}
 	}
 
@@ -205,12 +209,12 @@ func (kv *KVStoreClientImpl) SetVersion(key string, version uint, value []byte)
 func (kv *KVStoreClientImpl) setVersionWithoutRetry(key string, version uint, value []byte) error {
 	succVnodes, err := kv.ring.Lookup(kv.ring.GetNumSuccessors(), []byte(key))
 	if err != nil {
-		glog.Errorf("Error listing successors in Set(%q): %q", key, err)
+		kv.log().Error("Error listing successors in Set", Field("key", key), Field("err", err))
 		return err
 	}
 
 	if len(succVnodes) == 0 {
-		glog.Errorf("No successors found during Lookup in Get(%q)", key)
+		kv.log().Error("No successors found during Lookup in Set", Field("key", key))
 		return fmt.Errorf("No Successors found")
 	}
 
@@ -219,7 +223,7 @@ func (kv *KVStoreClientImpl) setVersionWithoutRetry(key string, version uint, va
 	err = kv.ring.Transport().Set(succVnodes[0], key, version, value)
 
 	if err != nil {
-		glog.Errorf("Aborting Set(%q, %d) due to error: %q", key, version, err)
+		kv.log().Error("Aborting Set", Field("key", key), Field("version", version), Field("err", err))
 
 		// Best-effort Abort
 		kv.lm.AbortWLock(key, version)
@@ -278,3 +282,83 @@ func (kv KVStoreClientImpl) GetForSet(key string, retry bool) ([]byte, uint, err
 
 	return nil, 0, fmt.Errorf("Code should note have reached here")
 }
+
+// Gives up a write lease acquired in KVStore.GetForSet without writing a
+// new version, so that other writers do not wait for the lease to time out.
+func (kv *KVStoreClientImpl) AbortVersion(key string, version uint) error {
+	return kv.lm.AbortWLock(key, version)
+}
+
+// Deletes every version of a key. A write lease is taken for a new version,
+// the older versions are purged from the owner and its successors, and the
+// new version is committed without a value, so that later reads of the key
+// fail with "Key deleted".
+// Expected error conditions:
+//    Key not found on its owner  => Fail, after aborting the lease
+//    Transient error             => Retry taking the lease
+//
+// Successors which do not hold a copy of the key are skipped.
+func (kv *KVStoreClientImpl) Delete(key string) error {
+	var err error = fmt.Errorf("DUMMY")
+	var v uint
+
+	for err != nil {
+		v, err = kv.lm.WLock(key, 0, 10)
+		if err == nil {
+			break
+		}
+		if !isRetryable(err) {
+			return err
+		}
+
+		time.Sleep(RETRY_WAIT)
+	}
+
+	succVnodes, err := kv.ring.Lookup(1, []byte(key))
+	if err == nil && len(succVnodes) == 0 {
+		err = fmt.Errorf("No Successors found")
+	}
+	if err == nil {
+		err = kv.ring.Transport().PurgeVersions(succVnodes[0], key, v)
+	}
+	if err != nil {
+		kv.log().Error("Aborting Delete", Field("key", key), Field("version", v), Field("err", err))
+		kv.lm.AbortWLock(key, v)
+		return err
+	}
+
+	// The owner replicates to all of its successors
+	owner := succVnodes[0]
+	hashBits := kv.ring.GetHashFunc()().Size() * 8
+	replicas, err := kv.ring.Transport().FindSuccessors(owner, kv.ring.GetNumSuccessors(), nextId(owner.Id, hashBits))
+	if err != nil {
+		kv.log().Error("Unable to find the replicas in Delete", Field("key", key), Field("err", err))
+	}
+	for _, vnode := range replicas {
+		if vnode != nil {
+			kv.ring.Transport().PurgeVersions(vnode, key, v)
+		}
+	}
+
+	return kv.lm.CommitWLock(key, v)
+}
+
+// Stores that can give up a write lease without writing
+type kvAborter interface {
+	AbortVersion(key string, version uint) error
+}
+
+// Rings that can list the keys stored on them
+type keyLister interface {
+	Keys() ([]string, error)
+}
+
+// Lists the keys stored on the ring, in sorted order. Every vnode of the
+// ring is asked for its keys, so this is expensive on large rings.
+func (kv *KVStoreClientImpl) Keys() ([]string, error) {
+	ring, ok := kv.ring.(keyLister)
+	if !ok {
+		return nil, fmt.Errorf("Ring cannot list its keys")
+	}
+	return ring.Keys()
+}
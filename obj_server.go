@@ -14,6 +14,7 @@ type KVStoreValue struct {
 type KVStore struct {
 	vn        localVnodeIface
 	kv        map[string]*list.List
+	deleted   map[string]uint // Version each deleted key was deleted at
 	pred_list []*Vnode
 	succ_list []*Vnode
 	kvLock    sync.Mutex
@@ -41,6 +42,7 @@ type KVStoreIntf interface {
 
 func (kvs *KVStore) init() error {
 	kvs.kv = make(map[string]*list.List)
+	kvs.deleted = make(map[string]uint)
 	r := kvs.vn.Ring()
 	kvs.pred_list = make([]*Vnode, r.GetNumSuccessors()+1)
 	kvs.succ_list = make([]*Vnode, r.GetNumSuccessors())
@@ -56,6 +58,11 @@ func (kvs *KVStore) get(key string, version uint) ([]byte, error) {
 
 	kvLst, found := kvs.kv[key]
 
+	// Deleted versions are committed without a value
+	if deleted, ok := kvs.deleted[key]; ok && version <= deleted {
+		return nil, fmt.Errorf("Key deleted")
+	}
+
 	if !found {
 		// fmt.Printf("[%s] GET(%s, %d) KEY NOT FOUND\n", kvs.vn, key, version)
 		return nil, fmt.Errorf("Key not found")
@@ -76,6 +83,21 @@ func (kvs *KVStore) get(key string, version uint) ([]byte, error) {
 	return nil, nil
 }
 
+// Returns the number of keys, versions and bytes of values stored
+func (kvs *KVStore) stats() (keys, versions, bytes int) {
+	kvs.kvLock.Lock()
+	defer kvs.kvLock.Unlock()
+
+	for _, kvLst := range kvs.kv {
+		keys++
+		for i := kvLst.Front(); i != nil; i = i.Next() {
+			versions++
+			bytes += len(i.Value.(*KVStoreValue).Val)
+		}
+	}
+	return keys, versions, bytes
+}
+
 func (kvs *KVStore) set(key string, version uint, value []byte) error {
 	kvs.kvLock.Lock()
 	defer kvs.kvLock.Unlock()
@@ -108,6 +130,11 @@ func (kvs *KVStore) set(key string, version uint, value []byte) error {
 		kvLst.PushFront(kvVal)
 	}
 
+	// The key is stored again, so later versions are not deleted
+	if deleted, ok := kvs.deleted[key]; ok && deleted < version {
+		delete(kvs.deleted, key)
+	}
+
 	kvs.incSync(key, version, value)
 
 	return nil
@@ -173,6 +200,12 @@ func (kvs *KVStore) purgeVersions(key string, maxVersion uint) error {
 	kvs.kvLock.Lock()
 	defer kvs.kvLock.Unlock()
 
+	// Remember the deletion, so that reads of the version tell it apart
+	// from a missing copy
+	if kvs.deleted != nil && kvs.deleted[key] < maxVersion {
+		kvs.deleted[key] = maxVersion
+	}
+
 	kvLst, found := kvs.kv[key]
 
 	if !found {
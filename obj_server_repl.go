@@ -157,6 +157,9 @@ func (kvs *KVStore) globalRepl() {
 func (kvs *KVStore) sendSyncKeys(target *Vnode, key string, wg *sync.WaitGroup, tokens chan bool) {
 	defer wg.Done()
 
+	metricReplBacklog.Add(1)
+	defer metricReplBacklog.Add(-1)
+
 	<-tokens
 
 	kvLst, found := kvs.kv[key]
@@ -226,6 +229,9 @@ func (kvs *KVStore) incSync(key string, version uint, value []byte) error {
 func (kvs *KVStore) incSyncToSucc(succVn *Vnode, key string, version uint, value []byte, wg *sync.WaitGroup, tokens chan bool, retErr *error) {
 	defer wg.Done()
 
+	metricReplBacklog.Add(1)
+	defer metricReplBacklog.Add(-1)
+
 	<-tokens
 
 	ok := kvs.vn.Ring().Transport().IsLocalVnode(succVn)
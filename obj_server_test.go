@@ -101,3 +101,24 @@ func TestGlobalReplication(t *testing.T) {
 	tr.AssertExpectations(t)
 	vn.AssertExpectations(t)
 }
+
+func TestKVStoreGetDeleted(t *testing.T) {
+	r := &MockRing{numSuccessors: 2, hashfunc: sha1.New}
+	vn := &MockLocalVnode{R: r}
+	kvs := &KVStore{vn: vn}
+	kvs.init()
+
+	kvs.kv["foo"] = list.New()
+	kvs.kv["foo"].PushFront(&KVStoreValue{Ver: 1, Val: []byte("bar")})
+
+	// Deleting version 2 purges version 1
+	if err := kvs.purgeVersions("foo", 2); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if _, err := kvs.get("foo", 2); !isDeleted(err) {
+		t.Fatalf("expected the key to be deleted. %v", err)
+	}
+	if _, err := kvs.get("foo", 3); err == nil || isDeleted(err) {
+		t.Fatalf("expected the key to be missing. %v", err)
+	}
+}
@@ -0,0 +1,506 @@
+package buddystore
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default number of unreachable nodes a transport relays connections for
+const TCP_RELAY_MAX_CLIENTS = 8
+
+// Time the relayed node has to pick up a connection accepted for it
+const TCP_RELAY_ATTACH_TIMEOUT = 10 * time.Second
+
+// Backoff between attempts to reconnect to a relay
+const TCP_RELAY_RETRY_MIN_WAIT = 1 * time.Second
+const TCP_RELAY_RETRY_MAX_WAIT = 30 * time.Second
+
+/*
+Relaying lets a node that peers cannot connect to take part in a ring anyway.
+
+The unreachable node opens a control connection to a reachable peer, which
+starts listening on a port of its own for the node. The node advertises that
+port. For every connection the relay accepts on it, the relay sends a
+notification over the control connection, and the node dials back to attach
+to it. Notifications carry a random ID, and only the host of the control
+connection may attach to it. From then on the relay copies bytes both ways, so the relayed node
+serves the connection like any other inbound one.
+*/
+type relayClient struct {
+	t      *TCPTransport
+	peer   string
+	host   string // Address we reached the relay under
+	port   int
+	conn   net.Conn
+	dec    *json.Decoder
+	lock   sync.Mutex
+	closed int32
+}
+
+// A connection accepted for a relayed node, waiting for the node to attach
+type relayedConn struct {
+	in    *net.TCPConn
+	owner string // Host of the control connection of the relayed node
+}
+
+/*
+Asks the peer at the given address to connect back to addr, which should be
+an address of the local node. Returns nil if the peer managed to list the
+vnodes of our ring there.
+*/
+func (t *TCPTransport) CheckReachable(peer, addr string) error {
+	resp := tcpBodyBoolError{}
+	err := t.networkCall(peer, tcpDialBackReq, tcpBodyString{S: addr}, &resp)
+	if err == nil && !resp.B {
+		err = fmt.Errorf("Peer %s could not reach %s", peer, addr)
+	}
+	return err
+}
+
+/*
+Asks the peer at the given address to relay inbound connections for this
+transport, and returns the address peers can reach us under. The relay is
+shared by all the rings on the transport, and is kept until shutdown.
+*/
+func (t *TCPTransport) StartRelay(peer string) (string, error) {
+	t.relayLock.Lock()
+	defer t.relayLock.Unlock()
+
+	if t.relay != nil {
+		return "", fmt.Errorf("Already relaying through %s", t.relay.peer)
+	}
+
+	rc := &relayClient{t: t, peer: peer}
+	if err := rc.connect(); err != nil {
+		return "", err
+	}
+	t.relay = rc
+
+	go rc.run()
+
+	return rc.addr(), nil
+}
+
+// Returns the address we are reachable under through our relay, or an
+// empty string if we are not being relayed
+func (t *TCPTransport) RelayAddr() string {
+	t.relayLock.Lock()
+	defer t.relayLock.Unlock()
+
+	if t.relay == nil {
+		return ""
+	}
+	return t.relay.addr()
+}
+
+// Returns the port mapping on the NAT gateway, if there is one
+func (t *TCPTransport) PortMapping() *PortMapping {
+	return t.mapping
+}
+
+/*
+Connects to addr on behalf of the peer at the other end of conn. Only
+addresses that resolve to the peer's own IP are checked, so that we cannot be
+used to probe arbitrary hosts.
+*/
+func (t *TCPTransport) dialBack(conn net.Conn, addr string) error {
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("Only peers connected over TCP can be dialed back")
+	}
+	remote := tcpAddr.IP
+
+	// Only the candidate addresses the peer connected to us from are checked
+	var own []string
+	for _, candidate := range HostAddrs(addr) {
+		host, _, err := net.SplitHostPort(candidate)
+		if err != nil {
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(remote) {
+				own = append(own, candidate)
+				break
+			}
+		}
+	}
+
+	if len(own) == 0 {
+		return fmt.Errorf("Refusing to connect to %s on behalf of %s", addr, remote)
+	}
+	return t.probe(JoinHostAddrs(own...))
+}
+
+// Lists the vnodes of our ring at addr over a new connection. Pooled
+// connections would not tell whether addr accepts new connections.
+func (t *TCPTransport) probe(addr string) error {
+	// Answer before the peer waiting for us times out
+	timeout := t.timeout / 2
+
+	conn, err := t.dial(addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+
+	if err := enc.Encode(&tcpHeader{ReqType: tcpListReq, RingId: t.ringId}); err != nil {
+		return err
+	}
+	if err := enc.Encode(tcpBodyString{S: addr}); err != nil {
+		return err
+	}
+
+	resp := tcpBodyVnodeListError{}
+	if err := dec.Decode(&resp); err != nil {
+		return err
+	}
+	return resp.Error()
+}
+
+// Starts listening for connections to a node we relay for. The port used
+// before is reused if possible, so that the node keeps its address.
+func (t *TCPTransport) listenForRelayed(port int) (*net.TCPListener, error) {
+	if t.maxRelayed <= 0 {
+		return nil, fmt.Errorf("Relaying is disabled")
+	}
+	if _, ok := t.sock.Addr().(*net.TCPAddr); !ok {
+		return nil, fmt.Errorf("Relaying needs a TCP listener")
+	}
+	if t.RelayAddr() != "" {
+		return nil, fmt.Errorf("Cannot relay while being relayed")
+	}
+	if atomic.AddInt32(&t.relayed, 1) > t.maxRelayed {
+		atomic.AddInt32(&t.relayed, -1)
+		return nil, fmt.Errorf("Already relaying for %d nodes", t.maxRelayed)
+	}
+
+	host, _, _ := net.SplitHostPort(t.sock.Addr().String())
+	sock, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil && port != 0 {
+		t.log().Info("Unable to relay on the same port again", Field("port", port), Field("err", err))
+		sock, err = net.Listen("tcp", net.JoinHostPort(host, "0"))
+	}
+	if err != nil {
+		atomic.AddInt32(&t.relayed, -1)
+		return nil, err
+	}
+
+	return sock.(*net.TCPListener), nil
+}
+
+// Relays connections for the node at the other end of the control
+// connection, until it goes away
+func (t *TCPTransport) serveRelay(conn net.Conn, dec *json.Decoder, enc *json.Encoder, port int) {
+	resp := tcpBodyRelayResp{}
+	sock, err := t.listenForRelayed(port)
+	if err != nil {
+		resp.SetError(err)
+		enc.Encode(&resp)
+		return
+	}
+	defer atomic.AddInt32(&t.relayed, -1)
+	defer sock.Close()
+
+	resp.Port = sock.Addr().(*net.TCPAddr).Port
+	if err := enc.Encode(&resp); err != nil {
+		return
+	}
+	t.log().Info("Relaying port", Field("port", resp.Port), Field("remote", conn.RemoteAddr()))
+
+	// Only the relayed node may pick up the connections accepted for it
+	owner := addrHost(conn.RemoteAddr())
+
+	// Nothing else is sent over the control connection, so this only
+	// returns once the relayed node goes away
+	go func() {
+		var ignored tcpHeader
+		for dec.Decode(&ignored) == nil {
+		}
+		sock.Close()
+	}()
+
+	for {
+		in, err := sock.AcceptTCP()
+		if err != nil {
+			t.log().Info("Stopped relaying port", Field("port", resp.Port), Field("remote", conn.RemoteAddr()))
+			return
+		}
+		t.setupConn(in)
+
+		id, err := t.addRelayedConn(in, owner)
+		if err == nil {
+			err = enc.Encode(&tcpBodyRelayConn{ConnId: id})
+		}
+		if err != nil {
+			t.takeRelayedConn(id, owner)
+			in.Close()
+			return
+		}
+
+		// Drop connections the relayed node does not pick up
+		time.AfterFunc(TCP_RELAY_ATTACH_TIMEOUT, func() {
+			if in := t.takeRelayedConn(id, owner); in != nil {
+				in.Close()
+			}
+		})
+	}
+}
+
+// Connects a connection accepted for a relayed node to the connection the
+// node attached with
+func (t *TCPTransport) attachRelayed(conn net.Conn, dec *json.Decoder, id uint64) {
+	in := t.takeRelayedConn(id, addrHost(conn.RemoteAddr()))
+	if in == nil {
+		t.log().Error("Relayed node attached to unknown connection", Field("remote", conn.RemoteAddr()), Field("conn", id))
+		conn.Close()
+		return
+	}
+
+	// Anything the decoder read ahead belongs to the relayed stream
+	go func() {
+		io.Copy(in, io.MultiReader(dec.Buffered(), conn))
+		in.Close()
+		conn.Close()
+	}()
+	io.Copy(conn, in)
+	in.Close()
+	conn.Close()
+}
+
+// Registers a connection accepted for the relayed node at owner, under an
+// unguessable ID
+func (t *TCPTransport) addRelayedConn(in *net.TCPConn, owner string) (uint64, error) {
+	t.relayLock.Lock()
+	defer t.relayLock.Unlock()
+
+	var buf [8]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0, err
+		}
+		id := binary.BigEndian.Uint64(buf[:])
+		if _, ok := t.relayConns[id]; ok || id == 0 {
+			continue
+		}
+		t.relayConns[id] = &relayedConn{in: in, owner: owner}
+		return id, nil
+	}
+}
+
+// Takes the connection registered under id, if the node at host owns it
+func (t *TCPTransport) takeRelayedConn(id uint64, host string) *net.TCPConn {
+	t.relayLock.Lock()
+	defer t.relayLock.Unlock()
+
+	rc := t.relayConns[id]
+	if rc == nil || rc.owner != host {
+		return nil
+	}
+	delete(t.relayConns, id)
+	return rc.in
+}
+
+// Returns the host part of a network address
+func addrHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Returns the address the relay accepts connections for us on
+func (rc *relayClient) addr() string {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	return net.JoinHostPort(rc.host, strconv.Itoa(rc.port))
+}
+
+// Opens the control connection and asks the relay for a port
+func (rc *relayClient) connect() error {
+	sock, err := rc.t.dial(rc.peer, rc.t.timeout)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(sock)
+	dec := json.NewDecoder(sock)
+
+	sock.SetDeadline(time.Now().Add(rc.t.timeout))
+	resp := tcpBodyRelayResp{}
+	err = enc.Encode(&tcpHeader{ReqType: tcpRelayReq})
+	if err == nil {
+		err = enc.Encode(&tcpBodyRelayReq{Port: rc.port})
+	}
+	if err == nil {
+		err = dec.Decode(&resp)
+	}
+	if err == nil {
+		err = resp.Error()
+	}
+	if err != nil {
+		sock.Close()
+		return err
+	}
+	sock.SetDeadline(time.Time{})
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	if rc.isClosed() {
+		sock.Close()
+		return fmt.Errorf("Relay client is closed")
+	}
+	if rc.port != 0 && rc.port != resp.Port {
+		rc.t.log().Error("Relay moved us to another port, peers will not find us", Field("relay", rc.peer), Field("from", rc.port), Field("to", resp.Port))
+	}
+	remote, ok := sock.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		sock.Close()
+		return fmt.Errorf("Relay %s is not connected over TCP", rc.peer)
+	}
+	rc.port = resp.Port
+	rc.host = remote.IP.String()
+	rc.conn = sock
+	rc.dec = dec
+	return nil
+}
+
+// Attaches to every connection the relay announces, reconnecting to the
+// relay if the control connection drops
+func (rc *relayClient) run() {
+	wait := TCP_RELAY_RETRY_MIN_WAIT
+	for {
+		rc.lock.Lock()
+		dec := rc.dec
+		rc.lock.Unlock()
+
+		msg := tcpBodyRelayConn{}
+		err := dec.Decode(&msg)
+		if err == nil {
+			go rc.attach(msg.ConnId)
+			continue
+		}
+
+		for {
+			if rc.isClosed() {
+				return
+			}
+			rc.t.log().Error("Lost connection to relay, reconnecting", Field("relay", rc.peer), Field("wait", wait), Field("err", err))
+			time.Sleep(wait)
+
+			if err = rc.connect(); err == nil {
+				wait = TCP_RELAY_RETRY_MIN_WAIT
+				break
+			}
+			wait *= 2
+			if wait > TCP_RELAY_RETRY_MAX_WAIT {
+				wait = TCP_RELAY_RETRY_MAX_WAIT
+			}
+		}
+	}
+}
+
+// Dials the relay to pick up an accepted connection, and serves it
+func (rc *relayClient) attach(id uint64) {
+	sock, err := rc.t.dial(rc.peer, rc.t.timeout)
+	if err != nil {
+		rc.t.log().Error("Unable to attach to relay", Field("relay", rc.peer), Field("err", err))
+		return
+	}
+
+	enc := json.NewEncoder(sock)
+	if err := enc.Encode(&tcpHeader{ReqType: tcpRelayAttachReq}); err == nil {
+		err = enc.Encode(&tcpBodyRelayAttach{ConnId: id})
+	}
+	if err != nil {
+		rc.t.log().Error("Unable to attach to relay", Field("relay", rc.peer), Field("err", err))
+		sock.Close()
+		return
+	}
+
+	// Register the inbound conn, so that it is closed on shutdown
+	rc.t.lock.Lock()
+	if atomic.LoadInt32(&rc.t.shutdown) == 1 {
+		rc.t.lock.Unlock()
+		sock.Close()
+		return
+	}
+	rc.t.inbound[sock] = struct{}{}
+	rc.t.lock.Unlock()
+
+	rc.t.handleConn(sock)
+}
+
+func (rc *relayClient) isClosed() bool {
+	return atomic.LoadInt32(&rc.closed) == 1
+}
+
+// Closes the control connection, which makes the relay stop listening for us
+func (rc *relayClient) close() {
+	atomic.StoreInt32(&rc.closed, 1)
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.conn.Close()
+}
+
+/*
+Runs the reachability self test of a transport through the given peer, if
+the NAT configuration asks for it. If the peer cannot reach conf.Hostname and
+relaying is enabled, the peer is asked to relay for us instead, and
+conf.Hostname is changed to the relayed address.
+*/
+func ensureReachable(nconf *NATConfig, transport Transport, conf *Config, peer string) error {
+	tcp, ok := transport.(*TCPTransport)
+	if nconf == nil || !nconf.SelfTest || !ok {
+		return nil
+	}
+
+	// Unix sockets do not go through a NAT
+	if tcp.ListenPort() == 0 {
+		return nil
+	}
+
+	if addr := tcp.RelayAddr(); addr != "" {
+		conf.Hostname = addr
+		return nil
+	}
+
+	err := tcp.CheckReachable(peer, conf.Hostname)
+	if err == nil {
+		tcp.log().Info("Peer can reach us", Field("peer", peer), Field("host", conf.Hostname))
+		return nil
+	}
+	tcp.log().Error("Peers cannot reach us", Field("host", conf.Hostname), Field("err", err))
+
+	if !nconf.Relay {
+		return nil
+	}
+
+	addr, err := tcp.StartRelay(peer)
+	if err != nil {
+		return fmt.Errorf("Unable to relay through %s: %s", peer, err)
+	}
+
+	tcp.log().Info("Relaying through peer", Field("peer", peer), Field("addr", addr))
+	conf.Hostname = addr
+	return nil
+}
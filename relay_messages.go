@@ -0,0 +1,21 @@
+package buddystore
+
+type tcpBodyRelayReq struct {
+	Port int // Relay port used before, if reconnecting
+}
+
+type tcpBodyRelayResp struct {
+	Port int
+
+	// Extends:
+	TCPResponseImpl
+}
+
+// Sent by the relay for every connection the relayed node should pick up
+type tcpBodyRelayConn struct {
+	ConnId uint64
+}
+
+type tcpBodyRelayAttach struct {
+	ConnId uint64
+}
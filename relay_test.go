@@ -0,0 +1,148 @@
+package buddystore
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates a ring on a TCP transport with a timeout long enough for relaying
+func prepRelayRing(t *testing.T, port uint) (*Config, *TCPTransport, *Ring) {
+	listen := fmt.Sprintf("127.0.0.1:%d", port)
+	conf := fastConf()
+	conf.Hostname = listen
+	trans, err := InitTCPTransport(listen, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	r, err := Create(conf, trans)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	return conf, trans, r
+}
+
+func TestTCPTransportCheckReachable(t *testing.T) {
+	c1, t1, r1 := prepRelayRing(t, PORT+2060)
+	defer t1.Shutdown()
+	defer r1.Shutdown()
+	c2, t2, r2 := prepRelayRing(t, PORT+2061)
+	defer t2.Shutdown()
+	defer r2.Shutdown()
+
+	assert.NoError(t, t2.CheckReachable(c1.Hostname, c2.Hostname))
+
+	// Nothing listens here
+	assert.Error(t, t2.CheckReachable(c1.Hostname, fmt.Sprintf("127.0.0.1:%d", PORT+2062)))
+
+	// Peers only connect back to the requesting host
+	assert.Error(t, t2.CheckReachable(c1.Hostname, "192.0.2.1:80"))
+}
+
+func TestTCPTransportRelay(t *testing.T) {
+	c1, t1, r1 := prepRelayRing(t, PORT+2063)
+	defer t1.Shutdown()
+	defer r1.Shutdown()
+
+	// The relayed node is reachable under the relay address only
+	c2, t2, r2 := prepRelayRing(t, PORT+2064)
+	defer t2.Shutdown()
+	defer r2.Shutdown()
+
+	addr, err := t2.StartRelay(c1.Hostname)
+	assert.NoError(t, err)
+	assert.NotEqual(t, c2.Hostname, addr)
+	assert.Equal(t, addr, t2.RelayAddr())
+
+	// A third node lists the vnodes of the relayed node through the relay
+	listen := fmt.Sprintf("127.0.0.1:%d", PORT+2065)
+	t3, err := InitTCPTransport(listen, time.Second)
+	assert.NoError(t, err)
+	defer t3.Shutdown()
+
+	vns, err := t3.ListVnodes(addr)
+	assert.NoError(t, err)
+	assert.Equal(t, c2.NumVnodes, len(vns))
+	for _, vn := range vns {
+		assert.Equal(t, c2.Hostname, vn.Host)
+	}
+
+	// Pooled connections keep working through the relay
+	ok, err := t3.Ping(&Vnode{Id: vns[0].Id, Host: addr})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// A relayed node does not relay for others
+	_, err = t3.StartRelay(addr)
+	assert.Error(t, err)
+}
+
+func TestTCPTransportRelayLimit(t *testing.T) {
+	c1, t1, r1 := prepRelayRing(t, PORT+2066)
+	defer t1.Shutdown()
+	defer r1.Shutdown()
+	t1.maxRelayed = -1
+
+	_, t2, r2 := prepRelayRing(t, PORT+2067)
+	defer t2.Shutdown()
+	defer r2.Shutdown()
+
+	_, err := t2.StartRelay(c1.Hostname)
+	assert.Error(t, err)
+	assert.Equal(t, "", t2.RelayAddr())
+}
+
+func TestEnsureReachableRelaysUnreachableNode(t *testing.T) {
+	c1, t1, r1 := prepRelayRing(t, PORT+2068)
+	defer t1.Shutdown()
+	defer r1.Shutdown()
+
+	listen := fmt.Sprintf("127.0.0.1:%d", PORT+2069)
+	t2, err := InitTCPTransport(listen, time.Second)
+	assert.NoError(t, err)
+	defer t2.Shutdown()
+
+	// Pretend that we advertise a port nobody can connect to
+	conf := fastConf()
+	conf.Hostname = fmt.Sprintf("127.0.0.1:%d", PORT+2070)
+
+	nconf := &NATConfig{SelfTest: true}
+	assert.NoError(t, ensureReachable(nconf, t2, conf, c1.Hostname))
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", PORT+2070), conf.Hostname)
+	assert.Equal(t, "", t2.RelayAddr())
+
+	nconf.Relay = true
+	assert.NoError(t, ensureReachable(nconf, t2, conf, c1.Hostname))
+	assert.Equal(t, t2.RelayAddr(), conf.Hostname)
+
+	// Joining with the relayed address makes the ring route through the relay
+	r2, err := Join(conf, t2, c1.Hostname)
+	assert.NoError(t, err)
+	defer r2.Shutdown()
+
+	vns, err := t1.ListVnodes(conf.Hostname)
+	assert.NoError(t, err)
+	assert.Equal(t, conf.NumVnodes, len(vns))
+}
+
+func TestTCPTransportRelayedConnOwner(t *testing.T) {
+	_, t1, r1 := prepRelayRing(t, PORT+2071)
+	defer t1.Shutdown()
+	defer r1.Shutdown()
+
+	in := &net.TCPConn{}
+	id1, err := t1.addRelayedConn(in, "192.0.2.1")
+	assert.NoError(t, err)
+	id2, err := t1.addRelayedConn(in, "192.0.2.1")
+	assert.NoError(t, err)
+	assert.NotEqual(t, id1, id2)
+
+	// Other hosts cannot take the connection, and do not drop it either
+	assert.Nil(t, t1.takeRelayedConn(id1, "192.0.2.2"))
+	assert.Equal(t, in, t1.takeRelayedConn(id1, "192.0.2.1"))
+	assert.Nil(t, t1.takeRelayedConn(id1, "192.0.2.1"))
+}
@@ -0,0 +1,120 @@
+package buddystore
+
+import (
+	"fmt"
+	"hash"
+)
+
+/*
+RemoteRing is a ring seen from outside, through the vnodes of one of its
+hosts. It answers lookups and walks the ring over a transport without
+joining it, so that KV store and lock manager clients can be used from a
+process that does not run any vnodes itself, such as a command-line tool.
+Its local vnode only identifies the client to the lock manager.
+*/
+type RemoteRing struct {
+	config    *Config
+	transport Transport
+	seeds     []*Vnode
+	self      *Vnode
+
+	// Implements:
+	RingIntf
+}
+
+var _ RingIntf = new(RemoteRing)
+
+/*
+Connects to the ring of the given host. The configuration must match the one
+of the ring, its Hostname is the address the client is reachable at for lock
+invalidations.
+*/
+func NewRemoteRing(conf *Config, trans Transport, host string) (*RemoteRing, error) {
+	conf.hashBits = conf.HashFunc().Size() * 8
+
+	seeds, err := trans.ListVnodes(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("Remote host has no vnodes!")
+	}
+
+	hash := conf.HashFunc()
+	hash.Write([]byte(conf.Hostname))
+	self := &Vnode{Id: hash.Sum(nil), Host: conf.Hostname}
+
+	return &RemoteRing{config: conf, transport: trans, seeds: seeds, self: self}, nil
+}
+
+// Does a key lookup for up to N successors of a key, through the nearest
+// vnode of the host
+func (rr *RemoteRing) Lookup(n int, key []byte) ([]*Vnode, error) {
+	if n > rr.config.NumSuccessors {
+		return nil, fmt.Errorf("Cannot ask for more successors than NumSuccessors!")
+	}
+
+	h := rr.config.HashFunc()
+	h.Write(key)
+	key_hash := h.Sum(nil)
+
+	successors, err := rr.transport.FindSuccessors(nearestVnodeToKey(rr.seeds, key_hash), n, key_hash)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trim the nil successors
+	for len(successors) > 0 && successors[len(successors)-1] == nil {
+		successors = successors[:len(successors)-1]
+	}
+	return successors, nil
+}
+
+// Takes a snapshot of the ring, walking it from a vnode of the host
+func (rr *RemoteRing) Snapshot() (*RingSnapshot, error) {
+	return snapshotRing(rr.transport, rr.seeds[0], rr.config)
+}
+
+// Returns the keys stored on the ring, in order
+func (rr *RemoteRing) Keys() ([]string, error) {
+	return listRingKeys(rr.transport, rr.seeds[0], rr.config.hashBits)
+}
+
+// Nothing to leave, the client never joined the ring
+func (rr *RemoteRing) Leave() error {
+	return nil
+}
+
+func (rr *RemoteRing) Shutdown() {
+}
+
+func (rr *RemoteRing) Transport() Transport {
+	return rr.transport
+}
+
+func (rr *RemoteRing) GetNumSuccessors() int {
+	return rr.config.NumSuccessors
+}
+
+func (rr *RemoteRing) GetLocalVnode() *Vnode {
+	return rr.self
+}
+
+// There are no local vnodes to return
+func (rr *RemoteRing) GetLocalLocalVnode() *localVnode {
+	return nil
+}
+
+func (rr *RemoteRing) GetRingId() string {
+	return rr.config.RingId
+}
+
+func (rr *RemoteRing) GetHashFunc() func() hash.Hash {
+	return rr.config.HashFunc
+}
+
+// Creates a KV store client using the ring from outside
+func NewRemoteKVStoreClient(ring *RemoteRing) *KVStoreClientImpl {
+	lm := &LManagerClient{Ring: ring, RLocks: make(map[string]*RLockVal), WLocks: make(map[string]*WLockVal)}
+	return &KVStoreClientImpl{ring: ring, lm: lm}
+}
@@ -0,0 +1,105 @@
+package buddystore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Starts a stable cluster and a remote view of its ring from outside
+func startRemoteRing(t *testing.T) (*Cluster, *RemoteRing) {
+	c, err := NewStableCluster(3, 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	remote, err := NewRemoteRing(DefaultConfig("client"), c.Network.TransportFor("client"), "host-1")
+	if err != nil {
+		c.Shutdown()
+		t.Fatalf("unexpected err. %s", err)
+	}
+	return c, remote
+}
+
+func TestRemoteRingLookup(t *testing.T) {
+	c, remote := startRemoteRing(t)
+	defer c.Shutdown()
+
+	expected, err := c.Node("host-0").Ring.Lookup(3, []byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	vnodes, err := remote.Lookup(3, []byte("key"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(vnodes) != 3 {
+		t.Fatalf("unexpected vnodes %v", vnodes)
+	}
+	for i := range vnodes {
+		if !bytes.Equal(vnodes[i].Id, expected[i].Id) {
+			t.Fatalf("expected %v, got %v", expected, vnodes)
+		}
+	}
+
+	if _, err := remote.Lookup(9, []byte("key")); err == nil {
+		t.Fatalf("expected an error asking for more than NumSuccessors")
+	}
+
+	snapshot, err := remote.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(snapshot.Vnodes) != 24 || snapshot.Vnodes[0].Host != "host-1" {
+		t.Fatalf("unexpected snapshot %+v", snapshot.Vnodes)
+	}
+}
+
+func TestRemoteRingKVClient(t *testing.T) {
+	c, remote := startRemoteRing(t)
+	defer c.Shutdown()
+	kv := NewRemoteKVStoreClient(remote)
+
+	if err := kv.Set("a", []byte("1")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := c.Node("host-2").KV.Set("b", []byte("2")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	if val, err := c.Node("host-0").KV.Get("a", true); err != nil || string(val) != "1" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+	if val, err := kv.Get("b", true); err != nil || string(val) != "2" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+
+	keys, err := remote.Keys()
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if local, err := c.Node("host-0").Ring.Keys(); err != nil || len(local) != 2 {
+		t.Fatalf("unexpected keys %v. %v", local, err)
+	}
+
+	if err := kv.Delete("a"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if val, err := c.Node("host-1").KV.Get("a", false); !IsNotFound(err) {
+		t.Fatalf("expected the key to be deleted, got %q. %v", val, err)
+	}
+	if err := kv.Delete("missing"); err == nil {
+		t.Fatalf("expected an error deleting a missing key")
+	}
+
+	// Keys can be set again once deleted
+	if err := kv.Set("a", []byte("3")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if val, err := c.Node("host-2").KV.Get("a", true); err != nil || string(val) != "3" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+}
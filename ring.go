@@ -2,7 +2,6 @@ package buddystore
 
 import (
 	"bytes"
-	"log"
 	"sort"
 )
 
@@ -28,6 +27,7 @@ func (r *Ring) init(conf *Config, trans Transport) {
 
 	// Sort the vnodes
 	sort.Sort(r)
+	registerRingMetrics(r)
 }
 
 /* Initialize the LManager with the block flag set to true */
@@ -51,6 +51,33 @@ func (r *Ring) initBlockingLM(conf *Config, trans Transport) {
 
 	// Sort the vnodes
 	sort.Sort(r)
+	registerRingMetrics(r)
+}
+
+// Logs on behalf of the ring
+func (r *Ring) log() *fieldLogger {
+	return configLogger(r.config)
+}
+
+// Logs on behalf of a ring with the given configuration
+func configLogger(conf *Config) *fieldLogger {
+	return newFieldLogger(conf.Logger, Field("ring", conf.RingId))
+}
+
+// Logs on behalf of a ring that may not be local
+func ringLogger(ring RingIntf) *fieldLogger {
+	if r, ok := ring.(*Ring); ok {
+		return r.log()
+	}
+	return newFieldLogger(nil)
+}
+
+// Returns the clock driving the timers of the ring
+func (r *Ring) clock() ClockIface {
+	if r.config.Clock != nil {
+		return r.config.Clock
+	}
+	return realClock
 }
 
 // Len is the number of vnodes
@@ -90,6 +117,20 @@ func (r *Ring) schedule() {
 	}
 }
 
+// Advertises the ring on the local network, if discovery is configured
+func (r *Ring) advertise() {
+	if r.config.Discovery != nil {
+		r.config.Discovery.Advertise(r.config.Hostname, r.config.RingId)
+	}
+}
+
+// Stops advertising the ring on the local network
+func (r *Ring) withdraw() {
+	if r.config.Discovery != nil {
+		r.config.Discovery.Withdraw(r.config.Hostname, r.config.RingId)
+	}
+}
+
 // Signal that the ring is being shut down.
 func (r *Ring) requestShutdown() {
 	defer r.shutdownLock.Unlock()
@@ -114,12 +155,34 @@ func (r *Ring) stopVnodes() {
 	}
 }
 
+// Stops all the vnodes without waiting for their next stabilization run.
+// Unlike stopVnodes, the vnodes stop answering for the ring right away, so
+// this is only suitable when not leaving gracefully.
+func (r *Ring) stopVnodesNow() {
+	r.requestShutdown()
+	for _, vn := range r.vnodes {
+		// Vnodes waiting on their stabilize timer can be stopped right away,
+		// the others notice the shutdown request on their next run
+		if vn.cancelSchedule() {
+			r.shutdownComplete <- true
+		}
+	}
+	for i := 0; i < r.config.NumVnodes; i++ {
+		<-r.shutdownComplete
+	}
+}
+
 // Stops the delegate handler
 func (r *Ring) stopDelegate() {
 	if r.config.Delegate != nil {
 		// Wait for all delegate messages to be processed
 		<-r.invokeDelegate(r.config.Delegate.Shutdown)
+
+		// Vnodes of other rings may still notify ours
+		r.delegateLock.Lock()
+		r.delegateClosed = true
 		close(r.delegateCh)
+		r.delegateLock.Unlock()
 	}
 }
 
@@ -169,6 +232,14 @@ func (r *Ring) invokeDelegate(f func()) chan struct{} {
 		f()
 	}
 
+	r.delegateLock.RLock()
+	defer r.delegateLock.RUnlock()
+	if r.delegateClosed {
+		// Nobody is listening anymore
+		ch <- struct{}{}
+		return ch
+	}
+
 	r.delegateCh <- wrapper
 	return ch
 }
@@ -187,8 +258,8 @@ func (r *Ring) delegateHandler() {
 // Called to safely call a function on the delegate
 func (r *Ring) safeInvoke(f func()) {
 	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("Caught a panic invoking a delegate function! Got: %s", r)
+		if rec := recover(); rec != nil {
+			r.log().Error("Caught a panic invoking a delegate function", Field("panic", rec))
 		}
 	}()
 	f()
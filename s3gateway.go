@@ -0,0 +1,527 @@
+package buddystore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Most keys returned by a single listing
+const S3_MAX_KEYS = 1000
+
+// The store keeps no modification times, so every object reports this one
+var s3ModTime = time.Unix(0, 0).UTC()
+
+/*
+S3Gateway serves the KV stores of rings through a subset of the Amazon S3
+API, so that tools speaking S3 can store objects on a ring unchanged. Each
+ring is a bucket, and each key an object. Buckets are addressed in the path
+only, as http://host/<bucket>/<key>.
+
+	GET    /                         ListBuckets
+	HEAD   /<bucket>                 HeadBucket
+	PUT    /<bucket>                 CreateBucket, for rings already joined
+	GET    /<bucket>?location        GetBucketLocation
+	GET    /<bucket>?list-type=2     ListObjectsV2, also ListObjects without list-type
+	PUT    /<bucket>/<key>           PutObject
+	GET    /<bucket>/<key>           GetObject, with ranges
+	HEAD   /<bucket>/<key>           HeadObject
+	DELETE /<bucket>/<key>           DeleteObject
+
+Requests are not authenticated, signatures are accepted without being
+checked. Multipart uploads, copies, versioning and object metadata are not
+supported. The ETag of an object is the MD5 of its value.
+*/
+type S3Gateway struct {
+	MaxValueSize int64 // Largest object accepted, GATEWAY_MAX_VALUE_SIZE if 0
+
+	clients func(ringId string) (KVStoreClient, int)
+	buckets func() []string
+}
+
+// Serves the KV stores of the rings clients returns as buckets. buckets lists them for ListBuckets.
+func NewS3Gateway(clients func(ringId string) (KVStoreClient, int), buckets func() []string) *S3Gateway {
+	return &S3Gateway{clients: clients, buckets: buckets}
+}
+
+// Starts serving the KV stores through the S3 API. Close the listener to stop.
+func ServeS3Gateway(listen string, clients func(ringId string) (KVStoreClient, int), buckets func() []string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	go http.Serve(listener, NewS3Gateway(clients, buckets))
+	return listener, nil
+}
+
+// Error returned by the S3 API
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+	status   int
+}
+
+var (
+	errS3NoSuchBucket   = &s3Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist", status: http.StatusNotFound}
+	errS3NoSuchKey      = &s3Error{Code: "NoSuchKey", Message: "The specified key does not exist", status: http.StatusNotFound}
+	errS3NotImplemented = &s3Error{Code: "NotImplemented", Message: "This operation is not supported by the gateway", status: http.StatusNotImplemented}
+	errS3NotRunning     = &s3Error{Code: "ServiceUnavailable", Message: "Store is not running", status: http.StatusServiceUnavailable}
+	errS3TooLarge       = &s3Error{Code: "EntityTooLarge", Message: "Your proposed upload exceeds the maximum allowed object size", status: http.StatusBadRequest}
+	errS3BadDigest      = &s3Error{Code: "BadDigest", Message: "The Content-MD5 you specified did not match what we received", status: http.StatusBadRequest}
+	errS3BadMethod      = &s3Error{Code: "MethodNotAllowed", Message: "The specified method is not allowed against this resource", status: http.StatusMethodNotAllowed}
+)
+
+// Maps an error of the KV store to an S3 error
+func s3StoreError(err error) *s3Error {
+	switch gatewayStatus(err) {
+	case http.StatusNotFound:
+		return errS3NoSuchKey
+	case http.StatusConflict:
+		return &s3Error{Code: "OperationAborted", Message: err.Error(), status: http.StatusConflict}
+	case http.StatusServiceUnavailable:
+		return &s3Error{Code: "SlowDown", Message: err.Error(), status: http.StatusServiceUnavailable}
+	}
+	return &s3Error{Code: "InternalError", Message: err.Error(), status: http.StatusInternalServerError}
+}
+
+func writeS3Error(w http.ResponseWriter, req *http.Request, e *s3Error) {
+	res := *e
+	res.Resource = req.URL.Path
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.status)
+	if req.Method != "HEAD" {
+		io.WriteString(w, xml.Header)
+		xml.NewEncoder(w).Encode(&res)
+	}
+}
+
+func writeS3XML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if len(path) == 0 {
+		if req.Method != "GET" {
+			writeS3Error(w, req, errS3BadMethod)
+			return
+		}
+		g.listBuckets(w, req)
+		return
+	}
+
+	parts := strings.SplitN(path, "/", 2)
+	bucket := parts[0]
+	kv, code := g.clients(bucket)
+	switch code {
+	case OK:
+	case ENOTINITIALIZED:
+		writeS3Error(w, req, errS3NotRunning)
+		return
+	default:
+		writeS3Error(w, req, errS3NoSuchBucket)
+		return
+	}
+
+	if len(parts) == 1 || len(parts[1]) == 0 {
+		g.handleBucket(w, req, kv, bucket)
+		return
+	}
+
+	query := req.URL.Query()
+	for _, sub := range []string{"uploads", "uploadId", "acl", "tagging", "versionId"} {
+		if _, ok := query[sub]; ok {
+			writeS3Error(w, req, errS3NotImplemented)
+			return
+		}
+	}
+
+	key := parts[1]
+	switch req.Method {
+	case "GET", "HEAD":
+		g.getObject(w, req, kv, key)
+	case "PUT":
+		if len(req.Header.Get("X-Amz-Copy-Source")) > 0 {
+			writeS3Error(w, req, errS3NotImplemented)
+			return
+		}
+		g.putObject(w, req, kv, key)
+	case "DELETE":
+		g.deleteObject(w, req, kv, key)
+	default:
+		writeS3Error(w, req, errS3NotImplemented)
+	}
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+func (g *S3Gateway) listBuckets(w http.ResponseWriter, req *http.Request) {
+	res := &s3ListBucketsResult{Owner: s3Owner{"buddystore", "buddystore"}}
+	if g.buckets != nil {
+		for _, name := range g.buckets() {
+			res.Buckets = append(res.Buckets, s3Bucket{name, s3ModTime.Format(time.RFC3339)})
+		}
+	}
+	writeS3XML(w, res)
+}
+
+func (g *S3Gateway) handleBucket(w http.ResponseWriter, req *http.Request, kv KVStoreClient, bucket string) {
+	query := req.URL.Query()
+	switch req.Method {
+	case "HEAD":
+		w.WriteHeader(http.StatusOK)
+	case "PUT":
+		// Rings are created by joining them, the bucket already exists
+		w.Header().Set("Location", "/"+bucket)
+		w.WriteHeader(http.StatusOK)
+	case "GET":
+		if _, ok := query["location"]; ok {
+			writeS3XML(w, &struct {
+				XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+			}{})
+			return
+		}
+		for _, sub := range []string{"uploads", "versions", "acl", "policy", "lifecycle", "tagging"} {
+			if _, ok := query[sub]; ok {
+				writeS3Error(w, req, errS3NotImplemented)
+				return
+			}
+		}
+		g.listObjects(w, req, kv, bucket)
+	default:
+		writeS3Error(w, req, errS3NotImplemented)
+	}
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+// Result of ListObjects, and of ListObjectsV2 which adds the fields after IsTruncated
+type s3ListObjectsResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Marker                *string `xml:"Marker,omitempty"`
+	NextMarker            string  `xml:"NextMarker,omitempty"`
+	Delimiter             string  `xml:"Delimiter,omitempty"`
+	EncodingType          string  `xml:"EncodingType,omitempty"`
+	MaxKeys               int
+	IsTruncated           bool
+	KeyCount              *int             `xml:"KeyCount,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+func (g *S3Gateway) listObjects(w http.ResponseWriter, req *http.Request, kv KVStoreClient, bucket string) {
+	lister, ok := kv.(keyLister)
+	if !ok {
+		writeS3Error(w, req, errS3NotImplemented)
+		return
+	}
+
+	query := req.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	maxKeys := S3_MAX_KEYS
+	if m := query.Get("max-keys"); len(m) > 0 {
+		n, err := strconv.Atoi(m)
+		if err != nil || n < 0 {
+			writeS3Error(w, req, &s3Error{Code: "InvalidArgument", Message: "Invalid max-keys " + m, status: http.StatusBadRequest})
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	res := &s3ListObjectsResult{Name: bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys}
+	after := ""
+	if v2 {
+		res.StartAfter = query.Get("start-after")
+		after = res.StartAfter
+		if token := query.Get("continuation-token"); len(token) > 0 {
+			last, err := base64.URLEncoding.DecodeString(token)
+			if err != nil {
+				writeS3Error(w, req, &s3Error{Code: "InvalidArgument", Message: "Invalid continuation-token", status: http.StatusBadRequest})
+				return
+			}
+			res.ContinuationToken = token
+			if string(last) > after {
+				after = string(last)
+			}
+		}
+	} else {
+		marker := query.Get("marker")
+		res.Marker = &marker
+		after = marker
+	}
+
+	keys, err := lister.Keys()
+	if err != nil {
+		writeS3Error(w, req, s3StoreError(err))
+		return
+	}
+	sort.Strings(keys)
+
+	last := ""
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+
+		// Keys sharing a prefix up to the delimiter are listed once, as a common prefix
+		if i := strings.Index(key[len(prefix):], delimiter); len(delimiter) > 0 && i >= 0 {
+			common := key[:len(prefix)+i+len(delimiter)]
+			if common == last || strings.HasPrefix(after, common) {
+				continue
+			}
+			if len(res.Contents)+len(res.CommonPrefixes) == maxKeys {
+				res.IsTruncated = true
+				break
+			}
+			res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{common})
+			last = common
+			continue
+		}
+
+		// Values are only read for the keys returned. The next page may
+		// turn out empty if the keys left are deleted meanwhile.
+		if len(res.Contents)+len(res.CommonPrefixes) == maxKeys {
+			res.IsTruncated = true
+			break
+		}
+
+		// Keys deleted since the listing are skipped
+		val, err := kv.Get(key, true)
+		if err != nil {
+			if IsNotFound(err) {
+				continue
+			}
+			writeS3Error(w, req, s3StoreError(err))
+			return
+		}
+		res.Contents = append(res.Contents, s3Object{key, s3ModTime.Format(time.RFC3339), s3ETag(val), len(val), "STANDARD"})
+		last = key
+	}
+
+	if res.IsTruncated {
+		if v2 {
+			res.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(last))
+		} else {
+			res.NextMarker = last
+		}
+	}
+	if v2 {
+		count := len(res.Contents) + len(res.CommonPrefixes)
+		res.KeyCount = &count
+	}
+
+	if query.Get("encoding-type") == "url" {
+		res.encodeKeys()
+	}
+	writeS3XML(w, res)
+}
+
+// URL encodes the keys of a listing, as asked for with encoding-type=url
+func (res *s3ListObjectsResult) encodeKeys() {
+	encode := func(s string) string {
+		return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+	}
+
+	res.EncodingType = "url"
+	res.Prefix = encode(res.Prefix)
+	res.Delimiter = encode(res.Delimiter)
+	res.StartAfter = encode(res.StartAfter)
+	res.NextMarker = encode(res.NextMarker)
+	if res.Marker != nil {
+		marker := encode(*res.Marker)
+		res.Marker = &marker
+	}
+	for i := range res.Contents {
+		res.Contents[i].Key = encode(res.Contents[i].Key)
+	}
+	for i := range res.CommonPrefixes {
+		res.CommonPrefixes[i].Prefix = encode(res.CommonPrefixes[i].Prefix)
+	}
+}
+
+func s3ETag(val []byte) string {
+	sum := md5.Sum(val)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (g *S3Gateway) getObject(w http.ResponseWriter, req *http.Request, kv KVStoreClient, key string) {
+	val, err := kv.Get(key, true)
+	if err != nil {
+		writeS3Error(w, req, s3StoreError(err))
+		return
+	}
+
+	w.Header().Set("ETag", s3ETag(val))
+	w.Header().Set("Last-Modified", s3ModTime.Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(val))
+}
+
+func (g *S3Gateway) putObject(w http.ResponseWriter, req *http.Request, kv KVStoreClient, key string) {
+	max := g.MaxValueSize
+	if max == 0 {
+		max = GATEWAY_MAX_VALUE_SIZE
+	}
+
+	body := req.Body
+	size := req.ContentLength
+	if strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		// Signed streaming uploads wrap the object in chunks
+		body = ioutil.NopCloser(newAWSChunkedReader(req.Body))
+		size, _ = strconv.ParseInt(req.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	}
+	if size > max {
+		writeS3Error(w, req, errS3TooLarge)
+		return
+	}
+
+	val, err := ioutil.ReadAll(http.MaxBytesReader(w, body, max))
+	if err != nil {
+		if int64(len(val)) >= max {
+			writeS3Error(w, req, errS3TooLarge)
+		} else {
+			writeS3Error(w, req, &s3Error{Code: "IncompleteBody", Message: err.Error(), status: http.StatusBadRequest})
+		}
+		return
+	}
+
+	if digest := req.Header.Get("Content-MD5"); len(digest) > 0 {
+		sum := md5.Sum(val)
+		if digest != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeS3Error(w, req, errS3BadDigest)
+			return
+		}
+	}
+
+	if err := kv.Set(key, val); err != nil {
+		writeS3Error(w, req, s3StoreError(err))
+		return
+	}
+	w.Header().Set("ETag", s3ETag(val))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *S3Gateway) deleteObject(w http.ResponseWriter, req *http.Request, kv KVStoreClient, key string) {
+	deleter, ok := kv.(kvDeleter)
+	if !ok {
+		writeS3Error(w, req, errS3NotImplemented)
+		return
+	}
+
+	// Deleting a missing object succeeds
+	if err := deleter.Delete(key); err != nil && !IsNotFound(err) {
+		writeS3Error(w, req, s3StoreError(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Reads the object out of an aws-chunked body, as sent by signed streaming
+uploads. Each chunk is a hex size and a signature on a line, followed by the
+data and a line break. A chunk of size 0 ends the object, and is followed by
+optional trailers which are ignored. Chunk signatures are not checked.
+*/
+type awsChunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func newAWSChunkedReader(r io.Reader) *awsChunkedReader {
+	return &awsChunkedReader{r: bufio.NewReader(r)}
+}
+
+func (cr *awsChunkedReader) Read(p []byte) (int, error) {
+	if cr.done {
+		return 0, io.EOF
+	}
+
+	if cr.left == 0 {
+		line, err := cr.r.ReadString('\n')
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		size := strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+		cr.left, err = strconv.ParseInt(size, 16, 64)
+		if err != nil || cr.left < 0 {
+			return 0, fmt.Errorf("Invalid chunk size %q", size)
+		}
+		if cr.left == 0 {
+			cr.done = true
+			return 0, io.EOF
+		}
+	}
+
+	if int64(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.r.Read(p)
+	cr.left -= int64(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+
+	if cr.left == 0 {
+		var crlf [2]byte
+		if _, err := io.ReadFull(cr.r, crlf[:]); err != nil || string(crlf[:]) != "\r\n" {
+			return n, fmt.Errorf("Missing line break after chunk")
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,215 @@
+package buddystore
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startS3Cluster(t *testing.T) (*Cluster, *httptest.Server) {
+	c, err := NewStableCluster(2, 5*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	gateway := NewS3Gateway(func(ringId string) (KVStoreClient, int) {
+		switch ringId {
+		case "bucket":
+			return c.Node("host-0").KV, OK
+		case "down":
+			return nil, ENOTINITIALIZED
+		}
+		return nil, ENOTJOINED
+	}, func() []string {
+		return []string{"bucket"}
+	})
+	return c, httptest.NewServer(gateway)
+}
+
+func s3List(t *testing.T, url string) *s3ListObjectsResult {
+	resp, res := gatewayRequest(t, "GET", url, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, res)
+	}
+
+	var list s3ListObjectsResult
+	if err := xml.Unmarshal([]byte(res), &list); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	return &list
+}
+
+func listedKeys(list *s3ListObjectsResult) string {
+	var keys []string
+	for _, obj := range list.Contents {
+		keys = append(keys, obj.Key)
+	}
+	for _, common := range list.CommonPrefixes {
+		keys = append(keys, common.Prefix)
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestAWSChunkedReader(t *testing.T) {
+	body := "5;chunk-signature=abc\r\nhello\r\n6;chunk-signature=def\r\n world\r\n0;chunk-signature=ghi\r\n\r\n"
+	val, err := ioutil.ReadAll(newAWSChunkedReader(strings.NewReader(body)))
+	if err != nil || string(val) != "hello world" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+
+	for _, bad := range []string{"5;chunk-signature=abc\r\nhel", "x;chunk-signature=abc\r\n", "5\r\nhelloXX0\r\n\r\n"} {
+		if _, err := ioutil.ReadAll(newAWSChunkedReader(strings.NewReader(bad))); err == nil {
+			t.Fatalf("expected an error reading %q", bad)
+		}
+	}
+}
+
+func TestS3Objects(t *testing.T) {
+	c, server := startS3Cluster(t)
+	defer c.Shutdown()
+	defer server.Close()
+	url := server.URL + "/bucket/dir/object"
+
+	sum := md5.Sum([]byte("hello world"))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	resp, _ := gatewayRequest(t, "PUT", url, strings.NewReader("hello world"), map[string]string{
+		"Content-MD5": base64.StdEncoding.EncodeToString(sum[:]),
+	})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != etag {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if val, err := c.Node("host-1").KV.Get("dir/object", true); err != nil || string(val) != "hello world" {
+		t.Fatalf("unexpected value %q. %v", val, err)
+	}
+
+	if resp, res := gatewayRequest(t, "GET", url, nil, nil); resp.StatusCode != http.StatusOK || res != "hello world" || resp.Header.Get("ETag") != etag {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, res)
+	}
+	if resp, res := gatewayRequest(t, "GET", url, nil, map[string]string{"Range": "bytes=0-4"}); resp.StatusCode != http.StatusPartialContent || res != "hello" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, res)
+	}
+	if resp, _ := gatewayRequest(t, "HEAD", url, nil, nil); resp.StatusCode != http.StatusOK || resp.ContentLength != 11 || len(resp.Header.Get("Last-Modified")) == 0 {
+		t.Fatalf("unexpected response %d %d", resp.StatusCode, resp.ContentLength)
+	}
+
+	resp, _ = gatewayRequest(t, "PUT", url, strings.NewReader("corrupted"), map[string]string{
+		"Content-MD5": base64.StdEncoding.EncodeToString(sum[:]),
+	})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	// Signed streaming uploads
+	resp, _ = gatewayRequest(t, "PUT", url, strings.NewReader("3;chunk-signature=a\r\nnew\r\n0;chunk-signature=b\r\n\r\n"), map[string]string{
+		"X-Amz-Content-Sha256":         "STREAMING-AWS4-HMAC-SHA256-PAYLOAD",
+		"X-Amz-Decoded-Content-Length": "3",
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, res := gatewayRequest(t, "GET", url, nil, nil); resp.StatusCode != http.StatusOK || res != "new" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, res)
+	}
+
+	if resp, _ := gatewayRequest(t, "DELETE", url, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	resp, res := gatewayRequest(t, "GET", url, nil, nil)
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(res, "<Code>NoSuchKey</Code>") {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, res)
+	}
+	if resp, _ := gatewayRequest(t, "DELETE", url, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestS3ListObjects(t *testing.T) {
+	c, server := startS3Cluster(t)
+	defer c.Shutdown()
+	defer server.Close()
+
+	for _, key := range []string{"a/1", "a/2", "a/b/3", "b", "c d"} {
+		if resp, _ := gatewayRequest(t, "PUT", server.URL+"/bucket/"+key, strings.NewReader(key), nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %d", resp.StatusCode)
+		}
+	}
+
+	list := s3List(t, server.URL+"/bucket?list-type=2")
+	if keys := listedKeys(list); keys != "a/1,a/2,a/b/3,b,c d" || list.IsTruncated || *list.KeyCount != 5 {
+		t.Fatalf("unexpected listing %s %+v", keys, list)
+	}
+	if list.Contents[3].Size != 1 || list.Contents[3].ETag != s3ETag([]byte("b")) {
+		t.Fatalf("unexpected object %+v", list.Contents[3])
+	}
+
+	if keys := listedKeys(s3List(t, server.URL+"/bucket?list-type=2&prefix=a/")); keys != "a/1,a/2,a/b/3" {
+		t.Fatalf("unexpected listing %s", keys)
+	}
+	if keys := listedKeys(s3List(t, server.URL+"/bucket?list-type=2&delimiter=/")); keys != "b,c d,a/" {
+		t.Fatalf("unexpected listing %s", keys)
+	}
+	if keys := listedKeys(s3List(t, server.URL+"/bucket?list-type=2&prefix=a/&delimiter=/")); keys != "a/1,a/2,a/b/" {
+		t.Fatalf("unexpected listing %s", keys)
+	}
+	if keys := listedKeys(s3List(t, server.URL+"/bucket?list-type=2&prefix=c&encoding-type=url")); keys != "c%20d" {
+		t.Fatalf("unexpected listing %s", keys)
+	}
+
+	// Pages continue after the last key of the previous one
+	var pages []string
+	next := server.URL + "/bucket?list-type=2&max-keys=2&delimiter=/"
+	for {
+		list := s3List(t, next)
+		pages = append(pages, listedKeys(list))
+		if !list.IsTruncated {
+			break
+		}
+		next = server.URL + "/bucket?list-type=2&max-keys=2&delimiter=/&continuation-token=" + list.NextContinuationToken
+	}
+	if strings.Join(pages, "|") != "b,a/|c d" {
+		t.Fatalf("unexpected pages %v", pages)
+	}
+
+	list = s3List(t, server.URL+"/bucket?marker=a/2&max-keys=2")
+	if keys := listedKeys(list); keys != "a/b/3,b" || !list.IsTruncated || list.NextMarker != "b" || list.KeyCount != nil {
+		t.Fatalf("unexpected listing %s %+v", keys, list)
+	}
+}
+
+func TestS3Buckets(t *testing.T) {
+	c, server := startS3Cluster(t)
+	defer c.Shutdown()
+	defer server.Close()
+
+	resp, res := gatewayRequest(t, "GET", server.URL+"/", nil, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(res, "<Name>bucket</Name>") {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, res)
+	}
+	if resp, res := gatewayRequest(t, "GET", server.URL+"/bucket?location", nil, nil); resp.StatusCode != http.StatusOK || !strings.Contains(res, "LocationConstraint") {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, res)
+	}
+	if resp, _ := gatewayRequest(t, "HEAD", server.URL+"/bucket", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ := gatewayRequest(t, "PUT", server.URL+"/bucket", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	resp, res = gatewayRequest(t, "GET", server.URL+"/other/key", nil, nil)
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(res, "<Code>NoSuchBucket</Code>") {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, res)
+	}
+	if resp, _ := gatewayRequest(t, "HEAD", server.URL+"/down", nil, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if resp, _ := gatewayRequest(t, "POST", server.URL+"/bucket/key?uploads", nil, nil); resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,294 @@
+package buddystore
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Simulator runs whole rings deterministically in virtual time. It implements
+ClockIface, so every stabilization, lock manager and tracker timer of the
+rings it creates becomes an event, and events are run one after the other
+from the goroutine calling Step or Run. Events due at the same time run in
+an order chosen by the seeded random source, and the rings talk over a
+MemoryNetwork, so the same seed always gives the same run, and a failing
+seed can be replayed.
+
+The simulation is only deterministic as long as the rings stay single
+threaded: storing keys starts replication goroutines, which run outside of
+the simulator. The Simulator is not safe for concurrent use, except for its
+ClockIface methods.
+*/
+type Simulator struct {
+	Network *MemoryNetwork
+
+	lock   sync.Mutex
+	rand   *rand.Rand
+	now    time.Time
+	seq    uint64
+	events simEvents
+	rings  map[string]*Ring
+}
+
+var _ ClockIface = new(Simulator)
+
+// Simulations start at the same virtual time, whatever the seed
+var SIM_EPOCH = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Creates a simulator with an empty network
+func NewSimulator(seed int64) *Simulator {
+	return &Simulator{
+		Network: NewMemoryNetwork(),
+		rand:    rand.New(rand.NewSource(seed)),
+		now:     SIM_EPOCH,
+		rings:   make(map[string]*Ring),
+	}
+}
+
+// A function scheduled to run at a virtual time
+type simEvent struct {
+	at   time.Time
+	tie  int64  // Random order of events due at the same time
+	seq  uint64 // Scheduling order, in case the tie is drawn as well
+	f    func()
+	done bool
+}
+
+// Heap of events, the next due first
+type simEvents []*simEvent
+
+func (e simEvents) Len() int {
+	return len(e)
+}
+
+func (e simEvents) Less(i, j int) bool {
+	switch {
+	case !e[i].at.Equal(e[j].at):
+		return e[i].at.Before(e[j].at)
+	case e[i].tie != e[j].tie:
+		return e[i].tie < e[j].tie
+	}
+	return e[i].seq < e[j].seq
+}
+
+func (e simEvents) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+
+func (e *simEvents) Push(x interface{}) {
+	*e = append(*e, x.(*simEvent))
+}
+
+func (e *simEvents) Pop() interface{} {
+	old := *e
+	ev := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return ev
+}
+
+type simTimer struct {
+	sim *Simulator
+	ev  *simEvent
+}
+
+func (t *simTimer) Stop() bool {
+	t.sim.lock.Lock()
+	defer t.sim.lock.Unlock()
+	if t.ev.done {
+		return false
+	}
+	t.ev.done = true
+	return true
+}
+
+// Returns the virtual time
+func (s *Simulator) Now() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.now
+}
+
+// Schedules f to run once the virtual time advanced by d
+func (s *Simulator) AfterFunc(d time.Duration, f func()) Timer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if d < 0 {
+		d = 0
+	}
+	s.seq++
+	ev := &simEvent{at: s.now.Add(d), tie: s.rand.Int63(), seq: s.seq, f: f}
+	heap.Push(&s.events, ev)
+	return &simTimer{s, ev}
+}
+
+// Removes and returns the next event due no later than deadline
+func (s *Simulator) next(deadline time.Time) *simEvent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.events) > 0 {
+		ev := s.events[0]
+		if ev.done {
+			heap.Pop(&s.events)
+			continue
+		}
+		if ev.at.After(deadline) {
+			return nil
+		}
+		heap.Pop(&s.events)
+		ev.done = true
+		s.now = ev.at
+		return ev
+	}
+	return nil
+}
+
+// Runs the next event, advancing the virtual time to it. Returns false if
+// there are no events left.
+func (s *Simulator) Step() bool {
+	ev := s.next(time.Unix(1<<62, 0))
+	if ev == nil {
+		return false
+	}
+	ev.f()
+	return true
+}
+
+// Runs the events due within d, then advances the virtual time by d.
+// Returns the number of events run.
+func (s *Simulator) Run(d time.Duration) int {
+	deadline := s.Now().Add(d)
+	n := 0
+	for ev := s.next(deadline); ev != nil; ev = s.next(deadline) {
+		ev.f()
+		n++
+	}
+
+	s.lock.Lock()
+	s.now = deadline
+	s.lock.Unlock()
+	return n
+}
+
+// Returns the number of events waiting to run
+func (s *Simulator) Pending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for _, ev := range s.events {
+		if !ev.done {
+			n++
+		}
+	}
+	return n
+}
+
+/*
+Returns the default configuration of a simulated host. Its timers are driven
+by the simulator, and its stabilization jitter is drawn from a source seeded
+by the simulator.
+*/
+func (s *Simulator) Config(host string) *Config {
+	conf := DefaultConfig(host)
+	conf.Clock = s
+
+	s.lock.Lock()
+	conf.Rand = rand.New(rand.NewSource(s.rand.Int63()))
+	s.lock.Unlock()
+	return conf
+}
+
+// Creates a new ring on a simulated host
+func (s *Simulator) Create(conf *Config) (*Ring, error) {
+	if err := s.checkConfig(conf); err != nil {
+		return nil, err
+	}
+	r, err := Create(conf, s.Network.TransportFor(conf.Hostname))
+	if err != nil {
+		return nil, err
+	}
+	s.rings[conf.Hostname] = r
+	return r, nil
+}
+
+// Joins a simulated host to the ring of an existing one
+func (s *Simulator) Join(conf *Config, existing string) (*Ring, error) {
+	if err := s.checkConfig(conf); err != nil {
+		return nil, err
+	}
+	r, err := Join(conf, s.Network.TransportFor(conf.Hostname), existing)
+	if err != nil {
+		return nil, err
+	}
+	s.rings[conf.Hostname] = r
+	return r, nil
+}
+
+func (s *Simulator) checkConfig(conf *Config) error {
+	if conf.Clock != s {
+		return fmt.Errorf("Simulated hosts must use the simulator as their clock")
+	}
+	if conf.Delegate != nil {
+		return fmt.Errorf("Delegates run on their own goroutine, and cannot be simulated")
+	}
+	if _, ok := s.rings[conf.Hostname]; ok {
+		return fmt.Errorf("Host %s is already running", conf.Hostname)
+	}
+	return nil
+}
+
+// Returns the ring of a simulated host, or nil if it is not running
+func (s *Simulator) Ring(host string) *Ring {
+	return s.rings[host]
+}
+
+// Returns the running hosts, in order
+func (s *Simulator) Hosts() []string {
+	hosts := make([]string, 0, len(s.rings))
+	for host := range s.rings {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Stops a host without notifying the other vnodes, which find out once
+// their calls to it start failing
+func (s *Simulator) Crash(host string) {
+	r, ok := s.rings[host]
+	if !ok {
+		return
+	}
+	r.Shutdown()
+	s.Network.Disconnect(host)
+	delete(s.rings, host)
+}
+
+/*
+Makes a host leave its ring gracefully. Ring.Leave waits for the next
+stabilization of every vnode, which cannot happen while the simulation is
+not running, so the vnodes are stopped right away instead. Between events no
+stabilization is in progress, so this is just as graceful.
+*/
+func (s *Simulator) Leave(host string) error {
+	r, ok := s.rings[host]
+	if !ok {
+		return fmt.Errorf("Host %s is not running", host)
+	}
+	r.withdraw()
+	r.stopVnodesNow()
+
+	var err error
+	for _, vn := range r.vnodes {
+		err = mergeErrors(err, vn.leave())
+	}
+	r.stopDelegate()
+	deregisterRingMetrics(r)
+
+	s.Network.Disconnect(host)
+	delete(s.rings, host)
+	return err
+}
@@ -0,0 +1,136 @@
+package buddystore
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Starts a simulated ring of n hosts with the given number of vnodes each
+func startSimRing(t *testing.T, sim *Simulator, n, vnodes int) {
+	for i := 0; i < n; i++ {
+		conf := sim.Config(fmt.Sprintf("sim-%d", i))
+		conf.NumVnodes = vnodes
+
+		var err error
+		if i == 0 {
+			_, err = sim.Create(conf)
+		} else {
+			_, err = sim.Join(conf, "sim-0")
+		}
+		if err != nil {
+			t.Fatalf("failed to start host %d: %s", i, err)
+		}
+		sim.Run(time.Second)
+	}
+}
+
+// Describes the successors and predecessors of all the simulated vnodes
+func simRingState(sim *Simulator) string {
+	var buf bytes.Buffer
+	for _, host := range sim.Hosts() {
+		for _, vn := range sim.Ring(host).vnodes {
+			fmt.Fprintf(&buf, "%s %s <- %s ->", host, vn.String(), vn.Predecessor())
+			for _, s := range vn.Successors() {
+				if s != nil {
+					fmt.Fprintf(&buf, " %s", s.String())
+				}
+			}
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
+
+// Checks that the simulated vnodes form a consistent ring
+func checkSimRing(sim *Simulator) error {
+	var rings []*Ring
+	for _, host := range sim.Hosts() {
+		rings = append(rings, sim.Ring(host))
+	}
+	return checkRingsStable(rings)
+}
+
+func TestSimulatorClock(t *testing.T) {
+	sim := NewSimulator(1)
+
+	var order []int
+	sim.AfterFunc(2*time.Second, func() { order = append(order, 2) })
+	sim.AfterFunc(time.Second, func() {
+		order = append(order, 1)
+		sim.AfterFunc(0, func() { order = append(order, 3) })
+	})
+	stopped := sim.AfterFunc(time.Second, func() { order = append(order, 4) })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatalf("expected only the first stop to succeed")
+	}
+
+	if n := sim.Run(1500 * time.Millisecond); n != 2 {
+		t.Fatalf("expected 2 events to run, got %d", n)
+	}
+	if !sim.Now().Equal(SIM_EPOCH.Add(1500 * time.Millisecond)) {
+		t.Fatalf("unexpected time %s", sim.Now())
+	}
+	if !sim.Step() || sim.Step() {
+		t.Fatalf("expected a single event left")
+	}
+	if fmt.Sprint(order) != "[1 3 2]" {
+		t.Fatalf("unexpected order %v", order)
+	}
+}
+
+func TestSimulatorDeterministic(t *testing.T) {
+	run := func(seed int64) (string, time.Time) {
+		sim := NewSimulator(seed)
+		startSimRing(t, sim, 4, 8)
+		sim.Crash("sim-2")
+		sim.Run(time.Minute)
+		return simRingState(sim), sim.Now()
+	}
+
+	first, firstNow := run(42)
+	second, secondNow := run(42)
+	if first != second || !firstNow.Equal(secondNow) {
+		t.Fatalf("expected the same run with the same seed\n%s\n%s", first, second)
+	}
+}
+
+func TestSimulatorConverges(t *testing.T) {
+	sim := NewSimulator(7)
+	startSimRing(t, sim, 32, 32)
+
+	// Stabilization rounds are cheap in virtual time
+	for i := 0; i < 30 && checkSimRing(sim) != nil; i++ {
+		sim.Run(time.Minute)
+	}
+	if err := checkSimRing(sim); err != nil {
+		t.Fatalf("ring of %d vnodes did not converge: %s", 32*32, err)
+	}
+}
+
+func TestSimulatorChurn(t *testing.T) {
+	sim := NewSimulator(3)
+	startSimRing(t, sim, 8, 4)
+	sim.Run(time.Minute)
+
+	sim.Crash("sim-3")
+	sim.Run(time.Minute)
+	if err := sim.Leave("sim-5"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := sim.Leave("sim-5"); err == nil {
+		t.Fatalf("expected an error leaving twice")
+	}
+	if _, err := sim.Join(sim.Config("sim-8"), "sim-1"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	sim.Run(2 * time.Minute)
+	if hosts := sim.Network.Hosts(); len(hosts) != 7 {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+	if err := checkSimRing(sim); err != nil {
+		t.Fatalf("ring did not recover from churn: %s", err)
+	}
+}
@@ -0,0 +1,216 @@
+package buddystore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+)
+
+// A vnode as seen while walking the ring
+type SnapshotVnode struct {
+	Id          string
+	Host        string
+	Predecessor string   // As reported by the vnode, empty if it knows none
+	RangeSize   *big.Int // Number of IDs the vnode owns, from its predecessor in the walk exclusive to its own ID
+	Share       float64  // Fraction of the ID space the vnode owns
+}
+
+/*
+RingSnapshot is the layout of a ring, as found by following successor
+pointers from a local vnode until they lead back to it. The vnodes are in
+ring order. A vnode whose Predecessor is not the vnode before it in the walk
+has not caught up with the ring yet.
+*/
+type RingSnapshot struct {
+	RingId string
+	Vnodes []*SnapshotVnode
+}
+
+/*
+Walks the ring through the successor of every vnode, asking each one for its
+predecessor on the way. Fails if a vnode cannot be reached, or the successor
+pointers loop without returning to the starting vnode.
+*/
+func (r *Ring) Snapshot() (*RingSnapshot, error) {
+	return snapshotRing(r.transport, r.GetLocalVnode(), r.config)
+}
+
+// Takes a snapshot of the ring through the given transport, starting the walk at start
+func snapshotRing(trans Transport, start *Vnode, conf *Config) (*RingSnapshot, error) {
+	walk, preds, err := walkSuccessors(trans, start, conf.hashBits)
+	if err != nil {
+		return nil, err
+	}
+
+	space := new(big.Int).Lsh(big.NewInt(1), uint(conf.hashBits))
+	snapshot := &RingSnapshot{RingId: conf.RingId}
+	for i, vn := range walk {
+		prev := walk[(i+len(walk)-1)%len(walk)]
+		size := new(big.Int).SetBytes(vn.Id)
+		size.Sub(size, new(big.Int).SetBytes(prev.Id))
+		size.Mod(size, space)
+		if len(walk) == 1 {
+			size.Set(space)
+		}
+
+		share, _ := new(big.Rat).SetFrac(size, space).Float64()
+		sv := &SnapshotVnode{Id: vn.String(), Host: vn.Host, RangeSize: size, Share: share}
+		if preds[i] != nil {
+			sv.Predecessor = preds[i].String()
+		}
+		snapshot.Vnodes = append(snapshot.Vnodes, sv)
+	}
+	return snapshot, nil
+}
+
+// Walks the ring from the first local vnode
+func (r *Ring) walkRing() ([]*Vnode, []*Vnode, error) {
+	return walkSuccessors(r.transport, r.GetLocalVnode(), r.config.hashBits)
+}
+
+/*
+Follows the successor pointers from start until they lead back to it, or
+stops at start if it has no successor. Returns the vnodes in ring order with
+the predecessor each one reports. On failure, the vnodes walked so far are
+returned with the error.
+*/
+func walkSuccessors(trans Transport, start *Vnode, hashBits int) ([]*Vnode, []*Vnode, error) {
+	var walk []*Vnode
+	var preds []*Vnode
+	visited := make(map[string]bool)
+
+	for cur := start; ; {
+		visited[cur.String()] = true
+		pred, err := trans.GetPredecessor(cur)
+		if err != nil {
+			return walk, preds, fmt.Errorf("Unable to get the predecessor of %s: %s", cur, err)
+		}
+		walk = append(walk, cur)
+		preds = append(preds, pred)
+
+		succs, err := trans.FindSuccessors(cur, 1, nextId(cur.Id, hashBits))
+		if err != nil {
+			return walk, preds, fmt.Errorf("Unable to get the successor of %s: %s", cur, err)
+		}
+		// A vnode alone on its ring has no successor, or is its own
+		alone := len(succs) == 0 || succs[0] == nil || bytes.Equal(succs[0].Id, cur.Id)
+		if alone && cur == start {
+			return walk, preds, nil
+		}
+		if len(succs) == 0 || succs[0] == nil {
+			return walk, preds, fmt.Errorf("Vnode %s has no successor", cur)
+		}
+
+		next := succs[0]
+		if bytes.Equal(next.Id, start.Id) {
+			return walk, preds, nil
+		}
+		if visited[next.String()] {
+			return walk, preds, fmt.Errorf("Successor pointers loop at %s without returning to %s", next, start)
+		}
+		cur = next
+	}
+}
+
+// Returns the keys stored on the ring, in order
+func (r *Ring) Keys() ([]string, error) {
+	return listRingKeys(r.transport, r.GetLocalVnode(), r.config.hashBits)
+}
+
+// Lists the keys of every vnode on the ring through the given transport
+func listRingKeys(trans Transport, start *Vnode, hashBits int) ([]string, error) {
+	walk, _, err := walkSuccessors(trans, start, hashBits)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	keys := []string{}
+	for _, vn := range walk {
+		vnKeys, err := trans.List(vn)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list the keys of %s: %s", vn, err)
+		}
+		for _, key := range vnKeys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Returns the ID following the given one, wrapping around the ID space
+func nextId(id []byte, bits int) []byte {
+	next := powerOffset(id, 0, bits)
+
+	// Keep leading zeros, IDs are compared bytewise
+	padded := make([]byte, len(id))
+	copy(padded[len(padded)-len(next):], next)
+	return padded
+}
+
+// Returns the fraction of the ID space owned by each host
+func (s *RingSnapshot) HostShares() map[string]float64 {
+	shares := make(map[string]float64)
+	for _, vn := range s.Vnodes {
+		shares[vn.Host] += vn.Share
+	}
+	return shares
+}
+
+func (s *RingSnapshot) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+/*
+Writes the snapshot as a Graphviz graph, with the vnodes of every host in a
+cluster labelled with their share of the ring, and an edge to each
+successor. Predecessors that do not match the walk are drawn as dashed red
+edges.
+*/
+func (s *RingSnapshot) WriteDOT(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "digraph %q {\n", "ring "+s.RingId)
+	buf.WriteString("\tnode [shape=box];\n")
+
+	byHost := make(map[string][]*SnapshotVnode)
+	var hosts []string
+	for _, vn := range s.Vnodes {
+		if _, ok := byHost[vn.Host]; !ok {
+			hosts = append(hosts, vn.Host)
+		}
+		byHost[vn.Host] = append(byHost[vn.Host], vn)
+	}
+	sort.Strings(hosts)
+
+	shares := s.HostShares()
+	for i, host := range hosts {
+		fmt.Fprintf(&buf, "\tsubgraph \"cluster_%d\" {\n", i)
+		fmt.Fprintf(&buf, "\t\tlabel=%q;\n", fmt.Sprintf("%s (%.1f%%)", host, shares[host]*100))
+		for _, vn := range byHost[host] {
+			fmt.Fprintf(&buf, "\t\t%q [label=%q];\n", vn.Id, fmt.Sprintf("%.8s\n%.1f%%", vn.Id, vn.Share*100))
+		}
+		buf.WriteString("\t}\n")
+	}
+
+	for i, vn := range s.Vnodes {
+		prev := s.Vnodes[(i+len(s.Vnodes)-1)%len(s.Vnodes)]
+		next := s.Vnodes[(i+1)%len(s.Vnodes)]
+		fmt.Fprintf(&buf, "\t%q -> %q;\n", vn.Id, next.Id)
+		if vn.Predecessor != "" && vn.Predecessor != prev.Id {
+			fmt.Fprintf(&buf, "\t%q -> %q [style=dashed, color=red];\n", vn.Id, vn.Predecessor)
+		}
+	}
+	buf.WriteString("}\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,159 @@
+package buddystore
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextId(t *testing.T) {
+	if id := nextId([]byte{0x00, 0x01}, 16); !bytes.Equal(id, []byte{0x00, 0x02}) {
+		t.Fatalf("unexpected id %x", id)
+	}
+	if id := nextId([]byte{0xff, 0xff}, 16); !bytes.Equal(id, []byte{0x00, 0x00}) {
+		t.Fatalf("expected the ID space to wrap around, got %x", id)
+	}
+}
+
+func TestRingSnapshot(t *testing.T) {
+	c, err := NewClusterWithConfig(3, func(conf *Config) {
+		conf.NumVnodes = 4
+	})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+	if err := c.WaitForStabilization(5 * time.Second); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	snapshot, err := c.Node("host-1").Ring.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(snapshot.Vnodes) != 12 {
+		t.Fatalf("expected every vnode, got %d", len(snapshot.Vnodes))
+	}
+
+	// The walk starts at a local vnode and every vnode follows its predecessor
+	total := new(big.Int)
+	var shares float64
+	for i, vn := range snapshot.Vnodes {
+		prev := snapshot.Vnodes[(i+len(snapshot.Vnodes)-1)%len(snapshot.Vnodes)]
+		if vn.Predecessor != prev.Id {
+			t.Fatalf("expected %s to follow %s, its predecessor is %s", vn.Id, prev.Id, vn.Predecessor)
+		}
+		total.Add(total, vn.RangeSize)
+		shares += vn.Share
+	}
+	if snapshot.Vnodes[0].Host != "host-1" {
+		t.Fatalf("expected the walk to start locally, got %s", snapshot.Vnodes[0].Host)
+	}
+	if total.Cmp(new(big.Int).Lsh(big.NewInt(1), 160)) != 0 || math.Abs(shares-1) > 1e-9 {
+		t.Fatalf("expected the ranges to cover the ID space, got %s, %f", total, shares)
+	}
+	if hosts := snapshot.HostShares(); len(hosts) != 3 {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+
+	var buf bytes.Buffer
+	if err := snapshot.WriteJSON(&buf); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	var decoded RingSnapshot
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(decoded.Vnodes) != 12 || decoded.Vnodes[3].RangeSize.Cmp(snapshot.Vnodes[3].RangeSize) != 0 {
+		t.Fatalf("unexpected decoded snapshot %+v", decoded)
+	}
+
+	buf.Reset()
+	if err := snapshot.WriteDOT(&buf); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	dot := buf.String()
+	for _, line := range []string{
+		"digraph \"ring \" {",
+		"label=\"host-2 (",
+		"\"" + snapshot.Vnodes[0].Id + "\" -> \"" + snapshot.Vnodes[1].Id + "\";",
+	} {
+		if !strings.Contains(dot, line) {
+			t.Fatalf("expected %q in\n%s", line, dot)
+		}
+	}
+	if strings.Contains(dot, "dashed") {
+		t.Fatalf("unexpected predecessor mismatch in\n%s", dot)
+	}
+}
+
+func TestRingSnapshotSingleVnode(t *testing.T) {
+	c, err := NewClusterWithConfig(1, func(conf *Config) {
+		conf.NumVnodes = 1
+	})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+
+	snapshot, err := c.Node("host-0").Ring.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(snapshot.Vnodes) != 1 || snapshot.Vnodes[0].Share != 1 {
+		t.Fatalf("expected a single vnode owning the ring, got %+v", snapshot.Vnodes)
+	}
+}
+
+func TestRingSnapshotSingleHost(t *testing.T) {
+	c, err := NewClusterWithConfig(1, func(conf *Config) {
+		conf.NumVnodes = 2
+	})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+
+	snapshot, err := c.Node("host-0").Ring.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(snapshot.Vnodes) != 2 {
+		t.Fatalf("expected both vnodes, got %+v", snapshot.Vnodes)
+	}
+	if share := snapshot.HostShares()["host-0"]; math.Abs(share-1) > 1e-9 {
+		t.Fatalf("expected the host to own the ring, got %f", share)
+	}
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	c, server := startAdminCluster(t, "")
+	defer c.Shutdown()
+	defer server.Close()
+
+	var snapshot RingSnapshot
+	if code := adminRequest(t, "GET", server.URL+"/admin/snapshot", "", &snapshot); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if len(snapshot.Vnodes) != 16 {
+		t.Fatalf("expected every vnode, got %d", len(snapshot.Vnodes))
+	}
+
+	resp, err := http.Get(server.URL + "/admin/snapshot?format=dot")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/vnd.graphviz" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	if code := adminRequest(t, "GET", server.URL+"/admin/snapshot?ring=other", "", nil); code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", code)
+	}
+}
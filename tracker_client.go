@@ -2,8 +2,6 @@ package buddystore
 
 import (
 	"fmt"
-
-	"github.com/golang/glog"
 )
 
 type TrackerClient interface {
@@ -12,15 +10,61 @@ type TrackerClient interface {
 }
 
 type TrackerClientImpl struct {
-	ring RingIntf
+	ring      RingIntf
+	discovery *LANDiscovery
+	state     *NodeState
+	transport *TCPTransportConfig
+	shared    *TCPTransport
 }
 
 func NewTrackerClient(ring RingIntf) TrackerClient {
 	return &TrackerClientImpl{ring: ring}
 }
 
+// Creates a tracker client that advertises joined rings on the local
+// network and prefers LAN peers when joining them
+func NewTrackerClientWithDiscovery(ring RingIntf, discovery *LANDiscovery) TrackerClient {
+	return &TrackerClientImpl{ring: ring, discovery: discovery}
+}
+
+// Creates a tracker client that additionally returns to the ring positions
+// and ports recorded in the node state when joining rings
+func NewTrackerClientWithDiscoveryAndState(ring RingIntf, discovery *LANDiscovery, state *NodeState) TrackerClient {
+	return NewTrackerClientWithTransportConfig(ring, discovery, state, nil)
+}
+
+// Creates a tracker client that listens according to the given transport
+// configuration for every ring it joins
+func NewTrackerClientWithTransportConfig(ring RingIntf, discovery *LANDiscovery, state *NodeState, tconf *TCPTransportConfig) TrackerClient {
+	return &TrackerClientImpl{ring: ring, discovery: discovery, state: state, transport: tconf}
+}
+
+// Creates a tracker client that serves every ring it joins over the given
+// transport, instead of opening a listener per ring
+func NewTrackerClientWithSharedTransport(ring RingIntf, discovery *LANDiscovery, state *NodeState, shared *TCPTransport) TrackerClient {
+	return &TrackerClientImpl{ring: ring, discovery: discovery, state: state, shared: shared}
+}
+
 const NUM_TRACKER_REPLICAS = 2
 
+// Creates the transport and ring configuration used to join a ring
+func (tr *TrackerClientImpl) createTransport(ringId string, localOnly bool) (Transport, *Config, error) {
+	if tr.shared == nil {
+		_, transport, conf, err := tr.state.createTransport(ringId, tr.transport, localOnly)
+		return transport, conf, err
+	}
+
+	// Every ring is reachable under the host name of the shared listener
+	conf := DefaultConfig(tr.ring.GetLocalVnode().Host)
+	if tr.state != nil {
+		if rs := tr.state.Ring(ringId); rs != nil {
+			conf.VnodeIds = rs.VnodeIds
+		}
+	}
+
+	return tr.shared.ForRing(ringId), conf, nil
+}
+
 func (tr *TrackerClientImpl) JoinRing(ringId string, localOnly bool) (*Ring, error) {
 	trackerNodes, err := tr.ring.Lookup(NUM_TRACKER_REPLICAS, []byte(ringId))
 
@@ -32,39 +76,62 @@ func (tr *TrackerClientImpl) JoinRing(ringId string, localOnly bool) (*Ring, err
 		return nil, fmt.Errorf("Unable to get any successors while trying to join ring")
 	}
 
-	_, transport, conf := CreateNewTCPTransport(localOnly)
+	transport, conf, err := tr.createTransport(ringId, localOnly)
+	if err != nil {
+		return nil, err
+	}
+	conf.RingId = ringId
+	conf.Discovery = tr.discovery
+
+	// Rings joined through the tracker log like the ring of the tracker
+	if r, ok := tr.ring.(*Ring); ok && conf.Logger == nil {
+		conf.Logger = r.config.Logger
+	}
 
 	vnodes, err := tr.ring.Transport().JoinRing(trackerNodes[0], ringId, &Vnode{Host: conf.Hostname})
 
 	if err != nil {
+		shutdownTransport(transport)
 		return nil, err
 	}
 
-	if len(vnodes) == 0 {
+	if len(vnodes) == 0 && (tr.discovery == nil || len(tr.discovery.Peers(ringId)) == 0) {
 		// I'm the first person joining the ring.
 		// Create the ring and wait for others to join.
 
-		glog.Infof("**** No one in the ring right now. Bootstrapping the ring. ******")
+		configLogger(conf).Info("No one in the ring right now. Bootstrapping the ring.")
 
 		ring, err := Create(conf, transport)
 		if err != nil {
+			shutdownTransport(transport)
 			return nil, err
 		}
 
+		tr.state.recordRing(ringId, ring)
 		return ring, nil
 	}
 
+	// BlockingJoin tries LAN peers before the given host, so only fall back
+	// to them here if the tracker does not know of anyone
+	hosts := make([]string, 0, len(vnodes))
 	for _, vnode := range vnodes {
-		if glog.V(2) {
-			glog.Infof("[Ring: %s] Connecting to %s", ringId, vnode.Host)
-		}
+		hosts = append(hosts, vnode.Host)
+	}
+	if len(hosts) == 0 {
+		hosts = tr.discovery.Peers(ringId)
+	}
+
+	for _, host := range hosts {
+		configLogger(conf).Debug("Connecting to ring member", Field("host", host))
 
-		ring, err := BlockingJoin(conf, transport, vnode.Host)
+		ring, err := BlockingJoin(conf, transport, host)
 		if err == nil {
+			tr.state.recordRing(ringId, ring)
 			return ring, nil
 		}
 	}
 
+	shutdownTransport(transport)
 	return nil, fmt.Errorf("Cannot connect to any existing nodes in the ring")
 }
 
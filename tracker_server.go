@@ -7,8 +7,6 @@ import (
 	"sort"
 	"sync"
 	"time"
-
-	"github.com/golang/glog"
 )
 
 // TimeoutQueue based on PriorityQueue from http://golang.org/pkg/container/heap/
@@ -77,15 +75,17 @@ const TRACKER_TIMEOUT_SECS = 600 * time.Second
 type Tracker interface {
 	handleJoinRing(ringId string, joiner *Vnode) ([]*Vnode, error)
 	handleLeaveRing(ringId string)
+	members(ringId string) ([]*Vnode, error)
 }
 
 type TrackerImpl struct {
 	timeoutQueue *TimeoutQueue
 	ringMembers  map[string][]*Vnode
 	lock         sync.Mutex
-	timer        *time.Timer
+	timer        Timer
 	clock        ClockIface
 	kvClient     KVStoreClient
+	logger       Logger
 
 	// Implements:
 	Tracker
@@ -111,6 +111,10 @@ func NewTracker() Tracker {
 	return NewTrackerWithClock(new(RealClock))
 }
 
+func (tr *TrackerImpl) log() *fieldLogger {
+	return newFieldLogger(tr.logger)
+}
+
 func (tr *TrackerImpl) purgeHeadofQueueIfStale() {
 	head := tr.timeoutQueue.Peek()
 
@@ -125,9 +129,7 @@ func (tr *TrackerImpl) purgeHeadofQueueIfStale() {
 		stale := tr.timeoutQueue.Pop()
 		item := stale.(*TimeoutItem)
 
-		if glog.V(2) {
-			glog.Infof("Node %s timed out. Removing from ring.", item)
-		}
+		tr.log().Debug("Node timed out. Removing from ring.", Field("ring", item.ringId), Field("node", item.vnode))
 
 		members := tr.ringMembers[item.ringId]
 		posn := sort.Search(len(members), func(i int) bool {
@@ -170,9 +172,7 @@ func (tr *TrackerImpl) handleJoinRingWithTimeout(ringId string, joiner *Vnode, t
 	defer tr.lock.Unlock()
 
 	now := tr.clock.Now()
-	if glog.V(2) {
-		glog.Infof("Node %s joining ring %s at %d", joiner, ringId, now)
-	}
+	tr.log().Debug("Node joining ring", Field("ring", ringId), Field("node", joiner), Field("time", now))
 
 	if len(joiner.Host) == 0 {
 		return nil, fmt.Errorf("Joining node has not provided network information")
@@ -210,11 +210,11 @@ func (tr *TrackerImpl) handleJoinRing(ringId string, joiner *Vnode) ([]*Vnode, e
 	var newNodesInRing []*Vnode
 
 	if err != nil {
-		glog.Errorf("Unable to get current tracker status")
+		tr.log().Error("Unable to get current tracker status", Field("ring", ringId), Field("err", err))
 		nodesInRing = []*Vnode{}
 	} else {
 		err := json.Unmarshal(val, &nodesInRing)
-		glog.Infof("Existing nodes in ring [err=%s]: %s, %s", err, string(val), nodesInRing)
+		tr.log().Info("Existing nodes in ring", Field("ring", ringId), Field("nodes", nodesInRing), Field("err", err))
 	}
 
 	newNodesInRing = append(nodesInRing, joiner)
@@ -222,15 +222,34 @@ func (tr *TrackerImpl) handleJoinRing(ringId string, joiner *Vnode) ([]*Vnode, e
 	writeBack, err := json.Marshal(newNodesInRing)
 
 	if err != nil {
-		glog.Errorf("Marshalling error: %s", err)
+		tr.log().Error("Marshalling error", Field("ring", ringId), Field("err", err))
 		return nil, err
 	}
 
-	glog.Infof("Sending response %s", string(writeBack))
+	tr.log().Info("Sending response", Field("ring", ringId), Field("nodes", newNodesInRing))
 
 	err = tr.kvClient.SetVersion(ringId, version, writeBack)
 
-	glog.Infof("Error setting ring data: %s", err)
+	tr.log().Info("Set ring data", Field("ring", ringId), Field("err", err))
 
 	return nodesInRing, nil
 }
+
+// Returns the vnodes that joined a ring through the tracker
+func (tr *TrackerImpl) members(ringId string) ([]*Vnode, error) {
+	if tr.kvClient == nil {
+		tr.lock.Lock()
+		defer tr.lock.Unlock()
+		members := tr.ringMembers[ringId]
+		return copyOfVnodesList(members, len(members)), nil
+	}
+
+	val, err := tr.kvClient.Get(ringId, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodesInRing []*Vnode
+	err = json.Unmarshal(val, &nodesInRing)
+	return nodesInRing, err
+}
@@ -300,6 +300,25 @@ func (lt *LocalTransport) JoinRing(target *Vnode, ringId string, self *Vnode) ([
 	return vnodeRpc.JoinRing(ringId, self)
 }
 
+func (lt *LocalTransport) LeaveRing(target *Vnode, ringId string) error {
+	vnodeRpc, ok := lt.get(target)
+
+	if !ok {
+		return lt.remote.LeaveRing(target, ringId)
+	}
+
+	return vnodeRpc.LeaveRing(ringId)
+}
+
+// Shuts down the remote transport, if it supports being shut down
+func (lt *LocalTransport) Shutdown() {
+	if s, ok := lt.remote.(interface {
+		Shutdown()
+	}); ok {
+		s.Shutdown()
+	}
+}
+
 func (lt *LocalTransport) IsLocalVnode(target *Vnode) bool {
 	_, ok := lt.get(target)
 	return ok
@@ -390,3 +409,19 @@ func (*BlackholeTransport) MissingKeys(v *Vnode, replVn *Vnode, key string, ver
 func (*BlackholeTransport) PurgeVersions(v *Vnode, key string, maxVersion uint) error {
 	return fmt.Errorf("Failed to connect! Blackhole : %s", v.String())
 }
+
+func (*BlackholeTransport) InvalidateRLock(v *Vnode, lockID string) error {
+	return fmt.Errorf("Failed to connect! Blackhole : %s", v.String())
+}
+
+func (*BlackholeTransport) IsLocalVnode(v *Vnode) bool {
+	return false
+}
+
+func (*BlackholeTransport) JoinRing(v *Vnode, ringId string, self *Vnode) ([]*Vnode, error) {
+	return nil, fmt.Errorf("Failed to connect! Blackhole : %s", v.String())
+}
+
+func (*BlackholeTransport) LeaveRing(v *Vnode, ringId string) error {
+	return fmt.Errorf("Failed to connect! Blackhole : %s", v.String())
+}
@@ -0,0 +1,284 @@
+package buddystore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Magic constant identifying the connect request of the UDP tracker protocol (BEP 15)
+const UDP_TRACKER_PROTOCOL_ID = 0x41727101980
+
+// Connection IDs handed out by the tracker are valid for this long
+const UDP_TRACKER_CONN_TTL = 2 * time.Minute
+
+// Announce interval handed out to clients
+const UDP_TRACKER_INTERVAL = 30 * time.Minute
+
+// Peers not announcing within this window are dropped
+const UDP_TRACKER_PEER_TTL = 2 * UDP_TRACKER_INTERVAL
+
+const (
+	udpTrackerConnect = iota
+	udpTrackerAnnounce
+	udpTrackerScrape
+	udpTrackerError
+)
+
+const (
+	udpTrackerConnectReqLen  = 16
+	udpTrackerAnnounceReqLen = 98
+)
+
+type udpTrackerAnnounceReq struct {
+	ConnectionId  uint64
+	Action        uint32
+	TransactionId uint32
+	InfoHash      [20]byte
+	PeerId        [20]byte
+	Downloaded    uint64
+	Left          uint64
+	Uploaded      uint64
+	Event         uint32
+	IP            uint32
+	Key           uint32
+	NumWant       int32
+	Port          uint16
+}
+
+type udpTrackerPeer struct {
+	addr *net.UDPAddr
+	port uint16
+	seen time.Time
+}
+
+/*
+UDPTracker is a minimal in-process implementation of the UDP BitTorrent
+tracker announce protocol (BEP 15). It is meant to stand in for the public
+tracker, so that BuddyStore bootstrap can run without internet access.
+Point BuddyStoreConfig.TrackerURL at UDPTracker.URL() to use it.
+
+Only IPv4 peers are returned, in the compact 6 byte format.
+*/
+type UDPTracker struct {
+	conn     *net.UDPConn
+	lock     sync.Mutex
+	connIds  map[uint64]time.Time
+	torrents map[string]map[string]*udpTrackerPeer
+	shutdown int32
+	logger   Logger
+}
+
+// Starts a UDP tracker on the given listen address
+func NewUDPTracker(listen string) (*UDPTracker, error) {
+	return NewUDPTrackerWithLogger(listen, nil)
+}
+
+// Starts a UDP tracker logging to the given logger, or DefaultLogger if nil
+func NewUDPTrackerWithLogger(listen string, logger Logger) (*UDPTracker, error) {
+	addr, err := net.ResolveUDPAddr("udp4", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &UDPTracker{
+		conn:     conn,
+		connIds:  make(map[uint64]time.Time),
+		torrents: make(map[string]map[string]*udpTrackerPeer),
+		logger:   logger,
+	}
+
+	go tr.listen()
+
+	return tr, nil
+}
+
+// Returns the announce URL of this tracker
+func (tr *UDPTracker) URL() string {
+	return fmt.Sprintf("udp://%s/announce", tr.conn.LocalAddr())
+}
+
+// Stops the tracker
+func (tr *UDPTracker) Shutdown() {
+	atomic.StoreInt32(&tr.shutdown, 1)
+	tr.conn.Close()
+}
+
+// Returns the number of live peers announced for an infohash
+func (tr *UDPTracker) NumPeers(infohash string) int {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	return len(tr.torrents[infohash])
+}
+
+func (tr *UDPTracker) listen() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := tr.conn.ReadFromUDP(buf)
+		if err != nil {
+			if atomic.LoadInt32(&tr.shutdown) == 1 {
+				return
+			}
+			newFieldLogger(tr.logger).Error("Error reading tracker request", Field("err", err))
+			continue
+		}
+
+		resp := tr.handlePacket(buf[:n], from)
+		if resp == nil {
+			continue
+		}
+
+		if _, err := tr.conn.WriteToUDP(resp, from); err != nil {
+			newFieldLogger(tr.logger).Error("Error sending tracker response", Field("to", from), Field("err", err))
+		}
+	}
+}
+
+// Handles a single request datagram, returning the response to send back
+func (tr *UDPTracker) handlePacket(pkt []byte, from *net.UDPAddr) []byte {
+	if len(pkt) < udpTrackerConnectReqLen {
+		return nil
+	}
+
+	connId := binary.BigEndian.Uint64(pkt[0:8])
+	action := binary.BigEndian.Uint32(pkt[8:12])
+	txId := binary.BigEndian.Uint32(pkt[12:16])
+
+	switch action {
+	case udpTrackerConnect:
+		if connId != UDP_TRACKER_PROTOCOL_ID {
+			return udpTrackerErrorResp(txId, "Invalid protocol id")
+		}
+		return tr.handleConnect(txId)
+
+	case udpTrackerAnnounce:
+		if !tr.validConnId(connId) {
+			return udpTrackerErrorResp(txId, "Invalid connection id")
+		}
+		if len(pkt) < udpTrackerAnnounceReqLen {
+			return udpTrackerErrorResp(txId, "Malformed announce request")
+		}
+
+		req := udpTrackerAnnounceReq{}
+		if err := binary.Read(bytes.NewReader(pkt[:udpTrackerAnnounceReqLen]), binary.BigEndian, &req); err != nil {
+			return udpTrackerErrorResp(txId, err.Error())
+		}
+		return tr.handleAnnounce(&req, from)
+
+	default:
+		return udpTrackerErrorResp(txId, "Unsupported action")
+	}
+}
+
+func (tr *UDPTracker) handleConnect(txId uint32) []byte {
+	var id [8]byte
+	rand.Read(id[:])
+	connId := binary.BigEndian.Uint64(id[:])
+
+	tr.lock.Lock()
+	now := time.Now()
+	for k, expiry := range tr.connIds {
+		if now.After(expiry) {
+			delete(tr.connIds, k)
+		}
+	}
+	tr.connIds[connId] = now.Add(UDP_TRACKER_CONN_TTL)
+	tr.lock.Unlock()
+
+	resp := new(bytes.Buffer)
+	binary.Write(resp, binary.BigEndian, uint32(udpTrackerConnect))
+	binary.Write(resp, binary.BigEndian, txId)
+	binary.Write(resp, binary.BigEndian, connId)
+	return resp.Bytes()
+}
+
+func (tr *UDPTracker) validConnId(connId uint64) bool {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	expiry, ok := tr.connIds[connId]
+	return ok && time.Now().Before(expiry)
+}
+
+func (tr *UDPTracker) handleAnnounce(req *udpTrackerAnnounceReq, from *net.UDPAddr) []byte {
+	infohash := string(req.InfoHash[:])
+
+	ip := from.IP.To4()
+	if req.IP != 0 {
+		ip = make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, req.IP)
+	}
+	if ip == nil {
+		return udpTrackerErrorResp(req.TransactionId, "Only IPv4 peers are supported")
+	}
+
+	// Peers are identified by address rather than peer id, so that several
+	// nodes on the same machine can share the tracker
+	self := &udpTrackerPeer{addr: &net.UDPAddr{IP: ip, Port: int(req.Port)}, port: req.Port, seen: time.Now()}
+	selfKey := self.addr.String()
+
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	peers := tr.torrents[infohash]
+	if peers == nil {
+		peers = make(map[string]*udpTrackerPeer)
+		tr.torrents[infohash] = peers
+	}
+
+	for k, p := range peers {
+		if self.seen.Sub(p.seen) > UDP_TRACKER_PEER_TTL {
+			delete(peers, k)
+		}
+	}
+
+	// Stopped event
+	if req.Event == 3 {
+		delete(peers, selfKey)
+	} else {
+		peers[selfKey] = self
+	}
+
+	numWant := int(req.NumWant)
+	if numWant < 0 || numWant > len(peers) {
+		numWant = len(peers)
+	}
+
+	resp := new(bytes.Buffer)
+	binary.Write(resp, binary.BigEndian, uint32(udpTrackerAnnounce))
+	binary.Write(resp, binary.BigEndian, req.TransactionId)
+	binary.Write(resp, binary.BigEndian, uint32(UDP_TRACKER_INTERVAL/time.Second))
+	binary.Write(resp, binary.BigEndian, uint32(0))
+	binary.Write(resp, binary.BigEndian, uint32(len(peers)))
+
+	for k, p := range peers {
+		if numWant == 0 {
+			break
+		}
+		if k == selfKey {
+			continue
+		}
+		resp.Write(p.addr.IP.To4())
+		binary.Write(resp, binary.BigEndian, p.port)
+		numWant--
+	}
+
+	return resp.Bytes()
+}
+
+func udpTrackerErrorResp(txId uint32, msg string) []byte {
+	resp := new(bytes.Buffer)
+	binary.Write(resp, binary.BigEndian, uint32(udpTrackerError))
+	binary.Write(resp, binary.BigEndian, txId)
+	resp.WriteString(msg)
+	return resp.Bytes()
+}
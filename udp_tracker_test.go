@@ -0,0 +1,102 @@
+package buddystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Infohashes are always 20 bytes long
+const TEST_INFOHASH = "0123456789abcdef0123"
+
+func udpTrackerRoundTrip(t *testing.T, conn *net.UDPConn, req []byte) []byte {
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("Failed to send tracker request: %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read tracker response: %s", err)
+	}
+	return buf[:n]
+}
+
+func udpTrackerConnectReq(txId uint32) []byte {
+	req := new(bytes.Buffer)
+	binary.Write(req, binary.BigEndian, uint64(UDP_TRACKER_PROTOCOL_ID))
+	binary.Write(req, binary.BigEndian, uint32(udpTrackerConnect))
+	binary.Write(req, binary.BigEndian, txId)
+	return req.Bytes()
+}
+
+func udpTrackerAnnounceBytes(connId uint64, txId uint32, infohash string, port uint16) []byte {
+	req := udpTrackerAnnounceReq{ConnectionId: connId, Action: udpTrackerAnnounce, TransactionId: txId, NumWant: -1, Port: port}
+	copy(req.InfoHash[:], infohash)
+	copy(req.PeerId[:], "same-peer-id")
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, &req)
+	return buf.Bytes()
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	tr, err := NewUDPTracker(fmt.Sprintf("127.0.0.1:%d", PORT+2010))
+	if err != nil {
+		t.Fatalf("Unable to start tracker: %s", err)
+	}
+	defer tr.Shutdown()
+
+	conn, err := net.DialUDP("udp4", nil, tr.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Unable to contact tracker: %s", err)
+	}
+	defer conn.Close()
+
+	resp := udpTrackerRoundTrip(t, conn, udpTrackerConnectReq(42))
+	assert.Equal(t, 16, len(resp))
+	assert.Equal(t, uint32(udpTrackerConnect), binary.BigEndian.Uint32(resp[0:4]))
+	assert.Equal(t, uint32(42), binary.BigEndian.Uint32(resp[4:8]))
+	connId := binary.BigEndian.Uint64(resp[8:16])
+
+	// First peer sees nobody else
+	resp = udpTrackerRoundTrip(t, conn, udpTrackerAnnounceBytes(connId, 43, TEST_INFOHASH, 1111))
+	assert.Equal(t, uint32(udpTrackerAnnounce), binary.BigEndian.Uint32(resp[0:4]))
+	assert.Equal(t, uint32(43), binary.BigEndian.Uint32(resp[4:8]))
+	assert.Equal(t, 20, len(resp))
+
+	// Second peer on the same host, with the same peer id, sees the first one
+	resp = udpTrackerRoundTrip(t, conn, udpTrackerAnnounceBytes(connId, 44, TEST_INFOHASH, 2222))
+	assert.Equal(t, 26, len(resp))
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(resp[16:20]))
+	assert.Equal(t, net.IPv4(127, 0, 0, 1).To4(), net.IP(resp[20:24]))
+	assert.Equal(t, uint16(1111), binary.BigEndian.Uint16(resp[24:26]))
+
+	assert.Equal(t, 2, tr.NumPeers(TEST_INFOHASH))
+	assert.Equal(t, 0, tr.NumPeers("3210fedcba9876543210"))
+}
+
+func TestUDPTrackerRejectsUnknownConnection(t *testing.T) {
+	tr, err := NewUDPTracker(fmt.Sprintf("127.0.0.1:%d", PORT+2011))
+	if err != nil {
+		t.Fatalf("Unable to start tracker: %s", err)
+	}
+	defer tr.Shutdown()
+
+	conn, err := net.DialUDP("udp4", nil, tr.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Unable to contact tracker: %s", err)
+	}
+	defer conn.Close()
+
+	resp := udpTrackerRoundTrip(t, conn, udpTrackerAnnounceBytes(1234, 45, TEST_INFOHASH, 1111))
+	assert.Equal(t, uint32(udpTrackerError), binary.BigEndian.Uint32(resp[0:4]))
+	assert.Equal(t, uint32(45), binary.BigEndian.Uint32(resp[4:8]))
+	assert.Equal(t, 0, tr.NumPeers(TEST_INFOHASH))
+}
@@ -7,9 +7,9 @@ import (
 	"math/rand"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/huin/goupnp/dcps/internetgateway1"
 )
 
@@ -19,7 +19,12 @@ const LISTEN_TIMEOUT = 30 * time.Second
 func randStabilize(conf *Config) time.Duration {
 	min := conf.StabilizeMin
 	max := conf.StabilizeMax
-	r := rand.Float64()
+	var r float64
+	if conf.Rand != nil {
+		r = conf.Rand.Float64()
+	} else {
+		r = rand.Float64()
+	}
 	return time.Duration((r * float64(max-min)) + float64(min))
 }
 
@@ -118,32 +123,109 @@ func mergeErrors(err1, err2 error) error {
 	}
 }
 
-func GetLocalExternalAddresses() (localAddr string, externalAddr string) {
-	upnpclient, _, err := internetgateway1.NewWANIPConnection1Clients()
-	if err == nil && len(upnpclient) > 0 {
-		externalAddr, err = upnpclient[0].GetExternalIPAddress()
-		glog.Infof("External IP: %s, err: %s", externalAddr, err)
-	} else {
-		glog.Infof("No external IP")
+// Separates the candidate addresses of a host
+const HOST_ADDR_SEP = ","
+
+/*
+Returns the candidate addresses of a host, most preferred first. A host that
+can be reached under several addresses, e.g. over both IPv6 and IPv4, lists
+all of them separated by HOST_ADDR_SEP.
+*/
+func HostAddrs(host string) []string {
+	parts := strings.Split(host, HOST_ADDR_SEP)
+	addrs := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); len(part) > 0 {
+			addrs = append(addrs, part)
+		}
+	}
+	return addrs
+}
+
+// Combines candidate addresses into a single host, dropping duplicates
+func JoinHostAddrs(addrs ...string) string {
+	seen := make(map[string]bool, len(addrs))
+	uniq := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if len(addr) > 0 && !seen[addr] {
+			seen[addr] = true
+			uniq = append(uniq, addr)
+		}
 	}
+	return strings.Join(uniq, HOST_ADDR_SEP)
+}
+
+/*
+Returns the unicast addresses of the network interfaces that are up, global
+IPv6 addresses first. Loopback and link-local addresses are left out, since
+remote peers cannot use them.
+*/
+func GetLocalAddresses() []net.IP {
+	var v6, v4 []net.IP
 
 	ifaces, err := net.Interfaces()
-	if err == nil {
-		for _, iface := range ifaces {
-			if iface.Flags&net.FlagLoopback == net.FlagLoopback {
+	if err != nil {
+		return nil
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback == net.FlagLoopback {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || !ipnet.IP.IsGlobalUnicast() {
 				continue
 			}
-			addrs, _ := iface.Addrs()
-
-			// TODO: Figure out how to handle IPv6 addresses.
-			if len(addrs) > 0 && addrs[0].(*net.IPNet).IP.To4() != nil {
-				glog.Infof("Local Address: %s", addrs[0].(*net.IPNet).IP.To4().String())
-				localAddr = addrs[0].(*net.IPNet).IP.String()
-				return
+			if ipnet.IP.To4() != nil {
+				v4 = append(v4, ipnet.IP.To4())
+			} else {
+				v6 = append(v6, ipnet.IP)
 			}
 		}
 	}
 
+	return append(v6, v4...)
+}
+
+/*
+Returns the first local IPv4 address, and the external address of the NAT
+gateway, as reported by UPnP or NAT-PMP. Either is empty if it could not be
+determined. Use GetLocalAddresses for all local addresses.
+*/
+func GetLocalExternalAddresses() (localAddr string, externalAddr string) {
+	return localExternalAddresses(newFieldLogger(nil))
+}
+
+func localExternalAddresses(log *fieldLogger) (localAddr string, externalAddr string) {
+	for _, ip := range GetLocalAddresses() {
+		if ip.To4() != nil {
+			log.Info("Local address", Field("addr", ip))
+			localAddr = ip.String()
+			break
+		}
+	}
+
+	upnpclient, _, err := internetgateway1.NewWANIPConnection1Clients()
+	if err == nil && len(upnpclient) > 0 {
+		externalAddr, err = upnpclient[0].GetExternalIPAddress()
+		log.Info("External IP from UPnP", Field("addr", externalAddr), Field("err", err))
+		if err == nil && len(externalAddr) > 0 {
+			return
+		}
+	}
+
+	if gw := DefaultNATConfig().gateway(localAddr); len(gw) > 0 {
+		pmp := &natPMPMapper{gateway: gw, timeout: NAT_GATEWAY_TIMEOUT}
+		if ip, err := pmp.externalAddr(); err == nil {
+			externalAddr = ip.String()
+			log.Info("External IP from NAT-PMP", Field("addr", externalAddr))
+			return
+		}
+	}
+
+	log.Info("No external IP")
 	return
 }
 
@@ -152,45 +234,203 @@ func CreateNewTCPTransport(localOnly bool) (int, Transport, *Config) {
 }
 
 func CreateNewTCPTransportWithConfig(localOnly bool, configGen func(string) *Config) (int, Transport, *Config) {
-	var localAddr, externalAddr string
+	return CreateNewTCPTransportOnPort(localOnly, 0, configGen)
+}
+
+// Like CreateNewTCPTransportWithConfig, but tries to listen on the given port
+// first. Falls back to a random port if it is 0 or unavailable.
+func CreateNewTCPTransportOnPort(localOnly bool, port int, configGen func(string) *Config) (int, Transport, *Config) {
+	// Without a port range we keep trying random ports, so this cannot fail
+	port, transport, conf, _ := NewTCPTransportFromConfig(nil, localOnly, port, configGen)
+	return port, transport, conf
+}
+
+// Configuration of the TCP transports created for rings
+type TCPTransportConfig struct {
+	ListenAddr    string // IP address to listen on. Defaults to all interfaces
+	AdvertiseAddr string // Host names or IP addresses advertised to peers, separated by HOST_ADDR_SEP. Autodetected if empty
+	Port          int    // First port to listen on. Random ports are used if 0
+	PortRange     int    // Number of consecutive ports starting at Port that may be used
+	Shared        bool   // Serve all rings of a node over a single listener
+	UnixSocket    string // Listen on this Unix domain socket path instead of TCP. Implies Shared
+
+	NAT        *NATConfig // Port mapping, reachability test and relaying. Defaults to DefaultNATConfig
+	MaxRelayed int        // Unreachable nodes we relay for. Defaults to TCP_RELAY_MAX_CLIENTS, negative disables
+
+	Logger Logger // Receives the log of the transports and of the rings configured for them. Defaults to DefaultLogger
+}
+
+// Returns true if the transport listens on a Unix domain socket. Works on a
+// nil configuration.
+func (c *TCPTransportConfig) isUnix() bool {
+	return c != nil && len(c.UnixSocket) > 0
+}
+
+// Returns the ports to try in order, or nil if random ports should be used.
+// The preferred port goes first if it is allowed.
+func (c *TCPTransportConfig) candidatePorts(preferred int) []int {
+	if c.Port == 0 {
+		return nil
+	}
+
+	n := max(c.PortRange, 1)
+	ports := make([]int, 0, n)
+	if preferred >= c.Port && preferred < c.Port+n {
+		ports = append(ports, preferred)
+	}
+	for p := c.Port; p < c.Port+n; p++ {
+		if p != preferred {
+			ports = append(ports, p)
+		}
+	}
+	return ports
+}
+
+/*
+Returns the candidate addresses to advertise to peers, most preferred first.
+Global IPv6 addresses go first, as they usually work without NAT, followed by
+the external address and the local IPv4 addresses. Only the listen address
+is advertised if we do not listen on all interfaces.
+*/
+func (c *TCPTransportConfig) advertiseAddrs(localAddrs []net.IP, externalAddr string, port, externalPort int) []string {
+	p := strconv.Itoa(port)
+
+	addrs := make([]string, 0, len(localAddrs)+1)
+	if len(c.AdvertiseAddr) > 0 {
+		for _, host := range HostAddrs(c.AdvertiseAddr) {
+			addrs = append(addrs, net.JoinHostPort(host, p))
+		}
+		return addrs
+	}
+
+	listenIP := net.ParseIP(c.ListenAddr)
+	allInterfaces := len(c.ListenAddr) == 0 || (listenIP != nil && listenIP.IsUnspecified())
+
+	if allInterfaces {
+		for _, ip := range localAddrs {
+			if ip.To4() == nil {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), p))
+			}
+		}
+	}
+
+	if len(externalAddr) > 0 {
+		addrs = append(addrs, net.JoinHostPort(externalAddr, strconv.Itoa(externalPort)))
+	}
+
+	if !allInterfaces {
+		addrs = append(addrs, net.JoinHostPort(c.ListenAddr, p))
+	} else {
+		for _, ip := range localAddrs {
+			if ip.To4() != nil {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), p))
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		addrs = append(addrs, net.JoinHostPort("localhost", p))
+	}
+	return addrs
+}
+
+/*
+Creates a TCP transport according to the given transport configuration, which
+may be nil. The preferred port, if non-zero, is tried first. Returns an error
+if the configuration restricts the ports and none of them is available.
+*/
+func NewTCPTransportFromConfig(tconf *TCPTransportConfig, localOnly bool, preferred int, configGen func(string) *Config) (int, Transport, *Config, error) {
+	if tconf == nil {
+		tconf = &TCPTransportConfig{}
+	}
+
+	log := newFieldLogger(tconf.Logger)
+
+	if tconf.isUnix() {
+		transport, err := initUnixTransport(tconf.UnixSocket, LISTEN_TIMEOUT, tconf.Logger)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		conf := configGen(transport.ListenAddr())
+		conf.Hostname = transport.ListenAddr()
+		conf.Logger = tconf.Logger
+		log.Info("Listening on Unix socket", Field("path", tconf.UnixSocket))
+		return 0, transport, conf, nil
+	}
+
+	listenAddr := tconf.ListenAddr
+	if len(listenAddr) == 0 {
+		listenAddr = "0.0.0.0"
+	}
+
+	var externalAddr string
 
-	var transport Transport
+	var transport *TCPTransport
 	var err error = fmt.Errorf("Dummy error")
 	var port int
 	var listen string
 
-	for err != nil {
-		port = int(rand.Uint32()%(64512) + 1024)
-		glog.Infof("PORT: %d", port)
+	ports := tconf.candidatePorts(preferred)
+	if ports == nil {
+		port = preferred
+		for err != nil {
+			if port == 0 {
+				port = int(rand.Uint32()%(64512) + 1024)
+			}
+			listen = net.JoinHostPort(listenAddr, strconv.Itoa(port))
+			log.Info("Listen address", Field("addr", listen))
+
+			transport, err = initTCPTransport(listen, LISTEN_TIMEOUT, tconf.Logger)
+			if err != nil {
+				log.Info("Unable to listen on port", Field("port", port), Field("err", err))
+				port = 0
+			}
+		}
+	} else {
+		for _, port = range ports {
+			listen = net.JoinHostPort(listenAddr, strconv.Itoa(port))
+			transport, err = initTCPTransport(listen, LISTEN_TIMEOUT, tconf.Logger)
+			if err == nil {
+				log.Info("Listen address", Field("addr", listen))
+				break
+			}
+			log.Info("Unable to listen on port", Field("port", port), Field("err", err))
+		}
 
-		listen = net.JoinHostPort("0.0.0.0", strconv.Itoa(port))
-		glog.Infof("Listen Address: %s", listen)
+		if err != nil {
+			return 0, nil, nil, fmt.Errorf("No port available in range %d-%d on %s", tconf.Port, tconf.Port+len(ports)-1, listenAddr)
+		}
+	}
 
-		transport, err = InitTCPTransport(listen, LISTEN_TIMEOUT)
+	if tconf.MaxRelayed != 0 {
+		transport.maxRelayed = int32(tconf.MaxRelayed)
 	}
 
+	var localAddrs []net.IP
+	externalPort := port
 	if !localOnly {
-		localAddr, externalAddr = GetLocalExternalAddresses()
-		upnpclient, errs, err := internetgateway1.NewWANIPConnection1Clients()
-		glog.Infof("Client: %q, errors: %q, error: %q", upnpclient, errs, err)
-
-		if err == nil && len(upnpclient) > 0 {
-			err = upnpclient[0].AddPortMapping("", uint16(port), "TCP", uint16(port), localAddr, true, "BuddyStore", 0)
-			glog.Infof("Added port mapping: %s", err)
+		var localAddr string
+		localAddr, externalAddr = localExternalAddresses(log)
+		localAddrs = GetLocalAddresses()
+
+		mapping, err := newPortMapping(tconf.NAT, localAddr, port, tconf.Logger)
+		if err == nil {
+			transport.mapping = mapping
+			externalPort = mapping.ExternalPort
+			if ip := mapping.ExternalIP; ip != nil && !ip.IsUnspecified() {
+				externalAddr = ip.String()
+			}
+		} else {
+			log.Info("Unable to map port on the NAT gateway", Field("port", port), Field("err", err))
 		}
-	} else {
-		localAddr = "localhost"
-		externalAddr = "localhost"
 	}
 
 	conf := configGen(listen)
-	if len(externalAddr) > 0 {
-		conf.Hostname = net.JoinHostPort(externalAddr, strconv.Itoa(port))
-	} else {
-		conf.Hostname = net.JoinHostPort(localAddr, strconv.Itoa(port))
-	}
+	conf.Hostname = JoinHostAddrs(tconf.advertiseAddrs(localAddrs, externalAddr, port, externalPort)...)
+	conf.Logger = tconf.Logger
+	log.Info("Advertised addresses", Field("host", conf.Hostname))
 
-	return port, transport, conf
+	return port, transport, conf, nil
 }
 
 func copyOfVnodesList(inList []*Vnode, n int) []*Vnode {
@@ -2,6 +2,9 @@ package buddystore
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -165,3 +168,128 @@ func TestMergeErrors(t *testing.T) {
 		t.Fatalf("bad merge")
 	}
 }
+
+func TestTCPTransportConfigPortRange(t *testing.T) {
+	// Occupy the first port of the range
+	sock, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", PORT+2020))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer sock.Close()
+
+	tconf := &TCPTransportConfig{ListenAddr: "127.0.0.1", Port: int(PORT + 2020), PortRange: 3}
+
+	port, t1, conf, err := NewTCPTransportFromConfig(tconf, true, 0, DefaultConfig)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.(*TCPTransport).Shutdown()
+	if port != int(PORT+2021) {
+		t.Fatalf("expected port %d, got %d", PORT+2021, port)
+	}
+	if conf.Hostname != fmt.Sprintf("127.0.0.1:%d", PORT+2021) {
+		t.Fatalf("unexpected hostname %s", conf.Hostname)
+	}
+
+	port, t2, _, err := NewTCPTransportFromConfig(tconf, true, 0, DefaultConfig)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.(*TCPTransport).Shutdown()
+	if port != int(PORT+2022) {
+		t.Fatalf("expected port %d, got %d", PORT+2022, port)
+	}
+
+	if _, _, _, err := NewTCPTransportFromConfig(tconf, true, 0, DefaultConfig); err == nil {
+		t.Fatalf("expected an error once the range is exhausted")
+	}
+}
+
+func TestTCPTransportConfigUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.sock")
+	tconf := &TCPTransportConfig{UnixSocket: path, Port: int(PORT + 2091)}
+
+	port, trans, conf, err := NewTCPTransportFromConfig(tconf, false, 0, DefaultConfig)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.(*TCPTransport).Shutdown()
+	if port != 0 {
+		t.Fatalf("expected no port, got %d", port)
+	}
+	if conf.Hostname != UNIX_ADDR_SCHEME+path {
+		t.Fatalf("unexpected hostname %s", conf.Hostname)
+	}
+}
+
+func TestTCPTransportConfigPreferredPort(t *testing.T) {
+	tconf := &TCPTransportConfig{Port: int(PORT + 2024), PortRange: 3, AdvertiseAddr: "node.example.com"}
+
+	port, trans, conf, err := NewTCPTransportFromConfig(tconf, true, int(PORT+2025), DefaultConfig)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.(*TCPTransport).Shutdown()
+	if port != int(PORT+2025) {
+		t.Fatalf("expected preferred port %d, got %d", PORT+2025, port)
+	}
+	if conf.Hostname != fmt.Sprintf("node.example.com:%d", PORT+2025) {
+		t.Fatalf("expected advertised hostname, got %s", conf.Hostname)
+	}
+
+	// Ports outside the range are never used
+	port, trans2, _, err := NewTCPTransportFromConfig(tconf, true, int(PORT+2030), DefaultConfig)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans2.(*TCPTransport).Shutdown()
+	if port != int(PORT+2024) {
+		t.Fatalf("expected port %d, got %d", PORT+2024, port)
+	}
+}
+
+func TestHostAddrs(t *testing.T) {
+	addrs := HostAddrs("[2001:db8::1]:4000, 192.168.1.5:4000,,")
+	if len(addrs) != 2 || addrs[0] != "[2001:db8::1]:4000" || addrs[1] != "192.168.1.5:4000" {
+		t.Fatalf("unexpected addresses %q", addrs)
+	}
+
+	if host := JoinHostAddrs("a:1", "", "b:2", "a:1"); host != "a:1,b:2" {
+		t.Fatalf("unexpected host %s", host)
+	}
+
+	if addrs := HostAddrs("localhost:4000"); len(addrs) != 1 || addrs[0] != "localhost:4000" {
+		t.Fatalf("unexpected addresses %q", addrs)
+	}
+}
+
+func TestTCPTransportConfigAdvertiseAddrs(t *testing.T) {
+	locals := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.168.1.5")}
+
+	// IPv6 first, then the external address with its mapped port, then LAN
+	tconf := &TCPTransportConfig{}
+	host := JoinHostAddrs(tconf.advertiseAddrs(locals, "203.0.113.7", 4000, 4001)...)
+	if host != "[2001:db8::1]:4000,203.0.113.7:4001,192.168.1.5:4000" {
+		t.Fatalf("unexpected host %s", host)
+	}
+
+	// Only the listen address is reachable when listening on a single one
+	tconf = &TCPTransportConfig{ListenAddr: "192.168.1.5"}
+	host = JoinHostAddrs(tconf.advertiseAddrs(locals, "", 4000, 4000)...)
+	if host != "192.168.1.5:4000" {
+		t.Fatalf("unexpected host %s", host)
+	}
+
+	// Configured addresses replace the detected ones
+	tconf = &TCPTransportConfig{AdvertiseAddr: "node.example.com,2001:db8::2"}
+	host = JoinHostAddrs(tconf.advertiseAddrs(locals, "203.0.113.7", 4000, 4001)...)
+	if host != "node.example.com:4000,[2001:db8::2]:4000" {
+		t.Fatalf("unexpected host %s", host)
+	}
+
+	tconf = &TCPTransportConfig{}
+	host = JoinHostAddrs(tconf.advertiseAddrs(nil, "", 4000, 4000)...)
+	if host != "localhost:4000" {
+		t.Fatalf("unexpected host %s", host)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
 	"time"
 )
 
@@ -13,6 +12,11 @@ func (vn *Vnode) String() string {
 	return fmt.Sprintf("%x", vn.Id)
 }
 
+// Logs on behalf of the vnode
+func (vn *localVnode) log() *fieldLogger {
+	return vn.ring.log().With(Field("vnode", &vn.Vnode))
+}
+
 // Initializes a local vnode
 func (vn *localVnode) init(idx int) {
 	// Generate an ID
@@ -36,7 +40,9 @@ func (vn *localVnode) init(idx int) {
 
 	// Initialize the tracker server
 	// TODO: Should we check this ring supports a tracker server?
-	vn.tracker = NewTrackerWithStore(NewKVStoreClientWithLM(vn.Ring(), vn.lm_client))
+	tracker := NewTrackerWithClockAndStore(vn.ring.clock(), NewKVStoreClientWithLM(vn.Ring(), vn.lm_client)).(*TrackerImpl)
+	tracker.logger = vn.log()
+	vn.tracker = tracker
 }
 
 // Schedules the Vnode to do regular maintenence
@@ -44,13 +50,33 @@ func (vn *localVnode) schedule() {
 	// Setup our stabilize timer
 	defer vn.timerLock.Unlock()
 	vn.timerLock.Lock()
-	vn.timer = time.AfterFunc(randStabilize(vn.ring.config), vn.stabilize)
+	vn.timer = vn.ring.clock().AfterFunc(randStabilize(vn.ring.config), vn.stabilize)
+}
+
+// Stops a pending stabilize timer. Returns true if the timer
+// was stopped before it fired.
+func (vn *localVnode) cancelSchedule() bool {
+	defer vn.timerLock.Unlock()
+	vn.timerLock.Lock()
+	if vn.timer == nil {
+		return false
+	}
+	stopped := vn.timer.Stop()
+	vn.timer = nil
+	return stopped
 }
 
 // Generates an ID for the node
 func (vn *localVnode) genId(idx uint16) {
-	// Use the hash funciton
 	conf := vn.ring.config
+
+	// Use the ID from a previous run, if we have one
+	if int(idx) < len(conf.VnodeIds) && len(conf.VnodeIds[idx]) > 0 {
+		vn.Id = conf.VnodeIds[idx]
+		return
+	}
+
+	// Use the hash funciton
 	hash := conf.HashFunc()
 	hash.Write([]byte(conf.Hostname))
 	binary.Write(hash, binary.BigEndian, idx)
@@ -79,29 +105,34 @@ func (vn *localVnode) stabilize() {
 	// Setup the next stabilize timer
 	defer vn.schedule()
 
+	start := time.Now()
+	defer func() {
+		metricStabilizeDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	// Check for new successor
 	if err := vn.checkNewSuccessor(); err != nil {
-		log.Printf("[ERR] Error checking for new successor: %s", err)
+		vn.log().Error("Error checking for new successor", Field("err", err))
 	}
 
 	// Notify the successor
 	if err := vn.notifySuccessor(); err != nil {
-		log.Printf("[ERR] Error notifying successor: %s", err)
+		vn.log().Error("Error notifying successor", Field("err", err))
 	}
 
 	// Finger table fix up
 	if err := vn.fixFingerTable(); err != nil {
-		log.Printf("[ERR] Error fixing finger table: %s", err)
+		vn.log().Error("Error fixing finger table", Field("err", err))
 	}
 
 	// Check the predecessor
 	if err := vn.checkPredecessor(); err != nil {
-		log.Printf("[ERR] Error checking predecessor: %s", err)
+		vn.log().Error("Error checking predecessor", Field("err", err))
 	}
 
 	// Update the predecessor list
 	if err := vn.updatePredecessorList(); err != nil {
-		log.Printf("[ERR] Error updating predecessor list: %s", err)
+		vn.log().Error("Error updating predecessor list", Field("err", err))
 	}
 
 	// Locking predecessors because we're passing predecessors by reference.
@@ -113,12 +144,31 @@ func (vn *localVnode) stabilize() {
 	vn.successorsLock.RUnlock()
 	vn.predecessorLock.RUnlock()
 
-	go vn.store.localRepl()
-	go vn.store.globalRepl()
+	vn.ring.clock().AfterFunc(0, vn.store.localRepl)
+	vn.ring.clock().AfterFunc(0, vn.store.globalRepl)
 
 	// Set the last stabilized time
-	vn.stabilized = time.Now()
+	vn.timerLock.Lock()
+	vn.stabilized = vn.ring.clock().Now()
+	vn.timerLock.Unlock()
+}
 
+// Returns the time the vnode last finished stabilizing
+func (vn *localVnode) lastStabilized() time.Time {
+	defer vn.timerLock.Unlock()
+	vn.timerLock.Lock()
+	return vn.stabilized
+}
+
+// Stabilizes right away instead of waiting for the stabilize timer. Returns
+// false without stabilizing if a run is already in progress, or the vnode
+// has been stopped.
+func (vn *localVnode) stabilizeNow() bool {
+	if !vn.cancelSchedule() {
+		return false
+	}
+	vn.stabilize()
+	return true
 }
 
 // Checks for a new successor
@@ -126,13 +176,27 @@ func (vn *localVnode) checkNewSuccessor() error {
 	// Ask our successor for it's predecessor
 	trans := vn.ring.transport
 
+	// Taken before the successor locks, which Notify takes inside the
+	// predecessor lock
+	pred := vn.Predecessor()
+
 	vn.successorsLock.Lock()
 	defer vn.successorsLock.Unlock()
 
 CHECK_NEW_SUC:
 	succ := vn.successors[0]
 	if succ == nil {
-		panic("Node has no successor!")
+		if len(vn.ring.vnodes) != 1 {
+			panic("Node has no successor!")
+		}
+
+		// A vnode alone on its ring has no successor, until a vnode joining
+		// the ring notifies it
+		if pred == nil {
+			return nil
+		}
+		vn.successors[0] = pred
+		goto CHECK_NEW_SUC
 	}
 	maybe_suc, err := trans.GetPredecessor(succ)
 	if err != nil {
@@ -206,6 +270,9 @@ func (vn *localVnode) notifySuccessor() error {
 	vn.successorsLock.RLock()
 	succ := vn.successors[0]
 	vn.successorsLock.RUnlock()
+	if succ == nil {
+		return nil
+	}
 	succ_list, err := vn.ring.transport.Notify(succ, &vn.Vnode)
 	if err != nil {
 		return err
@@ -252,14 +319,17 @@ func (vn *localVnode) Notify(maybe_pred *Vnode) ([]*Vnode, error) {
 			if !vn.lm.block { // If you are supposed to be blocking, do not start any activity yet
 				nearestNode := vn.lm.Ring.nearestVnode([]byte(vn.lm.Ring.config.RingId))
 
+				// The lookup below takes the successor locks again, so they
+				// must not be held across it
 				nearestNode.successorsLock.RLock()
-				defer nearestNode.successorsLock.RUnlock()
+				hasSuccessor := nearestNode.successors[0] != nil
+				nearestNode.successorsLock.RUnlock()
 
-				if nearestNode.successors[0] != nil {
+				if hasSuccessor {
 					if (vn.predecessor == nil && maybe_pred != nil) || bytes.Compare(vn.predecessor.Id, maybe_pred.Id) != 0 {
 						LMVnodes, err := vn.lm.Ring.Lookup(1, []byte(vn.lm.Ring.config.RingId))
 						if err != nil {
-							fmt.Println("Lookup for LockManager failed with error ", err)
+							vn.log().Error("Lookup for LockManager failed", Field("err", err))
 						}
 
 						/* Once a lock manager starts operating, it should care about only two possibilies in terms of failure handling
@@ -276,12 +346,14 @@ func (vn *localVnode) Notify(maybe_pred *Vnode) ([]*Vnode, error) {
 							}
 						} else {
 							if vn.lm.CurrentLM {
-								fmt.Println("Lost LockManager status, sending Lock context to current LM")
+								vn.log().Info("Lost LockManager status, sending Lock context to current LM", Field("lm", LMVnodes[0]))
 								resp := tcpVersionMapUpdateResp{}
-								err := vn.ring.transport.(*LocalTransport).remote.(*TCPTransport).networkCall(LMVnodes[0].Host, tcpVersionMapUpdate, tcpVersionMapUpdateReq{Vn: LMVnodes[0], VersionMap: &vn.lm.VersionMap}, &resp)
+								if tcp, ok := tcpTransportOf(vn.ring.transport); ok {
+									err := tcp.networkCall(LMVnodes[0].Host, tcpVersionMapUpdate, tcpVersionMapUpdateReq{Vn: LMVnodes[0], VersionMap: &vn.lm.VersionMap}, &resp)
 
-								if err != nil {
-									fmt.Errorf("Error while trying to provide Lock context to the new LockManager : ", err)
+									if err != nil {
+										vn.log().Error("Error while trying to provide Lock context to the new LockManager", Field("lm", LMVnodes[0]), Field("err", err))
+									}
 								}
 								vn.lm.CurrentLM = false
 							} else {
@@ -406,6 +478,11 @@ func (vn *localVnode) FindSuccessors(n int, key []byte) ([]*Vnode, error) {
 	vn.successorsLock.RLock()
 	defer vn.successorsLock.RUnlock()
 
+	// A vnode alone on its ring has no successors, and owns every key
+	if vn.successors[0] == nil {
+		return []*Vnode{&vn.Vnode}, nil
+	}
+
 	if betweenRightIncl(vn.Id, vn.successors[0].Id, key) {
 		return copyOfVnodesList(vn.successors, n), nil
 	}
@@ -425,7 +502,7 @@ func (vn *localVnode) FindSuccessors(n int, key []byte) ([]*Vnode, error) {
 		if err == nil {
 			return res, nil
 		} else {
-			log.Printf("[ERR] Failed to contact %s. Got %s", closest.String(), err)
+			vn.log().Error("Failed to contact vnode", Field("peer", closest), Field("err", err))
 		}
 	}
 
@@ -464,11 +541,24 @@ func (vn *localVnode) leave() error {
 	var err error
 	trans := vn.ring.transport
 	if vn.predecessor != nil {
-		err = trans.SkipSuccessor(vn.predecessor, &vn.Vnode)
+		err = vn.notifyLeaving(vn.predecessor, trans.SkipSuccessor(vn.predecessor, &vn.Vnode))
 	}
 
 	// Notify successor to clear old predecessor
-	err = mergeErrors(err, trans.ClearPredecessor(vn.successors[0], &vn.Vnode))
+	err = mergeErrors(err, vn.notifyLeaving(vn.successors[0], trans.ClearPredecessor(vn.successors[0], &vn.Vnode)))
+	return err
+}
+
+// Checks the error of telling a neighbour we are leaving. Neighbours which
+// no longer answer pings have departed themselves, and need not be told.
+func (vn *localVnode) notifyLeaving(neighbour *Vnode, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ok, pingErr := vn.ring.transport.Ping(neighbour); pingErr != nil || !ok {
+		vn.log().Debug("Neighbour departed before us", Field("peer", neighbour), Field("err", err))
+		return nil
+	}
 	return err
 }
 
@@ -616,5 +706,6 @@ func (vn *localVnode) JoinRing(ringId string, self *Vnode) ([]*Vnode, error) {
 }
 
 func (vn *localVnode) LeaveRing(ringId string) error {
-	panic("TODO: localVnode.LeaveRing")
+	// TODO: The tracker cannot tell which node is leaving yet
+	return fmt.Errorf("Leaving ring %s is not supported by the tracker", ringId)
 }